@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/go-logging"
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/encoding"
+)
+
+const (
+	// URL path of the change stream (below the VEAP URL prefix)
+	changeStreamPath = "/~events"
+	// number of buffered events per client
+	changeStreamBufferSize = 256
+	// cycle time for keep alive messages
+	changeStreamKeepAlive = 30 * time.Second
+	// timeout for writing to a WebSocket
+	changeStreamWriteTimeout = 10 * time.Second
+)
+
+var logEvents = logging.Get("change-stream")
+
+// ChangeStream pushes PV changes to HTTP clients. The clients select the data
+// points with one or more query parameters path, which contain path patterns
+// (q.v. path.Match(), e.g. /device/ABC*/1/STATE). If a client requests a
+// WebSocket upgrade, the changes are sent as JSON messages. Otherwise,
+// Server-Sent Events are used. If user management is active, only PVs with
+// PermReadPV are sent. If the user configuration changes (q.v. UpdateUsers),
+// the affected streams are closed. ChangeStream implements mqtt.PVRecorder and
+// vmodel.PVRecorder to receive the changes.
+type ChangeStream struct {
+	Store *rtcfg.Store
+	// AllowedOrigins for WebSocket connections from other origins. If empty,
+	// only connections from the same origin are allowed.
+	AllowedOrigins []string
+
+	mtx      sync.Mutex
+	clients  map[*streamClient]struct{}
+	upgrader websocket.Upgrader
+}
+
+// streamClient is a connected client of the change stream.
+type streamClient struct {
+	patterns []string
+	// copy of the user configuration, nil if user management is not active
+	user   *rtcfg.User
+	events chan []byte
+	// closed by the ChangeStream to disconnect the client
+	closed chan struct{}
+}
+
+// streamEvent is the JSON encoding of a PV change.
+type streamEvent struct {
+	Path string          `json:"path"`
+	PV   encoding.WirePV `json:"pv"`
+}
+
+// NewChangeStream creates a new ChangeStream.
+func NewChangeStream(store *rtcfg.Store, allowedOrigins []string) *ChangeStream {
+	s := &ChangeStream{
+		Store:          store,
+		AllowedOrigins: allowedOrigins,
+		clients:        make(map[*streamClient]struct{}),
+	}
+	s.upgrader.CheckOrigin = s.checkOrigin
+	return s
+}
+
+// Record implements mqtt.PVRecorder and vmodel.PVRecorder.
+func (s *ChangeStream) Record(pvPath string, pv veap.PV) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.clients) == 0 {
+		return
+	}
+	var msg []byte
+	for c := range s.clients {
+		if !c.accepts(pvPath) {
+			continue
+		}
+		// encode only once
+		if msg == nil {
+			var err error
+			msg, err = json.Marshal(streamEvent{Path: pvPath, PV: encoding.PVToWire(pv)})
+			if err != nil {
+				logEvents.Errorf("Encoding of PV %s failed: %v", pvPath, err)
+				return
+			}
+		}
+		select {
+		case c.events <- msg:
+		default:
+			logEvents.Warningf("Event lost, client is too slow: %s", pvPath)
+		}
+	}
+}
+
+func (s *ChangeStream) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	patterns := req.URL.Query()["path"]
+	if len(patterns) == 0 {
+		http.Error(rw, "Missing request parameter: path", http.StatusBadRequest)
+		return
+	}
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			http.Error(rw, fmt.Sprintf("Invalid path pattern: %s", p), http.StatusBadRequest)
+			return
+		}
+	}
+	c := &streamClient{
+		patterns: patterns,
+		events:   make(chan []byte, changeStreamBufferSize),
+		closed:   make(chan struct{}),
+	}
+	if err := s.add(c, requestUser(req)); err != nil {
+		http.Error(rw, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	defer s.remove(c)
+	if websocket.IsWebSocketUpgrade(req) {
+		s.serveWebSocket(rw, req, c)
+	} else {
+		s.serveSSE(rw, req, c)
+	}
+}
+
+func (s *ChangeStream) serveSSE(rw http.ResponseWriter, req *http.Request, c *streamClient) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	logEvents.Debugf("SSE client connected: %s", req.RemoteAddr)
+	defer logEvents.Debugf("SSE client disconnected: %s", req.RemoteAddr)
+
+	keepAlive := time.NewTicker(changeStreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-req.Context().Done():
+			return
+		case <-c.closed:
+			return
+		case msg := <-c.events:
+			_, err = fmt.Fprintf(rw, "event: pv\ndata: %s\n\n", msg)
+		case <-keepAlive.C:
+			// comment line
+			_, err = fmt.Fprint(rw, ":\n\n")
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (s *ChangeStream) serveWebSocket(rw http.ResponseWriter, req *http.Request, c *streamClient) {
+	conn, err := s.upgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		// upgrader has already sent an error response
+		logEvents.Warningf("WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	logEvents.Debugf("WebSocket client connected: %s", req.RemoteAddr)
+	defer logEvents.Debugf("WebSocket client disconnected: %s", req.RemoteAddr)
+
+	// read and discard incoming messages to process control messages and to
+	// detect a closed connection
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepAlive := time.NewTicker(changeStreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-closed:
+			return
+		case <-c.closed:
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Configuration of users changed"),
+				time.Now().Add(changeStreamWriteTimeout))
+			return
+		case msg := <-c.events:
+			conn.SetWriteDeadline(time.Now().Add(changeStreamWriteTimeout))
+			err = conn.WriteMessage(websocket.TextMessage, msg)
+		case <-keepAlive.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(changeStreamWriteTimeout))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// add registers a client. The permissions of the authenticated user are taken
+// from the current configuration.
+func (s *ChangeStream) add(c *streamClient, user *rtcfg.User) error {
+	// lock order: store, s.mtx (same as UpdateUsers)
+	return s.Store.View(func(cfg *rtcfg.Config) error {
+		if user != nil {
+			u, ok := cfg.Users[user.Identifier]
+			if !ok || !u.Active {
+				return fmt.Errorf("User not found or not active: %s", user.Identifier)
+			}
+			c.user = copyUser(u)
+		} else if usersActive(cfg.Users) {
+			return fmt.Errorf("Authentication required")
+		}
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		s.clients[c] = struct{}{}
+		return nil
+	})
+}
+
+func (s *ChangeStream) remove(c *streamClient) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.clients, c)
+}
+
+// UpdateUsers closes the streams, whose user was modified, deactivated or
+// removed. If user management is activated, the streams without user are
+// closed. The configuration store must be locked by the caller.
+func (s *ChangeStream) UpdateUsers(users map[string]*rtcfg.User) {
+	active := usersActive(users)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for c := range s.clients {
+		var valid bool
+		if c.user == nil {
+			valid = !active
+		} else if u, ok := users[c.user.Identifier]; ok {
+			valid = u.Active && u.EncryptedPassword == c.user.EncryptedPassword &&
+				reflect.DeepEqual(copyUser(u).Permissions, c.user.Permissions)
+		}
+		if !valid {
+			logEvents.Infof("Closing change stream, configuration of users changed")
+			delete(s.clients, c)
+			close(c.closed)
+		}
+	}
+}
+
+// usersActive checks whether user management is active.
+func usersActive(users map[string]*rtcfg.User) bool {
+	for _, u := range users {
+		if u.Active {
+			return true
+		}
+	}
+	return false
+}
+
+// copyUser returns a deep copy of the user configuration.
+func copyUser(u *rtcfg.User) *rtcfg.User {
+	cp := *u
+	cp.Permissions = make(map[string]*rtcfg.Permission, len(u.Permissions))
+	for id, p := range u.Permissions {
+		pc := *p
+		cp.Permissions[id] = &pc
+	}
+	return &cp
+}
+
+// checkOrigin allows WebSocket connections from the same origin and from the
+// allowed origins.
+func (s *ChangeStream) checkOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, o := range s.AllowedOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return u.Host == req.Host
+}
+
+// accepts checks the path patterns and the permissions of the client.
+func (c *streamClient) accepts(pvPath string) bool {
+	for _, p := range c.patterns {
+		if match, _ := path.Match(p, pvPath); match {
+			return c.user == nil || c.user.Authorized(rtcfg.EndpointVEAP, rtcfg.PermReadPV, pvPath)
+		}
+	}
+	return false
+}
@@ -4,6 +4,7 @@ go 1.23.1
 
 require (
 	github.com/gorilla/handlers v1.5.2
+	github.com/gorilla/websocket v1.5.3
 	github.com/mdzio/go-hmccu v1.5.3
 	github.com/mdzio/go-lib v0.2.2
 	github.com/mdzio/go-logging v1.0.0
@@ -14,7 +15,6 @@ require (
 
 require (
 	github.com/felixge/httpsnoop v1.0.4 // indirect
-	github.com/gorilla/websocket v1.5.3 // indirect
 	golang.org/x/net v0.40.0 // indirect
 	golang.org/x/text v0.25.0 // indirect
 )
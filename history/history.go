@@ -0,0 +1,356 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/go-logging"
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/encoding"
+)
+
+const (
+	// default cycle time for writing the histories to disk
+	flushCycle = 5 * time.Minute
+	// file extension of a persisted history
+	fileExt = ".json"
+)
+
+var log = logging.Get("history")
+
+// Store records the value changes of data points in ring buffers. The data
+// points and the size of the ring buffers are selected by rules. The ring
+// buffers are written cyclic and on shutdown into a directory, one file per
+// data point.
+type Store struct {
+	// Dir is the directory for the persisted histories.
+	Dir string
+	// Rules select the recorded data points. The first matching rule is used.
+	// After the start, the rules must be modified with UpdateRules.
+	Rules []*rtcfg.HistoryRule
+	// FlushCycle is the cycle time for writing modified histories. If not set,
+	// flushCycle is used.
+	FlushCycle time.Duration
+
+	mtx sync.Mutex
+	// histories by VEAP path, nil for not recorded data points
+	series map[string]*series
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// series is the ring buffer of a single data point.
+type series struct {
+	rule    *rtcfg.HistoryRule
+	entries []veap.PV
+	// index of the oldest entry, if the ring buffer is full
+	head  int
+	dirty bool
+}
+
+// Start loads the persisted histories and starts the cyclic writing.
+func (s *Store) Start() error {
+	log.Debug("Starting history store")
+	s.series = make(map[string]*series)
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return fmt.Errorf("Creating of history directory failed: %w", err)
+	}
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	cycle := s.FlushCycle
+	if cycle <= 0 {
+		cycle = flushCycle
+	}
+	go func() {
+		// defer clean up
+		defer func() {
+			log.Debug("Stopping history store")
+			s.flush()
+			s.done <- struct{}{}
+		}()
+
+		ticker := time.NewTicker(cycle)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				s.flush()
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop writes the modified histories and stops the store.
+func (s *Store) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+// Record adds a PV to the history of a data point. If the value and the state
+// did not change, the PV is not recorded.
+func (s *Store) Record(pvPath string, pv veap.PV) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	ser, ok := s.series[pvPath]
+	if !ok {
+		rule := s.findRule(pvPath)
+		if rule != nil {
+			ser = &series{rule: rule}
+		}
+		// remember also not recorded data points
+		s.series[pvPath] = ser
+	}
+	if ser == nil {
+		return
+	}
+	// value changed? (values from disk are decoded as JSON types)
+	if last, ok := ser.last(); ok && last.State == pv.State && fmt.Sprint(last.Value) == fmt.Sprint(pv.Value) {
+		return
+	}
+	ser.add(pv)
+}
+
+// Read returns the recorded PVs of a data point with begin <= timestamp < end
+// in chronological order. If more than limit PVs are in the time range, the
+// newest PVs are returned.
+func (s *Store) Read(pvPath string, begin, end time.Time, limit int64) ([]veap.PV, veap.Error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	ser, ok := s.series[pvPath]
+	if !ok && s.findRule(pvPath) != nil {
+		// no value recorded yet
+		return []veap.PV{}, nil
+	}
+	if ser == nil {
+		return nil, veap.NewErrorf(veap.StatusNotFound, "History not recorded: %s", pvPath)
+	}
+	ser.expire(time.Now())
+	var res []veap.PV
+	for _, pv := range ser.ordered() {
+		if !pv.Time.Before(begin) && pv.Time.Before(end) {
+			res = append(res, pv)
+		}
+	}
+	if limit >= 0 && int64(len(res)) > limit {
+		res = res[int64(len(res))-limit:]
+	}
+	if res == nil {
+		res = []veap.PV{}
+	}
+	return res, nil
+}
+
+// UpdateRules replaces the rules. The histories of no longer recorded data
+// points are discarded, histories of modified rules are shortened to the new
+// max. number of entries.
+func (s *Store) UpdateRules(rules []*rtcfg.HistoryRule) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	// copy rules, the configuration may be modified in place
+	s.Rules = make([]*rtcfg.HistoryRule, len(rules))
+	for i, r := range rules {
+		cr := *r
+		s.Rules[i] = &cr
+	}
+	for pvPath, ser := range s.series {
+		rule := s.findRule(pvPath)
+		if rule == nil {
+			delete(s.series, pvPath)
+			continue
+		}
+		if ser == nil {
+			// check again on the next record
+			delete(s.series, pvPath)
+			continue
+		}
+		ser.setRule(rule)
+	}
+}
+
+// findRule returns the first matching rule or nil.
+func (s *Store) findRule(pvPath string) *rtcfg.HistoryRule {
+	for _, r := range s.Rules {
+		match, err := path.Match(r.PathPattern, pvPath)
+		if err != nil {
+			log.Warningf("Invalid path pattern in history configuration: %s", r.PathPattern)
+			continue
+		}
+		if match && r.MaxEntries > 0 {
+			return r
+		}
+	}
+	return nil
+}
+
+// load reads the persisted histories from the directory.
+func (s *Store) load() error {
+	files, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return fmt.Errorf("Reading of history directory failed: %w", err)
+	}
+	now := time.Now()
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), fileExt) {
+			continue
+		}
+		pvPath, err := url.PathUnescape(strings.TrimSuffix(f.Name(), fileExt))
+		if err != nil {
+			log.Warningf("Invalid history file name: %s", f.Name())
+			continue
+		}
+		// still recorded?
+		rule := s.findRule(pvPath)
+		if rule == nil {
+			log.Debugf("Data point no longer recorded: %s", pvPath)
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(s.Dir, f.Name()))
+		if err != nil {
+			log.Errorf("Reading of history file failed: %v", err)
+			continue
+		}
+		var w encoding.WireHist
+		if err := json.Unmarshal(b, &w); err != nil {
+			log.Errorf("Invalid history file %s: %v", f.Name(), err)
+			continue
+		}
+		hist, err := encoding.WireToHist(w)
+		if err != nil {
+			log.Errorf("Invalid history file %s: %v", f.Name(), err)
+			continue
+		}
+		ser := &series{rule: rule}
+		for _, pv := range hist {
+			ser.add(pv)
+		}
+		ser.expire(now)
+		ser.dirty = false
+		s.series[pvPath] = ser
+	}
+	log.Debugf("Loaded histories: %d", len(s.series))
+	return nil
+}
+
+// flush writes the modified histories to disk. The histories are encoded
+// while s.mtx is locked, the files are written afterwards, so that Record is
+// not blocked by the disk I/O.
+func (s *Store) flush() {
+	type snapshot struct {
+		pvPath string
+		data   []byte
+	}
+	var snapshots []snapshot
+	s.mtx.Lock()
+	now := time.Now()
+	for pvPath, ser := range s.series {
+		if ser == nil || !ser.dirty {
+			continue
+		}
+		ser.expire(now)
+		b, err := json.Marshal(encoding.HistToWire(ser.ordered()))
+		if err != nil {
+			log.Errorf("Encoding of history %s failed: %v", pvPath, err)
+			continue
+		}
+		ser.dirty = false
+		snapshots = append(snapshots, snapshot{pvPath, b})
+	}
+	s.mtx.Unlock()
+
+	cnt := 0
+	for _, sn := range snapshots {
+		if err := s.writeFile(sn.pvPath, sn.data); err != nil {
+			log.Errorf("Writing of history file failed: %v", err)
+			// retry on next flush
+			s.mtx.Lock()
+			if ser := s.series[sn.pvPath]; ser != nil {
+				ser.dirty = true
+			}
+			s.mtx.Unlock()
+			continue
+		}
+		cnt++
+	}
+	log.Tracef("Written histories: %d", cnt)
+}
+
+// writeFile writes a history to a temporary file and replaces the old file.
+func (s *Store) writeFile(pvPath string, data []byte) error {
+	fn := filepath.Join(s.Dir, url.PathEscape(pvPath)+fileExt)
+	if err := os.WriteFile(fn+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(fn+".tmp", fn)
+}
+
+func (s *series) add(pv veap.PV) {
+	if len(s.entries) < s.rule.MaxEntries {
+		s.entries = append(s.entries, pv)
+	} else {
+		// overwrite oldest entry
+		s.entries[s.head] = pv
+		s.head = (s.head + 1) % len(s.entries)
+	}
+	s.dirty = true
+}
+
+// setRule sets a modified rule. The ring buffer is unwrapped, so that it can
+// grow to a larger size. If it is too large, the oldest entries are removed.
+func (s *series) setRule(rule *rtcfg.HistoryRule) {
+	s.rule = rule
+	es := s.ordered()
+	if len(es) > rule.MaxEntries {
+		es = es[len(es)-rule.MaxEntries:]
+		s.dirty = true
+	}
+	s.entries = es
+	s.head = 0
+}
+
+func (s *series) last() (veap.PV, bool) {
+	if len(s.entries) == 0 {
+		return veap.PV{}, false
+	}
+	return s.entries[(s.head+len(s.entries)-1)%len(s.entries)], true
+}
+
+// ordered returns the entries in chronological order.
+func (s *series) ordered() []veap.PV {
+	res := make([]veap.PV, 0, len(s.entries))
+	res = append(res, s.entries[s.head:]...)
+	return append(res, s.entries[:s.head]...)
+}
+
+// expire removes entries, which exceed the max. age.
+func (s *series) expire(now time.Time) {
+	if s.rule.MaxAge <= 0 {
+		return
+	}
+	limit := now.Add(-time.Duration(s.rule.MaxAge) * time.Hour)
+	es := s.ordered()
+	i := 0
+	for i < len(es) && es[i].Time.Before(limit) {
+		i++
+	}
+	if i == 0 {
+		return
+	}
+	s.entries = es[i:]
+	s.head = 0
+	s.dirty = true
+}
@@ -0,0 +1,288 @@
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/go-veap"
+)
+
+// base time for the tests, whole seconds survive the JSON round-trip
+var t0 = time.Now().Truncate(time.Second)
+
+func testPV(sec int, value float64) veap.PV {
+	return veap.PV{Time: t0.Add(time.Duration(sec) * time.Second), Value: value, State: veap.StateGood}
+}
+
+func values(pvs []veap.PV) []float64 {
+	res := make([]float64, len(pvs))
+	for i, pv := range pvs {
+		res[i], _ = pv.Value.(float64)
+	}
+	return res
+}
+
+func TestSeriesAdd(t *testing.T) {
+	testCases := []struct {
+		maxEntries int
+		adds       int
+		ordered    []float64
+		last       float64
+	}{
+		{3, 1, []float64{1}, 1},
+		{3, 3, []float64{1, 2, 3}, 3},
+		// ring buffer wraps around
+		{3, 4, []float64{2, 3, 4}, 4},
+		{3, 7, []float64{5, 6, 7}, 7},
+		{1, 2, []float64{2}, 2},
+	}
+	for idx, tc := range testCases {
+		ser := &series{rule: &rtcfg.HistoryRule{MaxEntries: tc.maxEntries}}
+		if _, ok := ser.last(); ok {
+			t.Errorf("test case %d: empty series expected", idx+1)
+		}
+		for i := 1; i <= tc.adds; i++ {
+			ser.add(testPV(i, float64(i)))
+		}
+		if o := values(ser.ordered()); !reflect.DeepEqual(o, tc.ordered) {
+			t.Errorf("test case %d: expected %v, got %v", idx+1, tc.ordered, o)
+		}
+		if l, ok := ser.last(); !ok || l.Value != tc.last {
+			t.Errorf("test case %d: expected last %g, got %v", idx+1, tc.last, l.Value)
+		}
+		if !ser.dirty {
+			t.Errorf("test case %d: series not dirty", idx+1)
+		}
+	}
+}
+
+func TestSeriesExpire(t *testing.T) {
+	testCases := []struct {
+		maxAge int
+		// ages of the entries in hours, oldest first
+		ages    []int
+		ordered []float64
+		dirty   bool
+	}{
+		// no age limit
+		{0, []int{10, 5, 1}, []float64{1, 2, 3}, false},
+		{2, []int{10, 5, 1}, []float64{3}, true},
+		{2, []int{1, 1}, []float64{1, 2}, false},
+		{2, []int{3, 3}, []float64{}, true},
+		// wrapped ring buffer (max. entries 3)
+		{4, []int{10, 9, 8, 7, 3, 2}, []float64{5, 6}, true},
+	}
+	for idx, tc := range testCases {
+		ser := &series{rule: &rtcfg.HistoryRule{MaxEntries: 3, MaxAge: tc.maxAge}}
+		for i, age := range tc.ages {
+			ser.add(veap.PV{Time: t0.Add(-time.Duration(age) * time.Hour), Value: float64(i + 1)})
+		}
+		ser.dirty = false
+		ser.expire(t0)
+		if o := values(ser.ordered()); !reflect.DeepEqual(o, tc.ordered) {
+			t.Errorf("test case %d: expected %v, got %v", idx+1, tc.ordered, o)
+		}
+		if ser.dirty != tc.dirty {
+			t.Errorf("test case %d: expected dirty %t", idx+1, tc.dirty)
+		}
+		// the buffer must still work after expiring
+		ser.add(veap.PV{Time: t0, Value: 100.0})
+		if l, _ := ser.last(); l.Value != 100.0 {
+			t.Errorf("test case %d: unexpected last value: %v", idx+1, l.Value)
+		}
+	}
+}
+
+func TestSeriesSetRule(t *testing.T) {
+	testCases := []struct {
+		maxEntries int
+		ordered    []float64
+	}{
+		// grows after unwrapping
+		{5, []float64{4, 5, 6, 7, 8}},
+		{3, []float64{6, 7, 8}},
+		// shortened
+		{2, []float64{7, 8}},
+		{1, []float64{8}},
+	}
+	for idx, tc := range testCases {
+		ser := &series{rule: &rtcfg.HistoryRule{MaxEntries: 3}}
+		for i := 1; i <= 5; i++ {
+			ser.add(testPV(i, float64(i)))
+		}
+		ser.setRule(&rtcfg.HistoryRule{MaxEntries: tc.maxEntries})
+		for i := 6; i <= 8; i++ {
+			ser.add(testPV(i, float64(i)))
+		}
+		if o := values(ser.ordered()); !reflect.DeepEqual(o, tc.ordered) {
+			t.Errorf("test case %d: expected %v, got %v", idx+1, tc.ordered, o)
+		}
+	}
+}
+
+func newTestStore(t *testing.T, dir string) *Store {
+	s := &Store{
+		Dir: dir,
+		Rules: []*rtcfg.HistoryRule{
+			{PathPattern: "/device/*/1/TEMPERATURE", MaxEntries: 5},
+			{PathPattern: "/device/*/*/*", MaxEntries: 0},
+			{PathPattern: "/sysvar/*", MaxEntries: 3, MaxAge: 1},
+		},
+		FlushCycle: time.Hour,
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStoreRead(t *testing.T) {
+	s := newTestStore(t, t.TempDir())
+	defer s.Stop()
+	for i := 1; i <= 4; i++ {
+		s.Record("/device/A/1/TEMPERATURE", testPV(i, float64(i)))
+	}
+	// unchanged value is not recorded
+	s.Record("/device/A/1/TEMPERATURE", testPV(5, 4))
+	s.Record("/device/A/1/TEMPERATURE", veap.PV{Time: t0.Add(6 * time.Second), Value: 4.0, State: veap.StateBad})
+
+	far := t0.Add(time.Hour)
+	testCases := []struct {
+		path       string
+		begin, end time.Time
+		limit      int64
+		values     []float64
+		err        bool
+	}{
+		{"/device/A/1/TEMPERATURE", t0, far, -1, []float64{1, 2, 3, 4, 4}, false},
+		// newest entries within the limit
+		{"/device/A/1/TEMPERATURE", t0, far, 2, []float64{4, 4}, false},
+		{"/device/A/1/TEMPERATURE", t0, far, 0, []float64{}, false},
+		// begin is inclusive, end is exclusive
+		{"/device/A/1/TEMPERATURE", t0.Add(2 * time.Second), t0.Add(4 * time.Second), -1, []float64{2, 3}, false},
+		{"/device/A/1/TEMPERATURE", far, far.Add(time.Hour), -1, []float64{}, false},
+		// recorded, but no value yet
+		{"/device/B/1/TEMPERATURE", t0, far, -1, []float64{}, false},
+		// rule with MaxEntries 0
+		{"/device/A/1/HUMIDITY", t0, far, -1, nil, true},
+		// no matching rule
+		{"/program/1", t0, far, -1, nil, true},
+	}
+	for idx, tc := range testCases {
+		pvs, err := s.Read(tc.path, tc.begin, tc.end, tc.limit)
+		if tc.err {
+			if err == nil || err.Code() != veap.StatusNotFound {
+				t.Errorf("test case %d: expected not found, got %v", idx+1, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test case %d: unexpected error: %v", idx+1, err)
+			continue
+		}
+		if v := values(pvs); !reflect.DeepEqual(v, tc.values) {
+			t.Errorf("test case %d: expected %v, got %v", idx+1, tc.values, v)
+		}
+	}
+}
+
+func TestStorePersistence(t *testing.T) {
+	dir := t.TempDir()
+
+	// first run
+	s := newTestStore(t, dir)
+	for i := 1; i <= 3; i++ {
+		s.Record("/device/A/1/TEMPERATURE", testPV(i, float64(i)))
+	}
+	s.Record("/sysvar/1", veap.PV{Time: time.Now().Add(-2 * time.Hour), Value: 1.0})
+	s.Record("/sysvar/1", veap.PV{Time: time.Now(), Value: 2.0})
+	s.Record("/sysvar/2", veap.PV{Time: time.Now().Add(-2 * time.Hour), Value: true})
+	s.Stop()
+	fn := filepath.Join(dir, "%2Fdevice%2FA%2F1%2FTEMPERATURE"+fileExt)
+	if _, err := os.Stat(fn); err != nil {
+		t.Fatal(err)
+	}
+
+	// second run
+	s = newTestStore(t, dir)
+	pvs, _ := s.Read("/device/A/1/TEMPERATURE", t0, t0.Add(time.Hour), -1)
+	if !reflect.DeepEqual(pvs, []veap.PV{testPV(1, 1), testPV(2, 2), testPV(3, 3)}) {
+		t.Errorf("unexpected history: %v", pvs)
+	}
+	// expired entries are removed
+	pvs, _ = s.Read("/sysvar/1", time.Time{}, time.Now().Add(time.Hour), -1)
+	if v := values(pvs); !reflect.DeepEqual(v, []float64{2}) {
+		t.Errorf("unexpected history: %v", v)
+	}
+	pvs, _ = s.Read("/sysvar/2", time.Time{}, time.Now().Add(time.Hour), -1)
+	if len(pvs) != 0 {
+		t.Errorf("unexpected history: %v", pvs)
+	}
+	// a value from disk is compared with the new value
+	s.Record("/device/A/1/TEMPERATURE", testPV(4, 3))
+	// not modified, no write
+	os.Remove(fn)
+	s.Stop()
+	if _, err := os.Stat(fn); !os.IsNotExist(err) {
+		t.Errorf("history file was written: %v", err)
+	}
+
+	// data points no longer recorded are not loaded
+	s = &Store{Dir: dir, Rules: []*rtcfg.HistoryRule{{PathPattern: "/device/*/*/*", MaxEntries: 10}}}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if _, err := s.Read("/sysvar/1", time.Time{}, time.Now(), -1); err == nil {
+		t.Error("error expected")
+	}
+}
+
+func TestStoreUpdateRules(t *testing.T) {
+	s := newTestStore(t, t.TempDir())
+	defer s.Stop()
+	for i := 1; i <= 5; i++ {
+		s.Record("/device/A/1/TEMPERATURE", testPV(i, float64(i)))
+		s.Record("/device/A/1/HUMIDITY", testPV(i, float64(i)))
+		s.Record("/sysvar/1", testPV(i, float64(i)))
+	}
+	s.UpdateRules([]*rtcfg.HistoryRule{
+		{PathPattern: "/device/*/*/*", MaxEntries: 2},
+	})
+	testCases := []struct {
+		path   string
+		values []float64
+		err    bool
+	}{
+		// shortened
+		{"/device/A/1/TEMPERATURE", []float64{4, 5}, false},
+		// previously not recorded
+		{"/device/A/1/HUMIDITY", []float64{}, false},
+		// no longer recorded
+		{"/sysvar/1", nil, true},
+	}
+	for idx, tc := range testCases {
+		pvs, err := s.Read(tc.path, t0, t0.Add(time.Hour), -1)
+		if tc.err {
+			if err == nil {
+				t.Errorf("test case %d: error expected", idx+1)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test case %d: unexpected error: %v", idx+1, err)
+			continue
+		}
+		if v := values(pvs); !reflect.DeepEqual(v, tc.values) {
+			t.Errorf("test case %d: expected %v, got %v", idx+1, tc.values, v)
+		}
+	}
+	s.Record("/device/A/1/HUMIDITY", testPV(6, 6))
+	if pvs, _ := s.Read("/device/A/1/HUMIDITY", t0, t0.Add(time.Hour), -1); !reflect.DeepEqual(values(pvs), []float64{6}) {
+		t.Errorf("unexpected history: %v", pvs)
+	}
+}
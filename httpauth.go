@@ -1,17 +1,60 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
 
 	"github.com/mdzio/ccu-jack/rtcfg"
 
 	"github.com/mdzio/go-logging"
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/encoding"
+)
+
+const (
+	// VEAP path of the configuration variable
+	configVeapPath = "/~vendor/config"
+
+	// max. size of a checked ExgData request (same as VEAP handler)
+	exgDataSizeLimit = 1 * 1024 * 1024
 )
 
 var (
 	logAuth = logging.Get("http-auth")
+
+	// configPVs are the data points, which read or modify the configuration.
+	// Accessing their PVs needs PermConfig. Pattern syntax q.v. path.Match().
+	configPVs = []string{
+		configVeapPath,
+		// export and import of virtual devices
+		"/~vendor/devicedefs",
+		// instantiation of device templates
+		"/~vendor/devicetemplates/*",
+		// approval of discovered devices
+		"/~vendor/discovery/*",
+		// enabling and disabling of rules
+		"/~vendor/rules/*/enabled",
+	}
 )
 
+// userContextKey is the key of the authenticated user in the request context.
+type userContextKey struct{}
+
+// requestUser returns the authenticated user of a request. If no active user
+// is configured, nil is returned.
+func requestUser(req *http.Request) *rtcfg.User {
+	u, _ := req.Context().Value(userContextKey{}).(*rtcfg.User)
+	return u
+}
+
 // HTTPAuthHandler wraps another http.Handler and authenticates an HTTP client.
 type HTTPAuthHandler struct {
 	http.Handler
@@ -63,8 +106,156 @@ func (h *HTTPAuthHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// credentials ok
-	h.Handler.ServeHTTP(rw, req)
+	// check permissions
+	if err := h.authorize(user, req); err != nil {
+		logAuth.Warningf("Access denied: address %s, user %s, %s %s: %v", req.RemoteAddr, name, req.Method, req.URL.Path, err)
+		h.sendError(rw, err)
+		return
+	}
+
+	// credentials and permissions ok
+	h.Handler.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), userContextKey{}, user)))
+}
+
+// authorize checks the permissions of the user for the VEAP request. Reading
+// and writing of PVs and histories needs PermReadPV resp. PermWritePV for the
+// PV path. Writing a scene additionally needs PermWritePV for the targets of
+// its steps. The PVs, which access the configuration (q.v. configPVs), and
+// modifications of the object tree need PermConfig. The metrics need
+// PermReadPV for the path /metrics. Reading of properties and subscribing the
+// change stream is allowed for every authenticated user. The change stream
+// checks PermReadPV for every PV.
+func (h *HTTPAuthHandler) authorize(user *rtcfg.User, req *http.Request) veap.Error {
+	fullPath := req.URL.EscapedPath()
+	if fullPath == metricsPath {
+		if !user.Authorized(rtcfg.EndpointVEAP, rtcfg.PermReadPV, metricsPath) {
+			return veap.NewErrorf(veap.StatusForbidden, "No permission to read metrics")
+		}
+		return nil
+	}
+	switch path.Base(fullPath) {
+
+	case veap.PVMarker:
+		pvPath := path.Dir(fullPath)
+		kind := rtcfg.PermReadPV
+		// VEAP protocol extension: HTTP-GET request with query parameter
+		// 'writepv' writes the PV
+		if req.Method != http.MethodGet || req.URL.Query().Get("writepv") != "" {
+			kind = rtcfg.PermWritePV
+		}
+		return h.authorizePV(user, kind, pvPath)
+
+	case veap.HistMarker:
+		kind := rtcfg.PermReadPV
+		if req.Method != http.MethodGet {
+			kind = rtcfg.PermWritePV
+		}
+		return h.authorizePV(user, kind, path.Dir(fullPath))
+
+	case veap.ExgDataMarker:
+		// body is needed for the check and must be restored for the VEAP
+		// handler
+		b, err := io.ReadAll(http.MaxBytesReader(nil, req.Body, exgDataSizeLimit))
+		if err != nil {
+			return veap.NewErrorf(veap.StatusBadRequest, "Receiving of request failed: %v", err)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(b))
+		var params encoding.WireExgDataParams
+		if err := json.Unmarshal(b, &params); err != nil {
+			// error is reported by the VEAP handler
+			return nil
+		}
+		for _, w := range params.WritePVs {
+			if err := h.authorizePV(user, rtcfg.PermWritePV, w.Path); err != nil {
+				return err
+			}
+		}
+		for _, p := range params.ReadPaths {
+			if err := h.authorizePV(user, rtcfg.PermReadPV, p); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case veap.QueryMarker:
+		// query returns only properties
+		return nil
+
+	default:
+		if req.Method == http.MethodGet {
+			return nil
+		}
+		// creating, modifying or deleting of objects
+		objPath, err := unescapePath(fullPath)
+		if err != nil {
+			return veap.NewErrorf(veap.StatusBadRequest, "Invalid path: %v", err)
+		}
+		if !user.Authorized(rtcfg.EndpointVEAP, rtcfg.PermConfig, objPath) {
+			return veap.NewErrorf(veap.StatusForbidden, "No permission to modify object: %s", req.URL.Path)
+		}
+		return nil
+	}
+}
+
+func (h *HTTPAuthHandler) authorizePV(user *rtcfg.User, kind rtcfg.PermKind, escapedPath string) veap.Error {
+	pvPath, err := unescapePath(escapedPath)
+	if err != nil {
+		return veap.NewErrorf(veap.StatusBadRequest, "Invalid path: %v", err)
+	}
+	// access to the configuration
+	for _, p := range configPVs {
+		if match, _ := path.Match(p, pvPath); match {
+			if !user.Authorized(rtcfg.EndpointVEAP, rtcfg.PermConfig, pvPath) {
+				return veap.NewErrorf(veap.StatusForbidden, "No permission to access configuration: %s", pvPath)
+			}
+			return nil
+		}
+	}
+	if kind == rtcfg.PermWritePV {
+		// writing a scene also needs the permissions for its steps
+		var ok bool
+		h.Store.View(func(c *rtcfg.Config) error {
+			ok = c.AuthorizedWrite(user, rtcfg.EndpointVEAP, pvPath)
+			return nil
+		})
+		if !ok {
+			return veap.NewErrorf(veap.StatusForbidden, "No permission to write PV: %s", pvPath)
+		}
+		return nil
+	}
+	if !user.Authorized(rtcfg.EndpointVEAP, kind, pvPath) {
+		return veap.NewErrorf(veap.StatusForbidden, "No permission to read PV: %s", pvPath)
+	}
+	return nil
+}
+
+// unescapePath unescapes every path segment like the VEAP model service.
+func unescapePath(p string) (string, error) {
+	segs := strings.Split(p, "/")
+	for i, s := range segs {
+		u, err := url.PathUnescape(s)
+		if err != nil {
+			return "", err
+		}
+		segs[i] = u
+	}
+	return strings.Join(segs, "/"), nil
+}
+
+// sendError sends an error response like the VEAP handler.
+func (h *HTTPAuthHandler) sendError(rw http.ResponseWriter, err veap.Error) {
+	b, jerr := json.Marshal(struct {
+		Message string `json:"message"`
+	}{err.Error()})
+	if jerr != nil {
+		http.Error(rw, fmt.Sprint(err), err.Code())
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	rw.WriteHeader(err.Code())
+	rw.Write(b)
 }
 
 func (h *HTTPAuthHandler) sendAuth(rw http.ResponseWriter, _ *http.Request) {
@@ -7,14 +7,17 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/handlers"
+	"github.com/mdzio/ccu-jack/history"
 	"github.com/mdzio/ccu-jack/mqtt"
 	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/ccu-jack/rules"
 	"github.com/mdzio/ccu-jack/virtdev"
 	"github.com/mdzio/ccu-jack/vmodel"
 	"github.com/mdzio/go-hmccu/itf"
@@ -51,19 +54,24 @@ var (
 	termSig = make(chan os.Signal, 1)
 
 	// base services
-	log          = logging.Get("main")
-	logFile      *os.File
-	logBuffer    *LogBuffer
-	store        rtcfg.Store
-	httpServer   *httputil.Server
-	modelRoot    *model.Root
-	configVar    *vmodel.Config
-	vendorCol    model.ChangeableCollection
-	modelService *model.Service
-	mqttServer   *mqtt.Server
-	mqttBridge   *mqtt.Bridge
+	log            = logging.Get("main")
+	logFile        *os.File
+	logBuffer      *LogBuffer
+	store          rtcfg.Store
+	httpServer     *httputil.Server
+	modelRoot      *model.Root
+	configVar      *vmodel.Config
+	vendorCol      model.ChangeableCollection
+	sceneCol       *vmodel.SceneCol
+	modelService   *model.Service
+	mqttServer     *mqtt.Server
+	mqttProfile    *mqtt.Profile
+	mqttBridges    *mqtt.Bridges
+	metricsHandler *MetricsHandler
+	changeStream   *ChangeStream
 
 	// application services
+	historyStore     *history.Store
 	virtualDevices   *virtdev.VirtualDevices
 	scriptClient     *script.Client
 	sysVarCol        *vmodel.SysVarCol
@@ -133,15 +141,42 @@ func message() {
 	log.Info("  HTTPS port: ", cfg.HTTP.PortTLS)
 	log.Info("  CORS origins: ", strings.Join(cfg.HTTP.CORSOrigins, ","))
 	log.Info("  Web UI dir: ", cfg.HTTP.WebUIDir)
+	log.Info("  Metrics: ", cfg.HTTP.Metrics)
 	log.Info("  MQTT port: ", cfg.MQTT.Port)
 	log.Info("  Secure MQTT port: ", cfg.MQTT.PortTLS)
 	log.Info("  MQTT web socket path: ", cfg.MQTT.WebSocketPath)
-	if cfg.MQTT.Bridge.Enable {
-		log.Info("  MQTT bridge address: ", cfg.MQTT.Bridge.Address)
-		log.Info("  MQTT bridge port: ", cfg.MQTT.Bridge.Port)
-		log.Info("  MQTT bridge TLS: ", cfg.MQTT.Bridge.UseTLS)
-		log.Info("  MQTT bridge user name: ", cfg.MQTT.Bridge.Username)
-		log.Info("  MQTT bridge client ID: ", cfg.MQTT.Bridge.ClientID)
+	log.Info("  MQTT system variable read cycle: ", cfg.MQTT.SysVars.ReadCycle, " ms")
+	log.Info("  MQTT system variable filter: ", cfg.MQTT.SysVars.DescriptionFilter)
+	log.Info("  MQTT profile: ", cfg.MQTT.Profile)
+	if cfg.MQTT.HomeAssistant.Enable {
+		log.Info("  Home Assistant discovery prefix: ", cfg.MQTT.HomeAssistant.DiscoveryPrefix)
+		log.Info("  Home Assistant scan cycle: ", cfg.MQTT.HomeAssistant.ScanCycle, " s")
+	}
+	if cfg.MQTT.StateSync.Enable {
+		log.Info("  MQTT state sync cycle: ", cfg.MQTT.StateSync.Cycle, " min")
+	}
+	if cfg.MQTT.Retained.Enable {
+		log.Info("  MQTT retained messages file: ", cfg.MQTT.Retained.File)
+		log.Info("  MQTT retained messages limit: ", cfg.MQTT.Retained.MaxEntries)
+	}
+	bridgeIDs := make([]string, 0, len(cfg.MQTT.Bridges))
+	for id := range cfg.MQTT.Bridges {
+		bridgeIDs = append(bridgeIDs, id)
+	}
+	sort.Strings(bridgeIDs)
+	for _, id := range bridgeIDs {
+		b := cfg.MQTT.Bridges[id]
+		if !b.Enable {
+			continue
+		}
+		log.Infof("  MQTT bridge %s address: %s", id, b.Address)
+		log.Infof("  MQTT bridge %s port: %d", id, b.Port)
+		log.Infof("  MQTT bridge %s TLS: %t", id, b.UseTLS)
+		log.Infof("  MQTT bridge %s user name: %s", id, b.Username)
+		log.Infof("  MQTT bridge %s client ID: %s", id, b.ClientID)
+		if b.Queue.Enable {
+			log.Infof("  MQTT bridge %s offline queue: %s", id, cfg.MQTT.QueueDir)
+		}
 	}
 	log.Info("  Generate certificates: ", cfg.Certificates.AutoGenerate)
 	log.Infof("  Certificate files: %s, %s, %s, %s", cfg.Certificates.CACertFile, cfg.Certificates.CAKeyFile,
@@ -150,6 +185,10 @@ func message() {
 	log.Info("  Interfaces: ", cfg.CCU.Interfaces.String())
 	log.Info("  Init ID: ", cfg.CCU.InitID)
 	log.Info("  Virtual devices: ", cfg.VirtualDevices.Enable)
+	log.Info("  History: ", cfg.History.Enable)
+	if cfg.History.Enable {
+		log.Info("  History directory: ", cfg.History.Dir)
+	}
 }
 
 func certificates() error {
@@ -223,9 +262,28 @@ func newRoot(handlerStats *veapsvr.HandlerStats) *model.Root {
 	configVar = vmodel.NewConfig(vendorCol, &store)
 	NewDiagnostics(vendorCol)
 	model.NewHandlerStats(vendorCol, handlerStats)
+	sceneCol = vmodel.NewSceneCol(vendorCol, &store)
+	vmodel.NewDeviceTemplateCol(vendorCol, &store, configVar)
+	vmodel.NewDeviceDefinitions(vendorCol, &store, configVar)
 	return r
 }
 
+// newMQTTProfile creates the active MQTT profile. On errors, the standard
+// profile is used.
+func newMQTTProfile(cfg *rtcfg.MQTT) *mqtt.Profile {
+	pcfg, ok := cfg.Profiles[cfg.Profile]
+	if !ok {
+		log.Errorf("MQTT profile not found, using standard profile: %s", cfg.Profile)
+		return mqtt.StandardProfile()
+	}
+	profile, err := mqtt.NewProfile(pcfg, modelService)
+	if err != nil {
+		log.Errorf("Invalid MQTT profile %s, using standard profile: %v", cfg.Profile, err)
+		return mqtt.StandardProfile()
+	}
+	return profile
+}
+
 func runBase() error {
 	// lock config for reading
 	store.RLock()
@@ -250,7 +308,8 @@ func runBase() error {
 	veapHandler := &veapsvr.Handler{}
 	modelRoot = newRoot(&veapHandler.Stats)
 	modelService = &model.Service{Root: modelRoot}
-	veapHandler.Service = &veap.BasicMetaService{Service: modelService}
+	veapHandler.Service = vmodel.NewMetaService(modelService)
+	sceneCol.Service = modelService
 
 	// authentication for VEAP
 	var handler http.Handler
@@ -261,23 +320,37 @@ func runBase() error {
 	}
 
 	// CORS handler for VEAP
+	var cors func(http.Handler) http.Handler
 	allowedMethods := handlers.AllowedMethods([]string{http.MethodGet, http.MethodPut})
 	allowedHeaders := handlers.AllowedHeaders([]string{"Content-Type", "Authorization"})
 	if len(cfg.HTTP.CORSOrigins) == 0 {
-		handler = handlers.CORS(allowedMethods, allowedHeaders)(handler)
+		cors = handlers.CORS(allowedMethods, allowedHeaders)
 	} else {
 		allowedOrigins := handlers.AllowedOrigins(cfg.HTTP.CORSOrigins)
 		// only if origin is specified, credentials are allowed (CORS spec)
 		allowCredentials := handlers.AllowCredentials()
-		handler = handlers.CORS(allowedMethods, allowedOrigins, allowCredentials, allowedHeaders)(handler)
+		cors = handlers.CORS(allowedMethods, allowedOrigins, allowCredentials, allowedHeaders)
 	}
 
 	// register VEAP handler
-	http.Handle(veapHandler.URLPrefix+"/", handler)
+	http.Handle(veapHandler.URLPrefix+"/", cors(handler))
+
+	// register change stream (SSE/WebSocket)
+	changeStream = NewChangeStream(&store, cfg.HTTP.CORSOrigins)
+	http.Handle(veapHandler.URLPrefix+changeStreamPath, cors(&HTTPAuthHandler{
+		Handler: changeStream,
+		Store:   &store,
+		Realm:   "CCU-Jack VEAP-Server",
+	}))
+
+	// MQTT topic and payload profile
+	mqttProfile = newMQTTProfile(&cfg.MQTT)
+	sceneCol.MQTTTopics = mqttProfile
 
 	// MQTT authentication handler
 	mqttAuth := "configAuthHandler"
-	auth.Register(mqttAuth, &mqtt.AuthHandler{Store: &store})
+	mqttAuthHandler := &mqtt.AuthHandler{Store: &store, Profile: mqttProfile}
+	auth.Register(mqttAuth, mqttAuthHandler)
 
 	// setup and start MQTT server
 	mqttServer = &mqtt.Server{
@@ -286,9 +359,16 @@ func runBase() error {
 		CertFile:      cfg.Certificates.ServerCertFile,
 		KeyFile:       cfg.Certificates.ServerKeyFile,
 		Authenticator: mqttAuth,
+		Authorizer:    mqttAuthHandler,
+		Profile:       mqttProfile,
 		BufferSize:    cfg.MQTT.BufferSize,
 		ServeErr:      serveErr,
 	}
+	if cfg.MQTT.Retained.Enable {
+		mqttServer.RetainedFile = cfg.MQTT.Retained.File
+		mqttServer.RetainedMaxEntries = cfg.MQTT.Retained.MaxEntries
+		mqttServer.RetainedFlushCycle = time.Duration(cfg.MQTT.Retained.FlushCycle) * time.Second
+	}
 	mqttServer.Start()
 	defer mqttServer.Stop()
 
@@ -299,12 +379,28 @@ func runBase() error {
 	}
 	http.Handle(cfg.MQTT.WebSocketPath, mqttWs)
 
-	// start MQTT bridge
-	mqttBridge = &mqtt.Bridge{
+	// start MQTT bridges, restarted on configuration changes
+	mqttBridges = &mqtt.Bridges{
 		EmbeddedServer: mqttServer,
+		TemplateFuncs:  virtdev.TemplateFuncs(),
+		QueueDir:       cfg.MQTT.QueueDir,
+	}
+	mqttBridges.Update(cfg.MQTT.Bridges)
+	defer mqttBridges.Stop()
+	vmodel.NewBridgeCol(vendorCol, &store, mqttBridges)
+
+	// register Prometheus exporter
+	if cfg.HTTP.Metrics {
+		metricsHandler = NewMetricsHandler()
+		metricsHandler.HandlerStats = &veapHandler.Stats
+		metricsHandler.MQTTServer = mqttServer
+		metricsHandler.MQTTBridges = mqttBridges
+		http.Handle(metricsPath, &HTTPAuthHandler{
+			Handler: metricsHandler,
+			Store:   &store,
+			Realm:   "CCU-Jack VEAP-Server",
+		})
 	}
-	mqttBridge.Start(&cfg.MQTT.Bridge)
-	defer mqttBridge.Stop()
 
 	// release config before going to next run level
 	store.RUnlock()
@@ -362,29 +458,93 @@ func runApp() error {
 
 	// remember for later
 	enableVirtualDevices := cfg.VirtualDevices.Enable
+	enableDiscovery := cfg.VirtualDevices.Discovery
+
+	// start history store
+	var pvRecorders mqtt.PVRecorders
+	var pvHistory vmodel.PVHistory
+	if cfg.History.Enable {
+		historyStore = &history.Store{
+			Dir:        cfg.History.Dir,
+			Rules:      cfg.History.Rules,
+			FlushCycle: time.Duration(cfg.History.FlushCycle) * time.Second,
+		}
+		if err := historyStore.Start(); err != nil {
+			log.Errorf("History is disabled: %v", err)
+		} else {
+			defer historyStore.Stop()
+			pvRecorders = append(pvRecorders, historyStore)
+			pvHistory = historyStore
+		}
+	}
+
+	// value changes for the metrics
+	if metricsHandler != nil {
+		pvRecorders = append(pvRecorders, metricsHandler)
+	}
+	var pvRecorder mqtt.PVRecorder
+	if len(pvRecorders) > 0 {
+		pvRecorder = pvRecorders
+	}
+	// rule engine, receives the value changes of the data points
+	ruleEngine := &rules.Engine{
+		Store:      &store,
+		Service:    modelService,
+		MQTTServer: mqttServer,
+	}
+	// computed channels of the virtual devices are recalculated on value changes
+	pvObserver := &virtdev.PVObserver{}
+	// the device events are streamed and evaluated by the device collection
+	eventRecorder := mqtt.PVRecorders{changeStream, ruleEngine, pvObserver}
+	streamRecorder := append(mqtt.PVRecorders{changeStream, ruleEngine, pvObserver}, pvRecorders...)
 
 	// intermediate unlock
 	store.RUnlock()
 
+	// start rule engine (store must be unlocked)
+	ruleEngine.Start()
+	defer ruleEngine.Stop()
+	vmodel.NewRuleCol(vendorCol, &store, ruleEngine)
+
 	// start virtual devices (store must be unlocked)
 	if enableVirtualDevices {
 		virtualDevices = &virtdev.VirtualDevices{
 			Store:            &store,
 			UseInternalPorts: useInternalPorts, // ATTENTION: Does not work on plain CCU3.
 			EventPublisher: &mqtt.VirtDevEventReceiver{
-				Server: mqttServer,
+				Server:   mqttServer,
+				Recorder: streamRecorder,
 			},
 			MQTTServer: mqttServer,
+			Service:    modelService,
+			PVObserver: pvObserver,
 		}
 		virtualDevices.Start()
 		defer virtualDevices.Stop()
-		// listen for configuration changes
-		configVar.SetChangeListener(func(_ *rtcfg.Config) {
-			virtualDevices.SynchronizeDevices()
-		})
-		defer configVar.SetChangeListener(nil)
+
+		// start device discovery (opt-in)
+		if enableDiscovery {
+			discovery := &virtdev.Discovery{MQTTServer: mqttServer}
+			discovery.Start()
+			defer discovery.Stop()
+			vmodel.NewDiscoveryCol(vendorCol, discovery, &store, configVar)
+		}
 	}
 
+	// listen for configuration changes
+	configVar.SetChangeListener(func(cfg *rtcfg.Config) {
+		if enableVirtualDevices {
+			virtualDevices.SynchronizeDevices()
+		}
+		ruleEngine.Update(cfg.Rules)
+		if pvHistory != nil {
+			historyStore.UpdateRules(cfg.History.Rules)
+		}
+		mqttBridges.Update(cfg.MQTT.Bridges)
+		changeStream.UpdateUsers(cfg.Users)
+	})
+	defer configVar.SetChangeListener(nil)
+
 	// wait for ReGaHss to come online
 	if shutdown, err := waitForReGaHss(); shutdown || err != nil {
 		return err
@@ -396,16 +556,23 @@ func runApp() error {
 
 	// create device collection
 	deviceCol = vmodel.NewDeviceCol(modelRoot)
+	deviceCol.MQTTTopics = mqttProfile
+	deviceCol.History = pvHistory
+	deviceCol.Recorder = eventRecorder
 
 	// create system variable collection
 	sysVarCol = vmodel.NewSysVarCol(modelRoot)
 	sysVarCol.ScriptClient = scriptClient
+	sysVarCol.MQTTTopics = mqttProfile
+	sysVarCol.History = pvHistory
 	sysVarCol.Start()
 	defer sysVarCol.Stop()
 
 	// create programs collection
 	prgCol = vmodel.NewProgramCol(modelRoot)
 	prgCol.ScriptClient = scriptClient
+	prgCol.MQTTTopics = mqttProfile
+	prgCol.Recorder = eventRecorder
 	prgCol.Start()
 	defer prgCol.Stop()
 
@@ -416,30 +583,80 @@ func runApp() error {
 	}
 	mqttVeapBridge.Start()
 	defer mqttVeapBridge.Stop()
+	sceneCol.OnResult = func(pvPath string, pv veap.PV) {
+		if err := mqttVeapBridge.PublishSceneResult(pvPath, pv); err != nil {
+			log.Errorf("Publishing of scene result failed: %v", err)
+		}
+	}
+	defer sceneCol.Stop()
 
 	// CCU device event receiver for MQTT
 	mqttReceiver := &mqtt.EventReceiver{
-		Server: mqttServer,
+		Server:   mqttServer,
+		Recorder: pvRecorder,
 		// forward events
 		Next: deviceCol,
 	}
 
+	// Home Assistant discovery publisher
+	if cfg.MQTT.HomeAssistant.Enable {
+		hassPublisher := &mqtt.HassPublisher{
+			Server:          mqttServer,
+			Service:         modelService,
+			DiscoveryPrefix: cfg.MQTT.HomeAssistant.DiscoveryPrefix,
+			ScanCycle:       time.Duration(cfg.MQTT.HomeAssistant.ScanCycle) * time.Second,
+			SysVarFilter:    cfg.MQTT.SysVars.DescriptionFilter,
+			Next:            deviceCol,
+		}
+		hassPublisher.Start()
+		defer hassPublisher.Stop()
+		// forward events
+		mqttReceiver.Next = hassPublisher
+	}
+
+	// publish values of all device parameters for the retained status topics
+	if cfg.MQTT.StateSync.Enable {
+		stateSync := &mqtt.StateSync{
+			Server:      mqttServer,
+			Service:     modelService,
+			MetaService: vmodel.NewMetaService(modelService),
+			Cycle:       time.Duration(cfg.MQTT.StateSync.Cycle) * time.Minute,
+			BatchSize:   cfg.MQTT.StateSync.BatchSize,
+			BatchDelay:  time.Duration(cfg.MQTT.StateSync.BatchDelay) * time.Millisecond,
+		}
+		stateSync.Start()
+		defer stateSync.Stop()
+	}
+
 	// system variable reader for MQTT
 	sysVarReader := &mqtt.SysVarReader{
-		Service:      modelService,
-		ScriptClient: scriptClient,
-		Server:       mqttServer,
+		Service:           modelService,
+		ScriptClient:      scriptClient,
+		Server:            mqttServer,
+		Recorder:          streamRecorder,
+		ReadCycle:         time.Duration(cfg.MQTT.SysVars.ReadCycle) * time.Millisecond,
+		DescriptionFilter: cfg.MQTT.SysVars.DescriptionFilter,
+		NotifyTimeout:     time.Duration(cfg.MQTT.SysVars.NotifyTimeout) * time.Second,
 	}
 	sysVarReader.Start()
 	defer sysVarReader.Stop()
 
+	// add variable for notifications about changed system variables
+	vmodel.NewSysVarNotifyVar(vendorCol, sysVarReader.Notify)
+
+	// track callbacks for the metrics
+	var logicLayer itf.LogicLayer = mqttReceiver
+	if metricsHandler != nil {
+		logicLayer = metricsHandler.Monitor(mqttReceiver)
+	}
+
 	// configure interconnector
 	intercon = &itf.Interconnector{
 		CCUAddr:          cfg.CCU.Address,
 		Types:            cfg.CCU.Interfaces,
 		UseInternalPorts: useInternalPorts,
 		IDPrefix:         cfg.CCU.InitID + "-",
-		LogicLayer:       mqttReceiver,
+		LogicLayer:       logicLayer,
 		ServeErr:         serveErr,
 		// for callbacks from CCU
 		HostAddr:   cfg.Host.Address,
@@ -452,6 +669,12 @@ func runApp() error {
 	reGaDOM.Start()
 	defer reGaDOM.Stop()
 
+	// sources for the labels and system variables of the metrics
+	if metricsHandler != nil {
+		metricsHandler.SetSources(reGaDOM, modelService, vmodel.NewMetaService(modelService), scriptClient)
+		defer metricsHandler.SetSources(nil, nil, nil, nil)
+	}
+
 	// add variable for rereading meta info from CCU
 	vmodel.NewRefreshVar(
 		vendorCol,
@@ -472,6 +695,8 @@ func runApp() error {
 		virtualDeviceCol.Container = virtualDevices.Devices
 		virtualDeviceCol.ModelService = modelService
 		virtualDeviceCol.ReGaDOM = reGaDOM
+		virtualDeviceCol.MQTTTopics = mqttProfile
+		virtualDeviceCol.History = pvHistory
 	}
 
 	// startup device domain (starts handling of events)
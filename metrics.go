@@ -0,0 +1,575 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mdzio/ccu-jack/mqtt"
+	"github.com/mdzio/go-hmccu/itf"
+	"github.com/mdzio/go-hmccu/script"
+	"github.com/mdzio/go-logging"
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/model"
+	veapsvr "github.com/mdzio/go-veap/server"
+)
+
+const (
+	// URL path of the metrics handler
+	metricsPath = "/metrics"
+	// prefix of all metric names
+	metricsPrefix = "ccujack_"
+	// VEAP path of the system variables
+	metricsSysVarPath = "/sysvar"
+	// cycle time for reading the system variables and the device parameters
+	metricsScanCycle = 60 * time.Second
+)
+
+// metricsDomains are the VEAP domains of the device parameters.
+var metricsDomains = []struct{ id, title string }{{"device", "device"}, {"virtdev", "virtual device"}}
+
+var logMetrics = logging.Get("metrics")
+
+// MetricsHandler exports the numeric and boolean data points and internal
+// counters in the Prometheus text format. The device and virtual device
+// parameters and the system variables are read cyclic in the background and
+// updated by the recorded value changes (see mqtt.PVRecorder). The values of
+// deleted devices are removed on the next read cycle resp. on the DeleteDevices
+// callback of the CCU.
+type MetricsHandler struct {
+	// Statistics of the VEAP handler
+	HandlerStats *veapsvr.HandlerStats
+	// MQTT server and bridges for the internal counters
+	MQTTServer  *mqtt.Server
+	MQTTBridges *mqtt.Bridges
+
+	mtx sync.RWMutex
+	// available after ReGaHss is online
+	reGaDOM      *script.ReGaDOM
+	service      veap.Service
+	metaService  veap.MetaService
+	scriptClient *script.Client
+	// last values by VEAP path
+	values map[string]veap.PV
+	// numeric and boolean system variables by ISE ID
+	sysVars map[string]*metricsSysVar
+	// time of the last callback by interface ID
+	callbacks map[string]time.Time
+
+	// cyclic reading of the system variables and device parameters
+	scanStop chan struct{}
+	scanDone chan struct{}
+}
+
+// metricsSysVar is a cached system variable.
+type metricsSysVar struct {
+	name  string
+	value float64
+}
+
+// NewMetricsHandler creates a new MetricsHandler.
+func NewMetricsHandler() *MetricsHandler {
+	return &MetricsHandler{
+		values:    make(map[string]veap.PV),
+		sysVars:   make(map[string]*metricsSysVar),
+		callbacks: make(map[string]time.Time),
+	}
+}
+
+// SetSources sets the sources for the labels, the system variables and the
+// device parameters. nil values remove the sources. The cyclic reading of the
+// system variables and device parameters is started, if the sources are
+// available.
+func (h *MetricsHandler) SetSources(reGaDOM *script.ReGaDOM, service veap.Service, metaService veap.MetaService, scriptClient *script.Client) {
+	// stop reading of system variables and device parameters
+	if h.scanStop != nil {
+		close(h.scanStop)
+		<-h.scanDone
+		h.scanStop = nil
+	}
+
+	h.mtx.Lock()
+	h.reGaDOM = reGaDOM
+	h.service = service
+	h.metaService = metaService
+	h.scriptClient = scriptClient
+	h.mtx.Unlock()
+
+	// start reading of system variables and device parameters
+	if service != nil && metaService != nil && scriptClient != nil {
+		h.scanStop = make(chan struct{})
+		h.scanDone = make(chan struct{})
+		go func() {
+			defer close(h.scanDone)
+			ticker := time.NewTicker(metricsScanCycle)
+			defer ticker.Stop()
+			for {
+				h.readSysVars(service, scriptClient)
+				h.readValues(service, metaService)
+				select {
+				case <-h.scanStop:
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+}
+
+// Record implements mqtt.PVRecorder.
+func (h *MetricsHandler) Record(pvPath string, pv veap.PV) {
+	v, ok := metricValue(pv.Value)
+	if !ok {
+		return
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	// update cached system variable
+	if strings.HasPrefix(pvPath, metricsSysVarPath+"/") {
+		if sv, ok := h.sysVars[strings.TrimPrefix(pvPath, metricsSysVarPath+"/")]; ok {
+			sv.value = v
+		}
+		return
+	}
+	if !strings.HasPrefix(pvPath, "/device/") && !strings.HasPrefix(pvPath, "/virtdev/") {
+		return
+	}
+	h.values[pvPath] = pv
+}
+
+// Monitor returns a logic layer, which tracks the callbacks of the CCU
+// interfaces and forwards them to next.
+func (h *MetricsHandler) Monitor(next itf.LogicLayer) itf.LogicLayer {
+	return &callbackMonitor{handler: h, next: next}
+}
+
+func (h *MetricsHandler) callbackReceived(interfaceID string) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.callbacks[interfaceID] = time.Now()
+}
+
+// removeDevices removes the values of deleted devices or channels.
+func (h *MetricsHandler) removeDevices(addresses []string) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for _, addr := range addresses {
+		// channel address ADDR:CH has path /device/ADDR/CH
+		prefix := "/device/" + strings.Replace(addr, ":", "/", 1) + "/"
+		for p := range h.values {
+			if strings.HasPrefix(p, prefix) {
+				delete(h.values, p)
+			}
+		}
+	}
+}
+
+func (h *MetricsHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var mw metricsWriter
+	h.writeValues(&mw)
+	h.writeSysVars(&mw)
+	h.writeCounters(&mw)
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	rw.Header().Set("Content-Length", strconv.Itoa(mw.Len()))
+	rw.Write([]byte(mw.String()))
+}
+
+// writeValues writes the values of the device and virtual device parameters.
+func (h *MetricsHandler) writeValues(mw *metricsWriter) {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	paths := make([]string, 0, len(h.values))
+	for p := range h.values {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, domain := range metricsDomains {
+		name := metricsPrefix + domain.id + "_value"
+		mw.header(name, "gauge", "Value of a "+domain.title+" parameter")
+		for _, p := range paths {
+			// path: /<domain>/<device>/<channel>/<parameter>
+			segs := strings.Split(p, "/")
+			if len(segs) != 5 || segs[1] != domain.id {
+				continue
+			}
+			pv := h.values[p]
+			v, _ := metricValue(pv.Value)
+			labels := []string{"device", segs[2], "channel", segs[3], "parameter", segs[4]}
+			labels = append(labels, h.channelLabels(segs[2]+":"+segs[3])...)
+			mw.sample(name, labels, v)
+		}
+	}
+}
+
+// channelLabels returns the labels from the ReGa DOM. h.mtx must be locked.
+func (h *MetricsHandler) channelLabels(addr string) []string {
+	if h.reGaDOM == nil {
+		return nil
+	}
+	ch := h.reGaDOM.Channel(addr)
+	if ch == nil {
+		return nil
+	}
+	var rooms, funcs []string
+	for _, id := range ch.Rooms {
+		if r := h.reGaDOM.Room(id); r != nil {
+			rooms = append(rooms, r.DisplayName)
+		}
+	}
+	for _, id := range ch.Functions {
+		if f := h.reGaDOM.Function(id); f != nil {
+			funcs = append(funcs, f.DisplayName)
+		}
+	}
+	sort.Strings(rooms)
+	sort.Strings(funcs)
+	return []string{
+		"name", ch.DisplayName,
+		"room", strings.Join(rooms, ","),
+		"function", strings.Join(funcs, ","),
+	}
+}
+
+// writeSysVars writes the cached numeric and boolean system variables.
+func (h *MetricsHandler) writeSysVars(mw *metricsWriter) {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	if len(h.sysVars) == 0 {
+		return
+	}
+	ids := make([]string, 0, len(h.sysVars))
+	for id := range h.sysVars {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	name := metricsPrefix + "sysvar_value"
+	mw.header(name, "gauge", "Value of a system variable")
+	for _, id := range ids {
+		sv := h.sysVars[id]
+		mw.sample(name, []string{"id", id, "name", sv.name}, sv.value)
+	}
+}
+
+// readSysVars reads the numeric and boolean system variables into the cache.
+func (h *MetricsHandler) readSysVars(service veap.Service, client *script.Client) {
+	// explore system variables
+	_, links, verr := service.ReadProperties(metricsSysVarPath)
+	if verr != nil {
+		logMetrics.Errorf("Reading system variables failed: %v", verr)
+		return
+	}
+	var defs []script.ValObjDef
+	var names []string
+	for _, l := range links {
+		if l.Role != "sysvar" {
+			continue
+		}
+		attrs, _, verr := service.ReadProperties(path.Join(metricsSysVarPath, l.Target))
+		if verr != nil {
+			continue
+		}
+		typ, _ := attrs["type"].(string)
+		if typ == "STRING" {
+			continue
+		}
+		id, _ := attrs[model.IdentifierProperty].(string)
+		title, _ := attrs[model.TitleProperty].(string)
+		defs = append(defs, script.ValObjDef{ISEID: id, Type: typ})
+		names = append(names, title)
+	}
+
+	// bulk read values
+	sysVars := make(map[string]*metricsSysVar)
+	if len(defs) > 0 {
+		results, err := client.ReadValues(defs)
+		if err != nil {
+			logMetrics.Errorf("Reading system variables failed: %v", err)
+			return
+		}
+		for idx := range defs {
+			if results[idx].Err != nil {
+				continue
+			}
+			v, ok := metricValue(results[idx].Value)
+			if !ok {
+				continue
+			}
+			sysVars[defs[idx].ISEID] = &metricsSysVar{name: names[idx], value: v}
+		}
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.sysVars = sysVars
+}
+
+// readValues explores the readable device and virtual device parameters and
+// reads their values with a single request. Cached values are used by the meta
+// service. The values of no longer existing parameters are removed.
+func (h *MetricsHandler) readValues(service veap.Service, metaService veap.MetaService) {
+	var paths []string
+	for _, domain := range metricsDomains {
+		ps, verr := metricsParameters(service, "/"+domain.id)
+		if verr != nil {
+			logMetrics.Errorf("Exploring %s parameters failed: %v", domain.title, verr)
+			return
+		}
+		paths = append(paths, ps...)
+	}
+	var results []veap.ReadPVResult
+	if len(paths) > 0 {
+		var verr veap.Error
+		_, results, verr = metaService.ExgData(nil, paths)
+		if verr != nil {
+			logMetrics.Errorf("Reading device parameters failed: %v", verr)
+			return
+		}
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	values := make(map[string]veap.PV, len(paths))
+	for idx, p := range paths {
+		old, hasOld := h.values[p]
+		r := results[idx]
+		if r.Error != nil {
+			// keep the last value
+			if hasOld {
+				values[p] = old
+			}
+			continue
+		}
+		if _, ok := metricValue(r.PV.Value); !ok {
+			continue
+		}
+		// a value change may have been recorded in the mean time
+		if hasOld && old.Time.After(r.PV.Time) {
+			values[p] = old
+		} else {
+			values[p] = r.PV
+		}
+	}
+	h.values = values
+}
+
+// metricsParameters returns the paths of the readable parameters in the
+// specified domain.
+func metricsParameters(service veap.Service, domainPath string) ([]string, veap.Error) {
+	_, devLinks, verr := service.ReadProperties(domainPath)
+	if verr != nil {
+		return nil, verr
+	}
+	var paths []string
+	for _, dl := range devLinks {
+		if dl.Role != "device" {
+			continue
+		}
+		devPath := path.Join(domainPath, dl.Target)
+		_, chLinks, verr := service.ReadProperties(devPath)
+		if verr != nil {
+			// device deleted in the mean time
+			continue
+		}
+		for _, cl := range chLinks {
+			if cl.Role != "channel" {
+				continue
+			}
+			chPath := path.Join(devPath, cl.Target)
+			_, prmLinks, verr := service.ReadProperties(chPath)
+			if verr != nil {
+				continue
+			}
+			for _, pl := range prmLinks {
+				if pl.Role != "parameter" {
+					continue
+				}
+				prmPath := path.Join(chPath, pl.Target)
+				attrs, _, verr := service.ReadProperties(prmPath)
+				if verr != nil {
+					continue
+				}
+				// only readable parameters (e.g. not PRESS_SHORT)
+				ops, _ := attrs["operations"].(int)
+				if ops&itf.ParameterOperationRead == 0 {
+					continue
+				}
+				paths = append(paths, prmPath)
+			}
+		}
+	}
+	return paths, nil
+}
+
+// writeCounters writes the internal counters.
+func (h *MetricsHandler) writeCounters(mw *metricsWriter) {
+	if h.MQTTServer != nil {
+		name := metricsPrefix + "mqtt_published_total"
+		mw.header(name, "counter", "Number of messages published by the CCU-Jack")
+		mw.sample(name, nil, float64(h.MQTTServer.PublishCount()))
+	}
+	if h.MQTTBridges != nil {
+		ids := h.MQTTBridges.Identifiers()
+		sts := make([]mqtt.BridgeStatus, len(ids))
+		for i, id := range ids {
+			sts[i], _ = h.MQTTBridges.Status(id)
+		}
+		for _, c := range []struct {
+			name, typ, help string
+			value           func(st mqtt.BridgeStatus) float64
+		}{
+			{"mqtt_bridge_connected", "gauge", "1, if the MQTT bridge is connected to the remote server",
+				func(st mqtt.BridgeStatus) float64 {
+					if st.Connected {
+						return 1
+					}
+					return 0
+				}},
+			{"mqtt_bridge_reconnects_total", "counter", "Number of connection attempts of the MQTT bridge after an error",
+				func(st mqtt.BridgeStatus) float64 { return float64(st.Reconnects) }},
+			{"mqtt_bridge_received_total", "counter", "Number of messages received from the remote server",
+				func(st mqtt.BridgeStatus) float64 { return float64(st.MessagesIn) }},
+			{"mqtt_bridge_sent_total", "counter", "Number of messages sent to the remote server",
+				func(st mqtt.BridgeStatus) float64 { return float64(st.MessagesOut) }},
+			{"mqtt_bridge_dropped_total", "counter", "Number of messages dropped by the transformations of the MQTT bridge",
+				func(st mqtt.BridgeStatus) float64 { return float64(st.MessagesDropped) }},
+			{"mqtt_bridge_queued", "gauge", "Number of outgoing messages in the offline queue of the MQTT bridge",
+				func(st mqtt.BridgeStatus) float64 { return float64(st.MessagesQueued) }},
+		} {
+			mw.header(metricsPrefix+c.name, c.typ, c.help)
+			for i, id := range ids {
+				if sts[i].Enabled {
+					mw.sample(metricsPrefix+c.name, []string{"bridge", id}, c.value(sts[i]))
+				}
+			}
+		}
+	}
+	if h.HandlerStats != nil {
+		for _, c := range []struct {
+			name, help string
+			value      *uint64
+		}{
+			{"veap_requests_total", "Number of VEAP requests", &h.HandlerStats.Requests},
+			{"veap_request_bytes_total", "Size of the VEAP requests", &h.HandlerStats.RequestBytes},
+			{"veap_response_bytes_total", "Size of the VEAP responses", &h.HandlerStats.ResponseBytes},
+			{"veap_error_responses_total", "Number of VEAP error responses", &h.HandlerStats.ErrorResponses},
+		} {
+			mw.header(metricsPrefix+c.name, "counter", c.help)
+			mw.sample(metricsPrefix+c.name, nil, float64(atomic.LoadUint64(c.value)))
+		}
+	}
+
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	ids := make([]string, 0, len(h.callbacks))
+	for id := range h.callbacks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	name := metricsPrefix + "ccu_callback_age_seconds"
+	mw.header(name, "gauge", "Time since the last callback of a CCU interface")
+	for _, id := range ids {
+		mw.sample(name, []string{"interface", id}, time.Since(h.callbacks[id]).Seconds())
+	}
+}
+
+// metricValue converts a PV value to a metric value.
+func metricValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case bool:
+		if n {
+			return 1, true
+		}
+		return 0, true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// metricsWriter builds the Prometheus text format.
+type metricsWriter struct {
+	strings.Builder
+}
+
+func (w *metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a sample. labels contains pairs of label name and value.
+// Timestamps are omitted, because Prometheus rejects samples of long unchanged
+// values.
+func (w *metricsWriter) sample(name string, labels []string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(labels[i])
+			w.WriteString(`="`)
+			w.WriteString(labelEscaper.Replace(labels[i+1]))
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	w.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// callbackMonitor tracks the callbacks of the CCU interfaces.
+type callbackMonitor struct {
+	handler *MetricsHandler
+	next    itf.LogicLayer
+}
+
+func (m *callbackMonitor) Event(interfaceID, address, valueKey string, value interface{}) error {
+	m.handler.callbackReceived(interfaceID)
+	return m.next.Event(interfaceID, address, valueKey, value)
+}
+
+func (m *callbackMonitor) NewDevices(interfaceID string, devDescriptions []*itf.DeviceDescription) error {
+	m.handler.callbackReceived(interfaceID)
+	return m.next.NewDevices(interfaceID, devDescriptions)
+}
+
+func (m *callbackMonitor) DeleteDevices(interfaceID string, addresses []string) error {
+	m.handler.callbackReceived(interfaceID)
+	m.handler.removeDevices(addresses)
+	return m.next.DeleteDevices(interfaceID, addresses)
+}
+
+func (m *callbackMonitor) UpdateDevice(interfaceID, address string, hint int) error {
+	m.handler.callbackReceived(interfaceID)
+	return m.next.UpdateDevice(interfaceID, address, hint)
+}
+
+func (m *callbackMonitor) ReplaceDevice(interfaceID, oldDeviceAddress, newDeviceAddress string) error {
+	m.handler.callbackReceived(interfaceID)
+	return m.next.ReplaceDevice(interfaceID, oldDeviceAddress, newDeviceAddress)
+}
+
+func (m *callbackMonitor) ReaddedDevice(interfaceID string, deletedAddresses []string) error {
+	m.handler.callbackReceived(interfaceID)
+	return m.next.ReaddedDevice(interfaceID, deletedAddresses)
+}
@@ -0,0 +1,492 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mdzio/go-mqtt/auth"
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-mqtt/service"
+)
+
+const (
+	// path prefix for generic MQTT topics, which is used for checking the PV
+	// filters of the permissions
+	mqttVeapPath = "/~mqtt"
+
+	// maximum packet size, if no buffer size is configured (same as go-mqtt)
+	defaultMaxPacketSize = 1024 * 256
+)
+
+// Authorizer checks the permissions of authenticated MQTT clients on topics.
+type Authorizer interface {
+	// AuthorizePublish checks whether the user may publish on the topic.
+	AuthorizePublish(user, topic string) bool
+	// AuthorizeReceive checks whether the user may receive messages of the
+	// topic.
+	AuthorizeReceive(user, topic string) bool
+}
+
+var errPacketTooLarge = errors.New("Packet too large")
+
+// sequence number for the names of the registered proxy authenticators
+var proxyAuthSeq uint64
+
+// proxyAuthenticator authenticates the connections of the ACL proxy at the
+// broker. The proxy prepends a secret to the user name. Connections without
+// the secret (e.g. from other local processes) are rejected, the others are
+// checked by the next authenticator with the original user name.
+type proxyAuthenticator struct {
+	secret string
+	next   *auth.Manager
+}
+
+// registerProxyAuthenticator registers a proxyAuthenticator in front of the
+// named authenticator. The name of the registered authenticator and the
+// secret are returned.
+func registerProxyAuthenticator(next string) (name, secret string, err error) {
+	if next == "" {
+		next = service.DefaultAuthenticator
+	}
+	mgr, err := auth.NewManager(next)
+	if err != nil {
+		return "", "", err
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", fmt.Errorf("Creating of proxy secret failed: %w", err)
+	}
+	secret = hex.EncodeToString(buf)
+	name = fmt.Sprintf("acl-proxy-%d", atomic.AddUint64(&proxyAuthSeq, 1))
+	auth.Register(name, &proxyAuthenticator{secret: secret, next: mgr})
+	return name, secret, nil
+}
+
+// Authenticate implements auth.Authenticator.
+func (a *proxyAuthenticator) Authenticate(id string, cred interface{}) error {
+	if !strings.HasPrefix(id, a.secret) {
+		log.Warningf("Connection to internal MQTT broker without ACL proxy rejected")
+		return auth.ErrAuthFailure
+	}
+	return a.next.Authenticate(strings.TrimPrefix(id, a.secret), cred)
+}
+
+// aclProxy accepts MQTT client connections, forwards them to the internal
+// broker and enforces the permissions of the connected user. go-mqtt provides
+// no hook for authorizing publish and subscribe requests, therefore the MQTT
+// packets are inspected on the way between client and broker:
+//
+// Publish requests of a client are dropped, if the user has no permission to
+// publish on the topic. Messages from the broker are dropped, if the user has
+// no permission to receive the topic. This also covers subscriptions with
+// wildcards and retained messages. Dropped messages are acknowledged in place
+// of the receiver, so that the sender completes the QoS flow.
+type aclProxy struct {
+	authorizer    Authorizer
+	brokerAddr    string
+	secret        string
+	maxPacketSize int
+
+	mtx       sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+func newACLProxy(authorizer Authorizer, brokerAddr, secret string, bufferSize int64) *aclProxy {
+	maxPacketSize := defaultMaxPacketSize
+	if bufferSize > 0 {
+		maxPacketSize = int(bufferSize)
+	}
+	return &aclProxy{
+		authorizer:    authorizer,
+		brokerAddr:    brokerAddr,
+		secret:        secret,
+		maxPacketSize: maxPacketSize,
+		listeners:     make(map[net.Listener]struct{}),
+		conns:         make(map[net.Conn]struct{}),
+	}
+}
+
+// ListenAndServe has the same signature as service.Server.ListenAndServe.
+func (p *aclProxy) ListenAndServe(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen(u.Scheme, u.Host)
+	if err != nil {
+		return err
+	}
+	return p.serve(ln)
+}
+
+// ListenAndServeTLS has the same signature as
+// service.Server.ListenAndServeTLS.
+func (p *aclProxy) ListenAndServeTLS(uri string, cfg *tls.Config) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	ln, err := tls.Listen(u.Scheme, u.Host, cfg)
+	if err != nil {
+		return err
+	}
+	return p.serve(ln)
+}
+
+// Close closes all listeners and client connections.
+func (p *aclProxy) Close() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.closed = true
+	for ln := range p.listeners {
+		ln.Close()
+	}
+	for c := range p.conns {
+		c.Close()
+	}
+}
+
+func (p *aclProxy) serve(ln net.Listener) error {
+	p.mtx.Lock()
+	if p.closed {
+		p.mtx.Unlock()
+		ln.Close()
+		return nil
+	}
+	p.listeners[ln] = struct{}{}
+	p.mtx.Unlock()
+	defer func() {
+		p.mtx.Lock()
+		delete(p.listeners, ln)
+		p.mtx.Unlock()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			p.mtx.Lock()
+			closed := p.closed
+			p.mtx.Unlock()
+			if closed {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				log.Warningf("Accept error: %v", err)
+				continue
+			}
+			return err
+		}
+		if !p.track(conn) {
+			conn.Close()
+			return nil
+		}
+		go func() {
+			defer p.untrack(conn)
+			c := &aclConn{proxy: p, client: conn}
+			c.run()
+		}()
+	}
+}
+
+func (p *aclProxy) track(c net.Conn) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.closed {
+		return false
+	}
+	p.conns[c] = struct{}{}
+	return true
+}
+
+func (p *aclProxy) untrack(c net.Conn) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	delete(p.conns, c)
+}
+
+// aclConn is a single proxied client connection.
+type aclConn struct {
+	proxy  *aclProxy
+	client net.Conn
+	broker net.Conn
+	user   string
+
+	clientMtx sync.Mutex
+	brokerMtx sync.Mutex
+
+	// packet IDs of dropped QoS 2 messages, which still need a PUBCOMP. Each
+	// map is only accessed by the reader of the sending side.
+	droppedFromClient map[uint16]struct{}
+	droppedFromBroker map[uint16]struct{}
+}
+
+func (c *aclConn) run() {
+	defer c.client.Close()
+	cr := bufio.NewReader(c.client)
+
+	// first packet must be CONNECT
+	pkt, err := readPacket(cr, c.proxy.maxPacketSize)
+	if err != nil {
+		log.Debugf("Reading CONNECT from %s failed: %v", c.client.RemoteAddr(), err)
+		return
+	}
+	if message.Type(pkt[0]>>4) != message.CONNECT {
+		log.Warningf("Expected CONNECT from %s, got %s", c.client.RemoteAddr(), message.Type(pkt[0]>>4))
+		return
+	}
+	cm := message.NewConnectMessage()
+	if _, err := cm.Decode(pkt); err != nil {
+		log.Warningf("Decoding of CONNECT from %s failed: %v", c.client.RemoteAddr(), err)
+		return
+	}
+	c.user = string(cm.Username())
+
+	// a last will must not bypass the permissions
+	if cm.WillFlag() && !c.proxy.authorizer.AuthorizePublish(c.user, string(cm.WillTopic())) {
+		log.Warningf("User %s is not authorized to publish last will on topic %s", c.user, cm.WillTopic())
+		resp := message.NewConnackMessage()
+		resp.SetReturnCode(message.ErrNotAuthorized)
+		_ = c.writeClient(resp)
+		return
+	}
+
+	// connect to broker
+	c.broker, err = net.Dial("tcp", c.proxy.brokerAddr)
+	if err != nil {
+		log.Errorf("Connecting to internal MQTT broker failed: %v", err)
+		return
+	}
+	defer c.broker.Close()
+	// authenticate as proxy at the broker
+	cm.SetUsername([]byte(c.proxy.secret + c.user))
+	if err := c.writeBroker(cm); err != nil {
+		return
+	}
+
+	// forward packets from broker to client
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// unblock the reader of the client
+		defer c.client.Close()
+		c.fromBroker()
+	}()
+	c.fromClient(cr)
+	// unblock the reader of the broker
+	c.broker.Close()
+	<-done
+}
+
+func (c *aclConn) fromClient(r *bufio.Reader) {
+	c.droppedFromClient = make(map[uint16]struct{})
+	for {
+		pkt, err := readPacket(r, c.proxy.maxPacketSize)
+		if err != nil {
+			return
+		}
+		switch message.Type(pkt[0] >> 4) {
+		case message.PUBLISH:
+			topic, qos, id, err := parsePublish(pkt)
+			if err != nil {
+				log.Warningf("Invalid PUBLISH from user %s: %v", c.user, err)
+				return
+			}
+			if !c.proxy.authorizer.AuthorizePublish(c.user, topic) {
+				log.Warningf("User %s is not authorized to publish on topic %s", c.user, topic)
+				// acknowledge in place of the broker
+				if err := c.ackDropped(c.writeClient, c.droppedFromClient, qos, id); err != nil {
+					return
+				}
+				continue
+			}
+		case message.PUBREL:
+			if c.completeDropped(c.writeClient, c.droppedFromClient, pkt) {
+				continue
+			}
+		}
+		if err := c.write(c.broker, &c.brokerMtx, pkt); err != nil {
+			return
+		}
+	}
+}
+
+func (c *aclConn) fromBroker() {
+	c.droppedFromBroker = make(map[uint16]struct{})
+	r := bufio.NewReader(c.broker)
+	for {
+		// packets from the broker are not limited by maxPacketSize
+		pkt, err := readPacket(r, 0)
+		if err != nil {
+			return
+		}
+		switch message.Type(pkt[0] >> 4) {
+		case message.PUBLISH:
+			topic, qos, id, err := parsePublish(pkt)
+			if err != nil {
+				log.Errorf("Invalid PUBLISH from internal broker: %v", err)
+				return
+			}
+			if !c.proxy.authorizer.AuthorizeReceive(c.user, topic) {
+				log.Tracef("User %s is not authorized to receive topic %s", c.user, topic)
+				// acknowledge in place of the client
+				if err := c.ackDropped(c.writeBroker, c.droppedFromBroker, qos, id); err != nil {
+					return
+				}
+				continue
+			}
+		case message.PUBREL:
+			if c.completeDropped(c.writeBroker, c.droppedFromBroker, pkt) {
+				continue
+			}
+		}
+		if err := c.write(c.client, &c.clientMtx, pkt); err != nil {
+			return
+		}
+	}
+}
+
+// ackDropped acknowledges a dropped PUBLISH to the sender.
+func (c *aclConn) ackDropped(write func(message.Message) error, dropped map[uint16]struct{}, qos byte, id uint16) error {
+	switch qos {
+	case message.QosAtLeastOnce:
+		ack := message.NewPubackMessage()
+		ack.SetPacketID(id)
+		return write(ack)
+	case message.QosExactlyOnce:
+		dropped[id] = struct{}{}
+		ack := message.NewPubrecMessage()
+		ack.SetPacketID(id)
+		return write(ack)
+	}
+	return nil
+}
+
+// completeDropped answers a PUBREL of a dropped QoS 2 message. If the PUBREL
+// belongs to a forwarded message, false is returned.
+func (c *aclConn) completeDropped(write func(message.Message) error, dropped map[uint16]struct{}, pkt []byte) bool {
+	hdrLen := len(pkt) - remainingLen(pkt)
+	if len(pkt) < hdrLen+2 {
+		return false
+	}
+	id := binary.BigEndian.Uint16(pkt[hdrLen:])
+	if _, ok := dropped[id]; !ok {
+		return false
+	}
+	delete(dropped, id)
+	ack := message.NewPubcompMessage()
+	ack.SetPacketID(id)
+	_ = write(ack)
+	return true
+}
+
+func (c *aclConn) writeClient(msg message.Message) error {
+	return c.writeMessage(c.client, &c.clientMtx, msg)
+}
+
+func (c *aclConn) writeBroker(msg message.Message) error {
+	return c.writeMessage(c.broker, &c.brokerMtx, msg)
+}
+
+func (c *aclConn) writeMessage(conn net.Conn, mtx *sync.Mutex, msg message.Message) error {
+	buf := make([]byte, msg.Len())
+	if _, err := msg.Encode(buf); err != nil {
+		return err
+	}
+	return c.write(conn, mtx, buf)
+}
+
+func (c *aclConn) write(conn net.Conn, mtx *sync.Mutex, pkt []byte) error {
+	mtx.Lock()
+	defer mtx.Unlock()
+	_, err := conn.Write(pkt)
+	return err
+}
+
+// readPacket reads a complete MQTT packet including the fixed header. If
+// maxSize is greater than 0, larger packets are rejected.
+func readPacket(r *bufio.Reader, maxSize int) ([]byte, error) {
+	hdr := make([]byte, 1, 5)
+	var err error
+	hdr[0], err = r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	// decode remaining length (variable byte integer)
+	remLen := 0
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errors.New("Invalid remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		hdr = append(hdr, b)
+		remLen |= int(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if maxSize > 0 && len(hdr)+remLen > maxSize {
+		return nil, errPacketTooLarge
+	}
+	pkt := make([]byte, len(hdr)+remLen)
+	copy(pkt, hdr)
+	if _, err := io.ReadFull(r, pkt[len(hdr):]); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// remainingLen returns the length of the packet without the fixed header.
+func remainingLen(pkt []byte) int {
+	n := 0
+	for i := 1; i < len(pkt) && i <= 4; i++ {
+		n |= int(pkt[i]&0x7f) << (7 * (i - 1))
+		if pkt[i]&0x80 == 0 {
+			break
+		}
+	}
+	return n
+}
+
+// parsePublish extracts topic, QoS and packet ID from a PUBLISH packet.
+func parsePublish(pkt []byte) (topic string, qos byte, id uint16, err error) {
+	qos = (pkt[0] >> 1) & 0x03
+	if !message.ValidQos(qos) {
+		return "", 0, 0, fmt.Errorf("Invalid QoS: %d", qos)
+	}
+	var body = pkt[len(pkt)-remainingLen(pkt):]
+	if len(body) < 2 {
+		return "", 0, 0, errors.New("Missing topic")
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	body = body[2:]
+	if len(body) < n {
+		return "", 0, 0, errors.New("Invalid topic length")
+	}
+	topic = string(body[:n])
+	body = body[n:]
+	if qos > message.QosAtMostOnce {
+		if len(body) < 2 {
+			return "", 0, 0, errors.New("Missing packet ID")
+		}
+		id = binary.BigEndian.Uint16(body)
+	}
+	return topic, qos, id, nil
+}
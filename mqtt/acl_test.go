@@ -0,0 +1,177 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/mdzio/go-mqtt/auth"
+	"github.com/mdzio/go-mqtt/message"
+)
+
+func TestTopicToPVPath(t *testing.T) {
+	a := &AuthHandler{}
+	testCases := []struct {
+		topic  string
+		pvPath string
+	}{
+		{"device/status/ABC/1/STATE", "/device/ABC/1/STATE"},
+		{"device/set/ABC/1/STATE", "/device/ABC/1/STATE"},
+		{"virtdev/set/JACK000001/1/LEVEL", "/virtdev/JACK000001/1/LEVEL"},
+		{"sysvar/get/1234", "/sysvar/1234"},
+		{"program/set/1234", "/program/1234"},
+		{"scene/set/night", "/~vendor/scenes/night"},
+		{"device/status/ABC/1", "/~mqtt/device/status/ABC/1"},
+		{"shelly/relay/0", "/~mqtt/shelly/relay/0"},
+	}
+	for _, tc := range testCases {
+		if got := a.topicToPVPath(tc.topic); got != tc.pvPath {
+			t.Errorf("topic %s: expected %s, got %s", tc.topic, tc.pvPath, got)
+		}
+	}
+}
+
+func TestIsGetTopic(t *testing.T) {
+	p := StandardProfile()
+	testCases := []struct {
+		topic string
+		get   bool
+	}{
+		{"sysvar/get/1234", true},
+		{"program/get/1234", true},
+		{"sysvar/set/1234", false},
+		{"device/set/ABC/1/STATE", false},
+	}
+	for _, tc := range testCases {
+		if got := p.isGetTopic(tc.topic); got != tc.get {
+			t.Errorf("topic %s: expected %t, got %t", tc.topic, tc.get, got)
+		}
+	}
+}
+
+func encodePacket(t *testing.T, msg message.Message) []byte {
+	buf := make([]byte, msg.Len())
+	if _, err := msg.Encode(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestReadPacket(t *testing.T) {
+	pm := message.NewPublishMessage()
+	pm.SetTopic([]byte("a/b"))
+	pm.SetPayload(bytes.Repeat([]byte("x"), 200))
+	large := encodePacket(t, pm)
+
+	testCases := []struct {
+		in      []byte
+		maxSize int
+		out     []byte
+		err     string
+	}{
+		{[]byte{0xc0, 0x00}, 0, []byte{0xc0, 0x00}, ""},
+		{[]byte{0x30, 0x03, 1, 2, 3}, 0, []byte{0x30, 0x03, 1, 2, 3}, ""},
+		{large, 0, large, ""},
+		{large, len(large), large, ""},
+		{large, len(large) - 1, nil, errPacketTooLarge.Error()},
+		{[]byte{0x30, 0x03, 1, 2}, 0, nil, "unexpected EOF"},
+		{[]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}, 0, nil, "Invalid remaining length"},
+		{[]byte{}, 0, nil, "EOF"},
+	}
+	for _, tc := range testCases {
+		out, err := readPacket(bufio.NewReader(bytes.NewReader(tc.in)), tc.maxSize)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("input %v: expected error %s, got %v", tc.in, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("input %v: unexpected error: %v", tc.in, err)
+			continue
+		}
+		if !bytes.Equal(out, tc.out) {
+			t.Errorf("input %v: unexpected packet %v", tc.in, out)
+		}
+	}
+}
+
+func TestParsePublish(t *testing.T) {
+	publish := func(topic string, qos byte, id uint16) []byte {
+		pm := message.NewPublishMessage()
+		pm.SetTopic([]byte(topic))
+		pm.SetQoS(qos)
+		pm.SetPacketID(id)
+		pm.SetPayload([]byte("payload"))
+		return encodePacket(t, pm)
+	}
+	testCases := []struct {
+		pkt   []byte
+		topic string
+		qos   byte
+		id    uint16
+		err   string
+	}{
+		{publish("a/b", 0, 0), "a/b", 0, 0, ""},
+		{publish("device/set/ABC/1/STATE", 1, 42), "device/set/ABC/1/STATE", 1, 42, ""},
+		{publish("x", 2, 4711), "x", 2, 4711, ""},
+		{[]byte{0x36, 0x00}, "", 0, 0, "Invalid QoS: 3"},
+		{[]byte{0x30, 0x01, 0x00}, "", 0, 0, "Missing topic"},
+		{[]byte{0x30, 0x03, 0x00, 0x05, 'a'}, "", 0, 0, "Invalid topic length"},
+		{[]byte{0x32, 0x03, 0x00, 0x01, 'a'}, "", 0, 0, "Missing packet ID"},
+	}
+	for _, tc := range testCases {
+		topic, qos, id, err := parsePublish(tc.pkt)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("packet %v: expected error %s, got %v", tc.pkt, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("packet %v: unexpected error: %v", tc.pkt, err)
+			continue
+		}
+		if topic != tc.topic || qos != tc.qos || id != tc.id {
+			t.Errorf("packet %v: unexpected result %s, %d, %d", tc.pkt, topic, qos, id)
+		}
+	}
+}
+
+type testAuthenticator map[string]string
+
+func (a testAuthenticator) Authenticate(id string, cred interface{}) error {
+	if passwd, ok := a[id]; !ok || passwd != cred.(string) {
+		return auth.ErrAuthFailure
+	}
+	return nil
+}
+
+func TestProxyAuthenticator(t *testing.T) {
+	auth.Register("test-users", testAuthenticator{"user": "secret"})
+	defer auth.Unregister("test-users")
+	name, secret, err := registerProxyAuthenticator("test-users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auth.Unregister(name)
+	mgr, err := auth.NewManager(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		id, passwd string
+		ok         bool
+	}{
+		{secret + "user", "secret", true},
+		{secret + "user", "wrong", false},
+		{"user", "secret", false},
+		{secret[1:] + "user", "secret", false},
+		{"", "", false},
+	}
+	for _, tc := range testCases {
+		if err := mgr.Authenticate(tc.id, tc.passwd); (err == nil) != tc.ok {
+			t.Errorf("user %s: expected success %t, got %v", tc.id, tc.ok, err)
+		}
+	}
+}
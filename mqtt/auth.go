@@ -8,6 +8,9 @@ import (
 // AuthHandler handles MQTT client authentication.
 type AuthHandler struct {
 	Store *rtcfg.Store
+	// Profile is used to map topics to VEAP paths. If not set, the standard
+	// profile is used.
+	Profile *Profile
 }
 
 // Authenticate implements auth.Authenticator.
@@ -26,3 +29,62 @@ func (a *AuthHandler) Authenticate(id string, cred interface{}) error {
 		return nil
 	})
 }
+
+// AuthorizePublish implements Authorizer. Publishing on a get topic of a
+// system variable or program only requests the current value and therefore
+// needs only a read permission.
+func (a *AuthHandler) AuthorizePublish(user, topic string) bool {
+	kind := rtcfg.PermWritePV
+	if a.profile().isGetTopic(topic) {
+		kind = rtcfg.PermReadPV
+	}
+	return a.authorize(user, kind, topic)
+}
+
+// AuthorizeReceive implements Authorizer.
+func (a *AuthHandler) AuthorizeReceive(user, topic string) bool {
+	return a.authorize(user, rtcfg.PermReadPV, topic)
+}
+
+func (a *AuthHandler) authorize(user string, kind rtcfg.PermKind, topic string) bool {
+	var ok bool
+	a.Store.View(func(c *rtcfg.Config) error {
+		// if no user is configured, allow everything for every user
+		if len(c.Users) == 0 {
+			ok = true
+			return nil
+		}
+		u, found := c.Users[user]
+		if !found || !u.Active {
+			return nil
+		}
+		pvPath := a.topicToPVPath(topic)
+		if kind == rtcfg.PermWritePV {
+			// writing a scene also needs the permissions for its steps
+			ok = c.AuthorizedWrite(u, rtcfg.EndpointMQTT, pvPath)
+		} else {
+			ok = u.Authorized(rtcfg.EndpointMQTT, kind, pvPath)
+		}
+		return nil
+	})
+	return ok
+}
+
+// topicToPVPath maps an MQTT topic to the PV path, which is checked against
+// the PV filters of the permissions. The topics of devices, system variables,
+// programs and virtual devices are mapped to their VEAP paths (e.g.
+// device/set/ABC/1/STATE to /device/ABC/1/STATE). All other topics are mapped
+// below /~mqtt (e.g. shelly/relay/0 to /~mqtt/shelly/relay/0).
+func (a *AuthHandler) topicToPVPath(topic string) string {
+	if pvPath, ok := a.profile().topicToPVPath(topic); ok {
+		return pvPath
+	}
+	return mqttVeapPath + "/" + topic
+}
+
+func (a *AuthHandler) profile() *Profile {
+	if a.Profile == nil {
+		return standardProfile
+	}
+	return a.Profile
+}
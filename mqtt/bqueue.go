@@ -0,0 +1,163 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// file extension of a persisted bridge queue
+const queueFileExt = ".json"
+
+// queuedMessage is a message for the remote server, which could not be sent.
+type queuedMessage struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+	Time    time.Time
+}
+
+// bridgeQueue stores the outgoing messages of a bridge, while the remote
+// server is unreachable. The queue is persisted in a file.
+type bridgeQueue struct {
+	fileName   string
+	maxEntries int
+	maxAge     time.Duration
+	latestOnly bool
+
+	mtx     sync.Mutex
+	entries []queuedMessage
+	dirty   bool
+}
+
+// newBridgeQueue creates a queue for the bridge with the specified identifier
+// and loads the persisted messages.
+func newBridgeQueue(dir, identifier string, maxEntries int, maxAge time.Duration, latestOnly bool) (*bridgeQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Creating of queue directory failed: %w", err)
+	}
+	q := &bridgeQueue{
+		fileName:   filepath.Join(dir, url.PathEscape(identifier)+queueFileExt),
+		maxEntries: maxEntries,
+		maxAge:     maxAge,
+		latestOnly: latestOnly,
+	}
+	b, err := os.ReadFile(q.fileName)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return q, nil
+		}
+		return nil, fmt.Errorf("Reading of queue file failed: %w", err)
+	}
+	var entries []queuedMessage
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("Invalid queue file %s: %w", q.fileName, err)
+	}
+	// apply the current limits
+	for _, e := range entries {
+		q.add(e)
+	}
+	q.expire(time.Now())
+	q.dirty = false
+	return q, nil
+}
+
+// Len returns the number of queued messages.
+func (q *bridgeQueue) Len() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return len(q.entries)
+}
+
+// Push appends a message. If the queue is full, the oldest message is
+// removed.
+func (q *bridgeQueue) Push(msg queuedMessage) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.add(msg)
+}
+
+// Peek returns the oldest message, which is not expired.
+func (q *bridgeQueue) Peek() (queuedMessage, bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.expire(time.Now())
+	if len(q.entries) == 0 {
+		return queuedMessage{}, false
+	}
+	return q.entries[0], true
+}
+
+// Pop removes the oldest message.
+func (q *bridgeQueue) Pop() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if len(q.entries) > 0 {
+		q.entries[0] = queuedMessage{}
+		q.entries = q.entries[1:]
+		q.dirty = true
+	}
+}
+
+// Flush writes the queue to disk, if it was modified.
+func (q *bridgeQueue) Flush() error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if !q.dirty {
+		return nil
+	}
+	q.expire(time.Now())
+	b, err := json.Marshal(q.entries)
+	if err != nil {
+		return fmt.Errorf("Encoding of queue failed: %w", err)
+	}
+	// write to temporary file and replace old file
+	if err := os.WriteFile(q.fileName+".tmp", b, 0644); err != nil {
+		return fmt.Errorf("Writing of queue file failed: %w", err)
+	}
+	if err := os.Rename(q.fileName+".tmp", q.fileName); err != nil {
+		return fmt.Errorf("Writing of queue file failed: %w", err)
+	}
+	q.dirty = false
+	return nil
+}
+
+// add appends a message. q.mtx must be locked.
+func (q *bridgeQueue) add(msg queuedMessage) {
+	if q.latestOnly {
+		// remove previous message on the same topic
+		for i, e := range q.entries {
+			if e.Topic == msg.Topic {
+				q.entries = append(q.entries[:i], q.entries[i+1:]...)
+				break
+			}
+		}
+	}
+	q.entries = append(q.entries, msg)
+	if q.maxEntries > 0 && len(q.entries) > q.maxEntries {
+		q.entries = append([]queuedMessage(nil), q.entries[len(q.entries)-q.maxEntries:]...)
+	}
+	q.dirty = true
+}
+
+// expire removes the messages, which are older than the max. age. q.mtx must
+// be locked.
+func (q *bridgeQueue) expire(now time.Time) {
+	if q.maxAge <= 0 {
+		return
+	}
+	n := 0
+	for n < len(q.entries) && now.Sub(q.entries[n].Time) > q.maxAge {
+		n++
+	}
+	if n > 0 {
+		q.entries = append([]queuedMessage(nil), q.entries[n:]...)
+		q.dirty = true
+	}
+}
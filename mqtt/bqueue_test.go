@@ -0,0 +1,157 @@
+package mqtt
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func queuedTopics(q *bridgeQueue) []string {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	var topics []string
+	for _, e := range q.entries {
+		topics = append(topics, e.Topic+"="+string(e.Payload))
+	}
+	return topics
+}
+
+func TestBridgeQueueLimits(t *testing.T) {
+	now := time.Now()
+	msg := func(topic, payload string, age time.Duration) queuedMessage {
+		return queuedMessage{Topic: topic, Payload: []byte(payload), Time: now.Add(-age)}
+	}
+	testCases := []struct {
+		maxEntries int
+		maxAge     time.Duration
+		latestOnly bool
+		msgs       []queuedMessage
+		topics     []string
+	}{
+		// no limits
+		{0, 0, false, []queuedMessage{msg("a", "1", 0), msg("b", "2", 0), msg("a", "3", 0)},
+			[]string{"a=1", "b=2", "a=3"}},
+		// oldest entries are removed
+		{2, 0, false, []queuedMessage{msg("a", "1", 0), msg("b", "2", 0), msg("c", "3", 0)},
+			[]string{"b=2", "c=3"}},
+		// compaction keeps the order of the latest messages
+		{0, 0, true, []queuedMessage{msg("a", "1", 0), msg("b", "2", 0), msg("a", "3", 0), msg("c", "4", 0)},
+			[]string{"b=2", "a=3", "c=4"}},
+		{2, 0, true, []queuedMessage{msg("a", "1", 0), msg("b", "2", 0), msg("a", "3", 0), msg("c", "4", 0)},
+			[]string{"a=3", "c=4"}},
+		// expired entries
+		{0, time.Hour, false, []queuedMessage{msg("a", "1", 2*time.Hour), msg("b", "2", 30*time.Minute)},
+			[]string{"b=2"}},
+		{0, time.Hour, false, []queuedMessage{msg("a", "1", 2*time.Hour)}, nil},
+	}
+	for idx, tc := range testCases {
+		q, err := newBridgeQueue(t.TempDir(), "bridge", tc.maxEntries, tc.maxAge, tc.latestOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range tc.msgs {
+			q.Push(m)
+		}
+		q.mtx.Lock()
+		q.expire(now)
+		q.mtx.Unlock()
+		if topics := queuedTopics(q); !reflect.DeepEqual(topics, tc.topics) {
+			t.Errorf("test case %d: expected %v, got %v", idx+1, tc.topics, topics)
+		}
+	}
+}
+
+func TestBridgeQueuePeekPop(t *testing.T) {
+	q, err := newBridgeQueue(t.TempDir(), "bridge", 0, time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := q.Peek(); ok {
+		t.Fatal("empty queue expected")
+	}
+	q.Push(queuedMessage{Topic: "old", Time: time.Now().Add(-2 * time.Hour)})
+	q.Push(queuedMessage{Topic: "a", Time: time.Now()})
+	q.Push(queuedMessage{Topic: "b", Time: time.Now()})
+	peek := func(topic string) {
+		msg, ok := q.Peek()
+		if !ok || msg.Topic != topic {
+			t.Fatalf("expected topic %s, got %s, %t", topic, msg.Topic, ok)
+		}
+	}
+	// expired messages are skipped
+	peek("a")
+	peek("a")
+	q.Pop()
+	peek("b")
+	q.Pop()
+	if q.Len() != 0 {
+		t.Errorf("empty queue expected, got %d entries", q.Len())
+	}
+	// pop on empty queue
+	q.Pop()
+}
+
+func TestBridgeQueuePersistence(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "queues")
+	now := time.Now().Round(0)
+
+	// first run
+	q, err := newBridgeQueue(dir, "remote/server", 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Push(queuedMessage{Topic: "a", Payload: []byte("1"), QoS: 1, Retain: true, Time: now})
+	q.Push(queuedMessage{Topic: "b", Payload: []byte("2"), Time: now.Add(-2 * time.Hour)})
+	q.Push(queuedMessage{Topic: "a", Payload: []byte("3"), Time: now})
+	if err := q.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(dir, "remote%2Fserver"+queueFileExt)
+	if _, err := os.Stat(fn); err != nil {
+		t.Fatal(err)
+	}
+
+	// reload with the same limits
+	q, err = newBridgeQueue(dir, "remote/server", 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topics := queuedTopics(q); !reflect.DeepEqual(topics, []string{"a=1", "b=2", "a=3"}) {
+		t.Errorf("unexpected queue: %v", topics)
+	}
+	msg, _ := q.Peek()
+	if msg.QoS != 1 || !msg.Retain || !msg.Time.Equal(now) {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+	// not modified, no write
+	os.Remove(fn)
+	if err := q.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fn); !os.IsNotExist(err) {
+		t.Errorf("queue file was written: %v", err)
+	}
+	q.Pop()
+	if err := q.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reload with new limits
+	q, err = newBridgeQueue(dir, "remote/server", 0, time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topics := queuedTopics(q); !reflect.DeepEqual(topics, []string{"a=3"}) {
+		t.Errorf("unexpected queue: %v", topics)
+	}
+
+	// invalid file
+	if err := os.WriteFile(fn, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newBridgeQueue(dir, "remote/server", 0, 0, false); err == nil {
+		t.Error("error expected")
+	}
+}
@@ -15,6 +15,8 @@ import (
 type EventReceiver struct {
 	// Server for publishing events.
 	Server *Server
+	// Recorder for value changes, optional.
+	Recorder PVRecorder
 
 	// Next handler for XML-RPC events.
 	Next itf.LogicLayer
@@ -71,15 +73,28 @@ func (r *EventReceiver) publishEvent(_, address, valueKey string, value interfac
 	dev = address[0:p]
 	ch = address[p+1:]
 
-	// build topic
-	topic := fmt.Sprintf("%s/%s/%s/%s", deviceStatusTopic, dev, ch, valueKey)
-
 	// build PV
+	pvPath := fmt.Sprintf("%s/%s/%s/%s", deviceVeapPath, dev, ch, valueKey)
 	pv := veap.PV{
 		Time:  time.Now(),
 		Value: value,
 		State: veap.StateGood,
 	}
+	if r.Recorder != nil {
+		r.Recorder.Record(pvPath, pv)
+	}
+	return publishDeviceStatus(r.Server, pvPath, valueKey, pv)
+}
+
+// publishDeviceStatus publishes the PV of a device parameter on the status
+// topic.
+func publishDeviceStatus(server *Server, pvPath, valueKey string, pv veap.PV) error {
+	// build topic
+	prof := server.profile()
+	topic, err := prof.statusTopic(&prof.device, pvPath)
+	if err != nil {
+		return err
+	}
 
 	// select qos and retain
 	var qos byte
@@ -93,7 +108,7 @@ func (r *EventReceiver) publishEvent(_, address, valueKey string, value interfac
 	}
 
 	// publish
-	if err := r.Server.PublishPV(topic, pv, qos, retain); err != nil {
+	if err := server.PublishPV(topic, pv, qos, retain); err != nil {
 		return err
 	}
 	return nil
@@ -0,0 +1,724 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdzio/go-hmccu/itf"
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/model"
+)
+
+const (
+	// default topic prefix of the Home Assistant discovery messages
+	hassDiscoveryPrefix = "homeassistant"
+	// default cycle time for scanning the data points
+	hassScanCycle = 10 * time.Minute
+	// delay of a scan after new devices are announced by the CCU
+	hassScanDelay = 30 * time.Second
+	// identifier prefix of the Home Assistant devices and entities
+	hassIDPrefix = "ccujack_"
+)
+
+// valid characters for node and object IDs of Home Assistant
+var hassInvalidIDChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// HassPublisher publishes Home Assistant MQTT discovery messages for the CCU
+// devices, the virtual devices and the selected system variables. The data
+// points are explored cyclic with the VEAP service. Additionally, a scan is
+// started, if the CCU announces new devices. Discovery messages of deleted
+// devices are removed from the MQTT server. HassPublisher forwards all
+// XML-RPC events to the next logic layer.
+type HassPublisher struct {
+	// Server is used for publishing the discovery messages.
+	Server *Server
+	// Service is used to explore the data points.
+	Service veap.Service
+	// Topic prefix of the discovery messages. If not set, hassDiscoveryPrefix
+	// is used.
+	DiscoveryPrefix string
+	// Cycle time for scanning the data points. If not set, hassScanCycle is
+	// used.
+	ScanCycle time.Duration
+	// Only system variables with SysVarFilter in the description are announced
+	// (case insensitive). An empty filter selects all system variables.
+	SysVarFilter string
+
+	// Next handler for XML-RPC events.
+	Next itf.LogicLayer
+
+	stop    chan struct{}
+	done    chan struct{}
+	trigger chan struct{}
+
+	// published discovery messages by topic
+	mtx     sync.Mutex
+	configs map[string]hassConfig
+}
+
+// hassConfig is a published discovery message.
+type hassConfig struct {
+	// address of the CCU device, empty for system variables
+	device  string
+	payload []byte
+}
+
+// hassParam describes a data point of a channel.
+type hassParam struct {
+	id        string
+	path      string
+	typ       string
+	ops       int
+	flags     int
+	unit      string
+	min, max  interface{}
+	valueList []string
+}
+
+// hassChannel describes a channel with its data points.
+type hassChannel struct {
+	device   map[string]interface{}
+	devAddr  string
+	address  string
+	title    string
+	typ      string
+	params   map[string]*hassParam
+	paramIDs []string
+}
+
+// Start starts the publisher.
+func (p *HassPublisher) Start() {
+	log.Debug("Starting Home Assistant discovery publisher")
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	p.trigger = make(chan struct{}, 1)
+	p.configs = make(map[string]hassConfig)
+	scanCycle := p.ScanCycle
+	if scanCycle <= 0 {
+		scanCycle = hassScanCycle
+	}
+	go func() {
+		// defer clean up
+		defer func() {
+			log.Debug("Stopping Home Assistant discovery publisher")
+			p.done <- struct{}{}
+		}()
+
+		ticker := time.NewTicker(scanCycle)
+		defer ticker.Stop()
+		// first scan after the start up of the device domain
+		delay := time.NewTimer(hassScanDelay)
+		defer delay.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+			case <-delay.C:
+			case <-p.trigger:
+				// wait for the exploration of the new devices
+				delay.Reset(hassScanDelay)
+				continue
+			}
+			p.scan()
+		}
+	}()
+}
+
+// Stop stops the publisher. Published discovery messages are retained.
+func (p *HassPublisher) Stop() {
+	close(p.stop)
+	<-p.done
+}
+
+// Event implements itf.LogicLayer.
+func (p *HassPublisher) Event(interfaceID, address, valueKey string, value interface{}) error {
+	// only forward
+	return p.Next.Event(interfaceID, address, valueKey, value)
+}
+
+// NewDevices implements itf.LogicLayer.
+func (p *HassPublisher) NewDevices(interfaceID string, devDescriptions []*itf.DeviceDescription) error {
+	// scan later
+	select {
+	case p.trigger <- struct{}{}:
+	default:
+	}
+	return p.Next.NewDevices(interfaceID, devDescriptions)
+}
+
+// DeleteDevices implements itf.LogicLayer.
+func (p *HassPublisher) DeleteDevices(interfaceID string, addresses []string) error {
+	p.removeDevices(addresses)
+	return p.Next.DeleteDevices(interfaceID, addresses)
+}
+
+// UpdateDevice implements itf.LogicLayer.
+func (p *HassPublisher) UpdateDevice(interfaceID, address string, hint int) error {
+	// only forward
+	return p.Next.UpdateDevice(interfaceID, address, hint)
+}
+
+// ReplaceDevice implements itf.LogicLayer.
+func (p *HassPublisher) ReplaceDevice(interfaceID, oldDeviceAddress, newDeviceAddress string) error {
+	p.removeDevices([]string{oldDeviceAddress})
+	return p.Next.ReplaceDevice(interfaceID, oldDeviceAddress, newDeviceAddress)
+}
+
+// ReaddedDevice implements itf.LogicLayer.
+func (p *HassPublisher) ReaddedDevice(interfaceID string, deletedAddresses []string) error {
+	p.removeDevices(deletedAddresses)
+	return p.Next.ReaddedDevice(interfaceID, deletedAddresses)
+}
+
+// removeDevices removes the discovery messages of the specified devices.
+func (p *HassPublisher) removeDevices(addresses []string) {
+	devs := make(map[string]bool)
+	for _, a := range addresses {
+		devs[a] = true
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for topic, c := range p.configs {
+		if c.device != "" && devs[c.device] {
+			p.remove(topic)
+		}
+	}
+}
+
+// scan explores all data points and publishes the changes of the discovery
+// messages.
+func (p *HassPublisher) scan() {
+	log.Debug("Scanning data points for Home Assistant")
+	configs := make(map[string]hassConfig)
+	if !p.scanDevices(deviceVeapPath, configs) {
+		return
+	}
+	if !p.scanDevices(virtDevVeapPath, configs) {
+		return
+	}
+	if !p.scanSysVars(configs) {
+		return
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	// publish new and modified discovery messages
+	for topic, c := range configs {
+		old, ok := p.configs[topic]
+		if ok && string(old.payload) == string(c.payload) {
+			continue
+		}
+		if err := p.Server.Publish(topic, c.payload, 0, true); err != nil {
+			log.Errorf("Publishing of Home Assistant discovery message failed: %v", err)
+			continue
+		}
+		p.configs[topic] = c
+	}
+	// remove discovery messages of vanished data points
+	for topic := range p.configs {
+		if _, ok := configs[topic]; !ok {
+			p.remove(topic)
+		}
+	}
+	log.Debugf("Home Assistant discovery messages: %d", len(p.configs))
+}
+
+// remove removes a discovery message. p.mtx must be locked.
+func (p *HassPublisher) remove(topic string) {
+	// Home Assistant removes the entity on an empty payload or an empty JSON
+	// object. The MQTT server can not deliver empty payloads to clients.
+	if err := p.Server.Publish(topic, []byte("{}"), 0, true); err != nil {
+		log.Errorf("Removing of Home Assistant discovery message failed: %v", err)
+		return
+	}
+	delete(p.configs, topic)
+}
+
+// scanDevices explores the devices below the specified VEAP path. On a fatal
+// error, false is returned.
+func (p *HassPublisher) scanDevices(rootPath string, configs map[string]hassConfig) bool {
+	_, devLinks, verr := p.Service.ReadProperties(rootPath)
+	if verr != nil {
+		// virtual devices disabled?
+		if verr.Code() == veap.StatusNotFound {
+			return true
+		}
+		log.Errorf("Home Assistant discovery: %v", verr)
+		return false
+	}
+	for _, dl := range devLinks {
+		if dl.Role != "device" {
+			continue
+		}
+		devPath := path.Join(rootPath, dl.Target)
+		devAttrs, chLinks, verr := p.Service.ReadProperties(devPath)
+		if verr != nil {
+			// device deleted in the mean time
+			log.Debugf("Home Assistant discovery: %v", verr)
+			continue
+		}
+		devAddr := attrString(devAttrs, model.IdentifierProperty)
+		device := map[string]interface{}{
+			"identifiers":  []string{hassIDPrefix + devAddr},
+			"name":         attrString(devAttrs, model.TitleProperty),
+			"model":        attrString(devAttrs, "type"),
+			"manufacturer": "eQ-3",
+		}
+		if fw := attrString(devAttrs, "firmware"); fw != "" {
+			device["sw_version"] = fw
+		}
+
+		for _, cl := range chLinks {
+			if cl.Role != "channel" {
+				continue
+			}
+			ch, ok := p.readChannel(path.Join(devPath, cl.Target), device, devAddr)
+			if !ok {
+				continue
+			}
+			for _, e := range p.channelEntities(ch) {
+				configs[e.topic] = e.config
+			}
+		}
+	}
+	return true
+}
+
+// readChannel reads a channel and its data points.
+func (p *HassPublisher) readChannel(chPath string, device map[string]interface{}, devAddr string) (*hassChannel, bool) {
+	chAttrs, links, verr := p.Service.ReadProperties(chPath)
+	if verr != nil {
+		log.Debugf("Home Assistant discovery: %v", verr)
+		return nil, false
+	}
+	ch := &hassChannel{
+		device:  device,
+		devAddr: devAddr,
+		address: attrString(chAttrs, model.IdentifierProperty),
+		title:   attrString(chAttrs, model.TitleProperty),
+		typ:     attrString(chAttrs, "type"),
+		params:  make(map[string]*hassParam),
+	}
+	for _, l := range links {
+		switch l.Role {
+		case "room":
+			// first room is the suggested area of the device
+			if _, ok := device["suggested_area"]; !ok && l.Title != "" {
+				device["suggested_area"] = l.Title
+			}
+		case "parameter":
+			paramPath := path.Join(chPath, l.Target)
+			attrs, _, verr := p.Service.ReadProperties(paramPath)
+			if verr != nil {
+				log.Debugf("Home Assistant discovery: %v", verr)
+				continue
+			}
+			prm := &hassParam{
+				id:        attrString(attrs, model.IdentifierProperty),
+				path:      paramPath,
+				typ:       attrString(attrs, "type"),
+				ops:       attrInt(attrs, "operations"),
+				flags:     attrInt(attrs, "flags"),
+				unit:      attrString(attrs, "unit"),
+				min:       attrs["minimum"],
+				max:       attrs["maximum"],
+				valueList: attrStrings(attrs, "valueList"),
+			}
+			ch.params[prm.id] = prm
+			ch.paramIDs = append(ch.paramIDs, prm.id)
+		}
+	}
+	return ch, true
+}
+
+// hassEntity is a discovery message of a single entity.
+type hassEntity struct {
+	topic  string
+	config hassConfig
+}
+
+// channelEntities maps the data points of a channel to Home Assistant
+// entities.
+func (p *HassPublisher) channelEntities(ch *hassChannel) []hassEntity {
+	var es []hassEntity
+	used := make(map[string]bool)
+	add := func(component string, prm *hassParam, cfg map[string]interface{}) {
+		used[prm.id] = true
+		objectID := hassID(ch.address + "_" + prm.id)
+		if _, ok := cfg["name"]; !ok {
+			cfg["name"] = ch.title + " " + prm.id
+		}
+		cfg["unique_id"] = hassIDPrefix + objectID
+		cfg["device"] = ch.device
+		b, err := json.Marshal(cfg)
+		if err != nil {
+			log.Errorf("Home Assistant discovery: %v", err)
+			return
+		}
+		es = append(es, hassEntity{
+			topic:  p.discoveryPrefix() + "/" + component + "/" + hassID(hassIDPrefix+ch.devAddr) + "/" + objectID + "/config",
+			config: hassConfig{device: ch.devAddr, payload: b},
+		})
+	}
+
+	// maintenance channel: only diagnostic data points
+	if strings.HasSuffix(ch.address, ":0") {
+		for _, id := range []string{"LOW_BAT", "LOWBAT", "UNREACH"} {
+			if prm, ok := ch.params[id]; ok && prm.typ == "BOOL" {
+				cfg := p.binarySensor(prm)
+				cfg["entity_category"] = "diagnostic"
+				add("binary_sensor", prm, cfg)
+			}
+		}
+		return es
+	}
+
+	// climate
+	sp, ok := ch.params["SET_POINT_TEMPERATURE"]
+	if !ok {
+		sp, ok = ch.params["SET_TEMPERATURE"]
+	}
+	if ok && sp.ops&itf.ParameterOperationWrite != 0 {
+		cfg := map[string]interface{}{
+			"name":                       ch.title,
+			"modes":                      []string{"heat"},
+			"temperature_command_topic":  p.setTopic(sp),
+			"temperature_state_topic":    p.statusTopic(sp),
+			"temperature_state_template": p.template(""),
+			"temperature_unit":           "C",
+			"temp_step":                  0.5,
+		}
+		if v, ok := attrFloat(sp.min); ok {
+			cfg["min_temp"] = v
+		}
+		if v, ok := attrFloat(sp.max); ok {
+			cfg["max_temp"] = v
+		}
+		if at, ok := ch.params["ACTUAL_TEMPERATURE"]; ok {
+			cfg["current_temperature_topic"] = p.statusTopic(at)
+			cfg["current_temperature_template"] = p.template("")
+		}
+		add("climate", sp, cfg)
+	}
+
+	// dimmer or blind
+	if lv, ok := ch.params["LEVEL"]; ok && lv.typ == "FLOAT" && lv.ops&itf.ParameterOperationWrite != 0 {
+		if isCoverChannel(ch.typ) {
+			add("cover", lv, map[string]interface{}{
+				"name":                  ch.title,
+				"command_topic":         p.setTopic(lv),
+				"payload_open":          "1.0",
+				"payload_close":         "0.0",
+				"payload_stop":          nil,
+				"position_topic":        p.statusTopic(lv),
+				"position_template":     p.template(" * 100 | round(0)"),
+				"set_position_topic":    p.setTopic(lv),
+				"set_position_template": "{{ position / 100 }}",
+			})
+			if st, ok := ch.params["STOP"]; ok && st.ops&itf.ParameterOperationWrite != 0 {
+				// the cover entity has no separate topic for stopping
+				used[st.id] = true
+			}
+		} else if isDimmerChannel(ch.typ) {
+			add("light", lv, map[string]interface{}{
+				"name":                 ch.title,
+				"schema":               "template",
+				"command_topic":        p.setTopic(lv),
+				"command_on_template":  "{% if brightness is defined %}{{ brightness / 255 }}{% else %}1.0{% endif %}",
+				"command_off_template": "0.0",
+				"state_topic":          p.statusTopic(lv),
+				"state_template":       "{{ 'on' if (" + p.Server.profile().valueExpr() + " | float(0)) > 0 else 'off' }}",
+				"brightness_template":  p.template(" * 255 | round(0)"),
+			})
+		}
+	}
+
+	// remaining data points
+	for _, id := range ch.paramIDs {
+		prm := ch.params[id]
+		if used[id] || prm.typ == "ACTION" || prm.flags&itf.ParameterFlagVisible == 0 {
+			continue
+		}
+		writeable := prm.ops&itf.ParameterOperationWrite != 0
+		readable := prm.ops&(itf.ParameterOperationRead|itf.ParameterOperationEvent) != 0
+		switch prm.typ {
+		case "BOOL":
+			if writeable && readable {
+				add("switch", prm, p.switchConfig(prm))
+			} else if readable {
+				add("binary_sensor", prm, p.binarySensor(prm))
+			}
+		case "FLOAT", "INTEGER", "ENUM", "STRING":
+			if readable {
+				add("sensor", prm, p.sensor(prm))
+			}
+		}
+	}
+	return es
+}
+
+// scanSysVars explores the selected system variables. On a fatal error, false
+// is returned.
+func (p *HassPublisher) scanSysVars(configs map[string]hassConfig) bool {
+	_, links, verr := p.Service.ReadProperties(sysVarVeapPath)
+	if verr != nil {
+		log.Errorf("Home Assistant discovery: %v", verr)
+		return false
+	}
+	device := map[string]interface{}{
+		"identifiers":  []string{hassIDPrefix + "sysvars"},
+		"name":         "CCU System Variables",
+		"manufacturer": "eQ-3",
+	}
+	filter := strings.ToLower(p.SysVarFilter)
+	for _, l := range links {
+		if l.Role != "sysvar" {
+			continue
+		}
+		svPath := path.Join(sysVarVeapPath, l.Target)
+		attrs, _, verr := p.Service.ReadProperties(svPath)
+		if verr != nil {
+			log.Debugf("Home Assistant discovery: %v", verr)
+			continue
+		}
+		if !strings.Contains(strings.ToLower(attrString(attrs, model.DescriptionProperty)), filter) {
+			continue
+		}
+		id := attrString(attrs, model.IdentifierProperty)
+		prm := &hassParam{
+			id:   id,
+			path: svPath,
+			typ:  attrString(attrs, "type"),
+			ops:  attrInt(attrs, "operations"),
+			unit: attrString(attrs, "unit"),
+		}
+		prm.valueList = attrStrings(attrs, "valueList")
+		var component string
+		var cfg map[string]interface{}
+		switch prm.typ {
+		case "BOOL", "ALARM":
+			if prm.ops&itf.ParameterOperationWrite != 0 {
+				component, cfg = "switch", p.switchConfig(prm)
+			} else {
+				component, cfg = "binary_sensor", p.binarySensor(prm)
+			}
+		default:
+			component, cfg = "sensor", p.sensor(prm)
+		}
+		objectID := hassID("sysvar_" + id)
+		cfg["name"] = attrString(attrs, model.TitleProperty)
+		cfg["unique_id"] = hassIDPrefix + objectID
+		cfg["device"] = device
+		b, err := json.Marshal(cfg)
+		if err != nil {
+			log.Errorf("Home Assistant discovery: %v", err)
+			continue
+		}
+		topic := p.discoveryPrefix() + "/" + component + "/" + hassIDPrefix + "sysvars/" + objectID + "/config"
+		configs[topic] = hassConfig{payload: b}
+	}
+	return true
+}
+
+func (p *HassPublisher) binarySensor(prm *hassParam) map[string]interface{} {
+	cfg := map[string]interface{}{
+		"state_topic":    p.statusTopic(prm),
+		"value_template": p.boolTemplate(),
+		"payload_on":     "ON",
+		"payload_off":    "OFF",
+	}
+	switch prm.id {
+	case "LOW_BAT", "LOWBAT":
+		cfg["device_class"] = "battery"
+	case "UNREACH", "ERROR_OVERHEAT", "SABOTAGE", "ERROR_SABOTAGE":
+		cfg["device_class"] = "problem"
+	case "MOTION":
+		cfg["device_class"] = "motion"
+	case "PRESENCE_DETECTION_STATE":
+		cfg["device_class"] = "presence"
+	}
+	return cfg
+}
+
+func (p *HassPublisher) switchConfig(prm *hassParam) map[string]interface{} {
+	return map[string]interface{}{
+		"state_topic":    p.statusTopic(prm),
+		"value_template": p.boolTemplate(),
+		"state_on":       "ON",
+		"state_off":      "OFF",
+		"command_topic":  p.setTopic(prm),
+		"payload_on":     "true",
+		"payload_off":    "false",
+	}
+}
+
+func (p *HassPublisher) sensor(prm *hassParam) map[string]interface{} {
+	cfg := map[string]interface{}{
+		"state_topic": p.statusTopic(prm),
+	}
+	switch prm.typ {
+	case "ENUM", "VALUE_LIST":
+		if len(prm.valueList) > 0 {
+			// map index to value name
+			b, _ := json.Marshal(prm.valueList)
+			cfg["value_template"] = "{{ " + string(b) + "[" + p.Server.profile().valueExpr() + " | int(0)] }}"
+			return cfg
+		}
+		cfg["value_template"] = p.template("")
+		return cfg
+	case "STRING":
+		cfg["value_template"] = p.template("")
+		return cfg
+	}
+
+	// numeric data point
+	unit := prm.unit
+	switch unit {
+	case "100%":
+		cfg["value_template"] = p.template(" * 100 | round(1)")
+		unit = "%"
+	case "Lux", "lux":
+		cfg["value_template"] = p.template("")
+		unit = "lx"
+	default:
+		cfg["value_template"] = p.template("")
+	}
+	if unit != "" {
+		cfg["unit_of_measurement"] = unit
+	}
+	cfg["state_class"] = "measurement"
+	if dc, sc := sensorClass(prm.id); dc != "" {
+		cfg["device_class"] = dc
+		if sc != "" {
+			cfg["state_class"] = sc
+		}
+	}
+	return cfg
+}
+
+// sensorClass returns the device and state class of a sensor by the parameter
+// name.
+func sensorClass(id string) (deviceClass, stateClass string) {
+	switch {
+	case strings.HasSuffix(id, "TEMPERATURE"):
+		return "temperature", ""
+	case strings.HasSuffix(id, "HUMIDITY"):
+		return "humidity", ""
+	case strings.HasPrefix(id, "ILLUMINATION") || id == "BRIGHTNESS":
+		return "illuminance", ""
+	case strings.HasPrefix(id, "ENERGY_COUNTER"):
+		return "energy", "total_increasing"
+	case id == "POWER":
+		return "power", ""
+	case id == "VOLTAGE" || id == "OPERATING_VOLTAGE":
+		return "voltage", ""
+	case id == "CURRENT":
+		return "current", ""
+	case id == "FREQUENCY":
+		return "frequency", ""
+	case strings.HasPrefix(id, "RSSI"):
+		return "signal_strength", ""
+	case id == "AIR_PRESSURE":
+		return "atmospheric_pressure", ""
+	case id == "GAS_COUNTER":
+		return "gas", "total_increasing"
+	}
+	return "", ""
+}
+
+func (p *HassPublisher) statusTopic(prm *hassParam) string {
+	status, _, _ := p.Server.profile().Topics(prm.path)
+	return status
+}
+
+func (p *HassPublisher) setTopic(prm *hassParam) string {
+	_, set, _ := p.Server.profile().Topics(prm.path)
+	return set
+}
+
+// template returns a Jinja2 template for extracting the value from a status
+// payload. The filter is appended to the value expression.
+func (p *HassPublisher) template(filter string) string {
+	if filter == "" {
+		return "{{ " + p.Server.profile().valueExpr() + " }}"
+	}
+	return "{{ (" + p.Server.profile().valueExpr() + " | float(0))" + filter + " }}"
+}
+
+// boolTemplate returns a Jinja2 template, which maps a boolean status payload
+// to ON or OFF.
+func (p *HassPublisher) boolTemplate() string {
+	return "{{ 'ON' if " + p.Server.profile().valueExpr() + " in [true, 'true', 'True', 1, '1'] else 'OFF' }}"
+}
+
+func (p *HassPublisher) discoveryPrefix() string {
+	if p.DiscoveryPrefix == "" {
+		return hassDiscoveryPrefix
+	}
+	return p.DiscoveryPrefix
+}
+
+func isCoverChannel(typ string) bool {
+	return strings.Contains(typ, "BLIND") || strings.Contains(typ, "SHUTTER_TRANSMITTER") ||
+		strings.Contains(typ, "JALOUSIE") || strings.Contains(typ, "SHUTTER_VIRTUAL_RECEIVER")
+}
+
+func isDimmerChannel(typ string) bool {
+	return strings.Contains(typ, "DIMMER")
+}
+
+// hassID replaces invalid characters for Home Assistant IDs.
+func hassID(s string) string {
+	return hassInvalidIDChars.ReplaceAllString(s, "_")
+}
+
+func attrString(attrs veap.AttrValues, name string) string {
+	s, _ := attrs[name].(string)
+	return s
+}
+
+// attrStrings converts a list attribute value.
+func attrStrings(attrs veap.AttrValues, name string) []string {
+	switch l := attrs[name].(type) {
+	case []string:
+		return l
+	case *[]string:
+		if l != nil {
+			return *l
+		}
+	case []interface{}:
+		ss := make([]string, len(l))
+		for i, v := range l {
+			ss[i], _ = v.(string)
+		}
+		return ss
+	}
+	return nil
+}
+
+func attrInt(attrs veap.AttrValues, name string) int {
+	v, _ := attrFloat(attrs[name])
+	return int(v)
+}
+
+// attrFloat converts a numeric attribute value.
+func attrFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
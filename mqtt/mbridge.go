@@ -1,12 +1,18 @@
 package mqtt
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"os"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/mdzio/ccu-jack/rtcfg"
@@ -21,13 +27,175 @@ var logBridge = logging.Get("mqtt-bridge")
 const (
 	bridgeKeepAlive       = 60 * time.Second
 	bridgeRecoverDuration = 60 * time.Second
+	bridgeConnectTimeout  = 30 * time.Second
 )
 
+// Bridges manages the bridges of the configuration. Added, modified and
+// removed bridges are started and stopped on Update.
+type Bridges struct {
+	EmbeddedServer *Server
+	// TemplateFuncs are available in the payload templates of the shared
+	// topics (e.g. virtdev.TemplateFuncs).
+	TemplateFuncs template.FuncMap
+	// QueueDir is the directory for the persisted offline queues.
+	QueueDir string
+
+	mtx     sync.Mutex
+	bridges map[string]*Bridge
+	// copies of the configurations of the started bridges
+	cfgs map[string]rtcfg.MQTTBridge
+
+	// serializes the updates and the stopping of the bridges
+	updateMtx sync.Mutex
+
+	// latest configuration, which is not yet applied
+	pendingMtx sync.Mutex
+	pending    map[string]rtcfg.MQTTBridge
+	stopped    bool
+}
+
+// Update starts and stops the bridges based on the configuration. The
+// configuration must be locked for reading. It is copied and applied in the
+// background, because stopping a bridge may take a while.
+func (bs *Bridges) Update(cfgs map[string]*rtcfg.MQTTBridge) {
+	cc := make(map[string]rtcfg.MQTTBridge, len(cfgs))
+	for id, cfg := range cfgs {
+		c := *cfg
+		c.Incoming = cloneSharedTopics(cfg.Incoming)
+		c.Outgoing = cloneSharedTopics(cfg.Outgoing)
+		cc[id] = c
+	}
+	bs.pendingMtx.Lock()
+	bs.pending = cc
+	bs.pendingMtx.Unlock()
+	go bs.apply()
+}
+
+// apply starts and stops the bridges based on the latest configuration.
+func (bs *Bridges) apply() {
+	bs.updateMtx.Lock()
+	defer bs.updateMtx.Unlock()
+	bs.pendingMtx.Lock()
+	cfgs := bs.pending
+	bs.pending = nil
+	stopped := bs.stopped
+	bs.pendingMtx.Unlock()
+	// already applied by a previous call?
+	if cfgs == nil || stopped {
+		return
+	}
+
+	// remove removed and modified bridges
+	var stop []*Bridge
+	bs.mtx.Lock()
+	if bs.bridges == nil {
+		bs.bridges = make(map[string]*Bridge)
+		bs.cfgs = make(map[string]rtcfg.MQTTBridge)
+	}
+	for id, b := range bs.bridges {
+		cfg, ok := cfgs[id]
+		if !ok || !reflect.DeepEqual(cfg, bs.cfgs[id]) {
+			stop = append(stop, b)
+			delete(bs.bridges, id)
+			delete(bs.cfgs, id)
+		}
+	}
+	bs.mtx.Unlock()
+	// stop them without blocking Status
+	for _, b := range stop {
+		b.Stop()
+	}
+
+	// start added and modified bridges
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	for id, cfg := range cfgs {
+		if _, ok := bs.bridges[id]; ok {
+			continue
+		}
+		c := cfg
+		b := &Bridge{EmbeddedServer: bs.EmbeddedServer, TemplateFuncs: bs.TemplateFuncs, QueueDir: bs.QueueDir}
+		b.Start(&c)
+		bs.bridges[id] = b
+		bs.cfgs[id] = cfg
+	}
+}
+
+// Stop stops all bridges. Afterwards, updates are ignored.
+func (bs *Bridges) Stop() {
+	bs.pendingMtx.Lock()
+	bs.stopped = true
+	bs.pending = nil
+	bs.pendingMtx.Unlock()
+	// wait for a running update
+	bs.updateMtx.Lock()
+	defer bs.updateMtx.Unlock()
+	bs.mtx.Lock()
+	stop := bs.bridges
+	bs.bridges = nil
+	bs.cfgs = nil
+	bs.mtx.Unlock()
+	for _, b := range stop {
+		b.Stop()
+	}
+}
+
+// Status returns the status of a bridge. false is returned, if the bridge
+// does not exist in the configuration.
+func (bs *Bridges) Status(id string) (BridgeStatus, bool) {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	b, ok := bs.bridges[id]
+	if !ok {
+		return BridgeStatus{}, false
+	}
+	return b.Status(), true
+}
+
+// Identifiers returns the sorted identifiers of the bridges.
+func (bs *Bridges) Identifiers() []string {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	ids := make([]string, 0, len(bs.bridges))
+	for id := range bs.bridges {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// BridgeStatus is the state of a bridge.
+type BridgeStatus struct {
+	// Enabled is true, if the bridge is enabled in the configuration.
+	Enabled bool
+	// Connected is true, if the bridge is connected to the remote server.
+	Connected bool
+	// LastError is the last error of the bridge, empty if no error occurred.
+	LastError     string
+	LastErrorTime time.Time
+	// Reconnects is the number of connection attempts after an error.
+	Reconnects uint64
+	// MessagesIn is the number of messages received from the remote server.
+	MessagesIn uint64
+	// MessagesOut is the number of messages sent to the remote server.
+	MessagesOut uint64
+	// MessagesDropped is the number of messages dropped by the
+	// transformations of the shared topics.
+	MessagesDropped uint64
+	// MessagesQueued is the number of outgoing messages in the offline queue.
+	MessagesQueued int
+}
+
 // Bridge connects the embedded MQTT server with a remote one. Messages on
 // configurable topics are exchanged between the servers.
 type Bridge struct {
 	EmbeddedServer *Server
+	// TemplateFuncs are available in the payload templates, optional.
+	TemplateFuncs template.FuncMap
+	// QueueDir is the directory for the persisted offline queue.
+	QueueDir string
 
+	identifier string
 	address    string
 	port       int
 	useTLS     bool
@@ -38,13 +206,69 @@ type Bridge struct {
 	connMsg *message.ConnectMessage
 
 	cancel func()
-	in     []rtcfg.MQTTSharedTopic
-	out    []rtcfg.MQTTSharedTopic
+	in     []*sharedTopic
+	out    []*sharedTopic
+	// offline queue, nil if disabled
+	queue *bridgeQueue
+
+	// connected client, nil if not connected
+	clientMtx sync.Mutex
+	client    *service.Client
+
+	// 1, if connected to the remote server (atomic access)
+	connected int32
+	// counters (atomic access)
+	reconnects      uint64
+	messagesIn      uint64
+	messagesOut     uint64
+	messagesDropped uint64
+
+	errMtx        sync.Mutex
+	lastError     string
+	lastErrorTime time.Time
+}
+
+// Connected returns true, if the bridge is connected to the remote server.
+func (b *Bridge) Connected() bool {
+	return atomic.LoadInt32(&b.connected) == 1
+}
+
+// Status returns the current state of the bridge.
+func (b *Bridge) Status() BridgeStatus {
+	queued := 0
+	if b.queue != nil {
+		queued = b.queue.Len()
+	}
+	b.errMtx.Lock()
+	defer b.errMtx.Unlock()
+	return BridgeStatus{
+		Enabled:       b.cancel != nil,
+		Connected:     b.Connected(),
+		LastError:     b.lastError,
+		LastErrorTime: b.lastErrorTime,
+		Reconnects:    atomic.LoadUint64(&b.reconnects),
+		MessagesIn:    atomic.LoadUint64(&b.messagesIn),
+		MessagesOut:   atomic.LoadUint64(&b.messagesOut),
+		// dropped messages
+		MessagesDropped: atomic.LoadUint64(&b.messagesDropped),
+		MessagesQueued:  queued,
+	}
+}
+
+// setError logs an error and remembers it for the status.
+func (b *Bridge) setError(err error) {
+	logBridge.Errorf("Bridge %s: %v", b.identifier, err)
+	b.errMtx.Lock()
+	defer b.errMtx.Unlock()
+	b.lastError = err.Error()
+	b.lastErrorTime = time.Now()
 }
 
 // Start starts the bridge with the specified configuration. The configuration
 // must be locked for reading.
 func (b *Bridge) Start(cfg *rtcfg.MQTTBridge) {
+	b.identifier = cfg.Identifier
+
 	// bridge enabled?
 	if !cfg.Enable {
 		return
@@ -68,32 +292,89 @@ func (b *Bridge) Start(cfg *rtcfg.MQTTBridge) {
 	b.connMsg.SetKeepAlive(uint16(bridgeKeepAlive / time.Second))
 
 	// clone shared topics
-	b.in = cloneSharedTopics(cfg.Incoming)
-	b.out = cloneSharedTopics(cfg.Outgoing)
+	b.in = b.newSharedTopics(cfg.Incoming)
+	b.out = b.newSharedTopics(cfg.Outgoing)
+
+	// load offline queue
+	if cfg.Queue.Enable {
+		q, err := newBridgeQueue(b.QueueDir, b.identifier, cfg.Queue.MaxEntries,
+			time.Duration(cfg.Queue.MaxAge)*time.Hour, cfg.Queue.LatestOnly)
+		if err != nil {
+			b.setError(err)
+		} else {
+			logBridge.Debugf("Messages in offline queue of bridge %s: %d", b.identifier, q.Len())
+			b.queue = q
+		}
+	}
 
 	// run daemon
+	b.errMtx.Lock()
 	b.cancel = conc.DaemonFunc(b.run)
+	b.errMtx.Unlock()
 }
 
 func (b *Bridge) Stop() {
 	// only stop, if enabled
-	if b.cancel != nil {
-		b.cancel()
-		b.cancel = nil
+	b.errMtx.Lock()
+	cancel := b.cancel
+	b.cancel = nil
+	b.errMtx.Unlock()
+	if cancel != nil {
+		cancel()
 	}
 }
 
 func (b *Bridge) run(ctx conc.Context) {
-	logBridge.Info("Starting MQTT bridge")
-	defer logBridge.Debug("Stopping MQTT bridge")
+	logBridge.Infof("Starting MQTT bridge %s", b.identifier)
+	defer logBridge.Debugf("Stopping MQTT bridge %s", b.identifier)
+	// persist offline queue on stop, after removing the subscriptions and
+	// discarding the delayed messages
+	defer b.flushQueue()
+	defer stopSharedTopics(b.in)
+	defer stopSharedTopics(b.out)
+
+	// subscribe local topics, the messages are queued while not connected
+	for _, tt := range b.out {
+		t := tt // clone for callbacks
+		var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+			lt := string(msg.Topic())
+			logBridge.Tracef("Outgoing local message on topic %s with retain %t, QoS %d and payload %s", lt, msg.Retain(), msg.QoS(), string(msg.Payload()))
+			// replace topic prefix
+			rt := t.RemotePrefix + strings.TrimPrefix(lt, t.LocalPrefix)
+			// transform and send message
+			dropped, err := t.forward(rt, msg, b.send)
+			if err != nil {
+				b.setError(err)
+				return nil
+			}
+			if dropped {
+				logBridge.Tracef("Dropping message for remote topic %s", rt)
+				atomic.AddUint64(&b.messagesDropped, 1)
+			}
+			return nil
+		}
+		if err := b.EmbeddedServer.Subscribe(t.LocalPrefix+t.Pattern, t.QoS, &onPublish); err != nil {
+			b.setError(fmt.Errorf("Subscribing outgoing local topic %s failed: %w", t.LocalPrefix+t.Pattern, err))
+			continue
+		}
+		// remove subscriptions on stop
+		defer b.EmbeddedServer.Unsubscribe(t.LocalPrefix+t.Pattern, &onPublish)
+	}
+
 	// rerun client on errors
 	for {
 		if err := b.runClient(ctx); err != nil {
-			logBridge.Error(err)
+			if ctx.IsDone() {
+				// connecting canceled, bridge should stop
+				return
+			}
+			b.setError(err)
+			b.flushQueue()
 			if err := ctx.Sleep(bridgeRecoverDuration); err != nil {
 				// bridge should stop
 				return
 			}
+			atomic.AddUint64(&b.reconnects, 1)
 		} else {
 			// bridge should stop
 			return
@@ -129,16 +410,18 @@ func (b *Bridge) runClient(ctx conc.Context) error {
 			}
 			tls.RootCAs = caCerts
 		}
-		if err := client.ConnectTLS(addr, b.connMsg, tls); err != nil {
+		if err := b.connect(ctx, client, func() error { return client.ConnectTLS(addr, b.connMsg, tls) }); err != nil {
 			return fmt.Errorf("Connecting to secure MQTT server on address %s failed: %w", addr, err)
 		}
 	} else {
 		logBridge.Debugf("Connecting to MQTT server on %s with client ID %s", addr, string(b.connMsg.ClientID()))
-		if err := client.Connect(addr, b.connMsg); err != nil {
+		if err := b.connect(ctx, client, func() error { return client.Connect(addr, b.connMsg) }); err != nil {
 			return fmt.Errorf("Connecting to MQTT server on address %s failed: %w", addr, err)
 		}
 	}
 	defer client.Disconnect()
+	atomic.StoreInt32(&b.connected, 1)
+	defer atomic.StoreInt32(&b.connected, 0)
 
 	// subscribe remote topics and publish local
 	for _, tt := range b.in {
@@ -149,18 +432,25 @@ func (b *Bridge) runClient(ctx conc.Context) error {
 		}
 		var onComplete service.OnCompleteFunc = func(msg, ack message.Message, err error) error {
 			if err != nil {
-				logBridge.Errorf("Subscribing remote topic %s failed: %v", t.RemotePrefix+t.Pattern, err)
+				b.setError(fmt.Errorf("Subscribing remote topic %s failed: %w", t.RemotePrefix+t.Pattern, err))
 			}
 			return nil
 		}
 		var onPublish service.OnPublishFunc = func(pubmsg *message.PublishMessage) error {
 			rt := string(pubmsg.Topic())
 			logBridge.Tracef("Incoming remote message on topic %s with retain %t, QoS %d and payload %s", rt, pubmsg.Retain(), pubmsg.QoS(), string(pubmsg.Payload()))
+			atomic.AddUint64(&b.messagesIn, 1)
 			// replace topic prefix
 			lt := t.LocalPrefix + strings.TrimPrefix(rt, t.RemotePrefix)
-			// publish on local server
-			if err := b.EmbeddedServer.Publish(lt, pubmsg.Payload(), pubmsg.QoS(), pubmsg.Retain()); err != nil {
-				logBridge.Errorf("Publishing message on local topic %s failed: %v", lt, err)
+			// transform message and publish on local server
+			dropped, err := t.forward(lt, pubmsg, b.publishLocal)
+			if err != nil {
+				b.setError(err)
+				return nil
+			}
+			if dropped {
+				logBridge.Tracef("Dropping message for local topic %s", lt)
+				atomic.AddUint64(&b.messagesDropped, 1)
 			}
 			return nil
 		}
@@ -169,41 +459,11 @@ func (b *Bridge) runClient(ctx conc.Context) error {
 		}
 	}
 
-	// subscribe local topics and publish remote
-	for _, tt := range b.out {
-		t := tt // clone for callbacks
-		var onComplete service.OnCompleteFunc = func(msg, ack message.Message, err error) error {
-			if err != nil {
-				logBridge.Errorf("Publishing on remote topic failed: %v", err)
-			}
-			return nil
-		}
-		var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
-			lt := string(msg.Topic())
-			logBridge.Tracef("Outgoing local message on topic %s with retain %t, QoS %d and payload %s", lt, msg.Retain(), msg.QoS(), string(msg.Payload()))
-			// replace topic prefix
-			rt := t.RemotePrefix + strings.TrimPrefix(lt, t.LocalPrefix)
-			// publish on remote server
-			pubmsg := message.NewPublishMessage()
-			if err := pubmsg.SetTopic([]byte(rt)); err != nil {
-				logBridge.Errorf("Invalid remote topic %s: %v", rt, err)
-				return nil
-			}
-			pubmsg.SetPayload(msg.Payload())
-			pubmsg.SetQoS(msg.QoS())
-			pubmsg.SetRetain(msg.Retain())
-			logBridge.Tracef("Publishing on remote topic %s: %s", rt, string(msg.Payload()))
-			if err := client.Publish(pubmsg, onComplete); err != nil {
-				logBridge.Errorf("Publishing message on remote topic %s failed: %v", rt, err)
-			}
-			return nil
-		}
-		if err := b.EmbeddedServer.Subscribe(t.LocalPrefix+t.Pattern, t.QoS, &onPublish); err != nil {
-			return fmt.Errorf("Subscribing outgoing local topic %s failed: %w", t.LocalPrefix+t.Pattern, err)
-		}
-		// remove subscriptions on stop
-		defer b.EmbeddedServer.Unsubscribe(t.LocalPrefix+t.Pattern, &onPublish)
+	// send queued messages, publish outgoing messages from now on
+	if err := b.attach(client); err != nil {
+		return err
 	}
+	defer b.detach()
 
 	// send keep alive pings
 	for {
@@ -218,15 +478,338 @@ func (b *Bridge) runClient(ctx conc.Context) error {
 	}
 }
 
+// connect runs the connect function in the background, because the MQTT
+// client does not support a dial timeout. It returns, if the connect function
+// returns, the timeout expires or the bridge should stop. A connection, which
+// is established afterwards, is closed.
+func (b *Bridge) connect(ctx conc.Context, client *service.Client, connect func() error) error {
+	result := make(chan error)
+	abort := make(chan struct{})
+	go func() {
+		err := connect()
+		select {
+		case result <- err:
+		case <-abort:
+			if err == nil {
+				client.Disconnect()
+			}
+		}
+	}()
+	timer := time.NewTimer(bridgeConnectTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		close(abort)
+		return fmt.Errorf("Timeout after %v", bridgeConnectTimeout)
+	case <-ctx.Done():
+		close(abort)
+		return conc.ErrCanceled
+	}
+}
+
+// send publishes a message on the remote server. If the bridge is not
+// connected, messages with QoS 1 or 2 are stored in the offline queue. false is
+// returned, if the message is dropped.
+func (b *Bridge) send(pubmsg *message.PublishMessage) bool {
+	b.clientMtx.Lock()
+	defer b.clientMtx.Unlock()
+	if b.client != nil {
+		// messages queued after a publish error are sent first to keep the
+		// order
+		_, err := b.sendQueued(b.client)
+		if err == nil {
+			err = b.publish(b.client, pubmsg)
+			if err == nil {
+				return true
+			}
+		}
+		b.setError(err)
+	}
+	if b.queue == nil || pubmsg.QoS() == 0 {
+		logBridge.Tracef("Not connected, dropping message for remote topic %s", string(pubmsg.Topic()))
+		return false
+	}
+	logBridge.Tracef("Not connected, queueing message for remote topic %s", string(pubmsg.Topic()))
+	b.queue.Push(queuedMessage{
+		Topic: string(pubmsg.Topic()),
+		// the payload buffer may be reused
+		Payload: append([]byte(nil), pubmsg.Payload()...),
+		QoS:     pubmsg.QoS(),
+		Retain:  pubmsg.Retain(),
+		Time:    time.Now(),
+	})
+	return true
+}
+
+// publishLocal publishes a message from the remote server on the embedded
+// server. false is returned, if this fails.
+func (b *Bridge) publishLocal(fwdmsg *message.PublishMessage) bool {
+	lt := string(fwdmsg.Topic())
+	if err := b.EmbeddedServer.Publish(lt, fwdmsg.Payload(), fwdmsg.QoS(), fwdmsg.Retain()); err != nil {
+		b.setError(fmt.Errorf("Publishing message on local topic %s failed: %w", lt, err))
+		return false
+	}
+	return true
+}
+
+// publish publishes a message on the remote server.
+func (b *Bridge) publish(client *service.Client, pubmsg *message.PublishMessage) error {
+	rt := string(pubmsg.Topic())
+	logBridge.Tracef("Publishing on remote topic %s: %s", rt, string(pubmsg.Payload()))
+	var onComplete service.OnCompleteFunc = func(msg, ack message.Message, err error) error {
+		if err != nil {
+			b.setError(fmt.Errorf("Publishing on remote topic %s failed: %w", rt, err))
+		}
+		return nil
+	}
+	if err := client.Publish(pubmsg, onComplete); err != nil {
+		return fmt.Errorf("Publishing message on remote topic %s failed: %w", rt, err)
+	}
+	atomic.AddUint64(&b.messagesOut, 1)
+	return nil
+}
+
+// attach sends the queued messages in order and sets the client for
+// publishing the outgoing messages.
+func (b *Bridge) attach(client *service.Client) error {
+	b.clientMtx.Lock()
+	defer b.clientMtx.Unlock()
+	cnt, err := b.sendQueued(client)
+	if err != nil {
+		return err
+	}
+	if cnt > 0 {
+		logBridge.Infof("Bridge %s: Queued messages sent: %d", b.identifier, cnt)
+	}
+	b.client = client
+	return nil
+}
+
+// sendQueued sends the queued messages in order. On error, the remaining
+// messages stay queued. b.clientMtx must be locked.
+func (b *Bridge) sendQueued(client *service.Client) (int, error) {
+	if b.queue == nil {
+		return 0, nil
+	}
+	cnt := 0
+	for {
+		qm, ok := b.queue.Peek()
+		if !ok {
+			break
+		}
+		pubmsg := message.NewPublishMessage()
+		if err := pubmsg.SetTopic([]byte(qm.Topic)); err != nil {
+			return cnt, fmt.Errorf("Invalid queued topic %s: %w", qm.Topic, err)
+		}
+		pubmsg.SetPayload(qm.Payload)
+		if err := pubmsg.SetQoS(qm.QoS); err != nil {
+			return cnt, fmt.Errorf("Invalid QoS for queued topic %s: %w", qm.Topic, err)
+		}
+		pubmsg.SetRetain(qm.Retain)
+		if err := b.publish(client, pubmsg); err != nil {
+			return cnt, err
+		}
+		b.queue.Pop()
+		cnt++
+	}
+	if cnt > 0 {
+		b.flushQueue()
+	}
+	return cnt, nil
+}
+
+// detach removes the client. Afterwards, the outgoing messages are queued.
+func (b *Bridge) detach() {
+	b.clientMtx.Lock()
+	defer b.clientMtx.Unlock()
+	b.client = nil
+}
+
+// flushQueue writes the offline queue to disk, if enabled.
+func (b *Bridge) flushQueue() {
+	if b.queue == nil {
+		return
+	}
+	if err := b.queue.Flush(); err != nil {
+		b.setError(err)
+	}
+}
+
 func cloneSharedTopics(ts []rtcfg.MQTTSharedTopic) []rtcfg.MQTTSharedTopic {
 	var cts []rtcfg.MQTTSharedTopic
 	for _, t := range ts {
-		cts = append(cts, rtcfg.MQTTSharedTopic{
-			Pattern:      t.Pattern,
-			LocalPrefix:  t.LocalPrefix,
-			RemotePrefix: t.RemotePrefix,
-			QoS:          t.QoS,
-		})
+		ct := rtcfg.MQTTSharedTopic{
+			Pattern:       t.Pattern,
+			LocalPrefix:   t.LocalPrefix,
+			RemotePrefix:  t.RemotePrefix,
+			QoS:           t.QoS,
+			Template:      t.Template,
+			MinInterval:   t.MinInterval,
+			DropUnchanged: t.DropUnchanged,
+		}
+		if t.PublishQoS != nil {
+			qos := *t.PublishQoS
+			ct.PublishQoS = &qos
+		}
+		if t.Retain != nil {
+			retain := *t.Retain
+			ct.Retain = &retain
+		}
+		cts = append(cts, ct)
 	}
 	return cts
 }
+
+// sharedTopic is a shared topic with the state of its transformations.
+type sharedTopic struct {
+	rtcfg.MQTTSharedTopic
+	template *template.Template
+
+	mtx sync.Mutex
+	// state of the rate limit and deduplication, the target topic is key
+	last map[string]*forwardedMessage
+}
+
+type forwardedMessage struct {
+	// payload and time of the last sent message
+	payload []byte
+	time    time.Time
+	// latest message delayed by the rate limit, nil if none
+	delayed *message.PublishMessage
+	send    func(*message.PublishMessage) bool
+	timer   *time.Timer
+}
+
+// newSharedTopics clones the shared topics and prepares the transformations.
+// Shared topics with an invalid template are skipped.
+func (b *Bridge) newSharedTopics(ts []rtcfg.MQTTSharedTopic) []*sharedTopic {
+	var sts []*sharedTopic
+	for _, t := range cloneSharedTopics(ts) {
+		st := &sharedTopic{MQTTSharedTopic: t, last: make(map[string]*forwardedMessage)}
+		if t.Template != "" {
+			tmpl, err := template.New("bridge").Funcs(b.TemplateFuncs).Parse(t.Template)
+			if err != nil {
+				b.setError(fmt.Errorf("Invalid template '%s' for shared topic %s: %w", t.Template, t.Pattern, err))
+				continue
+			}
+			st.template = tmpl
+		}
+		sts = append(sts, st)
+	}
+	return sts
+}
+
+// forward applies the transformations to a message, which is forwarded on the
+// specified topic, and passes the result to the send function. send returns
+// false, if the message could not be published or queued. A message within the
+// min. interval is delayed and sent, when the interval expires. Only the latest
+// delayed message is kept. dropped is true, if a message is discarded.
+func (t *sharedTopic) forward(topic string, msg *message.PublishMessage, send func(*message.PublishMessage) bool) (dropped bool, err error) {
+	payload := msg.Payload()
+	if t.template != nil {
+		var buf bytes.Buffer
+		if err := t.template.Execute(&buf, string(payload)); err != nil {
+			return false, fmt.Errorf("Transformation of payload for topic %s failed: %w", topic, err)
+		}
+		// an empty result drops the message
+		if buf.Len() == 0 {
+			return true, nil
+		}
+		payload = buf.Bytes()
+	}
+
+	fwdmsg := message.NewPublishMessage()
+	if err := fwdmsg.SetTopic([]byte(topic)); err != nil {
+		return false, fmt.Errorf("Invalid topic %s: %w", topic, err)
+	}
+	// the payload buffer may be reused, if the message is delayed
+	fwdmsg.SetPayload(append([]byte(nil), payload...))
+	qos := msg.QoS()
+	if t.PublishQoS != nil {
+		qos = *t.PublishQoS
+	}
+	if err := fwdmsg.SetQoS(qos); err != nil {
+		return false, fmt.Errorf("Invalid QoS for topic %s: %w", topic, err)
+	}
+	retain := msg.Retain()
+	if t.Retain != nil {
+		retain = *t.Retain
+	}
+	fwdmsg.SetRetain(retain)
+
+	// no rate limit and deduplication?
+	if t.MinInterval <= 0 && !t.DropUnchanged {
+		send(fwdmsg)
+		return false, nil
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	last, ok := t.last[topic]
+	if !ok {
+		last = &forwardedMessage{}
+		t.last[topic] = last
+	}
+	// the last sent payload is still up to date, a delayed message is obsolete
+	if t.DropUnchanged && !last.time.IsZero() && bytes.Equal(last.payload, fwdmsg.Payload()) {
+		last.delayed = nil
+		return true, nil
+	}
+	// within the min. interval?
+	interval := time.Duration(t.MinInterval) * time.Millisecond
+	if elapsed := time.Since(last.time); !last.time.IsZero() && elapsed < interval {
+		dropped = last.delayed != nil
+		last.delayed = fwdmsg
+		last.send = send
+		if last.timer == nil {
+			last.timer = time.AfterFunc(interval-elapsed, func() { t.sendDelayed(topic) })
+		}
+		return dropped, nil
+	}
+	last.delayed = nil
+	t.sendLocked(last, fwdmsg, send)
+	return false, nil
+}
+
+// sendDelayed sends the delayed message of a topic.
+func (t *sharedTopic) sendDelayed(topic string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	last, ok := t.last[topic]
+	if !ok {
+		return
+	}
+	last.timer = nil
+	if last.delayed == nil {
+		return
+	}
+	fwdmsg := last.delayed
+	last.delayed = nil
+	t.sendLocked(last, fwdmsg, last.send)
+}
+
+// sendLocked sends a message and records it for the rate limit and
+// deduplication, if it was published or queued. t.mtx must be locked.
+func (t *sharedTopic) sendLocked(last *forwardedMessage, fwdmsg *message.PublishMessage, send func(*message.PublishMessage) bool) {
+	if send(fwdmsg) {
+		last.payload = fwdmsg.Payload()
+		last.time = time.Now()
+	}
+}
+
+// stopSharedTopics discards the delayed messages of the shared topics.
+func stopSharedTopics(ts []*sharedTopic) {
+	for _, t := range ts {
+		t.mtx.Lock()
+		for _, last := range t.last {
+			if last.timer != nil {
+				last.timer.Stop()
+				last.timer = nil
+			}
+			last.delayed = nil
+		}
+		t.mtx.Unlock()
+	}
+}
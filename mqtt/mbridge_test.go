@@ -0,0 +1,202 @@
+package mqtt
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/go-mqtt/message"
+)
+
+// sentMessages records the messages passed to the send function of a shared
+// topic.
+type sentMessages struct {
+	mtx  sync.Mutex
+	msgs []string
+	// result of the send function
+	fail bool
+}
+
+func (s *sentMessages) send(msg *message.PublishMessage) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.fail {
+		return false
+	}
+	s.msgs = append(s.msgs, string(msg.Topic())+"="+string(msg.Payload()))
+	return true
+}
+
+func (s *sentMessages) get() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.msgs
+}
+
+func newTestSharedTopic(t *testing.T, cfg rtcfg.MQTTSharedTopic) *sharedTopic {
+	st := &sharedTopic{MQTTSharedTopic: cfg, last: make(map[string]*forwardedMessage)}
+	if cfg.Template != "" {
+		tmpl, err := template.New("bridge").Funcs(template.FuncMap{"upper": strings.ToUpper}).Parse(cfg.Template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.template = tmpl
+	}
+	return st
+}
+
+func TestSharedTopicTransform(t *testing.T) {
+	qos2 := byte(2)
+	retain := true
+	testCases := []struct {
+		cfg     rtcfg.MQTTSharedTopic
+		payload string
+		qos     byte
+		retain  bool
+		out     string
+		outQoS  byte
+		outRet  bool
+		dropped bool
+		err     string
+	}{
+		{rtcfg.MQTTSharedTopic{}, "on", 1, false, "on", 1, false, false, ""},
+		{rtcfg.MQTTSharedTopic{Template: "{{upper .}}"}, "on", 0, true, "ON", 0, true, false, ""},
+		{rtcfg.MQTTSharedTopic{Template: `{{if eq . "on"}}1{{else}}0{{end}}`}, "off", 0, false, "0", 0, false, false, ""},
+		// empty result drops the message
+		{rtcfg.MQTTSharedTopic{Template: `{{if ne . "skip"}}{{.}}{{end}}`}, "skip", 0, false, "", 0, false, true, ""},
+		{rtcfg.MQTTSharedTopic{Template: "{{index . 10}}"}, "on", 0, false, "", 0, false, false,
+			"Transformation of payload for topic out failed"},
+		{rtcfg.MQTTSharedTopic{PublishQoS: &qos2, Retain: &retain}, "on", 0, false, "on", 2, true, false, ""},
+	}
+	for idx, tc := range testCases {
+		st := newTestSharedTopic(t, tc.cfg)
+		msg := message.NewPublishMessage()
+		msg.SetTopic([]byte("in"))
+		msg.SetPayload([]byte(tc.payload))
+		msg.SetQoS(tc.qos)
+		msg.SetRetain(tc.retain)
+		var out *message.PublishMessage
+		dropped, err := st.forward("out", msg, func(m *message.PublishMessage) bool {
+			out = m
+			return true
+		})
+		if tc.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tc.err) {
+				t.Errorf("test case %d: expected error %s, got %v", idx+1, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test case %d: unexpected error: %v", idx+1, err)
+			continue
+		}
+		if dropped != tc.dropped {
+			t.Errorf("test case %d: expected dropped %t, got %t", idx+1, tc.dropped, dropped)
+		}
+		if tc.dropped {
+			if out != nil {
+				t.Errorf("test case %d: unexpected message", idx+1)
+			}
+			continue
+		}
+		if out == nil || string(out.Topic()) != "out" || string(out.Payload()) != tc.out ||
+			out.QoS() != tc.outQoS || out.Retain() != tc.outRet {
+			t.Errorf("test case %d: unexpected message %v", idx+1, out)
+		}
+	}
+}
+
+func TestSharedTopicDropUnchanged(t *testing.T) {
+	st := newTestSharedTopic(t, rtcfg.MQTTSharedTopic{DropUnchanged: true})
+	var sent sentMessages
+	forward := func(topic, payload string) bool {
+		msg := message.NewPublishMessage()
+		msg.SetPayload([]byte(payload))
+		dropped, err := st.forward(topic, msg, sent.send)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dropped
+	}
+	testCases := []struct {
+		topic, payload string
+		fail           bool
+		dropped        bool
+	}{
+		{"a", "1", false, false},
+		{"a", "1", false, true},
+		{"b", "1", false, false},
+		{"a", "2", false, false},
+		{"a", "1", false, false},
+		// a failed send is not recorded
+		{"a", "3", true, false},
+		{"a", "3", false, false},
+		{"a", "3", false, true},
+	}
+	for idx, tc := range testCases {
+		sent.fail = tc.fail
+		if dropped := forward(tc.topic, tc.payload); dropped != tc.dropped {
+			t.Errorf("test case %d: expected dropped %t, got %t", idx+1, tc.dropped, dropped)
+		}
+	}
+	expected := []string{"a=1", "b=1", "a=2", "a=1", "a=3"}
+	if msgs := sent.get(); !reflect.DeepEqual(msgs, expected) {
+		t.Errorf("expected %v, got %v", expected, msgs)
+	}
+}
+
+func TestSharedTopicMinInterval(t *testing.T) {
+	const interval = 100 * time.Millisecond
+	st := newTestSharedTopic(t, rtcfg.MQTTSharedTopic{MinInterval: int(interval / time.Millisecond), DropUnchanged: true})
+	var sent sentMessages
+	forward := func(payload string) bool {
+		msg := message.NewPublishMessage()
+		msg.SetPayload([]byte(payload))
+		dropped, err := st.forward("a", msg, sent.send)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dropped
+	}
+	check := func(expected ...string) {
+		if msgs := sent.get(); !reflect.DeepEqual(msgs, expected) {
+			t.Fatalf("expected %v, got %v", expected, msgs)
+		}
+	}
+
+	// first message is sent immediately
+	if forward("1") {
+		t.Error("message 1 dropped")
+	}
+	check("a=1")
+	// following messages are delayed, only the latest is kept
+	if forward("2") {
+		t.Error("message 2 dropped")
+	}
+	if !forward("3") {
+		t.Error("message 2 not replaced")
+	}
+	check("a=1")
+	time.Sleep(2 * interval)
+	check("a=1", "a=3")
+
+	// a delayed message is obsolete, if the payload returns to the last sent one
+	forward("4")
+	forward("5")
+	if !forward("4") {
+		t.Error("message 4 not dropped")
+	}
+	time.Sleep(2 * interval)
+	check("a=1", "a=3", "a=4")
+
+	// stopping discards the delayed messages
+	forward("6")
+	forward("7")
+	stopSharedTopics([]*sharedTopic{st})
+	time.Sleep(2 * interval)
+	check("a=1", "a=3", "a=4", "a=6")
+}
@@ -7,11 +7,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mdzio/go-logging"
+	"github.com/mdzio/go-mqtt/auth"
 	"github.com/mdzio/go-mqtt/message"
 	"github.com/mdzio/go-mqtt/service"
 	"github.com/mdzio/go-veap"
@@ -19,6 +22,21 @@ import (
 
 var log = logging.Get("mqtt-server")
 
+// PVRecorder records value changes of data points (e.g. history.Store).
+type PVRecorder interface {
+	Record(pvPath string, pv veap.PV)
+}
+
+// PVRecorders forwards value changes to multiple recorders.
+type PVRecorders []PVRecorder
+
+// Record implements PVRecorder.
+func (rs PVRecorders) Record(pvPath string, pv veap.PV) {
+	for _, r := range rs {
+		r.Record(pvPath, pv)
+	}
+}
+
 // Server for MQTT.
 type Server struct {
 	// Binding address for serving MQTT.
@@ -31,30 +49,94 @@ type Server struct {
 	KeyFile string
 	// Authenticator specifies the authenticator. Default is "mockSuccess".
 	Authenticator string
+	// Authorizer enforces the publish and receive permissions of the clients.
+	// If set, the clients are served by an ACL proxy in front of the broker,
+	// which listens on a local port. The broker only accepts connections of
+	// the proxy. If not set, every authenticated client has full access.
+	Authorizer Authorizer
+	// Profile specifies the topic layout and the payload encoding. If not set,
+	// the standard profile is used.
+	Profile *Profile
 	// Size of the in and out buffers. This affects the maximum payload size. If
 	// not set, the defaultBufferSize (1024*256) is used.
 	BufferSize int64
 	// When an error happens while serving (e.g. binding of port fails), this
 	// error is sent to the channel ServeErr.
 	ServeErr chan<- error
+	// RetainedFile persists the retained messages across restarts. If not
+	// set, the retained messages are not persisted.
+	RetainedFile string
+	// Max. number of persisted retained messages. 0 or a negative value
+	// disables the limit.
+	RetainedMaxEntries int
+	// Cycle time for writing the retained messages. If not set,
+	// retainedFlushCycle is used.
+	RetainedFlushCycle time.Duration
 
 	server     *service.Server
+	proxy      *aclProxy
+	proxyAuth  string
 	doneServer sync.WaitGroup
+
+	// persistence of the retained messages
+	retained     *retainedStore
+	onRetained   service.OnPublishFunc
+	retainedStop chan struct{}
+	retainedDone chan struct{}
+	// number of messages published by Publish (atomic access)
+	published uint64
 }
 
 // Start starts the MQTT server.
 func (b *Server) Start() {
+	// the broker behind the ACL proxy accepts only connections of the proxy
+	authenticator := b.Authenticator
+	var secret string
+	if b.Authorizer != nil {
+		var err error
+		b.proxyAuth, secret, err = registerProxyAuthenticator(b.Authenticator)
+		if err != nil {
+			if b.ServeErr != nil {
+				b.ServeErr <- fmt.Errorf("Running MQTT server failed: %v", err)
+			}
+			return
+		}
+		authenticator = b.proxyAuth
+	}
 	b.server = &service.Server{
-		Authenticator: b.Authenticator,
+		Authenticator: authenticator,
 		BufferSize:    b.BufferSize,
 	}
 
+	// restore retained messages
+	if b.RetainedFile != "" {
+		if err := b.startRetainedStore(); err != nil {
+			log.Errorf("Persistence of retained messages failed: %v", err)
+		}
+	}
+
+	// without authorizer the clients are served directly by the broker
+	listenAndServe := b.server.ListenAndServe
+	listenAndServeTLS := b.server.ListenAndServeTLS
+	if b.Authorizer != nil {
+		brokerAddr, err := b.startBroker()
+		if err != nil {
+			if b.ServeErr != nil {
+				b.ServeErr <- fmt.Errorf("Running MQTT server failed: %v", err)
+			}
+			return
+		}
+		b.proxy = newACLProxy(b.Authorizer, brokerAddr, secret, b.BufferSize)
+		listenAndServe = b.proxy.ListenAndServe
+		listenAndServeTLS = b.proxy.ListenAndServeTLS
+	}
+
 	// start MQTT listener
 	if b.Addr != "" {
 		b.doneServer.Add(1)
 		go func() {
 			log.Infof("Starting MQTT listener on address %s", b.Addr)
-			err := b.server.ListenAndServe(b.Addr)
+			err := listenAndServe(b.Addr)
 			// signal server is down
 			b.doneServer.Done()
 			// check for error
@@ -84,7 +166,7 @@ func (b *Server) Start() {
 			}
 			config := &tls.Config{Certificates: []tls.Certificate{cer}}
 			// start server
-			err = b.server.ListenAndServeTLS(b.AddrTLS, config)
+			err = listenAndServeTLS(b.AddrTLS, config)
 			// signal server is down
 			b.doneServer.Done()
 			// check for error
@@ -99,19 +181,59 @@ func (b *Server) Start() {
 
 }
 
+// startBroker starts the broker on a free local port for the ACL proxy. Local
+// processes can reach the port, but the broker authenticates only
+// connections with the secret of the proxy (q.v. proxyAuthenticator).
+func (b *Server) startBroker() (string, error) {
+	// find a free port
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	b.doneServer.Add(1)
+	go func() {
+		log.Debugf("Starting internal MQTT broker on address %s", addr)
+		err := b.server.ListenAndServe("tcp://" + addr)
+		// signal server is down
+		b.doneServer.Done()
+		// check for error
+		if err != nil {
+			// signal error while serving
+			if b.ServeErr != nil {
+				b.ServeErr <- fmt.Errorf("Running internal MQTT broker failed: %v", err)
+			}
+		}
+	}()
+	return addr, nil
+}
+
 // Stop stops the MQTT server.
 func (b *Server) Stop() {
 	// stop server
 	log.Debugf("Stopping MQTT server")
+	if b.proxy != nil {
+		b.proxy.Close()
+	}
 	_ = b.server.Close()
 
 	// wait for stop
 	b.doneServer.Wait()
+	if b.proxyAuth != "" {
+		auth.Unregister(b.proxyAuth)
+		b.proxyAuth = ""
+	}
+
+	// write retained messages
+	b.stopRetainedStore()
 }
 
-// PublishPV publishes a PV.
+// PublishPV publishes a PV. The payload is encoded as specified by the
+// profile.
 func (b *Server) PublishPV(topic string, pv veap.PV, qos byte, retain bool) error {
-	pl, err := pvToWire(pv)
+	pl, err := b.profile().encodeStatus(pv)
 	if err != nil {
 		return err
 	}
@@ -136,9 +258,22 @@ func (b *Server) Publish(topic string, payload []byte, qos byte, retain bool) er
 	if err := b.server.Publish(pm); err != nil {
 		return fmt.Errorf("Publish failed: %v", err)
 	}
+	atomic.AddUint64(&b.published, 1)
 	return nil
 }
 
+// PublishCount returns the number of messages published by Publish.
+func (b *Server) PublishCount() uint64 {
+	return atomic.LoadUint64(&b.published)
+}
+
+func (b *Server) profile() *Profile {
+	if b.Profile == nil {
+		return standardProfile
+	}
+	return b.Profile
+}
+
 // Subscribe subscribes a topic.
 func (b *Server) Subscribe(topic string, qos byte, onPublish *service.OnPublishFunc) error {
 	return b.server.Subscribe(topic, qos, onPublish)
@@ -0,0 +1,506 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/model"
+)
+
+// placeholders in topic templates
+const (
+	phDevice  = "{device}"
+	phChannel = "{channel}"
+	phName    = "{name}"
+	phParam   = "{param}"
+	phID      = "{id}"
+)
+
+// minimum time between two scans for channel names
+const nameScanInterval = 1 * time.Minute
+
+// fixed topic templates for scenes (below the prefix of the profile)
+const (
+	sceneStatusTopic = "scene/status/{id}"
+	sceneSetTopic    = "scene/set/{id}"
+)
+
+// Profile maps MQTT topics to VEAP paths and PVs to MQTT payloads (q.v.
+// rtcfg.MQTTProfile).
+type Profile struct {
+	device  topicSet
+	virtDev topicSet
+	sysVar  topicSet
+	prg     topicSet
+	scene   topicSet
+
+	statusPayload rtcfg.PayloadEncoding
+	setPayload    rtcfg.PayloadEncoding
+
+	// only set, if {name} is used
+	names *nameResolver
+}
+
+// NewProfile creates a profile from the configuration. The service is used to
+// resolve channel names, if the placeholder {name} is used.
+func NewProfile(cfg *rtcfg.MQTTProfile, service veap.Service) (*Profile, error) {
+	p := &Profile{
+		statusPayload: cfg.StatusPayload,
+		setPayload:    cfg.SetPayload,
+	}
+	var err error
+	parse := func(name, tmpl string, id bool) topicTemplate {
+		if err != nil {
+			return nil
+		}
+		var t topicTemplate
+		t, err = parseTopicTemplate(cfg.Prefix+tmpl, id)
+		if err != nil {
+			err = fmt.Errorf("Invalid topic template %s: %v", name, err)
+		}
+		return t
+	}
+	p.device = topicSet{
+		veapPath: deviceVeapPath,
+		status:   parse("DeviceStatusTopic", cfg.DeviceStatusTopic, false),
+		set:      parse("DeviceSetTopic", cfg.DeviceSetTopic, false),
+	}
+	p.virtDev = topicSet{
+		veapPath: virtDevVeapPath,
+		status:   parse("VirtDevStatusTopic", cfg.VirtDevStatusTopic, false),
+		set:      parse("VirtDevSetTopic", cfg.VirtDevSetTopic, false),
+	}
+	p.sysVar = topicSet{
+		veapPath: sysVarVeapPath,
+		status:   parse("SysVarStatusTopic", cfg.SysVarStatusTopic, true),
+		set:      parse("SysVarSetTopic", cfg.SysVarSetTopic, true),
+		get:      parse("SysVarGetTopic", cfg.SysVarGetTopic, true),
+	}
+	p.prg = topicSet{
+		veapPath: prgVeapPath,
+		status:   parse("ProgramStatusTopic", cfg.ProgramStatusTopic, true),
+		set:      parse("ProgramSetTopic", cfg.ProgramSetTopic, true),
+		get:      parse("ProgramGetTopic", cfg.ProgramGetTopic, true),
+	}
+	p.scene = topicSet{
+		veapPath: rtcfg.SceneVeapPath,
+		status:   parse("scene status topic", sceneStatusTopic, true),
+		set:      parse("scene set topic", sceneSetTopic, true),
+	}
+	if err != nil {
+		return nil, err
+	}
+	// channel names needed?
+	for _, t := range []topicTemplate{p.device.status, p.device.set, p.virtDev.status, p.virtDev.set} {
+		if t.has(phName) {
+			if service == nil {
+				return nil, errors.New("Resolving of channel names is not available")
+			}
+			p.names = &nameResolver{service: service}
+			break
+		}
+	}
+	return p, nil
+}
+
+// standardProfile is used, if no profile is configured.
+var standardProfile = func() *Profile {
+	p, err := NewProfile(rtcfg.StandardMQTTProfile(rtcfg.PayloadJSON), nil)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}()
+
+// StandardProfile returns the standard profile of the CCU-Jack.
+func StandardProfile() *Profile {
+	return standardProfile
+}
+
+// Topics returns the status, set and get topics for a VEAP path. Topics, which
+// are not available, are empty.
+func (p *Profile) Topics(pvPath string) (status, set, get string) {
+	for _, ts := range []*topicSet{&p.device, &p.virtDev, &p.sysVar, &p.prg, &p.scene} {
+		if !strings.HasPrefix(pvPath, ts.veapPath+"/") {
+			continue
+		}
+		status, _ = ts.topic(ts.status, pvPath, p.names)
+		set, _ = ts.topic(ts.set, pvPath, p.names)
+		if ts.get != nil {
+			get, _ = ts.topic(ts.get, pvPath, p.names)
+		}
+		return
+	}
+	return
+}
+
+// statusTopic returns the status topic for a VEAP path.
+func (p *Profile) statusTopic(ts *topicSet, pvPath string) (string, error) {
+	return ts.topic(ts.status, pvPath, p.names)
+}
+
+// topicToPVPath maps a topic of the profile to a VEAP path.
+func (p *Profile) topicToPVPath(topic string) (string, bool) {
+	for _, ts := range []*topicSet{&p.device, &p.virtDev, &p.sysVar, &p.prg, &p.scene} {
+		for _, t := range []topicTemplate{ts.status, ts.set, ts.get} {
+			if pvPath, ok := ts.pvPath(t, topic, p.names); ok {
+				return pvPath, true
+			}
+		}
+	}
+	return "", false
+}
+
+// isGetTopic checks whether the topic is a get topic of a system variable or
+// program.
+func (p *Profile) isGetTopic(topic string) bool {
+	_, ok := p.sysVar.get.match(topic)
+	if !ok {
+		_, ok = p.prg.get.match(topic)
+	}
+	return ok
+}
+
+// encodeStatus converts a PV to a payload.
+func (p *Profile) encodeStatus(pv veap.PV) ([]byte, error) {
+	if p.statusPayload == rtcfg.PayloadPlain {
+		return valueToPlain(pv.Value)
+	}
+	return pvToWire(pv)
+}
+
+// valueExpr returns a Jinja2 expression for Home Assistant, which extracts the
+// value from a status payload.
+func (p *Profile) valueExpr() string {
+	if p.statusPayload == rtcfg.PayloadPlain {
+		return "value"
+	}
+	return "value_json.v"
+}
+
+// decodeSet converts a payload to a PV.
+func (p *Profile) decodeSet(payload []byte) (veap.PV, error) {
+	if p.setPayload == rtcfg.PayloadPlain {
+		return plainToPV(payload), nil
+	}
+	return wireToPV(payload)
+}
+
+// topicSet contains the topic templates of a VEAP sub tree.
+type topicSet struct {
+	veapPath string
+	status   topicTemplate
+	set      topicTemplate
+	// only for system variables and programs
+	get topicTemplate
+}
+
+// topic builds a topic for a VEAP path.
+func (ts *topicSet) topic(t topicTemplate, pvPath string, names *nameResolver) (string, error) {
+	rel := strings.TrimPrefix(pvPath, ts.veapPath+"/")
+	if rel == pvPath {
+		return "", fmt.Errorf("Unexpected VEAP path: %s", pvPath)
+	}
+	segs := strings.Split(rel, "/")
+	vars := make(map[string]string)
+	if t.has(phID) {
+		if len(segs) != 1 {
+			return "", fmt.Errorf("Unexpected VEAP path: %s", pvPath)
+		}
+		vars[phID] = segs[0]
+	} else {
+		if len(segs) != 3 {
+			return "", fmt.Errorf("Unexpected VEAP path: %s", pvPath)
+		}
+		vars[phDevice] = segs[0]
+		vars[phChannel] = segs[1]
+		vars[phParam] = segs[2]
+		if t.has(phName) {
+			name := names.name(ts.veapPath + "/" + segs[0] + "/" + segs[1])
+			if !names.unique(ts.veapPath, name) {
+				return "", fmt.Errorf("Channel name %s is not unique: %s", name, pvPath)
+			}
+			vars[phName] = name
+		}
+	}
+	return t.format(vars), nil
+}
+
+// pvPath maps a topic to a VEAP path.
+func (ts *topicSet) pvPath(t topicTemplate, topic string, names *nameResolver) (string, bool) {
+	vars, ok := t.match(topic)
+	if !ok {
+		return "", false
+	}
+	if t.has(phID) {
+		return ts.veapPath + "/" + vars[phID], true
+	}
+	if t.has(phName) {
+		chPath, ok := names.path(ts.veapPath, vars[phName])
+		if !ok {
+			return "", false
+		}
+		return chPath + "/" + vars[phParam], true
+	}
+	return ts.veapPath + "/" + vars[phDevice] + "/" + vars[phChannel] + "/" + vars[phParam], true
+}
+
+// topicTemplate contains the levels of a topic template.
+type topicTemplate []string
+
+// parseTopicTemplate parses and checks a topic template. If id is true, the
+// template must contain {id}. Otherwise the template must contain {device},
+// {channel} and {param} or {name} and {param}.
+func parseTopicTemplate(tmpl string, id bool) (topicTemplate, error) {
+	if tmpl == "" {
+		return nil, errors.New("Empty template")
+	}
+	t := topicTemplate(strings.Split(tmpl, "/"))
+	found := make(map[string]bool)
+	for _, l := range t {
+		if strings.ContainsAny(l, "+#") {
+			return nil, fmt.Errorf("Wildcards are not allowed: %s", tmpl)
+		}
+		if strings.ContainsAny(l, "{}") {
+			switch l {
+			case phDevice, phChannel, phName, phParam, phID:
+			default:
+				return nil, fmt.Errorf("Invalid placeholder (must fill a whole level): %s", l)
+			}
+			if found[l] {
+				return nil, fmt.Errorf("Duplicate placeholder: %s", l)
+			}
+			found[l] = true
+		}
+	}
+	if id {
+		if len(found) != 1 || !found[phID] {
+			return nil, fmt.Errorf("Only placeholder %s is allowed and required: %s", phID, tmpl)
+		}
+	} else {
+		byAddr := len(found) == 3 && found[phDevice] && found[phChannel] && found[phParam]
+		byName := len(found) == 2 && found[phName] && found[phParam]
+		if !byAddr && !byName {
+			return nil, fmt.Errorf("Placeholders %s, %s and %s or %s and %s are required: %s",
+				phDevice, phChannel, phParam, phName, phParam, tmpl)
+		}
+	}
+	return t, nil
+}
+
+func (t topicTemplate) has(ph string) bool {
+	for _, l := range t {
+		if l == ph {
+			return true
+		}
+	}
+	return false
+}
+
+// format replaces the placeholders.
+func (t topicTemplate) format(vars map[string]string) string {
+	ls := make([]string, len(t))
+	for i, l := range t {
+		if v, ok := vars[l]; ok {
+			ls[i] = v
+		} else {
+			ls[i] = l
+		}
+	}
+	return strings.Join(ls, "/")
+}
+
+// filter returns a topic filter, which matches all topics of the template.
+func (t topicTemplate) filter() string {
+	ls := make([]string, len(t))
+	for i, l := range t {
+		if strings.HasPrefix(l, "{") {
+			ls[i] = "+"
+		} else {
+			ls[i] = l
+		}
+	}
+	return strings.Join(ls, "/")
+}
+
+// match checks whether the topic matches the template and returns the values
+// of the placeholders.
+func (t topicTemplate) match(topic string) (map[string]string, bool) {
+	if t == nil {
+		return nil, false
+	}
+	ls := strings.Split(topic, "/")
+	if len(ls) != len(t) {
+		return nil, false
+	}
+	vars := make(map[string]string)
+	for i, l := range t {
+		if strings.HasPrefix(l, "{") {
+			if ls[i] == "" {
+				return nil, false
+			}
+			vars[l] = ls[i]
+		} else if l != ls[i] {
+			return nil, false
+		}
+	}
+	return vars, true
+}
+
+// nameResolver maps channel names to VEAP paths and vice versa.
+type nameResolver struct {
+	service veap.Service
+
+	mtx sync.Mutex
+	// root path -> name -> channel path, empty if the name is not unique
+	paths    map[string]map[string]string
+	lastScan map[string]time.Time
+}
+
+// name returns the topic compatible name of a channel.
+func (r *nameResolver) name(chPath string) string {
+	attrs, _, err := r.service.ReadProperties(chPath)
+	var title string
+	if err == nil {
+		title, _ = attrs[model.TitleProperty].(string)
+	}
+	return channelName(chPath, title)
+}
+
+// path returns the VEAP path of the channel with the specified name. A cached
+// path is checked against the current name of the channel, because channels
+// can be renamed.
+func (r *nameResolver) path(root, name string) (string, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	p, ok := r.paths[root][name]
+	if ok && p != "" {
+		if r.name(p) == name {
+			return p, true
+		}
+		// channel was renamed, cache is outdated
+		r.rescan(root)
+	} else if r.rescanDue(root) {
+		r.rescan(root)
+	} else {
+		return "", false
+	}
+	p = r.paths[root][name]
+	return p, p != ""
+}
+
+// unique checks whether a channel name is not used by other channels. If the
+// name is unknown, the channel names are rescanned, but not too often.
+func (r *nameResolver) unique(root, name string) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok := r.paths[root][name]; !ok && r.rescanDue(root) {
+		r.rescan(root)
+	}
+	p, ok := r.paths[root][name]
+	return !ok || p != ""
+}
+
+// rescanDue checks whether the min. time between two scans has elapsed.
+// r.mtx must be locked.
+func (r *nameResolver) rescanDue(root string) bool {
+	return time.Since(r.lastScan[root]) >= nameScanInterval
+}
+
+// rescan updates the channel names of a root path. r.mtx must be locked.
+func (r *nameResolver) rescan(root string) {
+	if r.paths == nil {
+		r.paths = make(map[string]map[string]string)
+		r.lastScan = make(map[string]time.Time)
+	}
+	r.lastScan[root] = time.Now()
+	r.paths[root] = r.scan(root)
+}
+
+func (r *nameResolver) scan(root string) map[string]string {
+	log.Debugf("Scanning channel names of %s", root)
+	paths := make(map[string]string)
+	_, devLinks, verr := r.service.ReadProperties(root)
+	if verr != nil {
+		log.Warningf("Scanning of channel names failed: %v", verr)
+		return paths
+	}
+	for _, dl := range devLinks {
+		if dl.Role != "device" {
+			continue
+		}
+		devPath := root + "/" + dl.Target
+		_, chLinks, verr := r.service.ReadProperties(devPath)
+		if verr != nil {
+			log.Warningf("Scanning of channel names failed: %v", verr)
+			continue
+		}
+		for _, cl := range chLinks {
+			if cl.Role != "channel" {
+				continue
+			}
+			chPath := devPath + "/" + cl.Target
+			name := channelName(chPath, cl.Title)
+			if prev, ok := paths[name]; ok {
+				if prev != "" {
+					log.Warningf("Channel name %s is not unique: %s, %s", name, prev, chPath)
+				}
+				// ambiguous names are not resolved
+				paths[name] = ""
+				continue
+			}
+			paths[name] = chPath
+		}
+	}
+	return paths
+}
+
+// channelName returns the topic compatible name of a channel. If the title is
+// empty, the address of the channel is used.
+func channelName(chPath, title string) string {
+	name := topicName(title)
+	if name == "" {
+		segs := strings.Split(chPath, "/")
+		name = segs[len(segs)-2] + ":" + segs[len(segs)-1]
+	}
+	return name
+}
+
+// topicName replaces characters, which are not allowed in a topic level.
+func topicName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '+', '#':
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(name))
+}
+
+// valueToPlain encodes only the value. Strings are not quoted.
+func valueToPlain(v interface{}) ([]byte, error) {
+	if s, ok := v.(string); ok {
+		return []byte(s), nil
+	}
+	pl, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("Conversion of value to JSON failed: %v", err)
+	}
+	return pl, nil
+}
+
+// plainToPV takes the whole payload as value. If the payload is no valid JSON,
+// it is taken as string.
+func plainToPV(payload []byte) veap.PV {
+	var v interface{}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		v = string(payload)
+	}
+	return veap.PV{Time: time.Now(), Value: v, State: veap.StateGood}
+}
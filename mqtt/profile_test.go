@@ -0,0 +1,320 @@
+package mqtt
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/model"
+)
+
+func TestParseTopicTemplate(t *testing.T) {
+	testCases := []struct {
+		tmpl string
+		id   bool
+		err  string
+	}{
+		{"device/status/{device}/{channel}/{param}", false, ""},
+		{"{param}/{channel}/{device}", false, ""},
+		{"home/{name}/{param}", false, ""},
+		{"sysvar/{id}", true, ""},
+		{"", false, "Empty template"},
+		{"a/+/{device}/{channel}/{param}", false, "Wildcards are not allowed: a/+/{device}/{channel}/{param}"},
+		{"a/#", true, "Wildcards are not allowed: a/#"},
+		{"a/x{id}", true, "Invalid placeholder (must fill a whole level): x{id}"},
+		{"a/{foo}", true, "Invalid placeholder (must fill a whole level): {foo}"},
+		{"{id}/{id}", true, "Duplicate placeholder: {id}"},
+		{"sysvar/get", true, "Only placeholder {id} is allowed and required: sysvar/get"},
+		{"sysvar/{id}/{param}", true, "Only placeholder {id} is allowed and required: sysvar/{id}/{param}"},
+		{"device/{device}/{param}", false,
+			"Placeholders {device}, {channel} and {param} or {name} and {param} are required: device/{device}/{param}"},
+		{"device/{name}/{device}/{param}", false,
+			"Placeholders {device}, {channel} and {param} or {name} and {param} are required: device/{name}/{device}/{param}"},
+		{"device/{id}", false,
+			"Placeholders {device}, {channel} and {param} or {name} and {param} are required: device/{id}"},
+	}
+	for _, tc := range testCases {
+		_, err := parseTopicTemplate(tc.tmpl, tc.id)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("template %s: unexpected error: %v", tc.tmpl, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("template %s: expected error %s, got %v", tc.tmpl, tc.err, err)
+		}
+	}
+}
+
+func TestTopicTemplate(t *testing.T) {
+	testCases := []struct {
+		tmpl   string
+		filter string
+		topic  string
+		vars   map[string]string
+	}{
+		{"a/{device}/{channel}/{param}", "a/+/+/+", "a/ABC/1/STATE",
+			map[string]string{phDevice: "ABC", phChannel: "1", phParam: "STATE"}},
+		{"a/{device}/{channel}/{param}", "a/+/+/+", "b/ABC/1/STATE", nil},
+		{"a/{device}/{channel}/{param}", "a/+/+/+", "a/ABC/1", nil},
+		{"a/{device}/{channel}/{param}", "a/+/+/+", "a/ABC//STATE", nil},
+		{"{param}/x/{name}", "+/x/+", "STATE/x/Kitchen",
+			map[string]string{phName: "Kitchen", phParam: "STATE"}},
+		{"{param}/x/{name}", "+/x/+", "STATE/y/Kitchen", nil},
+	}
+	for _, tc := range testCases {
+		tmpl, err := parseTopicTemplate(tc.tmpl, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f := tmpl.filter(); f != tc.filter {
+			t.Errorf("template %s: expected filter %s, got %s", tc.tmpl, tc.filter, f)
+		}
+		vars, ok := tmpl.match(tc.topic)
+		if ok != (tc.vars != nil) || !reflect.DeepEqual(vars, tc.vars) {
+			t.Errorf("template %s, topic %s: unexpected match %v, %t", tc.tmpl, tc.topic, vars, ok)
+			continue
+		}
+		if ok {
+			if topic := tmpl.format(vars); topic != tc.topic {
+				t.Errorf("template %s: expected topic %s, got %s", tc.tmpl, tc.topic, topic)
+			}
+		}
+	}
+}
+
+func TestNewProfile(t *testing.T) {
+	cfg := rtcfg.StandardMQTTProfile(rtcfg.PayloadJSON)
+	cfg.DeviceStatusTopic = "device/{name}/{param}"
+	if _, err := NewProfile(cfg, nil); err == nil || err.Error() != "Resolving of channel names is not available" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	cfg = rtcfg.StandardMQTTProfile(rtcfg.PayloadJSON)
+	cfg.SysVarGetTopic = "sysvar/get"
+	if _, err := NewProfile(cfg, nil); err == nil ||
+		err.Error() != "Invalid topic template SysVarGetTopic: Only placeholder {id} is allowed and required: sysvar/get" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestProfileTopics(t *testing.T) {
+	cfg := &rtcfg.MQTTProfile{
+		Prefix:             "ccu/",
+		DeviceStatusTopic:  "dev/{device}/{channel}/{param}",
+		DeviceSetTopic:     "dev/{device}/{channel}/{param}/set",
+		VirtDevStatusTopic: "virt/{device}/{channel}/{param}",
+		VirtDevSetTopic:    "virt/{device}/{channel}/{param}/set",
+		SysVarStatusTopic:  "sysvar/{id}",
+		SysVarSetTopic:     "sysvar/{id}/set",
+		SysVarGetTopic:     "sysvar/{id}/get",
+		ProgramStatusTopic: "program/{id}",
+		ProgramSetTopic:    "program/{id}/set",
+		ProgramGetTopic:    "program/{id}/get",
+	}
+	p, err := NewProfile(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		pvPath           string
+		status, set, get string
+	}{
+		{"/device/ABC/1/STATE", "ccu/dev/ABC/1/STATE", "ccu/dev/ABC/1/STATE/set", ""},
+		{"/virtdev/JACK000001/1/LEVEL", "ccu/virt/JACK000001/1/LEVEL", "ccu/virt/JACK000001/1/LEVEL/set", ""},
+		{"/sysvar/1234", "ccu/sysvar/1234", "ccu/sysvar/1234/set", "ccu/sysvar/1234/get"},
+		{"/program/1234", "ccu/program/1234", "ccu/program/1234/set", "ccu/program/1234/get"},
+		{"/~vendor/scenes/night", "ccu/scene/status/night", "ccu/scene/set/night", ""},
+		{"/device/ABC/1", "", "", ""},
+		{"/sysvar/1234/x", "", "", ""},
+		{"/other/1234", "", "", ""},
+	}
+	for _, tc := range testCases {
+		status, set, get := p.Topics(tc.pvPath)
+		if status != tc.status || set != tc.set || get != tc.get {
+			t.Errorf("path %s: unexpected topics %s, %s, %s", tc.pvPath, status, set, get)
+		}
+		// reverse mapping
+		for _, topic := range []string{status, set, get} {
+			if topic == "" {
+				continue
+			}
+			if pvPath, ok := p.topicToPVPath(topic); !ok || pvPath != tc.pvPath {
+				t.Errorf("topic %s: unexpected path %s, %t", topic, pvPath, ok)
+			}
+		}
+		if get != "" && !p.isGetTopic(get) {
+			t.Errorf("topic %s: get topic expected", get)
+		}
+	}
+	for _, topic := range []string{"dev/ABC/1/STATE", "ccu/dev/ABC/1", "ccu/sysvar", "ccu/other/1234/x/y"} {
+		if pvPath, ok := p.topicToPVPath(topic); ok {
+			t.Errorf("topic %s: unexpected path %s", topic, pvPath)
+		}
+	}
+}
+
+func TestProfilePayload(t *testing.T) {
+	ts := time.Unix(1600000000, 123000000)
+	testCases := []struct {
+		enc    rtcfg.PayloadEncoding
+		pv     veap.PV
+		status string
+	}{
+		{rtcfg.PayloadJSON, veap.PV{Time: ts, Value: 1.5, State: veap.StateGood}, `{"ts":1600000000123,"v":1.5,"s":0}`},
+		{rtcfg.PayloadJSON, veap.PV{Time: ts, Value: "on", State: veap.StateBad}, `{"ts":1600000000123,"v":"on","s":200}`},
+		{rtcfg.PayloadPlain, veap.PV{Time: ts, Value: 1.5}, `1.5`},
+		{rtcfg.PayloadPlain, veap.PV{Time: ts, Value: true}, `true`},
+		{rtcfg.PayloadPlain, veap.PV{Time: ts, Value: "on"}, `on`},
+		{rtcfg.PayloadPlain, veap.PV{Time: ts, Value: "a \"b\""}, `a "b"`},
+	}
+	for _, tc := range testCases {
+		p, err := NewProfile(rtcfg.StandardMQTTProfile(tc.enc), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pl, err := p.encodeStatus(tc.pv)
+		if err != nil {
+			t.Errorf("PV %v: unexpected error: %v", tc.pv, err)
+			continue
+		}
+		if string(pl) != tc.status {
+			t.Errorf("PV %v: expected payload %s, got %s", tc.pv, tc.status, pl)
+		}
+	}
+}
+
+func TestProfileDecodeSet(t *testing.T) {
+	testCases := []struct {
+		enc     rtcfg.PayloadEncoding
+		payload string
+		value   interface{}
+		state   veap.State
+	}{
+		{rtcfg.PayloadJSON, `{"v":1.5,"s":200}`, 1.5, veap.StateBad},
+		{rtcfg.PayloadJSON, `{"v":"on"}`, "on", veap.StateGood},
+		{rtcfg.PayloadJSON, `42`, 42.0, veap.StateGood},
+		{rtcfg.PayloadJSON, `{"x":1}`, map[string]interface{}{"x": 1.0}, veap.StateGood},
+		{rtcfg.PayloadJSON, `on`, "on", veap.StateGood},
+		{rtcfg.PayloadPlain, `42`, 42.0, veap.StateGood},
+		{rtcfg.PayloadPlain, `true`, true, veap.StateGood},
+		{rtcfg.PayloadPlain, `"on"`, "on", veap.StateGood},
+		{rtcfg.PayloadPlain, `on`, "on", veap.StateGood},
+		{rtcfg.PayloadPlain, `{"v":1.5}`, map[string]interface{}{"v": 1.5}, veap.StateGood},
+	}
+	for _, tc := range testCases {
+		p, err := NewProfile(rtcfg.StandardMQTTProfile(tc.enc), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pv, err := p.decodeSet([]byte(tc.payload))
+		if err != nil {
+			t.Errorf("payload %s: unexpected error: %v", tc.payload, err)
+			continue
+		}
+		if !reflect.DeepEqual(pv.Value, tc.value) || pv.State != tc.state || pv.Time.IsZero() {
+			t.Errorf("payload %s: unexpected PV %v", tc.payload, pv)
+		}
+	}
+}
+
+func TestTopicName(t *testing.T) {
+	testCases := []struct {
+		name  string
+		topic string
+	}{
+		{"Kitchen", "Kitchen"},
+		{" Living room ", "Living room"},
+		{"a/b+c#d", "a_b_c_d"},
+		{"", ""},
+	}
+	for _, tc := range testCases {
+		if n := topicName(tc.name); n != tc.topic {
+			t.Errorf("name %q: expected %q, got %q", tc.name, tc.topic, n)
+		}
+	}
+}
+
+// channelService is a veap.Service with devices and titled channels.
+type channelService struct {
+	veap.Service
+	// device address -> channel titles
+	devices map[string][]string
+}
+
+func (s *channelService) ReadProperties(p string) (veap.AttrValues, []veap.Link, veap.Error) {
+	segs := strings.Split(strings.TrimPrefix(p, "/device"), "/")
+	var links []veap.Link
+	switch len(segs) {
+	case 1:
+		for addr := range s.devices {
+			links = append(links, veap.Link{Role: "device", Target: addr})
+		}
+	case 2:
+		for idx, title := range s.devices[segs[1]] {
+			links = append(links, veap.Link{Role: "channel", Target: strconv.Itoa(idx), Title: title})
+		}
+	case 3:
+		idx, _ := strconv.Atoi(segs[2])
+		return veap.AttrValues{model.TitleProperty: s.devices[segs[1]][idx]}, nil, nil
+	}
+	return veap.AttrValues{}, links, nil
+}
+
+func TestProfileChannelNames(t *testing.T) {
+	svc := &channelService{devices: map[string][]string{
+		"A": {"Kitchen", ""},
+		"B": {"Hall", "Hall"},
+	}}
+	cfg := rtcfg.StandardMQTTProfile(rtcfg.PayloadJSON)
+	cfg.DeviceStatusTopic = "home/{name}/{param}"
+	cfg.DeviceSetTopic = "home/{name}/{param}/set"
+	p, err := NewProfile(cfg, svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(step string, paths map[string]string) {
+		for pvPath, status := range paths {
+			if s, _, _ := p.Topics(pvPath); s != status {
+				t.Errorf("%s, path %s: expected topic %s, got %s", step, pvPath, status, s)
+			}
+			if status == "" {
+				continue
+			}
+			set := status + "/set"
+			if mapped, ok := p.topicToPVPath(set); !ok || mapped != pvPath {
+				t.Errorf("%s, topic %s: unexpected path %s, %t", step, set, mapped, ok)
+			}
+		}
+	}
+	check("initial", map[string]string{
+		"/device/A/0/STATE": "home/Kitchen/STATE",
+		// untitled channel
+		"/device/A/1/STATE": "home/A:1/STATE",
+		// ambiguous names are not published
+		"/device/B/0/STATE": "",
+		"/device/B/1/STATE": "",
+	})
+	if pvPath, ok := p.topicToPVPath("home/Hall/STATE/set"); ok {
+		t.Errorf("ambiguous name resolved: %s", pvPath)
+	}
+
+	// rename channels, the cache is outdated
+	svc.devices = map[string][]string{
+		"A": {"Bath", ""},
+		"B": {"Hall", "Kitchen"},
+	}
+	// old name points to the renamed channel in the cache
+	if pvPath, ok := p.topicToPVPath("home/Kitchen/STATE/set"); !ok || pvPath != "/device/B/1/STATE" {
+		t.Errorf("unexpected path after rename: %s, %t", pvPath, ok)
+	}
+	check("renamed", map[string]string{
+		"/device/A/0/STATE": "home/Bath/STATE",
+		"/device/B/0/STATE": "home/Hall/STATE",
+		"/device/B/1/STATE": "home/Kitchen/STATE",
+	})
+}
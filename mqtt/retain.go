@@ -0,0 +1,209 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mdzio/go-mqtt/message"
+)
+
+// default cycle time for writing the retained messages to disk
+const retainedFlushCycle = time.Minute
+
+// retainedMessage is a persisted retained message.
+type retainedMessage struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+}
+
+// retainedStore mirrors the retained messages of the embedded broker and
+// persists them in a file.
+type retainedStore struct {
+	fileName   string
+	maxEntries int
+
+	mtx sync.Mutex
+	// retained messages, the topic is key
+	msgs  map[string]retainedMessage
+	dirty bool
+	// limit exceeded warning is logged only once
+	limitLogged bool
+}
+
+// load reads the persisted retained messages. A missing file is not an error.
+func (s *retainedStore) load() ([]retainedMessage, error) {
+	b, err := os.ReadFile(s.fileName)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Reading of retained messages failed: %w", err)
+	}
+	var msgs []retainedMessage
+	if err := json.Unmarshal(b, &msgs); err != nil {
+		return nil, fmt.Errorf("Invalid file for retained messages %s: %w", s.fileName, err)
+	}
+	return msgs, nil
+}
+
+// seed adds the loaded messages to the mirror. Messages exceeding the limit
+// are returned separately and are not restored.
+func (s *retainedStore) seed(msgs []retainedMessage) (restored []retainedMessage) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, m := range msgs {
+		if len(m.Payload) == 0 || !s.put(m) {
+			continue
+		}
+		restored = append(restored, m)
+	}
+	return
+}
+
+// record updates the mirror with a published message.
+func (s *retainedStore) record(msg *message.PublishMessage) {
+	if !msg.Retain() {
+		return
+	}
+	topic := string(msg.Topic())
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	// an empty payload deletes the retained message
+	if len(msg.Payload()) == 0 {
+		if _, ok := s.msgs[topic]; ok {
+			delete(s.msgs, topic)
+			s.dirty = true
+		}
+		return
+	}
+	s.put(retainedMessage{
+		Topic: topic,
+		// the payload buffer may be reused
+		Payload: append([]byte(nil), msg.Payload()...),
+		QoS:     msg.QoS(),
+	})
+}
+
+// put stores a message, if the limit permits it. s.mtx must be locked.
+func (s *retainedStore) put(m retainedMessage) bool {
+	if _, ok := s.msgs[m.Topic]; !ok && s.maxEntries > 0 && len(s.msgs) >= s.maxEntries {
+		if !s.limitLogged {
+			log.Warningf("Max. number of persisted retained messages reached (%d), further topics are not persisted", s.maxEntries)
+			s.limitLogged = true
+		}
+		return false
+	}
+	s.msgs[m.Topic] = m
+	s.dirty = true
+	return true
+}
+
+// flush writes the retained messages to disk, if they were modified.
+func (s *retainedStore) flush() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	msgs := make([]retainedMessage, 0, len(s.msgs))
+	for _, m := range s.msgs {
+		msgs = append(msgs, m)
+	}
+	b, err := json.Marshal(msgs)
+	if err != nil {
+		return fmt.Errorf("Encoding of retained messages failed: %w", err)
+	}
+	if dir := filepath.Dir(s.fileName); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("Creating of directory for retained messages failed: %w", err)
+		}
+	}
+	// write to temporary file and replace old file
+	if err := os.WriteFile(s.fileName+".tmp", b, 0644); err != nil {
+		return fmt.Errorf("Writing of retained messages failed: %w", err)
+	}
+	if err := os.Rename(s.fileName+".tmp", s.fileName); err != nil {
+		return fmt.Errorf("Writing of retained messages failed: %w", err)
+	}
+	log.Tracef("Written retained messages: %d", len(msgs))
+	s.dirty = false
+	return nil
+}
+
+// startRetainedStore restores the persisted retained messages into the broker
+// and starts mirroring and cyclic writing.
+func (b *Server) startRetainedStore() error {
+	s := &retainedStore{
+		fileName:   b.RetainedFile,
+		maxEntries: b.RetainedMaxEntries,
+		msgs:       make(map[string]retainedMessage),
+	}
+	msgs, err := s.load()
+	if err != nil {
+		return err
+	}
+	// the mirror contains the restored messages, even if they are not
+	// delivered to the subscription below
+	msgs = s.seed(msgs)
+	for _, m := range msgs {
+		if err := b.Publish(m.Topic, m.Payload, m.QoS, true); err != nil {
+			log.Warningf("Restoring of retained message on topic %s failed: %v", m.Topic, err)
+		}
+	}
+	log.Debugf("Restored retained messages: %d", len(msgs))
+
+	// mirror retained messages, QoS 2 prevents a downgrade
+	b.onRetained = func(msg *message.PublishMessage) error {
+		s.record(msg)
+		return nil
+	}
+	if err := b.server.Subscribe("#", 2, &b.onRetained); err != nil {
+		return fmt.Errorf("Subscribing of retained messages failed: %w", err)
+	}
+	s.mtx.Lock()
+	s.dirty = false
+	s.mtx.Unlock()
+	b.retained = s
+
+	b.retainedStop = make(chan struct{})
+	b.retainedDone = make(chan struct{})
+	go func() {
+		defer close(b.retainedDone)
+		cycle := b.RetainedFlushCycle
+		if cycle <= 0 {
+			cycle = retainedFlushCycle
+		}
+		ticker := time.NewTicker(cycle)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-b.retainedStop:
+				return
+			case <-ticker.C:
+				if err := s.flush(); err != nil {
+					log.Error(err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// stopRetainedStore stops the cyclic writing and writes the retained
+// messages. The broker should be closed before.
+func (b *Server) stopRetainedStore() {
+	if b.retained == nil {
+		return
+	}
+	close(b.retainedStop)
+	<-b.retainedDone
+	if err := b.retained.flush(); err != nil {
+		log.Error(err)
+	}
+}
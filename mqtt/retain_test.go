@@ -0,0 +1,77 @@
+package mqtt
+
+import (
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/mdzio/go-mqtt/message"
+)
+
+func retainedTopics(t *testing.T, fn string) []string {
+	s := &retainedStore{fileName: fn}
+	msgs, err := s.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var topics []string
+	for _, m := range msgs {
+		topics = append(topics, m.Topic+"="+string(m.Payload))
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func retainedMsg(topic, payload string, retain bool) *message.PublishMessage {
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte(topic))
+	msg.SetPayload([]byte(payload))
+	msg.SetRetain(retain)
+	return msg
+}
+
+func TestRetainedStore(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "sub", "retained.json")
+
+	// first run
+	s := &retainedStore{fileName: fn, msgs: make(map[string]retainedMessage)}
+	s.record(retainedMsg("a", "1", true))
+	s.record(retainedMsg("b", "2", true))
+	s.record(retainedMsg("c", "3", false))
+	if err := s.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// restore, new publish, flush
+	s = &retainedStore{fileName: fn, maxEntries: 3, msgs: make(map[string]retainedMessage)}
+	msgs, err := s.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored := s.seed(msgs); len(restored) != 2 {
+		t.Fatalf("unexpected restored messages: %v", restored)
+	}
+	s.record(retainedMsg("d", "4", true))
+	s.record(retainedMsg("a", "", true))
+	if err := s.flush(); err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{"b=2", "d=4"}
+	if got := retainedTopics(t, fn); len(got) != len(exp) || got[0] != exp[0] || got[1] != exp[1] {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+
+	// limit on restore
+	s = &retainedStore{fileName: fn, maxEntries: 1, msgs: make(map[string]retainedMessage)}
+	msgs, err = s.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored := s.seed(msgs); len(restored) != 1 {
+		t.Fatalf("unexpected restored messages: %v", restored)
+	}
+	s.record(retainedMsg("e", "5", true))
+	if len(s.msgs) != 1 {
+		t.Fatalf("limit exceeded: %v", s.msgs)
+	}
+}
@@ -0,0 +1,205 @@
+package mqtt
+
+import (
+	"path"
+	"time"
+
+	"github.com/mdzio/go-hmccu/itf"
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/model"
+)
+
+const (
+	// delay of the first state sync after the start up of the device domain
+	stateSyncDelay = 60 * time.Second
+	// default number of parameters read at once
+	stateSyncBatchSize = 50
+	// default pause between two batches
+	stateSyncBatchDelay = time.Second
+)
+
+// StateSync publishes the values of all readable CCU device parameters on the
+// status topics, so that the retained topics are also filled for rarely
+// changing values (e.g. battery levels). The values are read in batches with
+// the VEAP meta service. The first sync starts after a delay and can be
+// repeated cyclic.
+type StateSync struct {
+	// Server is used for publishing the values.
+	Server *Server
+	// Service is used to explore the device parameters.
+	Service veap.Service
+	// MetaService reads the values of the device parameters in bulk (e.g.
+	// vmodel.MetaService).
+	MetaService veap.MetaService
+	// Cycle time for repeating the sync. If not set, the values are only
+	// published once after start up.
+	Cycle time.Duration
+	// Number of parameters read at once. If not set, stateSyncBatchSize is
+	// used.
+	BatchSize int
+	// Pause between two batches. If not set, stateSyncBatchDelay is used.
+	BatchDelay time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// stateSyncParam is a device parameter to sync.
+type stateSyncParam struct {
+	id   string
+	path string
+}
+
+// Start starts the state sync.
+func (s *StateSync) Start() {
+	log.Debug("Starting state sync")
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go func() {
+		// defer clean up
+		defer func() {
+			log.Debug("Stopping state sync")
+			s.done <- struct{}{}
+		}()
+
+		// first sync after the start up of the device domain
+		delay := time.NewTimer(stateSyncDelay)
+		defer delay.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-delay.C:
+			}
+			if !s.sync() {
+				// stopped
+				return
+			}
+			if s.Cycle <= 0 {
+				return
+			}
+			delay.Reset(s.Cycle)
+		}
+	}()
+}
+
+// Stop stops the state sync.
+func (s *StateSync) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+// sync reads and publishes the values of all device parameters. If the state
+// sync is stopped, false is returned.
+func (s *StateSync) sync() bool {
+	params := s.scan()
+	log.Debugf("State sync of %d device parameters", len(params))
+	batchSize := s.BatchSize
+	if batchSize <= 0 {
+		batchSize = stateSyncBatchSize
+	}
+	batchDelay := s.BatchDelay
+	if batchDelay <= 0 {
+		batchDelay = stateSyncBatchDelay
+	}
+	cnt := 0
+	for len(params) > 0 {
+		n := batchSize
+		if n > len(params) {
+			n = len(params)
+		}
+		cnt += s.publish(params[:n])
+		params = params[n:]
+		if len(params) == 0 {
+			break
+		}
+		// spread the reads over time
+		select {
+		case <-s.stop:
+			return false
+		case <-time.After(batchDelay):
+		}
+	}
+	log.Debugf("State sync published values: %d", cnt)
+	return true
+}
+
+// scan explores the readable parameters of the CCU devices.
+func (s *StateSync) scan() []stateSyncParam {
+	var params []stateSyncParam
+	_, devLinks, verr := s.Service.ReadProperties(deviceVeapPath)
+	if verr != nil {
+		log.Errorf("State sync: %v", verr)
+		return nil
+	}
+	for _, dl := range devLinks {
+		if dl.Role != "device" {
+			continue
+		}
+		devPath := path.Join(deviceVeapPath, dl.Target)
+		_, chLinks, verr := s.Service.ReadProperties(devPath)
+		if verr != nil {
+			// device deleted in the mean time
+			log.Debugf("State sync: %v", verr)
+			continue
+		}
+		for _, cl := range chLinks {
+			if cl.Role != "channel" {
+				continue
+			}
+			chPath := path.Join(devPath, cl.Target)
+			_, prmLinks, verr := s.Service.ReadProperties(chPath)
+			if verr != nil {
+				log.Debugf("State sync: %v", verr)
+				continue
+			}
+			for _, pl := range prmLinks {
+				if pl.Role != "parameter" {
+					continue
+				}
+				prmPath := path.Join(chPath, pl.Target)
+				attrs, _, verr := s.Service.ReadProperties(prmPath)
+				if verr != nil {
+					log.Debugf("State sync: %v", verr)
+					continue
+				}
+				// only readable parameters (e.g. not PRESS_SHORT)
+				if attrInt(attrs, "operations")&itf.ParameterOperationRead == 0 {
+					continue
+				}
+				params = append(params, stateSyncParam{
+					id:   attrString(attrs, model.IdentifierProperty),
+					path: prmPath,
+				})
+			}
+		}
+	}
+	return params
+}
+
+// publish reads the values of the parameters with a single request and
+// publishes them. The number of published values is returned.
+func (s *StateSync) publish(params []stateSyncParam) int {
+	paths := make([]string, len(params))
+	for i, p := range params {
+		paths[i] = p.path
+	}
+	_, results, verr := s.MetaService.ExgData(nil, paths)
+	if verr != nil {
+		log.Errorf("State sync: %v", verr)
+		return 0
+	}
+	cnt := 0
+	for i, r := range results {
+		if r.Error != nil {
+			log.Debugf("State sync: Reading of %s failed: %v", params[i].path, r.Error)
+			continue
+		}
+		if err := publishDeviceStatus(s.Server, params[i].path, params[i].id, r.PV); err != nil {
+			log.Errorf("State sync: Publishing of %s failed: %v", params[i].path, err)
+			continue
+		}
+		cnt++
+	}
+	return cnt
+}
@@ -3,6 +3,7 @@ package mqtt
 import (
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mdzio/go-hmccu/script"
@@ -13,11 +14,14 @@ import (
 )
 
 const (
-	// cycle time for reading system variables
+	// default cycle time for reading system variables
 	sysVarReadCycle = 3000 * time.Millisecond
 )
 
-// SysVarReader reads cyclic system variables.
+// SysVarReader publishes value changes of system variables. The system
+// variables are read cyclic. Additionally, the CCU can notify the reader about
+// changed system variables (e.g. by a ReGaHss program). While notifications
+// are received for a system variable, its cyclic reading is suspended.
 type SysVarReader struct {
 	// Service is used to explore the system variables.
 	Service veap.Service
@@ -25,9 +29,31 @@ type SysVarReader struct {
 	ScriptClient *script.Client
 	// Server is used for publishing value changes.
 	Server *Server
+	// Recorder for value changes, optional.
+	Recorder PVRecorder
+	// ReadCycle is the cycle time for polling the system variables. If not
+	// set, sysVarReadCycle is used.
+	ReadCycle time.Duration
+	// Only system variables with DescriptionFilter in the description are
+	// published (case insensitive). An empty filter selects all system
+	// variables.
+	DescriptionFilter string
+	// Polling of a system variable is suspended for NotifyTimeout after its
+	// last notification. A notification for all system variables suspends the
+	// polling of all. 0 disables the suspension.
+	NotifyTimeout time.Duration
 
 	stop chan struct{}
 	done chan struct{}
+
+	// notifications
+	notify     chan struct{}
+	mtx        sync.Mutex
+	pending    map[string]struct{}
+	pendingAll bool
+	// time of the last notification by ISE ID
+	lastNotify    map[string]time.Time
+	lastNotifyAll time.Time
 }
 
 // Start starts the system variable reader.
@@ -35,6 +61,13 @@ func (r *SysVarReader) Start() {
 	log.Debug("Starting system variable reader")
 	r.stop = make(chan struct{})
 	r.done = make(chan struct{})
+	r.notify = make(chan struct{}, 1)
+	r.pending = make(map[string]struct{})
+	r.lastNotify = make(map[string]time.Time)
+	readCycle := r.ReadCycle
+	if readCycle <= 0 {
+		readCycle = sysVarReadCycle
+	}
 	go func() {
 		// defer clean up
 		defer func() {
@@ -45,52 +78,51 @@ func (r *SysVarReader) Start() {
 		// PV cache
 		pvCache := make(map[string]veap.PV)
 
+		ticker := time.NewTicker(readCycle)
+		defer ticker.Stop()
 		for {
-			// sleep before next read
+			// wait for next cycle or notification
+			var ids, suspended map[string]struct{}
 			select {
 			case <-r.stop:
 				return
-			case <-time.After(sysVarReadCycle):
+			case <-ticker.C:
+				// polling suspended?
+				var all bool
+				suspended, all = r.suspended()
+				if all {
+					continue
+				}
+			case <-r.notify:
+				ids = r.takePending()
 			}
 
 			// get list of system variables
-			_, links, verr := r.Service.ReadProperties(sysVarVeapPath)
-			if verr != nil {
-				log.Errorf("System variable reader: %v", verr)
+			sysVars, ok := r.selectSysVars()
+			if !ok {
 				return
 			}
 
-			// find system variables with "mqtt" in description?
-			var sysVars []script.ValObjDef
-			for _, l := range links {
-				if l.Role == "sysvar" {
-					p := path.Join(sysVarVeapPath, l.Target)
-					attrs, _, verr := r.Service.ReadProperties(p)
-					if verr != nil {
-						log.Errorf("System variable reader: %v", verr)
-						return
-					}
-					q := any.Q(map[string]interface{}(attrs))
-					descr := q.Map().TryKey(model.DescriptionProperty).String()
-					if q.Err() != nil {
-						log.Errorf("System variable reader: %v", q.Err())
-						return
+			// only notified system variables?
+			if ids != nil {
+				var notified []script.ValObjDef
+				for _, sv := range sysVars {
+					if _, ok := ids[sv.ISEID]; ok {
+						notified = append(notified, sv)
 					}
+				}
+				sysVars = notified
+			}
 
-					// "mqtt" in description?
-					if strings.Contains(strings.ToLower(descr), "mqtt") {
-						iseID := q.Map().Key(model.IdentifierProperty).String()
-						dataType := q.Map().Key("type").String()
-						if q.Err() != nil {
-							log.Errorf("System variable reader: %v", q.Err())
-							return
-						}
-						sysVars = append(sysVars, script.ValObjDef{
-							ISEID: iseID,
-							Type:  dataType,
-						})
+			// skip system variables with recent notifications
+			if len(suspended) > 0 {
+				var polled []script.ValObjDef
+				for _, sv := range sysVars {
+					if _, ok := suspended[sv.ISEID]; !ok {
+						polled = append(polled, sv)
 					}
 				}
+				sysVars = polled
 			}
 
 			// nothing to do?
@@ -99,39 +131,7 @@ func (r *SysVarReader) Start() {
 			}
 
 			// bulk read system variables
-			results, err := r.ScriptClient.ReadValues(sysVars)
-			if err != nil {
-				log.Errorf("System variable reader: %v", err)
-				continue
-			}
-			for idx := range sysVars {
-				err = results[idx].Err
-				if err != nil {
-					log.Errorf("System variable reader: %v", err)
-					continue
-				}
-				iseID := sysVars[idx].ISEID
-
-				// create PV
-				state := veap.StateGood
-				if results[idx].Uncertain {
-					state = veap.StateUncertain
-				}
-				pv := veap.PV{Time: results[idx].Timestamp, Value: results[idx].Value, State: state}
-
-				// PV changed?
-				prevPV, ok := pvCache[iseID]
-				if !ok || !pv.Equal(prevPV) {
-
-					// publish PV
-					topic := sysVarTopic + "/status/" + iseID
-					if err := r.Server.PublishPV(topic, pv, message.QosExactlyOnce, true); err != nil {
-						log.Errorf("System variable reader: %v", err)
-					} else {
-						pvCache[iseID] = pv
-					}
-				}
-			}
+			r.readAndPublish(sysVars, pvCache)
 		}
 	}()
 }
@@ -142,3 +142,155 @@ func (r *SysVarReader) Stop() {
 	close(r.stop)
 	<-r.done
 }
+
+// Notify signals a value change of a system variable. If iseID is empty, all
+// published system variables are read.
+func (r *SysVarReader) Notify(iseID string) {
+	r.mtx.Lock()
+	if iseID == "" {
+		r.pendingAll = true
+		r.lastNotifyAll = time.Now()
+	} else {
+		r.pending[iseID] = struct{}{}
+		r.lastNotify[iseID] = time.Now()
+	}
+	r.mtx.Unlock()
+	log.Tracef("System variable notification received: %s", iseID)
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// takePending returns the notified system variables. nil is returned, if all
+// system variables should be read.
+func (r *SysVarReader) takePending() map[string]struct{} {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	ids := r.pending
+	all := r.pendingAll
+	r.pending = make(map[string]struct{})
+	r.pendingAll = false
+	if all {
+		return nil
+	}
+	return ids
+}
+
+// suspended returns the system variables, which are not polled because of
+// recent notifications. all is true, if the polling of all system variables is
+// suspended.
+func (r *SysVarReader) suspended() (ids map[string]struct{}, all bool) {
+	if r.NotifyTimeout <= 0 {
+		return nil, false
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	now := time.Now()
+	if !r.lastNotifyAll.IsZero() && now.Sub(r.lastNotifyAll) < r.NotifyTimeout {
+		return nil, true
+	}
+	for id, t := range r.lastNotify {
+		if now.Sub(t) < r.NotifyTimeout {
+			if ids == nil {
+				ids = make(map[string]struct{})
+			}
+			ids[id] = struct{}{}
+		} else {
+			// suspension expired
+			delete(r.lastNotify, id)
+		}
+	}
+	return ids, false
+}
+
+// selectSysVars returns the system variables to publish. On a fatal error, ok
+// is false.
+func (r *SysVarReader) selectSysVars() (sysVars []script.ValObjDef, ok bool) {
+	// get list of system variables
+	_, links, verr := r.Service.ReadProperties(sysVarVeapPath)
+	if verr != nil {
+		log.Errorf("System variable reader: %v", verr)
+		return nil, false
+	}
+
+	// find system variables with filter text in description
+	filter := strings.ToLower(r.DescriptionFilter)
+	for _, l := range links {
+		if l.Role == "sysvar" {
+			p := path.Join(sysVarVeapPath, l.Target)
+			attrs, _, verr := r.Service.ReadProperties(p)
+			if verr != nil {
+				log.Errorf("System variable reader: %v", verr)
+				return nil, false
+			}
+			q := any.Q(map[string]interface{}(attrs))
+			descr := q.Map().TryKey(model.DescriptionProperty).String()
+			if q.Err() != nil {
+				log.Errorf("System variable reader: %v", q.Err())
+				return nil, false
+			}
+
+			// filter text in description?
+			if strings.Contains(strings.ToLower(descr), filter) {
+				iseID := q.Map().Key(model.IdentifierProperty).String()
+				dataType := q.Map().Key("type").String()
+				if q.Err() != nil {
+					log.Errorf("System variable reader: %v", q.Err())
+					return nil, false
+				}
+				sysVars = append(sysVars, script.ValObjDef{
+					ISEID: iseID,
+					Type:  dataType,
+				})
+			}
+		}
+	}
+	return sysVars, true
+}
+
+// readAndPublish bulk reads the system variables and publishes changed values.
+func (r *SysVarReader) readAndPublish(sysVars []script.ValObjDef, pvCache map[string]veap.PV) {
+	results, err := r.ScriptClient.ReadValues(sysVars)
+	if err != nil {
+		log.Errorf("System variable reader: %v", err)
+		return
+	}
+	for idx := range sysVars {
+		err = results[idx].Err
+		if err != nil {
+			log.Errorf("System variable reader: %v", err)
+			continue
+		}
+		iseID := sysVars[idx].ISEID
+
+		// create PV
+		state := veap.StateGood
+		if results[idx].Uncertain {
+			state = veap.StateUncertain
+		}
+		pv := veap.PV{Time: results[idx].Timestamp, Value: results[idx].Value, State: state}
+
+		// PV changed?
+		prevPV, ok := pvCache[iseID]
+		if !ok || !pv.Equal(prevPV) {
+			pvPath := sysVarVeapPath + "/" + iseID
+			if r.Recorder != nil {
+				r.Recorder.Record(pvPath, pv)
+			}
+
+			// publish PV
+			p := r.Server.profile()
+			topic, err := p.statusTopic(&p.sysVar, pvPath)
+			if err != nil {
+				log.Errorf("System variable reader: %v", err)
+				continue
+			}
+			if err := r.Server.PublishPV(topic, pv, message.QosExactlyOnce, true); err != nil {
+				log.Errorf("System variable reader: %v", err)
+			} else {
+				pvCache[iseID] = pv
+			}
+		}
+	}
+}
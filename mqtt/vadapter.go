@@ -2,7 +2,6 @@ package mqtt
 
 import (
 	"fmt"
-	"strings"
 	"sync"
 	"time"
 
@@ -12,10 +11,8 @@ import (
 )
 
 type vadapter struct {
-	// MQTT topic prefix
-	mqttTopic string
-	// VEAP path prefix
-	veapPath string
+	// MQTT topics and VEAP path prefix
+	topics *topicSet
 	// read back duration (0: disabled)
 	readBackDur time.Duration
 	// MQTT server
@@ -46,23 +43,21 @@ func (a *vadapter) start() {
 		log.Tracef("Set message received: %s, %s", msg.Topic(), msg.Payload())
 
 		// parse PV
-		pv, err := wireToPV(msg.Payload())
+		profile := a.mqttServer.profile()
+		pv, err := profile.decodeSet(msg.Payload())
 		if err != nil {
 			return err
 		}
 
 		// map topic to VEAP address
-		setTopic := a.mqttTopic + "/set"
 		topic := string(msg.Topic())
-		if !strings.HasPrefix(topic, setTopic+"/") {
+		path, ok := a.topics.pvPath(a.topics.set, topic, profile.names)
+		if !ok {
 			return fmt.Errorf("Unexpected topic: %s", topic)
 		}
 
-		// path with leading /
-		path := topic[len(setTopic):]
-
 		// use VEAP service to write PV
-		if err = a.veapService.WritePV(a.veapPath+path, pv); err != nil {
+		if err = a.veapService.WritePV(path, pv); err != nil {
 			return err
 		}
 
@@ -88,16 +83,14 @@ func (a *vadapter) start() {
 				defer a.exit()
 
 				// read back
-				pv, verr := a.veapService.ReadPV(a.veapPath + path)
+				pv, verr := a.veapService.ReadPV(path)
 				if verr != nil {
-					log.Warning("Read back of %s failed: %v", a.veapPath+path, verr)
+					log.Warningf("Read back of %s failed: %v", path, verr)
 					return
 				}
 				// publish PV
-				statusTopic := a.mqttTopic + "/status"
-				err = a.mqttServer.PublishPV(statusTopic+path, pv, message.QosAtLeastOnce, true)
-				if err != nil {
-					log.Warning("Publish of %s failed: %v", statusTopic+path, err)
+				if err := a.publish(path, pv); err != nil {
+					log.Warningf("Publish of %s failed: %v", path, err)
 					return
 				}
 			}()
@@ -116,35 +109,31 @@ func (a *vadapter) start() {
 		log.Tracef("Get message received: %s", msg.Topic())
 
 		// map topic to VEAP address
-		getTopic := a.mqttTopic + "/get"
 		topic := string(msg.Topic())
-		if !strings.HasPrefix(topic, getTopic+"/") {
+		path, ok := a.topics.pvPath(a.topics.get, topic, a.mqttServer.profile().names)
+		if !ok {
 			return fmt.Errorf("Unexpected topic: %s", topic)
 		}
 
-		// path with leading /
-		path := topic[len(getTopic):]
-
 		// use VEAP service to read PV
-		pv, err := a.veapService.ReadPV(a.veapPath + path)
+		pv, err := a.veapService.ReadPV(path)
 		if err != nil {
 			return err
 		}
 
 		// publish PV
-		statusTopic := a.mqttTopic + "/status"
-		return a.mqttServer.PublishPV(statusTopic+path, pv, message.QosAtLeastOnce, true)
+		return a.publish(path, pv)
 	}
 
 	// subscribe topics
-	a.mqttServer.Subscribe(a.mqttTopic+"/set/+", message.QosExactlyOnce, &a.onSet)
-	a.mqttServer.Subscribe(a.mqttTopic+"/get/+", message.QosExactlyOnce, &a.onGet)
+	a.mqttServer.Subscribe(a.topics.set.filter(), message.QosExactlyOnce, &a.onSet)
+	a.mqttServer.Subscribe(a.topics.get.filter(), message.QosExactlyOnce, &a.onGet)
 }
 
 func (a *vadapter) stop() {
 	// unsubscribe topics
-	a.mqttServer.Unsubscribe(a.mqttTopic+"/set/+", &a.onSet)
-	a.mqttServer.Unsubscribe(a.mqttTopic+"/get/+", &a.onGet)
+	a.mqttServer.Unsubscribe(a.topics.set.filter(), &a.onSet)
+	a.mqttServer.Unsubscribe(a.topics.get.filter(), &a.onGet)
 
 	// disable callbacks
 	a.cond.L.Lock()
@@ -157,6 +146,15 @@ func (a *vadapter) stop() {
 	a.cond.L.Unlock()
 }
 
+// publish publishes a PV on the status topic.
+func (a *vadapter) publish(path string, pv veap.PV) error {
+	topic, err := a.mqttServer.profile().statusTopic(a.topics, path)
+	if err != nil {
+		return err
+	}
+	return a.mqttServer.PublishPV(topic, pv, message.QosAtLeastOnce, true)
+}
+
 func (a *vadapter) enter() bool {
 	// register callback
 	a.cond.L.Lock()
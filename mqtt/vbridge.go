@@ -2,7 +2,6 @@ package mqtt
 
 import (
 	"fmt"
-	"strings"
 	"time"
 
 	"github.com/mdzio/go-mqtt/message"
@@ -11,27 +10,17 @@ import (
 )
 
 const (
-	// topic prefixes for CCU devices
-	deviceStatusTopic = "device/status"
-	deviceSetTopic    = "device/set"
 	// path prefix for device data points in the VEAP address space
 	deviceVeapPath = "/device"
 
-	// topic prefix for system variables
-	sysVarTopic = "sysvar"
 	// path prefix for system variable data points in the VEAP address space
 	sysVarVeapPath = "/sysvar"
 	// delay time for reading back
 	sysVarReadBackDur = 300 * time.Millisecond
 
-	// topic prefix for programs
-	prgTopic = "program"
 	// path prefix for programs in the VEAP address space
 	prgVeapPath = "/program"
 
-	// topic prefixes for virtual devices
-	virtDevStatusTopic = "virtdev/status"
-	virtDevSetTopic    = "virtdev/set"
 	// path prefix for virtual devices in the VEAP address space
 	virtDevVeapPath = "/virtdev"
 )
@@ -45,6 +34,7 @@ type VEAPBridge struct {
 	Service veap.Service
 
 	onSetDevice service.OnPublishFunc
+	onSetScene  service.OnPublishFunc
 
 	sysVarAdapter *vadapter
 	prgAdapter    *vadapter
@@ -57,19 +47,19 @@ func (b *VEAPBridge) Start() {
 		log.Tracef("Set device message received: %s, %s", msg.Topic(), msg.Payload())
 
 		// parse PV
-		pv, err := wireToPV(msg.Payload())
+		profile := b.Server.profile()
+		pv, err := profile.decodeSet(msg.Payload())
 		if err != nil {
 			return err
 		}
 
 		// map topic to VEAP address
-		var path string
 		topic := string(msg.Topic())
-		if strings.HasPrefix(topic, deviceSetTopic+"/") {
-			path = deviceVeapPath + topic[len(deviceSetTopic):]
-		} else if strings.HasPrefix(topic, virtDevSetTopic+"/") {
-			path = virtDevVeapPath + topic[len(virtDevSetTopic):]
-		} else {
+		path, ok := profile.device.pvPath(profile.device.set, topic, profile.names)
+		if !ok {
+			path, ok = profile.virtDev.pvPath(profile.virtDev.set, topic, profile.names)
+		}
+		if !ok {
 			return fmt.Errorf("Unexpected topic: %s", topic)
 		}
 
@@ -79,13 +69,52 @@ func (b *VEAPBridge) Start() {
 		}
 		return nil
 	}
-	b.Server.Subscribe(deviceSetTopic+"/+/+/+", message.QosExactlyOnce, &b.onSetDevice)
-	b.Server.Subscribe(virtDevSetTopic+"/+/+/+", message.QosExactlyOnce, &b.onSetDevice)
+	profile := b.Server.profile()
+	b.Server.Subscribe(profile.device.set.filter(), message.QosExactlyOnce, &b.onSetDevice)
+	b.Server.Subscribe(profile.virtDev.set.filter(), message.QosExactlyOnce, &b.onSetDevice)
+
+	// subscribe set scene topics
+	b.onSetScene = func(msg *message.PublishMessage) error {
+		log.Tracef("Set scene message received: %s, %s", msg.Topic(), msg.Payload())
+
+		// parse PV
+		profile := b.Server.profile()
+		pv, err := profile.decodeSet(msg.Payload())
+		if err != nil {
+			return err
+		}
+
+		// map topic to VEAP address
+		topic := string(msg.Topic())
+		path, ok := profile.scene.pvPath(profile.scene.set, topic, nil)
+		if !ok {
+			return fmt.Errorf("Unexpected topic: %s", topic)
+		}
+
+		// execute scene, the result is also published on failed steps
+		prev, err := b.Service.ReadPV(path)
+		if err != nil {
+			return err
+		}
+		if err := b.Service.WritePV(path, pv); err != nil {
+			log.Warningf("Execution of scene %s failed: %v", path, err)
+		}
+		pv, err = b.Service.ReadPV(path)
+		if err != nil {
+			return err
+		}
+		// an execution in the background is published on completion (q.v.
+		// PublishSceneResult)
+		if pv.Time.Equal(prev.Time) {
+			return nil
+		}
+		return b.PublishSceneResult(path, pv)
+	}
+	b.Server.Subscribe(profile.scene.set.filter(), message.QosExactlyOnce, &b.onSetScene)
 
 	// adapt VEAP system variables
 	b.sysVarAdapter = &vadapter{
-		mqttTopic:   sysVarTopic,
-		veapPath:    sysVarVeapPath,
+		topics:      &profile.sysVar,
 		readBackDur: sysVarReadBackDur,
 		mqttServer:  b.Server,
 		veapService: b.Service,
@@ -94,20 +123,32 @@ func (b *VEAPBridge) Start() {
 
 	// adapt VEAP programs
 	b.prgAdapter = &vadapter{
-		mqttTopic:   prgTopic,
-		veapPath:    prgVeapPath,
+		topics:      &profile.prg,
 		mqttServer:  b.Server,
 		veapService: b.Service,
 	}
 	b.prgAdapter.start()
 }
 
+// PublishSceneResult publishes the result of a scene on its status topic (e.g.
+// for executions in the background).
+func (b *VEAPBridge) PublishSceneResult(pvPath string, pv veap.PV) error {
+	profile := b.Server.profile()
+	status, err := profile.statusTopic(&profile.scene, pvPath)
+	if err != nil {
+		return err
+	}
+	return b.Server.PublishPV(status, pv, message.QosAtLeastOnce, false)
+}
+
 // Stop stops the MQTT/VEAP-Bridge.
 func (b *VEAPBridge) Stop() {
 	// stop adapter
 	b.prgAdapter.stop()
 	b.sysVarAdapter.stop()
 
-	b.Server.Unsubscribe(virtDevSetTopic+"/+/+/+", &b.onSetDevice)
-	b.Server.Unsubscribe(deviceSetTopic+"/+/+/+", &b.onSetDevice)
+	profile := b.Server.profile()
+	b.Server.Unsubscribe(profile.scene.set.filter(), &b.onSetScene)
+	b.Server.Unsubscribe(profile.virtDev.set.filter(), &b.onSetDevice)
+	b.Server.Unsubscribe(profile.device.set.filter(), &b.onSetDevice)
 }
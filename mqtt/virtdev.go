@@ -14,6 +14,8 @@ import (
 type VirtDevEventReceiver struct {
 	// Server for publishing events.
 	Server *Server
+	// Recorder for value changes, optional.
+	Recorder PVRecorder
 }
 
 // PublishEvent implements vdevices.EventPublisher.
@@ -28,15 +30,24 @@ func (t *VirtDevEventReceiver) PublishEvent(address, valueKey string, value inte
 	dev = address[0:p]
 	ch = address[p+1:]
 
-	// build topic
-	topic := fmt.Sprintf("%s/%s/%s/%s", virtDevStatusTopic, dev, ch, valueKey)
-
 	// build PV
+	pvPath := fmt.Sprintf("%s/%s/%s/%s", virtDevVeapPath, dev, ch, valueKey)
 	pv := veap.PV{
 		Time:  time.Now(),
 		Value: value,
 		State: veap.StateGood,
 	}
+	if t.Recorder != nil {
+		t.Recorder.Record(pvPath, pv)
+	}
+
+	// build topic
+	prof := t.Server.profile()
+	topic, err := prof.statusTopic(&prof.virtDev, pvPath)
+	if err != nil {
+		log.Error(err)
+		return
+	}
 
 	// select qos and retain
 	var qos byte
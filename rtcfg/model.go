@@ -3,7 +3,10 @@ package rtcfg
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"path"
+	"regexp"
+	"strings"
 
 	"github.com/mdzio/go-hmccu/itf"
 	"github.com/mdzio/go-logging"
@@ -21,6 +24,9 @@ type Config struct {
 	Certificates   Certificates
 	Users          map[string]*User // Identifier is key.
 	VirtualDevices VirtualDevices
+	History        History
+	Scenes         map[string]*Scene // Identifier is key.
+	Rules          map[string]*Rule  // Identifier is key.
 }
 
 // CopyTo deep copies the configuration.
@@ -96,6 +102,8 @@ type HTTP struct {
 	PortTLS     int
 	CORSOrigins []string
 	WebUIDir    string
+	// Metrics enables the Prometheus exporter.
+	Metrics bool
 }
 
 // MQTT configuration
@@ -104,11 +112,168 @@ type MQTT struct {
 	PortTLS       int
 	BufferSize    int64
 	WebSocketPath string
-	Bridge        MQTTBridge
+	// Bridge is the configuration of the former single bridge. It is migrated
+	// to Bridges on reading the configuration.
+	Bridge MQTTBridge
+	// Bridges contains the bridges to remote MQTT servers. The identifier of
+	// the bridge is the key.
+	Bridges map[string]*MQTTBridge
+	// Directory for the persisted offline queues of the bridges.
+	QueueDir string
+	SysVars  MQTTSysVars
+	// Profile is the name of the active topic and payload profile.
+	Profile string
+	// Profiles contains the available topic and payload profiles. The name of
+	// the profile is the key.
+	Profiles      map[string]*MQTTProfile
+	HomeAssistant MQTTHomeAssistant
+	Retained      MQTTRetained
+	StateSync     MQTTStateSync
+}
+
+// MQTTStateSync configures the publishing of the values of all CCU device
+// parameters after start up and optionally cyclic.
+type MQTTStateSync struct {
+	Enable bool
+	// Cycle time in minutes for repeating the sync. 0 syncs only after start
+	// up.
+	Cycle int
+	// Number of parameters read at once.
+	BatchSize int
+	// Pause between two batches in milliseconds.
+	BatchDelay int
+}
+
+// MQTTRetained configures the persistence of the retained messages of the
+// embedded MQTT server across restarts.
+type MQTTRetained struct {
+	Enable bool
+	// File for the persisted retained messages.
+	File string
+	// Max. number of persisted retained messages. A negative value disables
+	// the limit. 0 is replaced by the default limit.
+	MaxEntries int
+	// Cycle time in seconds for writing the retained messages to disk.
+	FlushCycle int
+}
+
+// MQTTHomeAssistant configures the publishing of Home Assistant MQTT discovery
+// messages. System variables are announced, if they are selected by
+// MQTTSysVars.DescriptionFilter.
+type MQTTHomeAssistant struct {
+	Enable bool
+	// Topic prefix for the discovery messages (default: homeassistant).
+	DiscoveryPrefix string
+	// Cycle time in seconds for detecting new and removed data points.
+	ScanCycle int
+}
+
+// MQTTProfile specifies the topic layout and the payload encoding. The topic
+// templates may contain following placeholders, which must fill a whole topic
+// level: {device} (device address), {channel} (channel number), {name}
+// (channel name, replaces {device} and {channel}), {param} (parameter name) and
+// {id} (ISE ID of a system variable or program).
+type MQTTProfile struct {
+	// Prefix is prepended to all topic templates (e.g. "ccu/").
+	Prefix string
+
+	// topic templates for devices and virtual devices
+	DeviceStatusTopic  string
+	DeviceSetTopic     string
+	VirtDevStatusTopic string
+	VirtDevSetTopic    string
+
+	// topic templates for system variables and programs
+	SysVarStatusTopic  string
+	SysVarSetTopic     string
+	SysVarGetTopic     string
+	ProgramStatusTopic string
+	ProgramSetTopic    string
+	ProgramGetTopic    string
+
+	// StatusPayload is the encoding of published values.
+	StatusPayload PayloadEncoding
+	// SetPayload is the encoding of received set requests.
+	SetPayload PayloadEncoding
+}
+
+// StandardMQTTProfile returns the standard topic layout of the CCU-Jack with
+// the specified payload encoding.
+func StandardMQTTProfile(enc PayloadEncoding) *MQTTProfile {
+	return &MQTTProfile{
+		DeviceStatusTopic:  "device/status/{device}/{channel}/{param}",
+		DeviceSetTopic:     "device/set/{device}/{channel}/{param}",
+		VirtDevStatusTopic: "virtdev/status/{device}/{channel}/{param}",
+		VirtDevSetTopic:    "virtdev/set/{device}/{channel}/{param}",
+		SysVarStatusTopic:  "sysvar/status/{id}",
+		SysVarSetTopic:     "sysvar/set/{id}",
+		SysVarGetTopic:     "sysvar/get/{id}",
+		ProgramStatusTopic: "program/status/{id}",
+		ProgramSetTopic:    "program/set/{id}",
+		ProgramGetTopic:    "program/get/{id}",
+		StatusPayload:      enc,
+		SetPayload:         enc,
+	}
+}
+
+// PayloadEncoding specifies the encoding of an MQTT payload.
+type PayloadEncoding int
+
+const (
+	// PayloadJSON encodes a PV as JSON object with timestamp, value and state
+	// ({"ts":...,"v":...,"s":...}). On receiving, a plain value is also
+	// accepted.
+	PayloadJSON PayloadEncoding = iota
+	// PayloadPlain encodes only the value. Strings are not quoted.
+	PayloadPlain
+)
+
+var (
+	payloadEncodingStr = []string{
+		PayloadJSON:  "JSON",
+		PayloadPlain: "PLAIN",
+	}
+
+	errPayloadEncoding = errors.New("invalid payload encoding identifier")
+)
+
+// String implements interface Stringer.
+func (e PayloadEncoding) String() string {
+	return payloadEncodingStr[e]
+}
+
+// MarshalText implements TextMarshaler (for e.g. JSON encoding).
+func (e PayloadEncoding) MarshalText() ([]byte, error) {
+	return []byte(e.String()), nil
+}
+
+// UnmarshalText implements TextUnmarshaler (for e.g. JSON encoding).
+func (e *PayloadEncoding) UnmarshalText(text []byte) error {
+	if idx := findEntry(payloadEncodingStr, string(text)); idx != -1 {
+		*e = PayloadEncoding(idx)
+		return nil
+	}
+	return errPayloadEncoding
+}
+
+// MQTTSysVars configures the publishing of system variables.
+type MQTTSysVars struct {
+	// Cycle time in milliseconds for polling the system variables.
+	ReadCycle int
+	// Only system variables with this text in the description are published.
+	// The comparison is case insensitive. An empty filter selects all system
+	// variables.
+	DescriptionFilter string
+	// If notifications about system variable changes are received from the
+	// CCU (e.g. from a ReGaHss program), polling of a system variable is
+	// suspended for this time in seconds after its last notification. 0
+	// disables the suspension.
+	NotifyTimeout int
 }
 
 // MQTTBridge configuration
 type MQTTBridge struct {
+	Identifier   string
 	Enable       bool
 	Address      string
 	Port         int
@@ -122,6 +287,22 @@ type MQTTBridge struct {
 	CleanSession bool
 	Incoming     []MQTTSharedTopic
 	Outgoing     []MQTTSharedTopic
+	// Queue stores outgoing messages, while the remote server is unreachable.
+	Queue MQTTBridgeQueue
+}
+
+// MQTTBridgeQueue configures the offline queue of a bridge. Only outgoing
+// messages with QoS 1 or 2 are queued. The queued messages are sent in order
+// after reconnecting. At least one limit must be set, if the queue is enabled.
+type MQTTBridgeQueue struct {
+	Enable bool
+	// Max. number of queued messages. The oldest messages are dropped first.
+	// 0 disables the size limit.
+	MaxEntries int
+	// Max. age of the queued messages in hours. 0 disables the age limit.
+	MaxAge int
+	// LatestOnly keeps only the latest message per topic.
+	LatestOnly bool
 }
 
 // MQTTSharedTopic configuration
@@ -130,6 +311,22 @@ type MQTTSharedTopic struct {
 	LocalPrefix  string
 	RemotePrefix string
 	QoS          byte
+	// Template rewrites the payload of the forwarded messages (optional). The
+	// template receives the payload as string. An empty result drops the
+	// message.
+	Template string
+	// PublishQoS overrides the QoS of the forwarded messages (optional).
+	PublishQoS *byte
+	// Retain overrides the retain flag of the forwarded messages (optional).
+	Retain *bool
+	// MinInterval delays the messages on a topic, which follow the last
+	// forwarded one within this interval in milliseconds. Only the latest
+	// delayed message is forwarded, when the interval expires. 0 disables the
+	// rate limit.
+	MinInterval int
+	// DropUnchanged drops the messages on a topic, whose payload equals the
+	// last forwarded one.
+	DropUnchanged bool
 }
 
 // BINRPC configuration for CUxD support
@@ -157,7 +354,8 @@ type User struct {
 }
 
 // Authorized checks whether an authorization exists. The request must contain
-// only a single endpoint and kind. pvPath is not yet checked.
+// only a single endpoint and kind. If multiple permissions match the endpoint
+// and kind, one PV filter must match pvPath.
 func (u *User) Authorized(endpoint Endpoint, kind PermKind, pvPath string) bool {
 	// check all permissions
 	for _, per := range u.Permissions {
@@ -171,10 +369,12 @@ func (u *User) Authorized(endpoint Endpoint, kind PermKind, pvPath string) bool
 				// check pv path
 				match, err := path.Match(per.PVFilter, pvPath)
 				if err != nil {
-					log.Warning("Invalid PV filter in security configuration: %s", per.PVFilter)
-					return false
+					log.Warningf("Invalid PV filter in security configuration: %s", per.PVFilter)
+					continue
+				}
+				if match {
+					return true
 				}
-				return match
 			}
 		}
 	}
@@ -233,11 +433,146 @@ const (
 	PermReadPV
 )
 
+// History configures the recording of value changes. Modifications of the
+// rules are applied immediately, the other settings need a restart.
+type History struct {
+	Enable bool
+	// Directory for the persisted histories.
+	Dir string
+	// Cycle time in seconds for writing the histories to disk.
+	FlushCycle int
+	// Rules select the recorded data points. The first matching rule is used.
+	Rules []*HistoryRule
+}
+
+// HistoryRule specifies the retention for the data points, which match the
+// path pattern.
+type HistoryRule struct {
+	// pattern syntax q.v. path.Match()
+	PathPattern string
+	// Max. number of entries per data point.
+	MaxEntries int
+	// Max. age of the entries in hours. 0 disables the age limit.
+	MaxAge int
+}
+
+// SceneVeapPath is the VEAP path of the scenes.
+const SceneVeapPath = "/~vendor/scenes"
+
+// AuthorizedWrite checks PermWritePV of the user for a PV path. Writing the PV
+// of a scene executes its steps. Therefore PermWritePV is also needed for the
+// targets of all steps, including the steps of nested scenes.
+func (c *Config) AuthorizedWrite(u *User, endpoint Endpoint, pvPath string) bool {
+	return c.authorizedWrite(u, endpoint, pvPath, make(map[string]bool))
+}
+
+func (c *Config) authorizedWrite(u *User, endpoint Endpoint, pvPath string, visited map[string]bool) bool {
+	if !u.Authorized(endpoint, PermWritePV, pvPath) {
+		return false
+	}
+	id := strings.TrimPrefix(pvPath, SceneVeapPath+"/")
+	if id == pvPath || strings.Contains(id, "/") {
+		// not a scene
+		return true
+	}
+	scene, ok := c.Scenes[id]
+	if !ok || visited[id] {
+		return true
+	}
+	visited[id] = true
+	for _, st := range scene.Steps {
+		if !c.authorizedWrite(u, endpoint, st.Path, visited) {
+			return false
+		}
+	}
+	return true
+}
+
+// Scene is a named sequence of PV writes.
+type Scene struct {
+	Identifier  string
+	Title       string
+	Description string
+	Steps       []*SceneStep
+}
+
+// SceneStep writes a value to a data point.
+type SceneStep struct {
+	// VEAP path of the data point
+	Path  string
+	Value interface{}
+	// Delay in milliseconds before the value is written.
+	Delay int
+}
+
+// Rule is an automation, which writes data points, when it is triggered.
+type Rule struct {
+	Identifier  string
+	Description string
+	Enable      bool
+	Trigger     RuleTrigger
+	// Condition is a template (q.v. text/template), which must return true for
+	// executing the actions. If empty, the actions are always executed.
+	Condition string
+	Actions   []*RuleAction
+}
+
+// RuleTrigger specifies the events, which trigger a rule. Multiple kinds of
+// triggers can be combined.
+type RuleTrigger struct {
+	// PV changes of the data points, which match the VEAP path pattern (q.v.
+	// path.Match()).
+	PVPath string
+	// MQTT messages, which match the topic filter (wildcards + and # are
+	// allowed).
+	Topic string
+	// Cron schedule with the fields minute, hour, day of month, month and day
+	// of week (e.g. "30 6 * * 1-5").
+	Schedule string
+}
+
+// RuleAction writes a data point.
+type RuleAction struct {
+	// VEAP path of the data point
+	Path string
+	// Value is a template (q.v. text/template). The result is parsed as JSON.
+	// If this fails, the result is taken as string.
+	Value string
+}
+
 // Virtual devices
 type VirtualDevices struct {
 	Enable       bool
 	NextSerialNo int
-	Devices      map[string]*Device // Address is key.
+	Devices      map[string]*Device         // Address is key.
+	Templates    map[string]*DeviceTemplate // Identifier is key.
+	// Discovery enables the listing of devices, which announce themselves on
+	// the discovery topics of Tasmota, Shelly and Zigbee2MQTT.
+	Discovery bool
+}
+
+// NewAddress returns the next free device address and increments
+// NextSerialNo.
+func (v *VirtualDevices) NewAddress() string {
+	for {
+		addr := fmt.Sprintf("JACK%06d", v.NextSerialNo)
+		v.NextSerialNo++
+		if _, exists := v.Devices[addr]; !exists {
+			return addr
+		}
+	}
+}
+
+// DiscoveredAddress returns the address of the virtual device, which was
+// created for a discovered device. An empty string is returned, if no such
+// device exists.
+func (v *VirtualDevices) DiscoveredAddress(discovered string) string {
+	for addr, d := range v.Devices {
+		if d.Discovered == discovered {
+			return addr
+		}
+	}
+	return ""
 }
 
 // Device stores the configuration and master data of a virtual device.
@@ -245,6 +580,122 @@ type Device struct {
 	Address  string
 	HMType   string
 	Channels []Channel
+	// Identifier of the discovered device (q.v. virtdev.Discovery), for which
+	// this device was created. Empty, if the device was created manually.
+	Discovered string
+}
+
+// DeviceTemplate is a blueprint for virtual devices. String values of the
+// master parameters can contain placeholders (e.g. {{.Name}}), which are
+// replaced on instantiation.
+type DeviceTemplate struct {
+	Identifier  string
+	Description string
+	HMType      string
+	Channels    []Channel
+}
+
+// placeholder in the master parameters of a device template
+var templatePlaceholder = regexp.MustCompile(`\{\{\s*\.(\w+)\s*\}\}`)
+
+// Instantiate creates a device from the template. The placeholder {{.Address}}
+// and a placeholder for each key of params (e.g. {{.Name}}) are replaced.
+// Other template actions (e.g. {{ . }} in payload templates of the channels)
+// are kept unchanged.
+func (t *DeviceTemplate) Instantiate(address string, params map[string]string) *Device {
+	replace := func(s string) string {
+		return templatePlaceholder.ReplaceAllStringFunc(s, func(ph string) string {
+			key := templatePlaceholder.FindStringSubmatch(ph)[1]
+			if key == "Address" {
+				return address
+			}
+			if v, ok := params[key]; ok {
+				return v
+			}
+			return ph
+		})
+	}
+	d := &Device{
+		Address:  address,
+		HMType:   t.HMType,
+		Channels: make([]Channel, len(t.Channels)),
+	}
+	for i, ch := range t.Channels {
+		ps := make(map[string]interface{}, len(ch.MasterParamset))
+		for id, v := range ch.MasterParamset {
+			if s, ok := v.(string); ok {
+				v = replace(s)
+			}
+			ps[id] = v
+		}
+		d.Channels[i] = Channel{Kind: ch.Kind, MasterParamset: ps}
+	}
+	return d
+}
+
+// StandardDeviceTemplates returns the built-in device templates.
+func StandardDeviceTemplates() map[string]*DeviceTemplate {
+	return map[string]*DeviceTemplate{
+		"tasmota-plug": {
+			Identifier:  "tasmota-plug",
+			Description: "Tasmota plug (Name: topic of the device)",
+			HMType:      "HM-LC-Sw1-FM",
+			Channels: []Channel{
+				{
+					Kind: ChannelMQTTSwitchFeedback,
+					MasterParamset: map[string]interface{}{
+						"COMMAND_TOPIC":  "cmnd/{{.Name}}/POWER",
+						"ON_PAYLOAD":     "ON",
+						"OFF_PAYLOAD":    "OFF",
+						"FEEDBACK_TOPIC": "stat/{{.Name}}/POWER",
+						"ON_PATTERN":     "ON",
+						"OFF_PATTERN":    "OFF",
+					},
+				},
+				{
+					Kind: ChannelMQTTUnreach,
+					MasterParamset: map[string]interface{}{
+						"TOPIC":         "tele/{{.Name}}/LWT",
+						"ERROR_PATTERN": "Offline",
+						"OK_PATTERN":    "Online",
+					},
+				},
+			},
+		},
+		"shelly-1pm": {
+			Identifier:  "shelly-1pm",
+			Description: "Shelly 1PM (Name: device ID, e.g. shelly1pm-ABCDEF)",
+			HMType:      "HM-ES-PMSw1-Pl",
+			Channels: []Channel{
+				{
+					Kind: ChannelMQTTSwitchFeedback,
+					MasterParamset: map[string]interface{}{
+						"COMMAND_TOPIC":  "shellies/{{.Name}}/relay/0/command",
+						"ON_PAYLOAD":     "on",
+						"OFF_PAYLOAD":    "off",
+						"FEEDBACK_TOPIC": "shellies/{{.Name}}/relay/0",
+						"ON_PATTERN":     "on",
+						"OFF_PATTERN":    "off",
+					},
+				},
+				{
+					Kind: ChannelMQTTPowerMeter,
+					MasterParamset: map[string]interface{}{
+						"POWER_TOPIC":     "shellies/{{.Name}}/relay/0/power",
+						"POWER_EXTRACTOR": 3.0, // ALL
+					},
+				},
+				{
+					Kind: ChannelMQTTUnreach,
+					MasterParamset: map[string]interface{}{
+						"TOPIC":         "shellies/{{.Name}}/online",
+						"ERROR_PATTERN": "false",
+						"OK_PATTERN":    "true",
+					},
+				},
+			},
+		},
+	}
 }
 
 type ChannelKind int
@@ -273,6 +724,16 @@ const (
 	ChannelMQTTEnergyCounter
 	ChannelMQTTGasCounter
 	ChannelMQTTUnreach
+	ChannelMQTTBlind
+	ChannelMQTTThermostat
+	ChannelMQTTColorLight
+	ChannelMQTTStringReceiver
+	ChannelMQTTEnumReceiver
+	ChannelMQTTSmokeDetector
+	ChannelMQTTWaterSensor
+	ChannelMQTTMotionDetector
+	ChannelMQTTWindowHandle
+	ChannelComputed
 )
 
 var (
@@ -300,6 +761,16 @@ var (
 		ChannelMQTTEnergyCounter:  "MQTT_ENERGY_COUNTER",
 		ChannelMQTTGasCounter:     "MQTT_GAS_COUNTER",
 		ChannelMQTTUnreach:        "MQTT_UNREACH",
+		ChannelMQTTBlind:          "MQTT_BLIND",
+		ChannelMQTTThermostat:     "MQTT_THERMOSTAT",
+		ChannelMQTTColorLight:     "MQTT_COLOR_LIGHT",
+		ChannelMQTTStringReceiver: "MQTT_STRING_RECEIVER",
+		ChannelMQTTEnumReceiver:   "MQTT_ENUM_RECEIVER",
+		ChannelMQTTSmokeDetector:  "MQTT_SMOKE_DETECTOR",
+		ChannelMQTTWaterSensor:    "MQTT_WATER_SENSOR",
+		ChannelMQTTMotionDetector: "MQTT_MOTION_DETECTOR",
+		ChannelMQTTWindowHandle:   "MQTT_WINDOW_HANDLE",
+		ChannelComputed:           "COMPUTED",
 	}
 	errChannelKind = errors.New("invalid channel kind identifier")
 )
@@ -80,6 +80,103 @@ func (s *Store) Read() error {
 		s.Config.MQTT.WebSocketPath = "/ws-mqtt"
 		s.modified = true
 	}
+	emptySysVars := MQTTSysVars{}
+	sysVars := &s.Config.MQTT.SysVars
+	if *sysVars == emptySysVars {
+		sysVars.ReadCycle = 3000
+		sysVars.DescriptionFilter = "mqtt"
+		sysVars.NotifyTimeout = 3600
+		s.modified = true
+	}
+	hass := &s.Config.MQTT.HomeAssistant
+	if hass.DiscoveryPrefix == "" {
+		hass.DiscoveryPrefix = "homeassistant"
+		s.modified = true
+	}
+	if hass.ScanCycle == 0 {
+		hass.ScanCycle = 600
+		s.modified = true
+	}
+	if s.Config.MQTT.Profiles == nil {
+		s.Config.MQTT.Profiles = map[string]*MQTTProfile{
+			"standard": StandardMQTTProfile(PayloadJSON),
+			"plain":    StandardMQTTProfile(PayloadPlain),
+		}
+		s.modified = true
+	}
+	if s.Config.MQTT.Profile == "" {
+		s.Config.MQTT.Profile = "standard"
+		s.modified = true
+	}
+	hist := &s.Config.History
+	if hist.Dir == "" {
+		hist.Dir = "history"
+		s.modified = true
+	}
+	if hist.FlushCycle == 0 {
+		hist.FlushCycle = 300
+		s.modified = true
+	}
+	if hist.Rules == nil {
+		hist.Rules = []*HistoryRule{
+			{PathPattern: "/device/*/*/*", MaxEntries: 1000, MaxAge: 7 * 24},
+			{PathPattern: "/virtdev/*/*/*", MaxEntries: 1000, MaxAge: 7 * 24},
+			{PathPattern: "/sysvar/*", MaxEntries: 1000, MaxAge: 7 * 24},
+		}
+		s.modified = true
+	}
+	retained := &s.Config.MQTT.Retained
+	if retained.File == "" {
+		retained.File = "retained.json"
+		s.modified = true
+	}
+	if retained.MaxEntries == 0 {
+		retained.MaxEntries = 10000
+		s.modified = true
+	}
+	if retained.FlushCycle == 0 {
+		retained.FlushCycle = 60
+		s.modified = true
+	}
+	stateSync := &s.Config.MQTT.StateSync
+	if stateSync.BatchSize == 0 {
+		stateSync.BatchSize = 50
+		s.modified = true
+	}
+	if stateSync.BatchDelay == 0 {
+		stateSync.BatchDelay = 1000
+		s.modified = true
+	}
+	if s.Config.MQTT.QueueDir == "" {
+		s.Config.MQTT.QueueDir = "bridgequeue"
+		s.modified = true
+	}
+	// migrate single bridge
+	if s.Config.MQTT.Bridges == nil {
+		s.Config.MQTT.Bridges = make(map[string]*MQTTBridge)
+		s.modified = true
+	}
+	if s.Config.MQTT.Bridge.Address != "" {
+		b := s.Config.MQTT.Bridge
+		b.Identifier = "default"
+		if _, exists := s.Config.MQTT.Bridges[b.Identifier]; !exists {
+			s.Config.MQTT.Bridges[b.Identifier] = &b
+		}
+		s.Config.MQTT.Bridge = MQTTBridge{}
+		s.modified = true
+	}
+	// limit the offline queues of the bridges
+	for _, b := range s.Config.MQTT.Bridges {
+		if b.Queue.MaxEntries == 0 && b.Queue.MaxAge == 0 {
+			b.Queue.MaxEntries = 10000
+			b.Queue.MaxAge = 24
+			s.modified = true
+		}
+	}
+	if s.Config.VirtualDevices.Templates == nil {
+		s.Config.VirtualDevices.Templates = StandardDeviceTemplates()
+		s.modified = true
+	}
 	// save, if modified
 	if s.modified {
 		s.delayedWrite()
@@ -132,3 +132,44 @@ func TestPermissions(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestAuthorizedWrite(t *testing.T) {
+	u := &User{Identifier: "sub", Active: true}
+	u.AddPermission(&Permission{
+		Identifier: "scenes",
+		Endpoint:   EndpointVEAP,
+		Kind:       PermWritePV,
+		PVFilter:   SceneVeapPath + "/*",
+	})
+	u.AddPermission(&Permission{
+		Identifier: "lamp",
+		Endpoint:   EndpointVEAP,
+		Kind:       PermWritePV,
+		PVFilter:   "/device/lamp/1/STATE",
+	})
+	c := &Config{Scenes: map[string]*Scene{
+		"lamp":    {Identifier: "lamp", Steps: []*SceneStep{{Path: "/device/lamp/1/STATE", Value: true}}},
+		"door":    {Identifier: "door", Steps: []*SceneStep{{Path: "/device/door/1/STATE", Value: true}}},
+		"nested":  {Identifier: "nested", Steps: []*SceneStep{{Path: SceneVeapPath + "/lamp", Value: true}}},
+		"nested2": {Identifier: "nested2", Steps: []*SceneStep{{Path: SceneVeapPath + "/door", Value: true}}},
+		"cycle":   {Identifier: "cycle", Steps: []*SceneStep{{Path: SceneVeapPath + "/cycle", Value: true}}},
+	}}
+	cases := []struct {
+		path string
+		ok   bool
+	}{
+		{"/device/lamp/1/STATE", true},
+		{"/device/door/1/STATE", false},
+		{SceneVeapPath + "/lamp", true},
+		{SceneVeapPath + "/door", false},
+		{SceneVeapPath + "/nested", true},
+		{SceneVeapPath + "/nested2", false},
+		{SceneVeapPath + "/cycle", true},
+		{SceneVeapPath + "/unknown", true},
+	}
+	for _, c2 := range cases {
+		if ok := c.AuthorizedWrite(u, EndpointVEAP, c2.path); ok != c2.ok {
+			t.Errorf("unexpected authorization %t for %s", ok, c2.path)
+		}
+	}
+}
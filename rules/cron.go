@@ -0,0 +1,117 @@
+package rules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule is a parsed cron expression. The fields are bit sets of the
+// allowed values.
+type schedule struct {
+	minute, hour, dom, month, dow uint64
+	// day of month or day of week is not restricted (*)
+	domStar, dowStar bool
+}
+
+// bounds of the cron fields
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseSchedule parses a cron expression with the fields minute, hour, day of
+// month, month and day of week. Each field can be *, a number, a range (e.g.
+// 1-5) or a list of these (e.g. 1,3,5-7). Numbers, * and ranges can have a
+// step (e.g. */15). Sunday is 0 or 7.
+func parseSchedule(spec string) (*schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("Invalid cron expression (5 fields expected): %s", spec)
+	}
+	var bits [5]uint64
+	for i, f := range fields {
+		var err error
+		bits[i], err = parseCronField(f, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s in cron expression %s: %v", cronFields[i].name, spec, err)
+		}
+	}
+	// sunday is 0 or 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &schedule{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if pos := strings.IndexByte(part, '/'); pos != -1 {
+			var err error
+			step, err = strconv.Atoi(part[pos+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("Invalid step: %s", part)
+			}
+			rng = part[:pos]
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			var err error
+			if pos := strings.IndexByte(rng, '-'); pos != -1 {
+				lo, err = strconv.Atoi(rng[:pos])
+				if err == nil {
+					hi, err = strconv.Atoi(rng[pos+1:])
+				}
+			} else {
+				lo, err = strconv.Atoi(rng)
+				hi = lo
+				// a single value with step counts up to the maximum
+				if step != 1 {
+					hi = max
+				}
+			}
+			if err != nil {
+				return 0, fmt.Errorf("Invalid value: %s", part)
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("Value out of range: %s", part)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// matches checks whether the schedule is due at the specified minute.
+func (s *schedule) matches(t time.Time) bool {
+	if s.minute&(1<<uint(t.Minute())) == 0 || s.hour&(1<<uint(t.Hour())) == 0 ||
+		s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	// like cron: if both days are restricted, one of them must match
+	if !s.domStar && !s.dowStar {
+		return dom || dow
+	}
+	return dom && dow
+}
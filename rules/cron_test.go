@@ -0,0 +1,132 @@
+package rules
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronField(t *testing.T) {
+	testCases := []struct {
+		field    string
+		min, max int
+		bits     uint64
+		err      string
+	}{
+		{"*", 0, 5, 0x3f, ""},
+		{"3", 0, 59, 1 << 3, ""},
+		{"1-3", 0, 59, 0xe, ""},
+		{"1,3,5-6", 0, 59, 0x6a, ""},
+		{"*/2", 0, 7, 0x55, ""},
+		{"1-7/3", 0, 7, 0x92, ""},
+		{"5/2", 0, 7, 0xa0, ""},
+		{"x", 0, 59, 0, "Invalid value: x"},
+		{"1-x", 0, 59, 0, "Invalid value: 1-x"},
+		{"*/0", 0, 59, 0, "Invalid step: */0"},
+		{"*/x", 0, 59, 0, "Invalid step: */x"},
+		{"60", 0, 59, 0, "Value out of range: 60"},
+		{"0", 1, 31, 0, "Value out of range: 0"},
+		{"5-3", 0, 59, 0, "Value out of range: 5-3"},
+		{"", 0, 59, 0, "Invalid value: "},
+	}
+	for _, tc := range testCases {
+		bits, err := parseCronField(tc.field, tc.min, tc.max)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("field %q: expected error %s, got %v", tc.field, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("field %q: unexpected error: %v", tc.field, err)
+			continue
+		}
+		if bits != tc.bits {
+			t.Errorf("field %q: expected %#x, got %#x", tc.field, tc.bits, bits)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	testCases := []struct {
+		spec string
+		err  string
+	}{
+		{"", "Invalid cron expression (5 fields expected): "},
+		{"* * * *", "Invalid cron expression (5 fields expected): * * * *"},
+		{"* * * * * *", "Invalid cron expression (5 fields expected): * * * * * *"},
+		{"* 24 * * *", "Invalid hour in cron expression * 24 * * *: Value out of range: 24"},
+		{"* * 32 * *", "Invalid day of month in cron expression * * 32 * *: Value out of range: 32"},
+		{"* * * 13 *", "Invalid month in cron expression * * * 13 *: Value out of range: 13"},
+		{"* * * * 8", "Invalid day of week in cron expression * * * * 8: Value out of range: 8"},
+	}
+	for _, tc := range testCases {
+		_, err := parseSchedule(tc.spec)
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("spec %q: expected error %s, got %v", tc.spec, tc.err, err)
+		}
+	}
+}
+
+func TestScheduleMatches(t *testing.T) {
+	// 2024-01-07 is a sunday
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2024, month, day, hour, min, 0, 0, time.Local)
+	}
+	testCases := []struct {
+		spec    string
+		t       time.Time
+		matches bool
+	}{
+		{"* * * * *", at(1, 7, 12, 34), true},
+		{"30 6 * * *", at(1, 7, 6, 30), true},
+		{"30 6 * * *", at(1, 7, 6, 31), false},
+		{"30 6 * * *", at(1, 7, 7, 30), false},
+		{"*/15 * * * *", at(1, 7, 0, 45), true},
+		{"*/15 * * * *", at(1, 7, 0, 46), false},
+		{"30 6 * * 1-5", at(1, 8, 6, 30), true},
+		{"30 6 * * 1-5", at(1, 7, 6, 30), false},
+		// sunday as 0 or 7
+		{"0 0 * * 0", at(1, 7, 0, 0), true},
+		{"0 0 * * 7", at(1, 7, 0, 0), true},
+		{"0 0 * * 7", at(1, 6, 0, 0), false},
+		{"0 0 1 * *", at(2, 1, 0, 0), true},
+		{"0 0 1 * *", at(2, 2, 0, 0), false},
+		{"0 0 * 3 *", at(2, 1, 0, 0), false},
+		{"0 0 * 1,3 *", at(3, 1, 0, 0), true},
+		// day of month or day of week, if both are restricted
+		{"0 0 1 * 1", at(1, 1, 0, 0), true},
+		{"0 0 15 * 1", at(1, 8, 0, 0), true},
+		{"0 0 15 * 1", at(1, 15, 0, 0), true},
+		{"0 0 15 * 1", at(1, 9, 0, 0), false},
+		// otherwise both must match
+		{"0 0 15 * *", at(1, 8, 0, 0), false},
+		{"0 0 * * 1", at(1, 9, 0, 0), false},
+	}
+	for _, tc := range testCases {
+		s, err := parseSchedule(tc.spec)
+		if err != nil {
+			t.Errorf("spec %q: unexpected error: %v", tc.spec, err)
+			continue
+		}
+		if m := s.matches(tc.t); m != tc.matches {
+			t.Errorf("spec %q at %v: expected %t, got %t", tc.spec, tc.t, tc.matches, m)
+		}
+	}
+}
+
+func TestUntilNextMinute(t *testing.T) {
+	base := time.Date(2024, 1, 7, 12, 34, 0, 0, time.Local)
+	testCases := []struct {
+		now   time.Time
+		until time.Duration
+	}{
+		{base, time.Minute},
+		{base.Add(time.Second), 59 * time.Second},
+		{base.Add(59*time.Second + 500*time.Millisecond), 500 * time.Millisecond},
+	}
+	for _, tc := range testCases {
+		if d := untilNextMinute(tc.now); d != tc.until {
+			t.Errorf("time %v: expected %v, got %v", tc.now, tc.until, d)
+		}
+	}
+}
@@ -0,0 +1,487 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/mdzio/ccu-jack/mqtt"
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/ccu-jack/virtdev"
+	"github.com/mdzio/go-logging"
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-mqtt/service"
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/model"
+)
+
+const (
+	// size of the trigger queue
+	queueSize = 256
+	// loop protection: max. number of executions of a rule within loopWindow
+	loopMaxRuns = 10
+	loopWindow  = 10 * time.Second
+)
+
+var log = logging.Get("rules")
+
+// Engine executes the rules of the runtime configuration (q.v. rtcfg.Rule).
+// The PV changes are received as PVRecorder. The actions are written with the
+// model service, so that the same conversions apply as for VEAP requests. A
+// rule, which is executed more than loopMaxRuns times within loopWindow, is
+// suspended until it is enabled again or its configuration is modified.
+type Engine struct {
+	Store   *rtcfg.Store
+	Service *model.Service
+	// MQTTServer for the topic triggers, optional.
+	MQTTServer *mqtt.Server
+
+	mtx    sync.Mutex
+	rules  map[string]*rule
+	status map[string]*Status
+	// copies of the active rule configurations for detecting modifications
+	cfgs map[string]rtcfg.Rule
+
+	queue     chan trigger
+	onPublish service.OnPublishFunc
+	// retained messages are ignored on subscription
+	live int32
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Status is the state of a rule.
+type Status struct {
+	// time of the last trigger
+	Triggered time.Time
+	// time of the last execution of the actions
+	Executed   time.Time
+	Executions int
+	Suspended  bool
+	// Error of the last trigger, empty on success.
+	Error string `json:",omitempty"`
+}
+
+// Event is passed to the templates of a rule.
+type Event struct {
+	// Kind of the trigger: pv, mqtt or schedule
+	Kind string
+	Time time.Time
+	// VEAP path and value of a changed data point
+	Path  string
+	Value interface{}
+	// topic and payload of an MQTT message
+	Topic   string
+	Payload string
+}
+
+type trigger struct {
+	ruleID string
+	event  Event
+}
+
+// rule is a compiled rtcfg.Rule.
+type rule struct {
+	pvPath    string
+	topic     string
+	schedule  *schedule
+	condition *template.Template
+	actions   []action
+	// times of the recent executions
+	runs []time.Time
+}
+
+type action struct {
+	path  string
+	value *template.Template
+}
+
+// Start loads the rules and starts the execution.
+func (e *Engine) Start() {
+	log.Debug("Starting rule engine")
+	e.queue = make(chan trigger, queueSize)
+	e.stop = make(chan struct{})
+	e.done = make(chan struct{})
+	e.Store.View(func(cfg *rtcfg.Config) error {
+		e.Update(cfg.Rules)
+		return nil
+	})
+
+	// receive all MQTT messages, the topics are matched per rule
+	if e.MQTTServer != nil {
+		e.onPublish = func(msg *message.PublishMessage) error {
+			if atomic.LoadInt32(&e.live) != 0 {
+				e.receiveMessage(string(msg.Topic()), msg.Payload())
+			}
+			return nil
+		}
+		if err := e.MQTTServer.Subscribe("#", message.QosAtMostOnce, &e.onPublish); err != nil {
+			log.Errorf("Subscribe for rule triggers failed: %v", err)
+		}
+		atomic.StoreInt32(&e.live, 1)
+	}
+
+	go func() {
+		// defer clean up
+		defer func() {
+			log.Debug("Stopping rule engine")
+			e.done <- struct{}{}
+		}()
+
+		timer := time.NewTimer(untilNextMinute(time.Now()))
+		defer timer.Stop()
+		for {
+			select {
+			case <-e.stop:
+				return
+			case t := <-e.queue:
+				e.execute(t)
+			case now := <-timer.C:
+				e.checkSchedules(now.Round(time.Minute))
+				timer.Reset(untilNextMinute(time.Now()))
+			}
+		}
+	}()
+}
+
+// Stop stops the execution.
+func (e *Engine) Stop() {
+	if e.MQTTServer != nil {
+		atomic.StoreInt32(&e.live, 0)
+		e.MQTTServer.Unsubscribe("#", &e.onPublish)
+	}
+	close(e.stop)
+	<-e.done
+}
+
+// Update activates the rules of a configuration. The configuration store must
+// be locked by the caller. Unmodified rules keep their state (e.g. a
+// suspension).
+func (e *Engine) Update(cfgs map[string]*rtcfg.Rule) {
+	funcs := e.templateFuncs()
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	rules := make(map[string]*rule)
+	copies := make(map[string]rtcfg.Rule)
+	for id, cfg := range cfgs {
+		cp := copyRule(cfg)
+		copies[id] = cp
+		prev, unmodified := e.cfgs[id]
+		unmodified = unmodified && reflect.DeepEqual(prev, cp)
+		st := e.statusOf(id)
+		if !unmodified {
+			st.Suspended = false
+			st.Error = ""
+		}
+		if !cfg.Enable {
+			continue
+		}
+		// keep the compiled rule with its recent executions
+		if r, ok := e.rules[id]; ok && unmodified {
+			rules[id] = r
+			continue
+		}
+		r, err := compile(cfg, funcs)
+		if err != nil {
+			log.Errorf("Invalid rule %s: %v", id, err)
+			st.Error = err.Error()
+			continue
+		}
+		rules[id] = r
+	}
+	e.rules = rules
+	e.cfgs = copies
+	for id := range e.status {
+		if _, ok := cfgs[id]; !ok {
+			delete(e.status, id)
+		}
+	}
+	log.Debugf("Active rules: %d", len(rules))
+}
+
+// copyRule returns a deep copy of a rule configuration.
+func copyRule(cfg *rtcfg.Rule) rtcfg.Rule {
+	cp := *cfg
+	cp.Actions = make([]*rtcfg.RuleAction, len(cfg.Actions))
+	for i, a := range cfg.Actions {
+		if a != nil {
+			ac := *a
+			cp.Actions[i] = &ac
+		}
+	}
+	return cp
+}
+
+// SetEnabled enables or disables a rule in the configuration. A suspended rule
+// is resumed.
+func (e *Engine) SetEnabled(id string, enable bool) error {
+	return e.Store.Update(func(cfg *rtcfg.Config) error {
+		r, ok := cfg.Rules[id]
+		if !ok {
+			return fmt.Errorf("Rule not found: %s", id)
+		}
+		r.Enable = enable
+		e.Update(cfg.Rules)
+		if enable {
+			e.mtx.Lock()
+			st := e.statusOf(id)
+			if st.Suspended {
+				st.Suspended = false
+				st.Error = ""
+			}
+			e.mtx.Unlock()
+		}
+		return nil
+	})
+}
+
+// Status returns the status of a rule as PV.
+func (e *Engine) Status(id string) veap.PV {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	st := *e.statusOf(id)
+	ts := st.Triggered
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	return veap.PV{Time: ts, Value: st, State: veap.StateGood}
+}
+
+// Record implements mqtt.PVRecorder and vmodel.PVRecorder.
+func (e *Engine) Record(pvPath string, pv veap.PV) {
+	e.mtx.Lock()
+	var ids []string
+	for id, r := range e.rules {
+		if r.pvPath == "" {
+			continue
+		}
+		if match, _ := path.Match(r.pvPath, pvPath); match {
+			ids = append(ids, id)
+		}
+	}
+	e.mtx.Unlock()
+	for _, id := range ids {
+		e.enqueue(trigger{id, Event{Kind: "pv", Time: pv.Time, Path: pvPath, Value: pv.Value}})
+	}
+}
+
+func (e *Engine) receiveMessage(topic string, payload []byte) {
+	e.mtx.Lock()
+	var ids []string
+	for id, r := range e.rules {
+		if r.topic != "" && virtdev.MatchTopic(r.topic, topic) {
+			ids = append(ids, id)
+		}
+	}
+	e.mtx.Unlock()
+	for _, id := range ids {
+		e.enqueue(trigger{id, Event{Kind: "mqtt", Time: time.Now(), Topic: topic, Payload: string(payload)}})
+	}
+}
+
+func (e *Engine) checkSchedules(now time.Time) {
+	e.mtx.Lock()
+	var ids []string
+	for id, r := range e.rules {
+		if r.schedule != nil && r.schedule.matches(now) {
+			ids = append(ids, id)
+		}
+	}
+	e.mtx.Unlock()
+	for _, id := range ids {
+		e.execute(trigger{id, Event{Kind: "schedule", Time: now}})
+	}
+}
+
+func (e *Engine) enqueue(t trigger) {
+	select {
+	case e.queue <- t:
+	default:
+		log.Warningf("Trigger of rule %s lost, queue is full", t.ruleID)
+	}
+}
+
+// execute checks the condition and executes the actions of a rule.
+func (e *Engine) execute(t trigger) {
+	e.mtx.Lock()
+	r, ok := e.rules[t.ruleID]
+	st := e.statusOf(t.ruleID)
+	// rule disabled or suspended in the meantime?
+	if !ok || st.Suspended {
+		e.mtx.Unlock()
+		return
+	}
+	st.Triggered = time.Now()
+	e.mtx.Unlock()
+
+	// check condition
+	run, err := r.check(t.event)
+	if err != nil || !run {
+		e.setResult(t.ruleID, false, err)
+		return
+	}
+
+	// loop protection
+	e.mtx.Lock()
+	now := time.Now()
+	recent := r.runs[:0]
+	for _, ts := range r.runs {
+		if now.Sub(ts) < loopWindow {
+			recent = append(recent, ts)
+		}
+	}
+	r.runs = append(recent, now)
+	if len(r.runs) > loopMaxRuns {
+		st.Suspended = true
+		st.Error = "Loop detected, rule is suspended"
+		e.mtx.Unlock()
+		log.Errorf("Rule %s executed more than %d times within %v, rule is suspended", t.ruleID, loopMaxRuns, loopWindow)
+		return
+	}
+	e.mtx.Unlock()
+
+	log.Debugf("Executing rule %s (trigger: %s)", t.ruleID, t.event.Kind)
+	e.setResult(t.ruleID, true, e.writeActions(r, t.event))
+}
+
+func (e *Engine) setResult(id string, executed bool, err error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	st := e.statusOf(id)
+	if executed {
+		st.Executed = time.Now()
+		st.Executions++
+	}
+	if err != nil {
+		log.Warningf("Rule %s failed: %v", id, err)
+		st.Error = err.Error()
+	} else {
+		st.Error = ""
+	}
+}
+
+// writeActions writes the data points of the actions. Failed actions do not
+// abort the execution.
+func (e *Engine) writeActions(r *rule, ev Event) error {
+	var errs []string
+	for _, a := range r.actions {
+		var sb strings.Builder
+		if err := a.value.Execute(&sb, ev); err != nil {
+			errs = append(errs, fmt.Sprintf("Value for %s: %v", a.path, err))
+			continue
+		}
+		pv := veap.PV{Time: time.Now(), Value: parseValue(sb.String()), State: veap.StateGood}
+		if err := e.Service.WritePV(a.path, pv); err != nil {
+			errs = append(errs, fmt.Sprintf("Writing %s: %v", a.path, err))
+		}
+	}
+	if errs != nil {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// statusOf returns the status of a rule. e.mtx must be locked.
+func (e *Engine) statusOf(id string) *Status {
+	if e.status == nil {
+		e.status = make(map[string]*Status)
+	}
+	st, ok := e.status[id]
+	if !ok {
+		st = &Status{}
+		e.status[id] = st
+	}
+	return st
+}
+
+// templateFuncs returns the functions of the virtual devices and the function
+// pv, which reads the value of a data point.
+func (e *Engine) templateFuncs() template.FuncMap {
+	funcs := virtdev.TemplateFuncs()
+	funcs["pv"] = func(pvPath string) (interface{}, error) {
+		pv, err := e.Service.ReadPV(pvPath)
+		if err != nil {
+			return nil, err
+		}
+		return pv.Value, nil
+	}
+	return funcs
+}
+
+func compile(cfg *rtcfg.Rule, funcs template.FuncMap) (*rule, error) {
+	r := &rule{
+		pvPath: cfg.Trigger.PVPath,
+		topic:  cfg.Trigger.Topic,
+	}
+	if r.pvPath != "" {
+		if _, err := path.Match(r.pvPath, ""); err != nil {
+			return nil, fmt.Errorf("Invalid path pattern: %s", r.pvPath)
+		}
+	}
+	if cfg.Trigger.Schedule != "" {
+		var err error
+		r.schedule, err = parseSchedule(cfg.Trigger.Schedule)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.pvPath == "" && r.topic == "" && r.schedule == nil {
+		return nil, fmt.Errorf("No trigger specified")
+	}
+	if cfg.Condition != "" {
+		var err error
+		r.condition, err = template.New("condition").Funcs(funcs).Parse(cfg.Condition)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid condition: %v", err)
+		}
+	}
+	for idx, a := range cfg.Actions {
+		tmpl, err := template.New("action").Funcs(funcs).Parse(a.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value of action %d: %v", idx+1, err)
+		}
+		r.actions = append(r.actions, action{path: a.Path, value: tmpl})
+	}
+	return r, nil
+}
+
+// check evaluates the condition.
+func (r *rule) check(ev Event) (bool, error) {
+	if r.condition == nil {
+		return true, nil
+	}
+	var sb strings.Builder
+	if err := r.condition.Execute(&sb, ev); err != nil {
+		return false, fmt.Errorf("Condition failed: %v", err)
+	}
+	res := strings.TrimSpace(sb.String())
+	if res == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(res)
+	if err != nil {
+		return false, fmt.Errorf("Condition returned no boolean: %s", res)
+	}
+	return b, nil
+}
+
+// parseValue parses the result of a template as JSON. If this fails, the
+// result is taken as string.
+func parseValue(txt string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(txt)), &v); err != nil {
+		return txt
+	}
+	return v
+}
+
+func untilNextMinute(now time.Time) time.Duration {
+	return now.Truncate(time.Minute).Add(time.Minute).Sub(now)
+}
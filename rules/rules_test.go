@@ -0,0 +1,49 @@
+package rules
+
+import (
+	"testing"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+)
+
+func TestUpdateKeepsSuspension(t *testing.T) {
+	newCfgs := func(schedule, value string) map[string]*rtcfg.Rule {
+		return map[string]*rtcfg.Rule{
+			"r1": {
+				Identifier: "r1",
+				Enable:     true,
+				Trigger:    rtcfg.RuleTrigger{Schedule: schedule},
+				Actions:    []*rtcfg.RuleAction{{Path: "/sysvar/1", Value: value}},
+			},
+		}
+	}
+	e := &Engine{}
+	e.Update(newCfgs("* * * * *", "1"))
+
+	// the updates are applied in sequence
+	testCases := []struct {
+		suspend   bool
+		cfgs      map[string]*rtcfg.Rule
+		suspended bool
+		err       string
+	}{
+		// unchanged configuration
+		{true, newCfgs("* * * * *", "1"), true, ""},
+		// modified action
+		{false, newCfgs("* * * * *", "2"), false, ""},
+		{true, newCfgs("* * * * *", "2"), true, ""},
+		// invalid rule
+		{false, newCfgs("x", "2"), false, "Invalid cron expression (5 fields expected): x"},
+		{false, newCfgs("x", "2"), false, "Invalid cron expression (5 fields expected): x"},
+	}
+	for idx, tc := range testCases {
+		if tc.suspend {
+			e.statusOf("r1").Suspended = true
+		}
+		e.Update(tc.cfgs)
+		st := e.statusOf("r1")
+		if st.Suspended != tc.suspended || st.Error != tc.err {
+			t.Errorf("update %d: unexpected status: %+v", idx+1, st)
+		}
+	}
+}
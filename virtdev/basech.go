@@ -4,9 +4,20 @@ import (
 	"fmt"
 
 	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/go-hmccu/itf"
 	"github.com/mdzio/go-hmccu/itf/vdevices"
 )
 
+// addInstallTest adds the INSTALL_TEST parameter to a channel, which is not
+// created by package vdevices.
+func addInstallTest(ch vdevices.GenericChannel) {
+	p := vdevices.NewBoolParameter("INSTALL_TEST")
+	p.Description().Type = itf.ParameterTypeAction
+	p.Description().Operations = itf.ParameterOperationWrite
+	p.Description().Flags = itf.ParameterFlagVisible | itf.ParameterFlagInternal
+	ch.AddValueParam(p)
+}
+
 type baseChannel struct {
 	vdevices.GenericChannel
 	virtualDevices *VirtualDevices  // root of all virtual devices
@@ -72,3 +83,18 @@ func (c *baseChannel) storeMasterParamset() {
 		chcfg.MasterParamset[p.Description().ID] = p.Value()
 	}
 }
+
+// setUnreach sets the parameter UNREACH of the maintenance channel (index 0).
+func setUnreach(dev *vdevices.Device, unreach bool) {
+	gch, err := dev.Channel("0")
+	if err != nil {
+		log.Errorf("Maintenance channel (0) not found: %v", err)
+		return
+	}
+	mch, ok := gch.(*vdevices.MaintenanceChannel)
+	if !ok {
+		log.Errorf("Channel (0) is not a maintenance channel")
+		return
+	}
+	mch.SetUnreach(unreach)
+}
@@ -0,0 +1,271 @@
+package virtdev
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/mdzio/go-hmccu/itf/vdevices"
+	"github.com/mdzio/go-veap"
+)
+
+// VEAP path of the virtual devices
+const virtDevVeapPath = "/virtdev"
+
+// PVObserver receives the value changes of the data points (e.g. CCU devices,
+// system variables and virtual devices) and triggers the recalculation of the
+// computed channels, which depend on them. It implements mqtt.PVRecorder.
+type PVObserver struct {
+	mtx sync.RWMutex
+	// dependencies (PV paths) of the computed channels
+	deps map[*computedChannel]map[string]bool
+}
+
+// Record implements mqtt.PVRecorder.
+func (o *PVObserver) Record(pvPath string, pv veap.PV) {
+	o.mtx.RLock()
+	defer o.mtx.RUnlock()
+	for ch, deps := range o.deps {
+		if deps[pvPath] {
+			ch.trigger()
+		}
+	}
+}
+
+// observe sets the dependencies of a computed channel. nil removes the
+// channel. true is returned, if the channel depends on its own value through
+// other computed channels.
+func (o *PVObserver) observe(ch *computedChannel, deps map[string]bool) bool {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	if deps == nil {
+		delete(o.deps, ch)
+		return false
+	}
+	if o.deps == nil {
+		o.deps = make(map[*computedChannel]map[string]bool)
+	}
+	o.deps[ch] = deps
+	return o.cyclic(ch)
+}
+
+// cyclic checks whether a computed channel depends on its own value. o.mtx
+// must be locked.
+func (o *PVObserver) cyclic(start *computedChannel) bool {
+	// computed channels by the VEAP path of their value
+	chs := make(map[string]*computedChannel, len(o.deps))
+	for ch := range o.deps {
+		chs[ch.valuePath()] = ch
+	}
+	visited := make(map[*computedChannel]bool)
+	var visit func(ch *computedChannel) bool
+	visit = func(ch *computedChannel) bool {
+		for dep := range o.deps[ch] {
+			next, ok := chs[dep]
+			if !ok {
+				continue
+			}
+			if next == start {
+				return true
+			}
+			if !visited[next] {
+				visited[next] = true
+				if visit(next) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return visit(start)
+}
+
+// computedChannel calculates its value with a template. The template can read
+// data points with the functions pv (VEAP path) and param (address of a
+// virtual device parameter). The value is recalculated, when one of the read
+// data points changes. A channel, which depends on its own value through other
+// computed channels, is faulty (VOLTAGE_STATUS 1) and does not update its
+// value, so that the cycle stops.
+type computedChannel struct {
+	baseChannel
+	analogChannel *vdevices.AnalogInputChannel
+
+	paramExpression *vdevices.StringParameter
+
+	template *template.Template
+	// data points read during the current calculation
+	deps      map[string]bool
+	triggered chan struct{}
+	stopped   chan struct{}
+	done      chan struct{}
+}
+
+func (c *computedChannel) start() {
+	txt := c.paramExpression.Value().(string)
+	if txt == "" {
+		return
+	}
+	funcs := c.trackingFuncs()
+	tmpl, err := template.New("computed").Funcs(tmplFuncs).Funcs(funcs).Parse(txt)
+	if err != nil {
+		log.Errorf("Invalid template '%s' for computed channel %s:%d: %v", txt, c.Description().Parent,
+			c.Description().Index, err)
+		c.analogChannel.SetVoltageStatus(1)
+		return
+	}
+	c.template = tmpl
+	c.triggered = make(chan struct{}, 1)
+	c.stopped = make(chan struct{})
+	c.done = make(chan struct{})
+	go c.run()
+}
+
+func (c *computedChannel) stop() {
+	if c.done == nil {
+		return
+	}
+	close(c.stopped)
+	<-c.done
+	c.done = nil
+	if c.virtualDevices.PVObserver != nil {
+		c.virtualDevices.PVObserver.observe(c, nil)
+	}
+}
+
+// trigger requests a recalculation. Multiple requests are merged.
+func (c *computedChannel) trigger() {
+	select {
+	case c.triggered <- struct{}{}:
+	default:
+	}
+}
+
+func (c *computedChannel) run() {
+	defer close(c.done)
+	c.calculate()
+	for {
+		select {
+		case <-c.triggered:
+			c.calculate()
+		case <-c.stopped:
+			return
+		}
+	}
+}
+
+func (c *computedChannel) calculate() {
+	c.deps = make(map[string]bool)
+	var buf bytes.Buffer
+	err := c.template.Execute(&buf, nil)
+	// a change of the own value must not trigger a recalculation
+	delete(c.deps, c.valuePath())
+	if c.virtualDevices.PVObserver != nil && c.virtualDevices.PVObserver.observe(c, c.deps) {
+		log.Warningf("Computed channel %s:%d depends on its own value through other computed channels",
+			c.Description().Parent, c.Description().Index)
+		c.setStatus(1)
+		return
+	}
+	if err != nil {
+		log.Warningf("Calculation of computed channel %s:%d failed: %v", c.Description().Parent,
+			c.Description().Index, err)
+		c.setStatus(1)
+		return
+	}
+	sval := strings.TrimSpace(buf.String())
+	value, err := strconv.ParseFloat(sval, 64)
+	if err != nil {
+		log.Warningf("Template of computed channel %s:%d returned invalid number literal '%s'", c.Description().Parent,
+			c.Description().Index, sval)
+		c.setStatus(1)
+		return
+	}
+	// only changes are published to prevent endless recalculations of
+	// mutually dependent channels
+	if value != c.analogChannel.Voltage() {
+		c.analogChannel.SetVoltage(value)
+	}
+	c.setStatus(0)
+}
+
+func (c *computedChannel) setStatus(status int) {
+	if c.analogChannel.VoltageStatus() != status {
+		c.analogChannel.SetVoltageStatus(status)
+	}
+}
+
+// valuePath returns the VEAP path of the calculated value.
+func (c *computedChannel) valuePath() string {
+	return c.pvPath(c.Description().Parent, strconv.Itoa(c.Description().Index), "VOLTAGE")
+}
+
+// pvPath returns the VEAP path of a virtual device parameter.
+func (c *computedChannel) pvPath(device, channel, param string) string {
+	return virtDevVeapPath + "/" + device + "/" + channel + "/" + param
+}
+
+// trackingFuncs returns the functions of createSpecificFuncs and the function
+// pv. The functions param and pv record the read data points as dependencies.
+func (c *computedChannel) trackingFuncs() template.FuncMap {
+	funcs := createSpecificFuncs(c.virtualDevices.Devices, c.device, c)
+	param := funcs["param"].(func(string) (interface{}, error))
+	funcs["param"] = func(address string) (interface{}, error) {
+		// same address formats as createParamResolver
+		device := c.Description().Parent
+		channel := strconv.Itoa(c.Description().Index)
+		rest := address
+		if p := strings.IndexRune(rest, ':'); p != -1 {
+			device, rest = rest[:p], rest[p+1:]
+		}
+		if p := strings.IndexRune(rest, '.'); p != -1 {
+			channel, rest = rest[:p], rest[p+1:]
+		}
+		c.deps[c.pvPath(device, channel, rest)] = true
+		return param(address)
+	}
+	funcs["pv"] = func(pvPath string) (interface{}, error) {
+		c.deps[pvPath] = true
+		if c.virtualDevices.Service == nil {
+			return nil, fmt.Errorf("Reading of data points is not available")
+		}
+		pv, err := c.virtualDevices.Service.ReadPV(pvPath)
+		if err != nil {
+			return nil, err
+		}
+		return pv.Value, nil
+	}
+	return funcs
+}
+
+func (vd *VirtualDevices) addComputedChannel(dev *vdevices.Device) vdevices.GenericChannel {
+	ch := new(computedChannel)
+	ch.virtualDevices = vd
+	ch.device = dev
+
+	// inititalize baseChannel
+	ch.analogChannel = vdevices.NewAnalogInputChannel(dev)
+	ch.GenericChannel = ch.analogChannel
+
+	// EXPRESSION
+	ch.paramExpression = vdevices.NewStringParameter("EXPRESSION")
+	ch.AddMasterParam(ch.paramExpression)
+
+	// clean up
+	ch.analogChannel.OnDispose = ch.stop
+
+	// store master param on PutParamset, restart calculation
+	ch.MasterParamset().HandlePutParamset(func() {
+		ch.stop()
+		ch.storeMasterParamset()
+		ch.start()
+	})
+
+	// load master parameters from config
+	ch.loadMasterParamset()
+
+	// start calculation
+	ch.start()
+	return ch
+}
@@ -0,0 +1,50 @@
+package virtdev
+
+import (
+	"testing"
+
+	"github.com/mdzio/go-hmccu/itf/vdevices"
+)
+
+func TestPVObserverCycles(t *testing.T) {
+	dev := vdevices.NewDevice("JACK000001", "HmIP-MIO16-PCB", nil)
+	vdevices.NewMaintenanceChannel(dev)
+	chs := make([]*computedChannel, 4)
+	for i := range chs {
+		chs[i] = &computedChannel{analogChannel: vdevices.NewAnalogInputChannel(dev)}
+		chs[i].GenericChannel = chs[i].analogChannel
+	}
+	value := func(idx int) string { return chs[idx].valuePath() }
+	deps := func(paths ...string) map[string]bool {
+		m := make(map[string]bool)
+		for _, p := range paths {
+			m[p] = true
+		}
+		return m
+	}
+
+	var o PVObserver
+	testCases := []struct {
+		ch     int
+		deps   map[string]bool
+		cyclic bool
+	}{
+		// 1 depends on 2 and a CCU device
+		{1, deps(value(2), "/device/ABC/1/STATE"), false},
+		// 2 depends on 3
+		{2, deps(value(3)), false},
+		// 3 depends on 1: cycle 1 -> 2 -> 3 -> 1
+		{3, deps(value(1)), true},
+		{1, deps(value(2)), true},
+		// 3 no longer depends on 1
+		{3, deps("/sysvar/1234"), false},
+		{1, deps(value(2), value(3)), false},
+		// removed channel
+		{3, nil, false},
+	}
+	for i, tc := range testCases {
+		if got := o.observe(chs[tc.ch], tc.deps); got != tc.cyclic {
+			t.Errorf("case %d: expected cyclic %t, got %t", i, tc.cyclic, got)
+		}
+	}
+}
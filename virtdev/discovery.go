@@ -0,0 +1,622 @@
+package virtdev
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mdzio/ccu-jack/mqtt"
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/go-lib/any"
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-mqtt/service"
+)
+
+const (
+	// sources of discovered devices
+	SourceTasmota     = "tasmota"
+	SourceShelly      = "shelly"
+	SourceZigbee2MQTT = "zigbee2mqtt"
+
+	tasmotaDiscoveryTopic = "tasmota/discovery/+/config"
+	shellyAnnounceTopic   = "shellies/announce"
+	shellyCommandTopic    = "shellies/command"
+	zigbeeDevicesTopic    = "zigbee2mqtt/bridge/devices"
+	zigbeeBaseTopic       = "zigbee2mqtt"
+
+	// values of the enum master parameters
+	matcherContainsValue   = 1.0 // CONTAINS
+	extractorAllValue      = 3.0 // ALL
+	extractorTemplateValue = 4.0 // TEMPLATE
+)
+
+// DiscoveredDevice is a device, which announced itself on the MQTT server.
+type DiscoveredDevice struct {
+	// Identifier is unique across all sources.
+	Identifier string
+	// Source of the announcement (e.g. SourceTasmota)
+	Source string
+	Name   string
+	Model  string
+	// Template is the proposed definition of the virtual device. It is nil,
+	// if the device is not supported.
+	Template *rtcfg.DeviceTemplate
+}
+
+// Discovery collects the devices, which announce themselves on the discovery
+// topics of Tasmota, Shelly (Gen1) and Zigbee2MQTT.
+type Discovery struct {
+	// MQTT server must be set before calling Start.
+	MQTTServer *mqtt.Server
+
+	mtx     sync.RWMutex
+	devices map[string]*DiscoveredDevice
+
+	onTasmota service.OnPublishFunc
+	onShelly  service.OnPublishFunc
+	onZigbee  service.OnPublishFunc
+}
+
+// Start subscribes the discovery topics.
+func (d *Discovery) Start() {
+	log.Info("Starting device discovery")
+	d.devices = make(map[string]*DiscoveredDevice)
+	d.onTasmota = d.handleTasmota
+	d.onShelly = d.handleShelly
+	d.onZigbee = d.handleZigbee
+	for topic, onPublish := range d.subscriptions() {
+		if err := d.MQTTServer.Subscribe(topic, message.QosExactlyOnce, onPublish); err != nil {
+			log.Errorf("Subscribe failed on topic %s: %v", topic, err)
+		}
+	}
+	// Shelly devices do not retain their announcements
+	if err := d.MQTTServer.Publish(shellyCommandTopic, []byte("announce"), message.QosAtLeastOnce, false); err != nil {
+		log.Errorf("Requesting announcements of Shelly devices failed: %v", err)
+	}
+}
+
+// Stop unsubscribes the discovery topics.
+func (d *Discovery) Stop() {
+	log.Debug("Stopping device discovery")
+	for topic, onPublish := range d.subscriptions() {
+		d.MQTTServer.Unsubscribe(topic, onPublish)
+	}
+}
+
+func (d *Discovery) subscriptions() map[string]*service.OnPublishFunc {
+	return map[string]*service.OnPublishFunc{
+		tasmotaDiscoveryTopic: &d.onTasmota,
+		shellyAnnounceTopic:   &d.onShelly,
+		zigbeeDevicesTopic:    &d.onZigbee,
+	}
+}
+
+// Devices returns copies of the discovered devices sorted by identifier.
+func (d *Discovery) Devices() []DiscoveredDevice {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	devs := make([]DiscoveredDevice, 0, len(d.devices))
+	for _, dev := range d.devices {
+		devs = append(devs, *dev)
+	}
+	sort.Slice(devs, func(i, j int) bool { return devs[i].Identifier < devs[j].Identifier })
+	return devs
+}
+
+// Device returns a copy of a discovered device.
+func (d *Discovery) Device(id string) (DiscoveredDevice, bool) {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	dev, ok := d.devices[id]
+	if !ok {
+		return DiscoveredDevice{}, false
+	}
+	return *dev, true
+}
+
+// put adds or replaces a discovered device. d.mtx must be locked.
+func (d *Discovery) put(dev *DiscoveredDevice) {
+	if _, ok := d.devices[dev.Identifier]; !ok {
+		log.Infof("Device %s (%s) discovered: %s", dev.Identifier, dev.Model, dev.Name)
+	}
+	d.devices[dev.Identifier] = dev
+}
+
+func (d *Discovery) handleTasmota(msg *message.PublishMessage) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	// an empty payload removes the device
+	if len(msg.Payload()) == 0 {
+		mac := strings.Split(string(msg.Topic()), "/")[2]
+		delete(d.devices, "tasmota-"+mac)
+		return nil
+	}
+	dev, err := tasmotaDevice(msg.Payload())
+	if err != nil {
+		log.Warningf("Invalid Tasmota discovery message on topic %s: %v", msg.Topic(), err)
+		return nil
+	}
+	d.put(dev)
+	return nil
+}
+
+func (d *Discovery) handleShelly(msg *message.PublishMessage) error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	dev, err := shellyDevice(msg.Payload())
+	if err != nil {
+		log.Warningf("Invalid Shelly announcement: %v", err)
+		return nil
+	}
+	d.put(dev)
+	return nil
+}
+
+func (d *Discovery) handleZigbee(msg *message.PublishMessage) error {
+	devs, err := zigbeeDevices(msg.Payload())
+	if err != nil {
+		log.Warningf("Invalid Zigbee2MQTT device list: %v", err)
+		return nil
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	// the list contains all paired devices
+	found := make(map[string]bool)
+	for _, dev := range devs {
+		d.put(dev)
+		found[dev.Identifier] = true
+	}
+	for id, dev := range d.devices {
+		if dev.Source == SourceZigbee2MQTT && !found[id] {
+			delete(d.devices, id)
+		}
+	}
+	return nil
+}
+
+// tasmotaDevice decodes the discovery message of a Tasmota device. Only the
+// relays and lights (power outputs) are mapped to channels.
+func tasmotaDevice(payload []byte) (*DiscoveredDevice, error) {
+	var v interface{}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return nil, err
+	}
+	q := any.Q(v)
+	o := q.Map()
+	mac := o.Key("mac").String()
+	topic := o.Key("t").String()
+	hostname := o.TryKey("hn").String()
+	fullTopic := o.Key("ft").String()
+	prefixes := o.Key("tp").Slice()
+	name := o.TryKey("dn").String()
+	model := o.TryKey("md").String()
+	offline := o.TryKey("ofln").String()
+	online := o.TryKey("onln").String()
+	var relays []int
+	for idx, rq := range o.TryKey("rl").Slice() {
+		// 1: relay, 2: light
+		if t := rq.Float64(); t == 1 || t == 2 {
+			relays = append(relays, idx+1)
+		}
+	}
+	var states []string
+	for _, sq := range o.TryKey("state").Slice() {
+		states = append(states, sq.String())
+	}
+	if q.Err() != nil {
+		return nil, q.Err()
+	}
+	if len(prefixes) < 3 {
+		return nil, fmt.Errorf("Missing topic prefixes")
+	}
+	if name == "" {
+		name = topic
+	}
+	if offline == "" {
+		offline = "Offline"
+	}
+	if online == "" {
+		online = "Online"
+	}
+	offPayload, onPayload := "OFF", "ON"
+	if len(states) >= 2 {
+		offPayload, onPayload = states[0], states[1]
+	}
+	id := mac
+	if len(id) > 6 {
+		id = id[len(id)-6:]
+	}
+	// build topic from full topic
+	buildTopic := func(prefix int, suffix string) string {
+		r := strings.NewReplacer(
+			"%prefix%", prefixes[prefix].String(),
+			"%topic%", topic,
+			"%hostname%", hostname,
+			"%id%", id,
+		)
+		return strings.TrimSuffix(r.Replace(fullTopic), "/") + "/" + suffix
+	}
+
+	dev := &DiscoveredDevice{
+		Identifier: "tasmota-" + mac,
+		Source:     SourceTasmota,
+		Name:       name,
+		Model:      model,
+	}
+	if len(relays) == 0 {
+		return dev, nil
+	}
+	var chs []rtcfg.Channel
+	for _, r := range relays {
+		power := "POWER"
+		if len(relays) > 1 || r > 1 {
+			power = fmt.Sprintf("POWER%d", r)
+		}
+		chs = append(chs, rtcfg.Channel{
+			Kind: rtcfg.ChannelMQTTSwitchFeedback,
+			MasterParamset: map[string]interface{}{
+				"COMMAND_TOPIC":  buildTopic(0, power),
+				"ON_PAYLOAD":     onPayload,
+				"OFF_PAYLOAD":    offPayload,
+				"FEEDBACK_TOPIC": buildTopic(1, power),
+				"ON_PATTERN":     onPayload,
+				"OFF_PATTERN":    offPayload,
+			},
+		})
+	}
+	chs = append(chs, rtcfg.Channel{
+		Kind: rtcfg.ChannelMQTTUnreach,
+		MasterParamset: map[string]interface{}{
+			"TOPIC":         buildTopic(2, "LWT"),
+			"ERROR_PATTERN": offline,
+			"OK_PATTERN":    online,
+		},
+	})
+	dev.Template = discoveryTemplate(dev, chs)
+	return dev, nil
+}
+
+// shellyModel describes the channels of a Shelly (Gen1) model.
+type shellyModel struct {
+	relays     int
+	powerMeter bool
+	sensor     rtcfg.ChannelKind
+}
+
+// supported Shelly (Gen1) models, a sensor of kind ChannelKey means no sensor
+var shellyModels = map[string]shellyModel{
+	"SHSW-1":   {relays: 1},
+	"SHSW-PM":  {relays: 1, powerMeter: true},
+	"SHSW-21":  {relays: 2},
+	"SHSW-25":  {relays: 2, powerMeter: true},
+	"SHPLG-1":  {relays: 1, powerMeter: true},
+	"SHPLG-S":  {relays: 1, powerMeter: true},
+	"SHPLG-U1": {relays: 1, powerMeter: true},
+	"SHPLG2-1": {relays: 1, powerMeter: true},
+	"SHHT-1":   {sensor: rtcfg.ChannelMQTTTemperature},
+	"SHDW-1":   {sensor: rtcfg.ChannelMQTTDoorSensor},
+	"SHDW-2":   {sensor: rtcfg.ChannelMQTTDoorSensor},
+	"SHWT-1":   {sensor: rtcfg.ChannelMQTTWaterSensor},
+}
+
+// shellyDevice decodes the announcement of a Shelly (Gen1) device.
+func shellyDevice(payload []byte) (*DiscoveredDevice, error) {
+	var v interface{}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return nil, err
+	}
+	q := any.Q(v)
+	o := q.Map()
+	id := o.Key("id").String()
+	model := o.Key("model").String()
+	if q.Err() != nil {
+		return nil, q.Err()
+	}
+	dev := &DiscoveredDevice{
+		Identifier: id,
+		Source:     SourceShelly,
+		Name:       id,
+		Model:      model,
+	}
+	sm, ok := shellyModels[model]
+	if !ok {
+		return dev, nil
+	}
+	base := "shellies/" + id
+	var chs []rtcfg.Channel
+	for r := 0; r < sm.relays; r++ {
+		chs = append(chs, rtcfg.Channel{
+			Kind: rtcfg.ChannelMQTTSwitchFeedback,
+			MasterParamset: map[string]interface{}{
+				"COMMAND_TOPIC":  fmt.Sprintf("%s/relay/%d/command", base, r),
+				"ON_PAYLOAD":     "on",
+				"OFF_PAYLOAD":    "off",
+				"FEEDBACK_TOPIC": fmt.Sprintf("%s/relay/%d", base, r),
+				"ON_PATTERN":     "on",
+				"OFF_PATTERN":    "off",
+			},
+		})
+		if sm.powerMeter {
+			chs = append(chs, rtcfg.Channel{
+				Kind: rtcfg.ChannelMQTTPowerMeter,
+				MasterParamset: map[string]interface{}{
+					"POWER_TOPIC":     fmt.Sprintf("%s/relay/%d/power", base, r),
+					"POWER_EXTRACTOR": extractorAllValue,
+				},
+			})
+		}
+	}
+	switch sm.sensor {
+	case rtcfg.ChannelMQTTTemperature:
+		chs = append(chs, rtcfg.Channel{
+			Kind: rtcfg.ChannelMQTTTemperature,
+			MasterParamset: map[string]interface{}{
+				"TEMPERATURE_TOPIC":     base + "/sensor/temperature",
+				"TEMPERATURE_EXTRACTOR": extractorAllValue,
+				"HUMIDITY_TOPIC":        base + "/sensor/humidity",
+				"HUMIDITY_EXTRACTOR":    extractorAllValue,
+			},
+		})
+	case rtcfg.ChannelMQTTDoorSensor:
+		chs = append(chs, rtcfg.Channel{
+			Kind: rtcfg.ChannelMQTTDoorSensor,
+			MasterParamset: map[string]interface{}{
+				"TOPIC":          base + "/sensor/state",
+				"OPEN_PATTERN":   "open",
+				"CLOSED_PATTERN": "close",
+			},
+		})
+	case rtcfg.ChannelMQTTWaterSensor:
+		chs = append(chs, rtcfg.Channel{
+			Kind: rtcfg.ChannelMQTTWaterSensor,
+			MasterParamset: map[string]interface{}{
+				"TOPIC":       base + "/sensor/flood",
+				"WET_PATTERN": "true",
+				"DRY_PATTERN": "false",
+			},
+		})
+	}
+	chs = append(chs, rtcfg.Channel{
+		Kind: rtcfg.ChannelMQTTUnreach,
+		MasterParamset: map[string]interface{}{
+			"TOPIC":         base + "/online",
+			"ERROR_PATTERN": "false",
+			"OK_PATTERN":    "true",
+		},
+	})
+	dev.Template = discoveryTemplate(dev, chs)
+	return dev, nil
+}
+
+// zigbeeDevices decodes the device list of Zigbee2MQTT. The exposed features
+// of a device are mapped to channels.
+func zigbeeDevices(payload []byte) ([]*DiscoveredDevice, error) {
+	var v interface{}
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return nil, err
+	}
+	q := any.Q(v)
+	var devs []*DiscoveredDevice
+	for _, dq := range q.Slice() {
+		o := dq.Map()
+		if o.TryKey("type").String() == "Coordinator" {
+			continue
+		}
+		ieee := o.Key("ieee_address").String()
+		name := o.Key("friendly_name").String()
+		if q.Err() != nil {
+			return nil, q.Err()
+		}
+		dev := &DiscoveredDevice{
+			Identifier: "zigbee2mqtt-" + ieee,
+			Source:     SourceZigbee2MQTT,
+			Name:       name,
+		}
+		// devices without definition are not supported by Zigbee2MQTT
+		if dq := o.TryKey("definition"); dq.Unwrap() != nil {
+			def := dq.Map()
+			dev.Model = strings.TrimSpace(def.TryKey("vendor").String() + " " + def.TryKey("model").String())
+			chs := zigbeeChannels(zigbeeBaseTopic+"/"+name, def.TryKey("exposes").Slice())
+			if q.Err() != nil {
+				return nil, q.Err()
+			}
+			if len(chs) > 0 {
+				chs = append(chs, rtcfg.Channel{
+					Kind: rtcfg.ChannelMQTTUnreach,
+					MasterParamset: map[string]interface{}{
+						"TOPIC":         zigbeeBaseTopic + "/" + name + "/availability",
+						"ERROR_PATTERN": "offline",
+						"OK_PATTERN":    "online",
+						"MATCHER":       matcherContainsValue,
+					},
+				})
+				dev.Template = discoveryTemplate(dev, chs)
+			}
+		}
+		devs = append(devs, dev)
+	}
+	if q.Err() != nil {
+		return nil, q.Err()
+	}
+	return devs, nil
+}
+
+// zigbeeChannels maps the exposed features of a Zigbee2MQTT device to
+// channels. Errors are reported through the queries.
+func zigbeeChannels(base string, exposes []*any.Query) []rtcfg.Channel {
+	var chs []rtcfg.Channel
+	// master parameters of the channels, which combine several properties
+	var temperature, power, motion map[string]interface{}
+	var illumination string
+	jsonPattern := func(property string) string {
+		return fmt.Sprintf("{{ (parseJSON .).%s }}", property)
+	}
+	for _, eq := range exposes {
+		e := eq.Map()
+		typ := e.Key("type").String()
+		property := e.TryKey("property").String()
+		switch typ {
+		case "switch", "light":
+			var state, brightness *any.MapQuery
+			for _, fq := range e.TryKey("features").Slice() {
+				f := fq.Map()
+				switch f.TryKey("name").String() {
+				case "state":
+					state = f
+				case "brightness":
+					brightness = f
+				}
+			}
+			if state == nil {
+				continue
+			}
+			stateProp := state.Key("property").String()
+			valueOn := state.TryKey("value_on").String()
+			valueOff := state.TryKey("value_off").String()
+			if brightness != nil {
+				brightnessProp := brightness.Key("property").String()
+				max := 254.0
+				if brightness.Has("value_max") {
+					max = brightness.Key("value_max").Float64()
+				}
+				chs = append(chs, rtcfg.Channel{
+					Kind: rtcfg.ChannelMQTTDimmer,
+					MasterParamset: map[string]interface{}{
+						"COMMAND_TOPIC":  base + "/set",
+						"RANGE_MIN":      0.0,
+						"RANGE_MAX":      max,
+						"TEMPLATE":       fmt.Sprintf("{\"%s\":{{ round . }}}", brightnessProp),
+						"FEEDBACK_TOPIC": base,
+						"EXTRACTOR":      extractorTemplateValue,
+						"PATTERN": fmt.Sprintf("{{ $m := parseJSON . }}{{ if eq $m.%s \"%s\" }}0{{ else }}{{ $m.%s }}{{ end }}",
+							stateProp, valueOff, brightnessProp),
+					},
+				})
+				continue
+			}
+			chs = append(chs, rtcfg.Channel{
+				Kind: rtcfg.ChannelMQTTSwitchFeedback,
+				MasterParamset: map[string]interface{}{
+					"COMMAND_TOPIC":  base + "/set",
+					"ON_PAYLOAD":     fmt.Sprintf("{\"%s\":\"%s\"}", stateProp, valueOn),
+					"OFF_PAYLOAD":    fmt.Sprintf("{\"%s\":\"%s\"}", stateProp, valueOff),
+					"FEEDBACK_TOPIC": base,
+					"ON_PATTERN":     fmt.Sprintf("\"%s\":\"%s\"", stateProp, valueOn),
+					"OFF_PATTERN":    fmt.Sprintf("\"%s\":\"%s\"", stateProp, valueOff),
+					"MATCHER":        matcherContainsValue,
+				},
+			})
+		case "binary":
+			// binary features of the sensors are expected as JSON booleans
+			var kind rtcfg.ChannelKind
+			var onID, offID string
+			switch property {
+			case "contact":
+				// contact true means closed
+				kind, onID, offID = rtcfg.ChannelMQTTDoorSensor, "CLOSED_PATTERN", "OPEN_PATTERN"
+			case "water_leak":
+				kind, onID, offID = rtcfg.ChannelMQTTWaterSensor, "WET_PATTERN", "DRY_PATTERN"
+			case "smoke":
+				kind, onID, offID = rtcfg.ChannelMQTTSmokeDetector, "ALARM_PATTERN", "IDLE_PATTERN"
+			case "occupancy":
+				kind, onID, offID = rtcfg.ChannelMQTTMotionDetector, "MOTION_PATTERN", "NO_MOTION_PATTERN"
+			default:
+				continue
+			}
+			chs = append(chs, rtcfg.Channel{
+				Kind: kind,
+				MasterParamset: map[string]interface{}{
+					"TOPIC":   base,
+					onID:      fmt.Sprintf("\"%s\":true", property),
+					offID:     fmt.Sprintf("\"%s\":false", property),
+					"MATCHER": matcherContainsValue,
+				},
+			})
+			if kind == rtcfg.ChannelMQTTMotionDetector {
+				motion = chs[len(chs)-1].MasterParamset
+			}
+		case "numeric":
+			var target *map[string]interface{}
+			var kind rtcfg.ChannelKind
+			var param string
+			switch property {
+			case "temperature", "humidity":
+				target, kind, param = &temperature, rtcfg.ChannelMQTTTemperature, strings.ToUpper(property)
+			case "power", "current", "voltage":
+				target, kind, param = &power, rtcfg.ChannelMQTTPowerMeter, strings.ToUpper(property)
+			case "energy":
+				target, kind, param = &power, rtcfg.ChannelMQTTPowerMeter, "ENERGY_COUNTER"
+			case "illuminance_lux", "illuminance":
+				// added to a motion detector later on, lux is preferred
+				if illumination == "" || property == "illuminance_lux" {
+					illumination = property
+				}
+				continue
+			default:
+				continue
+			}
+			if *target == nil {
+				*target = make(map[string]interface{})
+				// power meter is added later on
+				if kind != rtcfg.ChannelMQTTPowerMeter {
+					chs = append(chs, rtcfg.Channel{Kind: kind, MasterParamset: *target})
+				}
+			}
+			(*target)[param+"_TOPIC"] = base
+			(*target)[param+"_EXTRACTOR"] = extractorTemplateValue
+			(*target)[param+"_PATTERN"] = jsonPattern(property)
+		}
+	}
+	// without power, voltage and current are e.g. battery values of sensors
+	if _, ok := power["POWER_TOPIC"]; ok {
+		chs = append(chs, rtcfg.Channel{Kind: rtcfg.ChannelMQTTPowerMeter, MasterParamset: power})
+	}
+	if motion != nil && illumination != "" {
+		motion["ILLUMINATION_TOPIC"] = base
+		motion["ILLUMINATION_EXTRACTOR"] = extractorTemplateValue
+		motion["ILLUMINATION_PATTERN"] = jsonPattern(illumination)
+	}
+	return chs
+}
+
+// discoveryTemplate creates the device template for a discovered device. The
+// HM type is derived from the channels.
+func discoveryTemplate(dev *DiscoveredDevice, chs []rtcfg.Channel) *rtcfg.DeviceTemplate {
+	kinds := make(map[rtcfg.ChannelKind]int)
+	for _, ch := range chs {
+		kinds[ch.Kind]++
+	}
+	var hmType string
+	switch {
+	case kinds[rtcfg.ChannelMQTTPowerMeter] > 0 && kinds[rtcfg.ChannelMQTTSwitchFeedback] == 1:
+		hmType = "HM-ES-PMSw1-Pl"
+	case kinds[rtcfg.ChannelMQTTSwitchFeedback] == 1:
+		hmType = "HM-LC-Sw1-FM"
+	case kinds[rtcfg.ChannelMQTTSwitchFeedback] == 2:
+		hmType = "HM-LC-Sw2-FM"
+	case kinds[rtcfg.ChannelMQTTSwitchFeedback] > 2:
+		hmType = "HM-LC-Sw4-DR"
+	case kinds[rtcfg.ChannelMQTTDimmer] > 0:
+		hmType = "HM-LC-Dim1T-FM"
+	case kinds[rtcfg.ChannelMQTTMotionDetector] > 0:
+		hmType = "HmIP-SMI"
+	case kinds[rtcfg.ChannelMQTTSmokeDetector] > 0:
+		hmType = "HM-Sec-SD-2"
+	case kinds[rtcfg.ChannelMQTTWaterSensor] > 0:
+		hmType = "HM-Sec-WDS-2"
+	case kinds[rtcfg.ChannelMQTTDoorSensor] > 0:
+		hmType = "HM-Sec-SC-2"
+	case kinds[rtcfg.ChannelMQTTTemperature] > 0:
+		hmType = "HmIP-STHO"
+	default:
+		hmType = "HmIP-MIO16-PCB"
+	}
+	return &rtcfg.DeviceTemplate{
+		Identifier:  dev.Identifier,
+		Description: fmt.Sprintf("%s (%s): %s", dev.Model, dev.Source, dev.Name),
+		HMType:      hmType,
+		Channels:    chs,
+	}
+}
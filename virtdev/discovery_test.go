@@ -0,0 +1,474 @@
+package virtdev
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+)
+
+// discoveryResult is the expected result of a device announcement.
+type discoveryResult struct {
+	id, name, model string
+	// empty, if the device is not supported
+	hmType   string
+	channels []rtcfg.Channel
+}
+
+func checkDiscovered(t *testing.T, desc string, dev *DiscoveredDevice, exp discoveryResult) {
+	if dev.Identifier != exp.id || dev.Name != exp.name || dev.Model != exp.model {
+		t.Errorf("%s: unexpected device %s, %s, %s", desc, dev.Identifier, dev.Name, dev.Model)
+	}
+	if exp.hmType == "" {
+		if dev.Template != nil {
+			t.Errorf("%s: unexpected template %+v", desc, dev.Template)
+		}
+		return
+	}
+	if dev.Template == nil {
+		t.Errorf("%s: template expected", desc)
+		return
+	}
+	if dev.Template.Identifier != exp.id || dev.Template.HMType != exp.hmType {
+		t.Errorf("%s: unexpected template %s, %s", desc, dev.Template.Identifier, dev.Template.HMType)
+	}
+	if !reflect.DeepEqual(dev.Template.Channels, exp.channels) {
+		t.Errorf("%s: unexpected channels:\n%+v\nexpected:\n%+v", desc, dev.Template.Channels, exp.channels)
+	}
+}
+
+func tasmotaSwitch(cmd, stat, on, off string) rtcfg.Channel {
+	return rtcfg.Channel{
+		Kind: rtcfg.ChannelMQTTSwitchFeedback,
+		MasterParamset: map[string]interface{}{
+			"COMMAND_TOPIC":  cmd,
+			"ON_PAYLOAD":     on,
+			"OFF_PAYLOAD":    off,
+			"FEEDBACK_TOPIC": stat,
+			"ON_PATTERN":     on,
+			"OFF_PATTERN":    off,
+		},
+	}
+}
+
+func unreachChannel(topic, errPattern, okPattern string) rtcfg.Channel {
+	return rtcfg.Channel{
+		Kind: rtcfg.ChannelMQTTUnreach,
+		MasterParamset: map[string]interface{}{
+			"TOPIC":         topic,
+			"ERROR_PATTERN": errPattern,
+			"OK_PATTERN":    okPattern,
+		},
+	}
+}
+
+func TestTasmotaDevice(t *testing.T) {
+	testCases := []struct {
+		payload string
+		result  discoveryResult
+		err     string
+	}{
+		// Sonoff Basic
+		{
+			`{"ip":"192.168.1.100","dn":"Kitchen light","fn":["Tasmota",null,null,null,null,null,null,null],` +
+				`"hn":"tasmota-ABCDEF-1234","mac":"A4CF12ABCDEF","md":"Sonoff Basic","ty":0,"if":0,` +
+				`"ofln":"Offline","onln":"Online","state":["OFF","ON","TOGGLE","HOLD"],"sw":"12.1.1",` +
+				`"t":"tasmota_ABCDEF","ft":"%prefix%/%topic%/","tp":["cmnd","stat","tele"],` +
+				`"rl":[1,0,0,0,0,0,0,0],"swc":[-1,-1,-1,-1,-1,-1,-1,-1],"swn":[null,null,null,null,null,null,null,null],` +
+				`"btn":[0,0,0,0,0,0,0,0],"so":{"4":0,"11":0,"13":0,"17":0,"20":0,"30":0,"68":0,"73":0,"82":0,"114":0,"117":0},` +
+				`"lk":0,"lt_st":0,"sho":[0,0,0,0],"sht":[[0,0,0],[0,0,0],[0,0,0],[0,0,0]],"ver":1}`,
+			discoveryResult{"tasmota-A4CF12ABCDEF", "Kitchen light", "Sonoff Basic", "HM-LC-Sw1-FM", []rtcfg.Channel{
+				tasmotaSwitch("cmnd/tasmota_ABCDEF/POWER", "stat/tasmota_ABCDEF/POWER", "ON", "OFF"),
+				unreachChannel("tele/tasmota_ABCDEF/LWT", "Offline", "Online"),
+			}},
+			"",
+		},
+		// Sonoff Dual R2 with custom full topic and state texts, no device name
+		{
+			`{"ip":"192.168.1.101","dn":"","hn":"dual","mac":"DC4F22123456","md":"Sonoff Dual R2",` +
+				`"ofln":"Off","onln":"On","state":["aus","an","um","halten"],"t":"dual",` +
+				`"ft":"%topic%/%prefix%/","tp":["cmnd","stat","tele"],"rl":[1,2,0,0,0,0,0,0],"ver":1}`,
+			discoveryResult{"tasmota-DC4F22123456", "dual", "Sonoff Dual R2", "HM-LC-Sw2-FM", []rtcfg.Channel{
+				tasmotaSwitch("dual/cmnd/POWER1", "dual/stat/POWER1", "an", "aus"),
+				tasmotaSwitch("dual/cmnd/POWER2", "dual/stat/POWER2", "an", "aus"),
+				unreachChannel("dual/tele/LWT", "Off", "On"),
+			}},
+			"",
+		},
+		// second relay only, placeholders %hostname% and %id%
+		{
+			`{"dn":"Relay","hn":"relay-host","mac":"DC4F22654321","md":"Generic","t":"relay",` +
+				`"ft":"home/%hostname%/%id%/%prefix%/","tp":["cmnd","stat","tele"],"rl":[0,1,0,0,0,0,0,0]}`,
+			discoveryResult{"tasmota-DC4F22654321", "Relay", "Generic", "HM-LC-Sw1-FM", []rtcfg.Channel{
+				tasmotaSwitch("home/relay-host/654321/cmnd/POWER2", "home/relay-host/654321/stat/POWER2", "ON", "OFF"),
+				unreachChannel("home/relay-host/654321/tele/LWT", "Offline", "Online"),
+			}},
+			"",
+		},
+		// sensor without relays is not supported
+		{
+			`{"dn":"Sensor","hn":"sensor","mac":"DC4F22000001","md":"Generic","t":"sensor",` +
+				`"ft":"%prefix%/%topic%/","tp":["cmnd","stat","tele"],"rl":[0,0,0,0,0,0,0,0]}`,
+			discoveryResult{"tasmota-DC4F22000001", "Sensor", "Generic", "", nil},
+			"",
+		},
+		{`{"mac":"DC4F22000001","t":"x","ft":"%prefix%/%topic%/","tp":["cmnd"]}`, discoveryResult{}, "Missing topic prefixes"},
+		{`{"mac":"DC4F22000001","t":"x","tp":["cmnd","stat","tele"]}`, discoveryResult{}, "field not found: ft"},
+		{`{"mac":`, discoveryResult{}, "unexpected end of JSON input"},
+	}
+	for idx, tc := range testCases {
+		dev, err := tasmotaDevice([]byte(tc.payload))
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("test case %d: expected error %s, got %v", idx+1, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test case %d: unexpected error: %v", idx+1, err)
+			continue
+		}
+		checkDiscovered(t, "Tasmota device "+dev.Identifier, dev, tc.result)
+	}
+}
+
+func shellySwitch(base string, relay string) rtcfg.Channel {
+	return rtcfg.Channel{
+		Kind: rtcfg.ChannelMQTTSwitchFeedback,
+		MasterParamset: map[string]interface{}{
+			"COMMAND_TOPIC":  base + "/relay/" + relay + "/command",
+			"ON_PAYLOAD":     "on",
+			"OFF_PAYLOAD":    "off",
+			"FEEDBACK_TOPIC": base + "/relay/" + relay,
+			"ON_PATTERN":     "on",
+			"OFF_PATTERN":    "off",
+		},
+	}
+}
+
+func shellyPower(base string, relay string) rtcfg.Channel {
+	return rtcfg.Channel{
+		Kind: rtcfg.ChannelMQTTPowerMeter,
+		MasterParamset: map[string]interface{}{
+			"POWER_TOPIC":     base + "/relay/" + relay + "/power",
+			"POWER_EXTRACTOR": extractorAllValue,
+		},
+	}
+}
+
+func TestShellyDevice(t *testing.T) {
+	testCases := []struct {
+		payload string
+		result  discoveryResult
+		err     string
+	}{
+		{
+			`{"id":"shelly1-98CDAC1F0A2B","model":"SHSW-1","mac":"98CDAC1F0A2B","ip":"192.168.1.50",` +
+				`"new_fw":false,"fw_ver":"20230913-112003/v1.14.0-gcb84623"}`,
+			discoveryResult{"shelly1-98CDAC1F0A2B", "shelly1-98CDAC1F0A2B", "SHSW-1", "HM-LC-Sw1-FM", []rtcfg.Channel{
+				shellySwitch("shellies/shelly1-98CDAC1F0A2B", "0"),
+				unreachChannel("shellies/shelly1-98CDAC1F0A2B/online", "false", "true"),
+			}},
+			"",
+		},
+		{
+			`{"id":"shellyplug-s-C8C9A3B1D2E3","model":"SHPLG-S","mac":"C8C9A3B1D2E3","ip":"192.168.1.51",` +
+				`"new_fw":false,"fw_ver":"20230913-113610/v1.14.0-gcb84623"}`,
+			discoveryResult{"shellyplug-s-C8C9A3B1D2E3", "shellyplug-s-C8C9A3B1D2E3", "SHPLG-S", "HM-ES-PMSw1-Pl", []rtcfg.Channel{
+				shellySwitch("shellies/shellyplug-s-C8C9A3B1D2E3", "0"),
+				shellyPower("shellies/shellyplug-s-C8C9A3B1D2E3", "0"),
+				unreachChannel("shellies/shellyplug-s-C8C9A3B1D2E3/online", "false", "true"),
+			}},
+			"",
+		},
+		{
+			`{"id":"shellyswitch25-40F5200A1B2C","model":"SHSW-25","mac":"40F5200A1B2C","ip":"192.168.1.52",` +
+				`"new_fw":false,"fw_ver":"20230913-112234/v1.14.0-gcb84623","mode":"relay"}`,
+			discoveryResult{"shellyswitch25-40F5200A1B2C", "shellyswitch25-40F5200A1B2C", "SHSW-25", "HM-LC-Sw2-FM", []rtcfg.Channel{
+				shellySwitch("shellies/shellyswitch25-40F5200A1B2C", "0"),
+				shellyPower("shellies/shellyswitch25-40F5200A1B2C", "0"),
+				shellySwitch("shellies/shellyswitch25-40F5200A1B2C", "1"),
+				shellyPower("shellies/shellyswitch25-40F5200A1B2C", "1"),
+				unreachChannel("shellies/shellyswitch25-40F5200A1B2C/online", "false", "true"),
+			}},
+			"",
+		},
+		{
+			`{"id":"shellyht-A1B2C3","model":"SHHT-1","mac":"C45BBEA1B2C3","ip":"192.168.1.53",` +
+				`"new_fw":false,"fw_ver":"20230913-112531/v1.14.0-gcb84623"}`,
+			discoveryResult{"shellyht-A1B2C3", "shellyht-A1B2C3", "SHHT-1", "HmIP-STHO", []rtcfg.Channel{
+				{
+					Kind: rtcfg.ChannelMQTTTemperature,
+					MasterParamset: map[string]interface{}{
+						"TEMPERATURE_TOPIC":     "shellies/shellyht-A1B2C3/sensor/temperature",
+						"TEMPERATURE_EXTRACTOR": extractorAllValue,
+						"HUMIDITY_TOPIC":        "shellies/shellyht-A1B2C3/sensor/humidity",
+						"HUMIDITY_EXTRACTOR":    extractorAllValue,
+					},
+				},
+				unreachChannel("shellies/shellyht-A1B2C3/online", "false", "true"),
+			}},
+			"",
+		},
+		{
+			`{"id":"shellydw2-D4E5F6","model":"SHDW-2","mac":"C45BBED4E5F6","ip":"192.168.1.54",` +
+				`"new_fw":false,"fw_ver":"20230913-112616/v1.14.0-gcb84623"}`,
+			discoveryResult{"shellydw2-D4E5F6", "shellydw2-D4E5F6", "SHDW-2", "HM-Sec-SC-2", []rtcfg.Channel{
+				{
+					Kind: rtcfg.ChannelMQTTDoorSensor,
+					MasterParamset: map[string]interface{}{
+						"TOPIC":          "shellies/shellydw2-D4E5F6/sensor/state",
+						"OPEN_PATTERN":   "open",
+						"CLOSED_PATTERN": "close",
+					},
+				},
+				unreachChannel("shellies/shellydw2-D4E5F6/online", "false", "true"),
+			}},
+			"",
+		},
+		// unsupported model
+		{
+			`{"id":"shellyrgbw2-A1B2C3","model":"SHRGBW2","mac":"C45BBEA1B2C3","ip":"192.168.1.55",` +
+				`"new_fw":false,"fw_ver":"20230913-114150/v1.14.0-gcb84623","mode":"color"}`,
+			discoveryResult{"shellyrgbw2-A1B2C3", "shellyrgbw2-A1B2C3", "SHRGBW2", "", nil},
+			"",
+		},
+		{`{"model":"SHSW-1"}`, discoveryResult{}, "field not found: id"},
+		{`announce`, discoveryResult{}, "invalid character 'a' looking for beginning of value"},
+	}
+	for idx, tc := range testCases {
+		dev, err := shellyDevice([]byte(tc.payload))
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("test case %d: expected error %s, got %v", idx+1, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test case %d: unexpected error: %v", idx+1, err)
+			continue
+		}
+		checkDiscovered(t, "Shelly device "+dev.Identifier, dev, tc.result)
+	}
+}
+
+func zigbeeUnreach(name string) rtcfg.Channel {
+	return rtcfg.Channel{
+		Kind: rtcfg.ChannelMQTTUnreach,
+		MasterParamset: map[string]interface{}{
+			"TOPIC":         "zigbee2mqtt/" + name + "/availability",
+			"ERROR_PATTERN": "offline",
+			"OK_PATTERN":    "online",
+			"MATCHER":       matcherContainsValue,
+		},
+	}
+}
+
+func TestZigbeeDevices(t *testing.T) {
+	// device list of Zigbee2MQTT (shortened)
+	payload := `[
+{"ieee_address":"0x00124b0022aabbcc","type":"Coordinator","network_address":0,"supported":false,
+ "friendly_name":"Coordinator","disabled":false,"definition":null,"interview_completed":true},
+{"ieee_address":"0xa4c1380123456789","type":"Router","network_address":12345,"supported":true,
+ "friendly_name":"plug_tv","disabled":false,"interview_completed":true,
+ "definition":{"model":"TS011F_plug_1","vendor":"TuYa","description":"Smart plug (with power monitoring)",
+  "exposes":[
+   {"type":"switch","features":[{"access":7,"description":"On/off state of the switch","name":"state",
+    "property":"state","type":"binary","value_off":"OFF","value_on":"ON","value_toggle":"TOGGLE"}]},
+   {"access":5,"description":"Instantaneous measured power","name":"power","property":"power","type":"numeric","unit":"W"},
+   {"access":5,"description":"Instantaneous measured electrical current","name":"current","property":"current","type":"numeric","unit":"A"},
+   {"access":5,"description":"Measured electrical potential value","name":"voltage","property":"voltage","type":"numeric","unit":"V"},
+   {"access":1,"description":"Sum of consumed energy","name":"energy","property":"energy","type":"numeric","unit":"kWh"},
+   {"access":3,"description":"Recover state after power outage","name":"power_outage_memory",
+    "property":"power_outage_memory","type":"enum","values":["on","off","restore"]},
+   {"access":1,"description":"Link quality (signal strength)","name":"linkquality","property":"linkquality",
+    "type":"numeric","unit":"lqi","value_max":255,"value_min":0}]}},
+{"ieee_address":"0x000d6ffffe123456","type":"Router","network_address":23456,"supported":true,
+ "friendly_name":"living/lamp","disabled":false,"interview_completed":true,
+ "definition":{"model":"LED1545G12","vendor":"IKEA","description":"TRADFRI bulb E27, white spectrum, globe, opal, 980 lm",
+  "exposes":[
+   {"type":"light","features":[
+    {"access":7,"description":"On/off state of this light","name":"state","property":"state","type":"binary",
+     "value_off":"OFF","value_on":"ON","value_toggle":"TOGGLE"},
+    {"access":7,"description":"Brightness of this light","name":"brightness","property":"brightness",
+     "type":"numeric","value_max":254,"value_min":0},
+    {"access":7,"description":"Color temperature of this light","name":"color_temp","property":"color_temp",
+     "type":"numeric","unit":"mired","value_max":454,"value_min":250}]},
+   {"access":1,"description":"Link quality (signal strength)","name":"linkquality","property":"linkquality",
+    "type":"numeric","unit":"lqi","value_max":255,"value_min":0}]}},
+{"ieee_address":"0x00158d0001a2b3c4","type":"EndDevice","network_address":34567,"supported":true,
+ "friendly_name":"door_kitchen","disabled":false,"interview_completed":true,
+ "definition":{"model":"MCCGQ11LM","vendor":"Aqara","description":"Door and window sensor",
+  "exposes":[
+   {"access":1,"description":"Remaining battery in %","name":"battery","property":"battery","type":"numeric",
+    "unit":"%","value_max":100,"value_min":0},
+   {"access":1,"description":"Voltage of the battery in millivolts","name":"voltage","property":"voltage",
+    "type":"numeric","unit":"mV"},
+   {"access":1,"description":"Indicates if the contact is closed (= true) or open (= false)","name":"contact",
+    "property":"contact","type":"binary","value_off":true,"value_on":false},
+   {"access":1,"description":"Link quality (signal strength)","name":"linkquality","property":"linkquality",
+    "type":"numeric","unit":"lqi","value_max":255,"value_min":0}]}},
+{"ieee_address":"0x00158d0002b3c4d5","type":"EndDevice","network_address":45678,"supported":true,
+ "friendly_name":"motion_hall","disabled":false,"interview_completed":true,
+ "definition":{"model":"RTCGQ11LM","vendor":"Aqara","description":"Motion sensor",
+  "exposes":[
+   {"access":1,"description":"Remaining battery in %","name":"battery","property":"battery","type":"numeric",
+    "unit":"%","value_max":100,"value_min":0},
+   {"access":1,"description":"Voltage of the battery in millivolts","name":"voltage","property":"voltage",
+    "type":"numeric","unit":"mV"},
+   {"access":1,"description":"Indicates whether the device detected occupancy","name":"occupancy",
+    "property":"occupancy","type":"binary","value_off":false,"value_on":true},
+   {"access":1,"description":"Measured illuminance in lux","name":"illuminance","property":"illuminance",
+    "type":"numeric","unit":"lx"},
+   {"access":1,"description":"Measured illuminance in lux","name":"illuminance_lux","property":"illuminance_lux",
+    "type":"numeric","unit":"lx"},
+   {"access":1,"description":"Link quality (signal strength)","name":"linkquality","property":"linkquality",
+    "type":"numeric","unit":"lqi","value_max":255,"value_min":0}]}},
+{"ieee_address":"0x00158d0003c4d5e6","type":"EndDevice","network_address":56789,"supported":true,
+ "friendly_name":"climate_bath","disabled":false,"interview_completed":true,
+ "definition":{"model":"WSDCGQ11LM","vendor":"Aqara","description":"Temperature, humidity and pressure sensor",
+  "exposes":[
+   {"access":1,"description":"Remaining battery in %","name":"battery","property":"battery","type":"numeric",
+    "unit":"%","value_max":100,"value_min":0},
+   {"access":1,"description":"Measured temperature value","name":"temperature","property":"temperature",
+    "type":"numeric","unit":"°C"},
+   {"access":1,"description":"Measured relative humidity","name":"humidity","property":"humidity",
+    "type":"numeric","unit":"%"},
+   {"access":1,"description":"The measured atmospheric pressure","name":"pressure","property":"pressure",
+    "type":"numeric","unit":"hPa"},
+   {"access":1,"description":"Voltage of the battery in millivolts","name":"voltage","property":"voltage",
+    "type":"numeric","unit":"mV"}]}},
+{"ieee_address":"0x00158d0004d5e6f7","type":"EndDevice","network_address":61234,"supported":true,
+ "friendly_name":"remote","disabled":false,"interview_completed":true,
+ "definition":{"model":"WXKG01LM","vendor":"Aqara","description":"Wireless mini switch",
+  "exposes":[
+   {"access":1,"description":"Triggered action (e.g. a button click)","name":"action","property":"action",
+    "type":"enum","values":["single","double","triple","quadruple","hold","release","many"]},
+   {"access":1,"description":"Voltage of the battery in millivolts","name":"voltage","property":"voltage",
+    "type":"numeric","unit":"mV"}]}},
+{"ieee_address":"0x0017880100aabbcc","type":"EndDevice","network_address":65000,"supported":false,
+ "friendly_name":"0x0017880100aabbcc","disabled":false,"definition":null,"interview_completed":false}
+]`
+	testCases := []discoveryResult{
+		{"zigbee2mqtt-0xa4c1380123456789", "plug_tv", "TuYa TS011F_plug_1", "HM-ES-PMSw1-Pl", []rtcfg.Channel{
+			{
+				Kind: rtcfg.ChannelMQTTSwitchFeedback,
+				MasterParamset: map[string]interface{}{
+					"COMMAND_TOPIC":  "zigbee2mqtt/plug_tv/set",
+					"ON_PAYLOAD":     `{"state":"ON"}`,
+					"OFF_PAYLOAD":    `{"state":"OFF"}`,
+					"FEEDBACK_TOPIC": "zigbee2mqtt/plug_tv",
+					"ON_PATTERN":     `"state":"ON"`,
+					"OFF_PATTERN":    `"state":"OFF"`,
+					"MATCHER":        matcherContainsValue,
+				},
+			},
+			{
+				Kind: rtcfg.ChannelMQTTPowerMeter,
+				MasterParamset: map[string]interface{}{
+					"POWER_TOPIC":              "zigbee2mqtt/plug_tv",
+					"POWER_EXTRACTOR":          extractorTemplateValue,
+					"POWER_PATTERN":            "{{ (parseJSON .).power }}",
+					"CURRENT_TOPIC":            "zigbee2mqtt/plug_tv",
+					"CURRENT_EXTRACTOR":        extractorTemplateValue,
+					"CURRENT_PATTERN":          "{{ (parseJSON .).current }}",
+					"VOLTAGE_TOPIC":            "zigbee2mqtt/plug_tv",
+					"VOLTAGE_EXTRACTOR":        extractorTemplateValue,
+					"VOLTAGE_PATTERN":          "{{ (parseJSON .).voltage }}",
+					"ENERGY_COUNTER_TOPIC":     "zigbee2mqtt/plug_tv",
+					"ENERGY_COUNTER_EXTRACTOR": extractorTemplateValue,
+					"ENERGY_COUNTER_PATTERN":   "{{ (parseJSON .).energy }}",
+				},
+			},
+			zigbeeUnreach("plug_tv"),
+		}},
+		{"zigbee2mqtt-0x000d6ffffe123456", "living/lamp", "IKEA LED1545G12", "HM-LC-Dim1T-FM", []rtcfg.Channel{
+			{
+				Kind: rtcfg.ChannelMQTTDimmer,
+				MasterParamset: map[string]interface{}{
+					"COMMAND_TOPIC":  "zigbee2mqtt/living/lamp/set",
+					"RANGE_MIN":      0.0,
+					"RANGE_MAX":      254.0,
+					"TEMPLATE":       `{"brightness":{{ round . }}}`,
+					"FEEDBACK_TOPIC": "zigbee2mqtt/living/lamp",
+					"EXTRACTOR":      extractorTemplateValue,
+					"PATTERN":        `{{ $m := parseJSON . }}{{ if eq $m.state "OFF" }}0{{ else }}{{ $m.brightness }}{{ end }}`,
+				},
+			},
+			zigbeeUnreach("living/lamp"),
+		}},
+		// battery voltage does not create a power meter
+		{"zigbee2mqtt-0x00158d0001a2b3c4", "door_kitchen", "Aqara MCCGQ11LM", "HM-Sec-SC-2", []rtcfg.Channel{
+			{
+				Kind: rtcfg.ChannelMQTTDoorSensor,
+				MasterParamset: map[string]interface{}{
+					"TOPIC":          "zigbee2mqtt/door_kitchen",
+					"CLOSED_PATTERN": `"contact":true`,
+					"OPEN_PATTERN":   `"contact":false`,
+					"MATCHER":        matcherContainsValue,
+				},
+			},
+			zigbeeUnreach("door_kitchen"),
+		}},
+		{"zigbee2mqtt-0x00158d0002b3c4d5", "motion_hall", "Aqara RTCGQ11LM", "HmIP-SMI", []rtcfg.Channel{
+			{
+				Kind: rtcfg.ChannelMQTTMotionDetector,
+				MasterParamset: map[string]interface{}{
+					"TOPIC":                  "zigbee2mqtt/motion_hall",
+					"MOTION_PATTERN":         `"occupancy":true`,
+					"NO_MOTION_PATTERN":      `"occupancy":false`,
+					"MATCHER":                matcherContainsValue,
+					"ILLUMINATION_TOPIC":     "zigbee2mqtt/motion_hall",
+					"ILLUMINATION_EXTRACTOR": extractorTemplateValue,
+					"ILLUMINATION_PATTERN":   "{{ (parseJSON .).illuminance_lux }}",
+				},
+			},
+			zigbeeUnreach("motion_hall"),
+		}},
+		{"zigbee2mqtt-0x00158d0003c4d5e6", "climate_bath", "Aqara WSDCGQ11LM", "HmIP-STHO", []rtcfg.Channel{
+			{
+				Kind: rtcfg.ChannelMQTTTemperature,
+				MasterParamset: map[string]interface{}{
+					"TEMPERATURE_TOPIC":     "zigbee2mqtt/climate_bath",
+					"TEMPERATURE_EXTRACTOR": extractorTemplateValue,
+					"TEMPERATURE_PATTERN":   "{{ (parseJSON .).temperature }}",
+					"HUMIDITY_TOPIC":        "zigbee2mqtt/climate_bath",
+					"HUMIDITY_EXTRACTOR":    extractorTemplateValue,
+					"HUMIDITY_PATTERN":      "{{ (parseJSON .).humidity }}",
+				},
+			},
+			zigbeeUnreach("climate_bath"),
+		}},
+		// no supported features
+		{"zigbee2mqtt-0x00158d0004d5e6f7", "remote", "Aqara WXKG01LM", "", nil},
+		// not interviewed
+		{"zigbee2mqtt-0x0017880100aabbcc", "0x0017880100aabbcc", "", "", nil},
+	}
+	devs, err := zigbeeDevices([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devs) != len(testCases) {
+		t.Fatalf("expected %d devices, got %d", len(testCases), len(devs))
+	}
+	for idx, tc := range testCases {
+		checkDiscovered(t, "Zigbee device "+tc.name, devs[idx], tc)
+	}
+
+	// invalid device lists
+	errCases := []struct {
+		payload string
+		err     string
+	}{
+		{`{}`, "not a slice"},
+		{`[{"ieee_address":"0x1"}]`, "field not found: friendly_name"},
+		{`[{"ieee_address":"0x1","friendly_name":"a","definition":{"exposes":[{"property":"state"}]}}]`,
+			"field not found: type"},
+	}
+	for _, tc := range errCases {
+		_, err := zigbeeDevices([]byte(tc.payload))
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("payload %s: expected error %s, got %v", tc.payload, tc.err, err)
+		}
+	}
+}
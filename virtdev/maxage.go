@@ -0,0 +1,102 @@
+package virtdev
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mdzio/go-hmccu/itf/vdevices"
+)
+
+// maxAge supervises the time since the last received message of a channel. If
+// the optional master parameter MAX_AGE expires, the channel becomes stale:
+// onStale is called (e.g. to set the status to unknown) and UNREACH of the
+// maintenance channel is set. The next message clears the stale state.
+//
+// Only the analog receiver (VOLTAGE_STATUS) and the temperature sensor
+// (ACTUAL_TEMPERATURE_STATUS, HUMIDITY_STATUS) have status parameters. The
+// other channel kinds (e.g. digital receivers, counters, power meters, string
+// and enum receivers) keep their last values, only UNREACH signals the stale
+// state.
+type maxAge struct {
+	channel *baseChannel
+	onStale func()
+
+	paramMaxAge *vdevices.FloatParameter
+
+	mtx   sync.Mutex
+	timer *time.Timer
+	stale bool
+}
+
+// init adds the master parameter MAX_AGE to the channel.
+func (m *maxAge) init(channel *baseChannel) {
+	m.channel = channel
+
+	// MAX_AGE [s] (0 disables the supervision)
+	m.paramMaxAge = vdevices.NewFloatParameter("MAX_AGE")
+	m.paramMaxAge.Description().Min = 0.0
+	m.paramMaxAge.Description().Default = 0.0
+	m.paramMaxAge.Description().Unit = "s"
+	channel.AddMasterParam(m.paramMaxAge)
+}
+
+func (m *maxAge) duration() time.Duration {
+	return time.Duration(m.paramMaxAge.Value().(float64) * float64(time.Second))
+}
+
+func (m *maxAge) start() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	dur := m.duration()
+	if dur <= 0 {
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(dur, func() { m.expire(t) })
+	m.timer = t
+}
+
+func (m *maxAge) stop() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	m.setStale(false)
+}
+
+// touch must be called on every received message.
+func (m *maxAge) touch() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.timer == nil {
+		return
+	}
+	m.timer.Reset(m.duration())
+	m.setStale(false)
+}
+
+func (m *maxAge) expire(t *time.Timer) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	// stopped or restarted in the meantime?
+	if m.timer != t || m.stale {
+		return
+	}
+	log.Warningf("No message received for channel %s:%d since %v", m.channel.Description().Parent,
+		m.channel.Description().Index, m.duration())
+	if m.onStale != nil {
+		m.onStale()
+	}
+	m.setStale(true)
+}
+
+// setStale updates the stale state. m.mtx must be locked.
+func (m *maxAge) setStale(stale bool) {
+	if m.stale == stale {
+		return
+	}
+	m.stale = stale
+	m.channel.virtualDevices.setChannelStale(m.channel.device, m.channel.Description().Index, stale)
+}
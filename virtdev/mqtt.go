@@ -24,6 +24,8 @@ type mqttAnalogInHandler struct {
 	mqttServer    *mqtt.Server
 	valueHandler  func(value float64)
 	statusHandler func(status int)
+	// optional supervision of the message age
+	maxAge *maxAge
 
 	paramTopic         *vdevices.StringParameter
 	paramPattern       *vdevices.StringParameter
@@ -67,6 +69,9 @@ func (h *mqttAnalogInHandler) start() {
 		h.onPublish = func(msg *message.PublishMessage) error {
 			log.Debugf("Message for %s:%d.%s received: %s, %s", h.channel.Description().Parent,
 				h.channel.Description().Index, h.targetParam, msg.Topic(), msg.Payload())
+			if h.maxAge != nil {
+				h.maxAge.touch()
+			}
 			value, err := extractor.Extract(msg.Payload())
 			if err != nil {
 				log.Warningf("Extraction of value for analog receiver %s:%d.%s failed: %v", h.channel.Description().Parent,
@@ -88,6 +93,17 @@ func (h *mqttAnalogInHandler) start() {
 	}
 }
 
+// startFeedback starts the handler, if its topic does not overlap with the
+// command topic of the channel.
+func (h *mqttAnalogInHandler) startFeedback(cmdTopic string) {
+	fbTopic := h.paramTopic.Value().(string)
+	if fbTopic != "" && matchTopic(fbTopic, cmdTopic) {
+		log.Errorf("Feedback topic '%s' must not overlap with command topic '%s'", fbTopic, cmdTopic)
+		return
+	}
+	h.start()
+}
+
 func (h *mqttAnalogInHandler) stop() {
 	if h.subscribedTopic != "" {
 		h.mqttServer.Unsubscribe(h.subscribedTopic, &h.onPublish)
@@ -254,6 +270,16 @@ var tmplFuncs = template.FuncMap{
 	"mapRange":  mapRange,
 }
 
+// TemplateFuncs returns the functions, which are available in all templates of
+// the virtual devices.
+func TemplateFuncs() template.FuncMap {
+	funcs := make(template.FuncMap, len(tmplFuncs))
+	for n, f := range tmplFuncs {
+		funcs[n] = f
+	}
+	return funcs
+}
+
 type paramSet int
 
 const (
@@ -423,8 +449,10 @@ type matcher interface {
 }
 
 func newMatcher(kindParam *vdevices.IntParameter, patternParam *vdevices.StringParameter) (matcher, error) {
-	kind := matcherKind(kindParam.Value().(int))
-	pattern := patternParam.Value().(string)
+	return newMatcherFor(matcherKind(kindParam.Value().(int)), patternParam.Value().(string))
+}
+
+func newMatcherFor(kind matcherKind, pattern string) (matcher, error) {
 	switch kind {
 	case MatcherExact:
 		return &matcherExact{pattern: pattern}, nil
@@ -480,6 +508,12 @@ func matchLevels(pattern []string, topic []string) bool {
 	return false
 }
 
+// MatchTopic checks whether an MQTT topic matches a topic filter with the
+// wildcards + and #.
+func MatchTopic(pattern, topic string) bool {
+	return matchTopic(pattern, topic)
+}
+
 func matchTopic(pattern, topic string) bool {
 	return matchLevels(strings.Split(pattern, "/"), strings.Split(topic, "/"))
 }
@@ -17,9 +17,11 @@ type mqttAnalogReceiver struct {
 
 	subscribedTopic string
 	onPublish       service.OnPublishFunc
+	maxAge          maxAge
 }
 
 func (c *mqttAnalogReceiver) start() {
+	c.maxAge.start()
 	topic := c.paramTopic.Value().(string)
 	if topic != "" {
 		extractor, err := newExtractor(c.paramExtractorKind, c.paramPattern, c.paramRegexpGroup)
@@ -31,6 +33,7 @@ func (c *mqttAnalogReceiver) start() {
 		c.onPublish = func(msg *message.PublishMessage) error {
 			log.Debugf("Message for analog receiver %s:%d received: %s, %s", c.Description().Parent,
 				c.Description().Index, msg.Topic(), msg.Payload())
+			c.maxAge.touch()
 			value, err := extractor.Extract(msg.Payload())
 			if err != nil {
 				log.Warningf("Extraction of value for analog receiver %s:%d failed: %v", c.Description().Parent,
@@ -53,6 +56,7 @@ func (c *mqttAnalogReceiver) start() {
 }
 
 func (c *mqttAnalogReceiver) stop() {
+	c.maxAge.stop()
 	if c.subscribedTopic != "" {
 		c.virtualDevices.MQTTServer.Unsubscribe(c.subscribedTopic, &c.onPublish)
 		c.subscribedTopic = ""
@@ -87,6 +91,13 @@ func (vd *VirtualDevices) addMQTTAnalogReceiver(dev *vdevices.Device) vdevices.G
 	ch.paramRegexpGroup.Description().Default = 0
 	ch.AddMasterParam(ch.paramRegexpGroup)
 
+	// MAX_AGE
+	ch.maxAge.onStale = func() {
+		// set status to unknown
+		ch.analogChannel.SetVoltageStatus(1)
+	}
+	ch.maxAge.init(&ch.baseChannel)
+
 	// clean up
 	ch.analogChannel.OnDispose = ch.stop
 
@@ -0,0 +1,398 @@
+package virtdev
+
+import (
+	"bytes"
+	"math"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/mdzio/go-hmccu/itf"
+	"github.com/mdzio/go-hmccu/itf/vdevices"
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-mqtt/service"
+)
+
+// values of the DIRECTION parameter
+const (
+	blindDirectionNone int = iota
+	blindDirectionUp
+	blindDirectionDown
+)
+
+// interval of the LEVEL updates while simulating the travel
+const blindSimulationInterval = time.Second
+
+type mqttBlind struct {
+	baseChannel
+	blindChannel    *vdevices.Channel
+	subscribedTopic string
+	onPublish       service.OnPublishFunc
+	levelTemplate   *template.Template
+	stopTemplate    *template.Template
+
+	// value parameters
+	level     *vdevices.FloatParameter
+	working   *vdevices.BoolParameter
+	direction *vdevices.IntParameter
+
+	// range parameters
+	paramRangeMin *vdevices.FloatParameter
+	paramRangeMax *vdevices.FloatParameter
+
+	// command parameters
+	paramCommandTopic *vdevices.StringParameter
+	paramRetain       *vdevices.BoolParameter
+	paramLevelPayload *vdevices.StringParameter
+	paramStopPayload  *vdevices.StringParameter
+
+	// feedback parameters
+	paramFBTopic       *vdevices.StringParameter
+	paramPattern       *vdevices.StringParameter
+	paramExtractorKind *vdevices.IntParameter
+	paramRegexpGroup   *vdevices.IntParameter
+
+	// simulation parameters
+	paramTravelTime *vdevices.FloatParameter
+
+	// state of the travel simulation, protected by simMtx
+	simMtx    sync.Mutex
+	simDone   chan struct{}
+	simFrom   float64
+	simTarget float64
+	simStart  time.Time
+}
+
+func (c *mqttBlind) createTemplate(param *vdevices.StringParameter) *template.Template {
+	txt := param.Value().(string)
+	specFuncs := createSpecificFuncs(c.virtualDevices.Devices, c.device, c)
+	tmpl, err := template.New("mqttblind").Funcs(tmplFuncs).Funcs(specFuncs).Parse(txt)
+	if err != nil {
+		log.Errorf("Invalid template '%s': %v", txt, err)
+		return nil
+	}
+	return tmpl
+}
+
+func (c *mqttBlind) start() {
+	c.levelTemplate = c.createTemplate(c.paramLevelPayload)
+	c.stopTemplate = c.createTemplate(c.paramStopPayload)
+
+	fbTopic := c.paramFBTopic.Value().(string)
+	if fbTopic != "" {
+		cmdTopic := c.paramCommandTopic.Value().(string)
+		if matchTopic(fbTopic, cmdTopic) {
+			log.Errorf("Feedback topic '%s' must not overlap with command topic '%s'", fbTopic, cmdTopic)
+			return
+		}
+		extractor, err := newExtractor(c.paramExtractorKind, c.paramPattern, c.paramRegexpGroup)
+		if err != nil {
+			log.Errorf("Creation of value extractor for MQTT blind %s:%d failed: %v", c.Description().Parent,
+				c.Description().Index, err)
+			return
+		}
+		c.onPublish = func(msg *message.PublishMessage) error {
+			log.Debugf("Message for MQTT blind %s:%d received: %s, %s", c.Description().Parent,
+				c.Description().Index, msg.Topic(), msg.Payload())
+			value, err := extractor.Extract(msg.Payload())
+			if err != nil {
+				log.Warningf("Extraction of position for MQTT blind %s:%d failed: %v", c.Description().Parent,
+					c.Description().Index, err)
+				// nothing can be done
+				return nil
+			}
+			// the device reports its position, the travel has ended
+			c.level.InternalSetValue(c.mapFromRange(value))
+			c.setMoving(blindDirectionNone)
+			return nil
+		}
+		if err := c.virtualDevices.MQTTServer.Subscribe(fbTopic, message.QosExactlyOnce, &c.onPublish); err != nil {
+			log.Errorf("Subscribe failed on topic %s: %v", fbTopic, err)
+		} else {
+			c.subscribedTopic = fbTopic
+		}
+	}
+}
+
+func (c *mqttBlind) stop() {
+	if c.subscribedTopic != "" {
+		c.virtualDevices.MQTTServer.Unsubscribe(c.subscribedTopic, &c.onPublish)
+		c.subscribedTopic = ""
+	}
+	c.simMtx.Lock()
+	c.haltSimulation()
+	c.simMtx.Unlock()
+}
+
+func (c *mqttBlind) mapToRange(value float64) float64 {
+	min := c.paramRangeMin.Value().(float64)
+	max := c.paramRangeMax.Value().(float64)
+	return value*(max-min) + min
+}
+
+func (c *mqttBlind) mapFromRange(value float64) float64 {
+	min := c.paramRangeMin.Value().(float64)
+	max := c.paramRangeMax.Value().(float64)
+	if min == max {
+		return 0.0
+	}
+	out := (value - min) / (max - min)
+	if out < 0.0 {
+		out = 0.0
+	}
+	if out > 1.0 {
+		out = 1.0
+	}
+	return out
+}
+
+func (c *mqttBlind) publishToMQTT(tmpl *template.Template, param *vdevices.StringParameter, value interface{}) {
+	if tmpl == nil {
+		log.Warningf("Invalid template: %s", param.Value().(string))
+		return
+	}
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, value)
+	if err != nil {
+		log.Errorf("Execution of template '%s' failed for value %v: %v", param.Value().(string), value, err)
+		return
+	}
+	c.virtualDevices.MQTTServer.Publish(
+		c.paramCommandTopic.Value().(string),
+		buf.Bytes(),
+		message.QosExactlyOnce,
+		c.paramRetain.Value().(bool),
+	)
+}
+
+func (c *mqttBlind) setMoving(direction int) {
+	c.working.InternalSetValue(direction != blindDirectionNone)
+	c.direction.InternalSetValue(direction)
+}
+
+// simulated returns true, if the position is simulated. This is the case, if
+// no feedback topic and a travel time is configured.
+func (c *mqttBlind) simulated() bool {
+	return c.paramFBTopic.Value().(string) == "" && c.paramTravelTime.Value().(float64) > 0.0
+}
+
+// simulatedLevel calculates the current position of a simulated travel.
+// c.simMtx must be locked.
+func (c *mqttBlind) simulatedLevel(now time.Time) float64 {
+	dist := now.Sub(c.simStart).Seconds() / c.paramTravelTime.Value().(float64)
+	if dist >= math.Abs(c.simTarget-c.simFrom) {
+		return c.simTarget
+	}
+	if c.simTarget > c.simFrom {
+		return c.simFrom + dist
+	}
+	return c.simFrom - dist
+}
+
+// haltSimulation stops a running travel simulation at the current position.
+// c.simMtx must be locked.
+func (c *mqttBlind) haltSimulation() {
+	if c.simDone == nil {
+		return
+	}
+	close(c.simDone)
+	c.simDone = nil
+	c.level.InternalSetValue(c.simulatedLevel(time.Now()))
+	c.setMoving(blindDirectionNone)
+}
+
+// simulate starts a travel simulation to the target position. c.simMtx must
+// be locked.
+func (c *mqttBlind) simulate(target float64) {
+	c.haltSimulation()
+	from := c.level.Value().(float64)
+	if from == target {
+		return
+	}
+	c.simFrom = from
+	c.simTarget = target
+	c.simStart = time.Now()
+	if target > from {
+		c.setMoving(blindDirectionUp)
+	} else {
+		c.setMoving(blindDirectionDown)
+	}
+	done := make(chan struct{})
+	c.simDone = done
+	go func() {
+		ticker := time.NewTicker(blindSimulationInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				c.simMtx.Lock()
+				// simulation halted in the meantime?
+				if c.simDone != done {
+					c.simMtx.Unlock()
+					return
+				}
+				level := c.simulatedLevel(now)
+				c.level.InternalSetValue(level)
+				if level == c.simTarget {
+					c.simDone = nil
+					c.setMoving(blindDirectionNone)
+					c.simMtx.Unlock()
+					return
+				}
+				c.simMtx.Unlock()
+			}
+		}
+	}()
+}
+
+func (vd *VirtualDevices) addMQTTBlind(dev *vdevices.Device) vdevices.GenericChannel {
+	ch := new(mqttBlind)
+	ch.virtualDevices = vd
+	ch.device = dev
+
+	// inititalize baseChannel
+	ch.blindChannel = new(vdevices.Channel)
+	ch.blindChannel.Init("BLIND")
+	// adding channel to device also initializes some fields
+	dev.AddChannel(ch.blindChannel)
+	ch.GenericChannel = ch.blindChannel
+
+	addInstallTest(ch)
+
+	// LEVEL
+	ch.level = vdevices.NewFloatParameter("LEVEL")
+	ch.level.Description().Control = "BLIND.LEVEL"
+	ch.level.Description().TabOrder = 0
+	ch.level.Description().Default = 0.0
+	ch.level.Description().Min = 0.0
+	ch.level.Description().Max = 1.0
+	ch.level.Description().Unit = "100%"
+	ch.AddValueParam(ch.level)
+
+	// STOP
+	stop := vdevices.NewBoolParameter("STOP")
+	stop.Description().Control = "BLIND.STOP"
+	stop.Description().TabOrder = 1
+	stop.Description().Type = itf.ParameterTypeAction
+	stop.Description().Operations = itf.ParameterOperationWrite
+	ch.AddValueParam(stop)
+
+	// WORKING
+	ch.working = vdevices.NewBoolParameter("WORKING")
+	ch.working.Description().Operations = itf.ParameterOperationRead | itf.ParameterOperationEvent
+	ch.working.Description().Flags = itf.ParameterFlagVisible | itf.ParameterFlagInternal
+	ch.AddValueParam(ch.working)
+
+	// DIRECTION
+	ch.direction = vdevices.NewIntParameter("DIRECTION")
+	ch.direction.Description().Type = itf.ParameterTypeEnum
+	ch.direction.Description().Operations = itf.ParameterOperationRead | itf.ParameterOperationEvent
+	ch.direction.Description().Flags = itf.ParameterFlagVisible | itf.ParameterFlagInternal
+	ch.direction.Description().Min = blindDirectionNone
+	ch.direction.Description().Max = blindDirectionDown
+	ch.direction.Description().Default = blindDirectionNone
+	ch.direction.Description().ValueList = []string{"NONE", "UP", "DOWN"}
+	ch.AddValueParam(ch.direction)
+
+	// RANGE_MIN
+	ch.paramRangeMin = vdevices.NewFloatParameter("RANGE_MIN")
+	ch.paramRangeMin.Description().Default = 0.0
+	ch.paramRangeMin.InternalSetValue(0.0)
+	ch.AddMasterParam(ch.paramRangeMin)
+
+	// RANGE_MAX
+	ch.paramRangeMax = vdevices.NewFloatParameter("RANGE_MAX")
+	ch.paramRangeMax.Description().Default = 1.0
+	ch.paramRangeMax.InternalSetValue(1.0)
+	ch.AddMasterParam(ch.paramRangeMax)
+
+	// COMMAND_TOPIC
+	ch.paramCommandTopic = vdevices.NewStringParameter("COMMAND_TOPIC")
+	ch.AddMasterParam(ch.paramCommandTopic)
+
+	// RETAIN
+	ch.paramRetain = vdevices.NewBoolParameter("RETAIN")
+	ch.AddMasterParam(ch.paramRetain)
+
+	// LEVEL_PAYLOAD
+	ch.paramLevelPayload = vdevices.NewStringParameter("LEVEL_PAYLOAD")
+	ch.paramLevelPayload.Description().Default = "{{ . }}"
+	ch.paramLevelPayload.InternalSetValue("{{ . }}")
+	ch.AddMasterParam(ch.paramLevelPayload)
+
+	// STOP_PAYLOAD
+	ch.paramStopPayload = vdevices.NewStringParameter("STOP_PAYLOAD")
+	ch.paramStopPayload.Description().Default = "stop"
+	ch.paramStopPayload.InternalSetValue("stop")
+	ch.AddMasterParam(ch.paramStopPayload)
+
+	// FEEDBACK_TOPIC
+	ch.paramFBTopic = vdevices.NewStringParameter("FEEDBACK_TOPIC")
+	ch.AddMasterParam(ch.paramFBTopic)
+
+	// PATTERN
+	ch.paramPattern = vdevices.NewStringParameter("PATTERN")
+	ch.AddMasterParam(ch.paramPattern)
+
+	// EXTRACTOR
+	ch.paramExtractorKind = newExtractorKindParameter("EXTRACTOR")
+	ch.AddMasterParam(ch.paramExtractorKind)
+
+	// REGEXP_GROUP
+	ch.paramRegexpGroup = vdevices.NewIntParameter("REGEXP_GROUP")
+	ch.paramRegexpGroup.Description().Min = 0
+	ch.paramRegexpGroup.Description().Max = 100
+	ch.paramRegexpGroup.Description().Default = 0
+	ch.AddMasterParam(ch.paramRegexpGroup)
+
+	// TRAVEL_TIME (seconds for a full travel, 0 disables the simulation)
+	ch.paramTravelTime = vdevices.NewFloatParameter("TRAVEL_TIME")
+	ch.paramTravelTime.Description().Min = 0.0
+	ch.paramTravelTime.Description().Max = 600.0
+	ch.paramTravelTime.Description().Default = 0.0
+	ch.paramTravelTime.Description().Unit = "s"
+	ch.AddMasterParam(ch.paramTravelTime)
+
+	// level change
+	ch.level.OnSetValue = func(value float64) bool {
+		ch.publishToMQTT(ch.levelTemplate, ch.paramLevelPayload, ch.mapToRange(value))
+		if ch.simulated() {
+			ch.simMtx.Lock()
+			ch.simulate(value)
+			ch.simMtx.Unlock()
+			// LEVEL is updated by the simulation
+			return false
+		}
+		// update level in channel and publish event to CCU, a feedback
+		// overwrites the level later on
+		return true
+	}
+
+	// stop travel
+	stop.OnSetValue = func(value bool) bool {
+		ch.publishToMQTT(ch.stopTemplate, ch.paramStopPayload, ch.mapToRange(ch.level.Value().(float64)))
+		ch.simMtx.Lock()
+		ch.haltSimulation()
+		ch.simMtx.Unlock()
+		return true
+	}
+
+	// clean up
+	ch.blindChannel.OnDispose = ch.stop
+
+	// store master param on PutParamset, reregister topics
+	ch.MasterParamset().HandlePutParamset(func() {
+		ch.stop()
+		ch.storeMasterParamset()
+		ch.start()
+	})
+
+	// load master parameters from config
+	ch.loadMasterParamset()
+
+	// register topics
+	ch.start()
+	return ch
+}
@@ -0,0 +1,221 @@
+package virtdev
+
+import (
+	"bytes"
+	"math"
+	"text/template"
+
+	"github.com/mdzio/go-hmccu/itf/vdevices"
+	"github.com/mdzio/go-mqtt/message"
+)
+
+// colorLightAttr is a controllable attribute of a color light (e.g. LEVEL or
+// HUE) with its command payload and feedback.
+type colorLightAttr struct {
+	value    vdevices.GenericParameter
+	payload  *vdevices.StringParameter
+	template *template.Template
+	feedback mqttAnalogInHandler
+}
+
+type mqttColorLight struct {
+	baseChannel
+	lightChannel *vdevices.Channel
+
+	// command parameters
+	paramCommandTopic *vdevices.StringParameter
+	paramRetain       *vdevices.BoolParameter
+
+	level            colorLightAttr
+	hue              colorLightAttr
+	saturation       colorLightAttr
+	colorTemperature colorLightAttr
+}
+
+func (c *mqttColorLight) attrs() []*colorLightAttr {
+	return []*colorLightAttr{&c.level, &c.hue, &c.saturation, &c.colorTemperature}
+}
+
+func (c *mqttColorLight) createTemplate(attr *colorLightAttr) {
+	attr.template = nil
+	txt := attr.payload.Value().(string)
+	// no command for this attribute
+	if txt == "" {
+		return
+	}
+	specFuncs := createSpecificFuncs(c.virtualDevices.Devices, c.device, c)
+	tmpl, err := template.New("mqttcolorlight").Funcs(tmplFuncs).Funcs(specFuncs).Parse(txt)
+	if err != nil {
+		log.Errorf("Invalid template '%s': %v", txt, err)
+		return
+	}
+	attr.template = tmpl
+}
+
+func (c *mqttColorLight) start() {
+	cmdTopic := c.paramCommandTopic.Value().(string)
+	for _, attr := range c.attrs() {
+		c.createTemplate(attr)
+		attr.feedback.startFeedback(cmdTopic)
+	}
+}
+
+func (c *mqttColorLight) stop() {
+	for _, attr := range c.attrs() {
+		attr.feedback.stop()
+	}
+}
+
+func (c *mqttColorLight) publishToMQTT(attr *colorLightAttr, value interface{}) {
+	txt := attr.payload.Value().(string)
+	if txt == "" {
+		log.Debugf("No payload configured for %s:%d.%s", c.Description().Parent, c.Description().Index,
+			attr.value.Description().ID)
+		return
+	}
+	if attr.template == nil {
+		log.Warningf("Invalid template: %s", txt)
+		return
+	}
+	var buf bytes.Buffer
+	err := attr.template.Execute(&buf, value)
+	if err != nil {
+		log.Errorf("Execution of template '%s' failed for value %v: %v", txt, value, err)
+		return
+	}
+	c.virtualDevices.MQTTServer.Publish(
+		c.paramCommandTopic.Value().(string),
+		buf.Bytes(),
+		message.QosExactlyOnce,
+		c.paramRetain.Value().(bool),
+	)
+}
+
+// initAttr adds the master parameters for the command payload and the
+// feedback of an attribute.
+func (c *mqttColorLight) initAttr(attr *colorLightAttr, value vdevices.GenericParameter) {
+	attr.value = value
+	id := value.Description().ID
+	c.AddValueParam(value)
+
+	// <ATTR>_PAYLOAD
+	attr.payload = vdevices.NewStringParameter(id + "_PAYLOAD")
+	attr.payload.Description().Default = "{{ . }}"
+	attr.payload.InternalSetValue("{{ . }}")
+	c.AddMasterParam(attr.payload)
+
+	// <ATTR>_TOPIC, <ATTR>_PATTERN, <ATTR>_EXTRACTOR, <ATTR>_REGEXP_GROUP
+	attr.feedback.channel = c
+	attr.feedback.targetParam = id
+	attr.feedback.mqttServer = c.virtualDevices.MQTTServer
+	attr.feedback.valueHandler = func(v float64) {
+		// integer parameters accept only integral float64 values
+		if _, ok := value.(*vdevices.IntParameter); ok {
+			v = math.Round(v)
+		}
+		if err := value.InternalSetValue(v); err != nil {
+			log.Warningf("Setting feedback for %s:%d.%s failed: %v", c.Description().Parent, c.Description().Index, id, err)
+		}
+	}
+	attr.feedback.statusHandler = func(_ int) {}
+	attr.feedback.init()
+}
+
+func (vd *VirtualDevices) addMQTTColorLight(dev *vdevices.Device) vdevices.GenericChannel {
+	ch := new(mqttColorLight)
+	ch.virtualDevices = vd
+	ch.device = dev
+
+	// inititalize baseChannel
+	ch.lightChannel = new(vdevices.Channel)
+	ch.lightChannel.Init("UNIVERSAL_LIGHT_RECEIVER")
+	// adding channel to device also initializes some fields
+	dev.AddChannel(ch.lightChannel)
+	ch.GenericChannel = ch.lightChannel
+	addInstallTest(ch)
+
+	// COMMAND_TOPIC
+	ch.paramCommandTopic = vdevices.NewStringParameter("COMMAND_TOPIC")
+	ch.AddMasterParam(ch.paramCommandTopic)
+
+	// RETAIN
+	ch.paramRetain = vdevices.NewBoolParameter("RETAIN")
+	ch.AddMasterParam(ch.paramRetain)
+
+	// LEVEL
+	level := vdevices.NewFloatParameter("LEVEL")
+	level.Description().Control = "DIMMER.LEVEL"
+	level.Description().TabOrder = 0
+	level.Description().Default = 0.0
+	level.Description().Min = 0.0
+	level.Description().Max = 1.0
+	level.Description().Unit = "100%"
+	level.OnSetValue = func(value float64) bool {
+		// update level for usage in template
+		level.InternalSetValue(value)
+		ch.publishToMQTT(&ch.level, value)
+		return true
+	}
+	ch.initAttr(&ch.level, level)
+
+	// HUE
+	hue := vdevices.NewIntParameter("HUE")
+	hue.Description().TabOrder = 1
+	hue.Description().Default = 0
+	hue.Description().Min = 0
+	hue.Description().Max = 360
+	hue.Description().Unit = "°"
+	hue.OnSetValue = func(value int) bool {
+		hue.InternalSetValue(value)
+		ch.publishToMQTT(&ch.hue, value)
+		return true
+	}
+	ch.initAttr(&ch.hue, hue)
+
+	// SATURATION
+	saturation := vdevices.NewFloatParameter("SATURATION")
+	saturation.Description().TabOrder = 2
+	saturation.Description().Default = 1.0
+	saturation.Description().Min = 0.0
+	saturation.Description().Max = 1.0
+	saturation.Description().Unit = "100%"
+	saturation.InternalSetValue(1.0)
+	saturation.OnSetValue = func(value float64) bool {
+		saturation.InternalSetValue(value)
+		ch.publishToMQTT(&ch.saturation, value)
+		return true
+	}
+	ch.initAttr(&ch.saturation, saturation)
+
+	// COLOR_TEMPERATURE
+	colorTemperature := vdevices.NewIntParameter("COLOR_TEMPERATURE")
+	colorTemperature.Description().TabOrder = 3
+	colorTemperature.Description().Default = 4000
+	colorTemperature.Description().Min = 1000
+	colorTemperature.Description().Max = 10000
+	colorTemperature.Description().Unit = "K"
+	colorTemperature.InternalSetValue(4000)
+	colorTemperature.OnSetValue = func(value int) bool {
+		colorTemperature.InternalSetValue(value)
+		ch.publishToMQTT(&ch.colorTemperature, value)
+		return true
+	}
+	ch.initAttr(&ch.colorTemperature, colorTemperature)
+
+	// clean up
+	ch.lightChannel.OnDispose = ch.stop
+
+	// store master param on PutParamset, reregister topics
+	ch.MasterParamset().HandlePutParamset(func() {
+		ch.stop()
+		ch.storeMasterParamset()
+		ch.start()
+	})
+
+	// load master parameters from config
+	ch.loadMasterParamset()
+
+	// register topics
+	ch.start()
+	return ch
+}
@@ -21,16 +21,19 @@ type mqttCounter struct {
 	baseChannel
 	energyCounter mqttAnalogInHandler
 	power         mqttAnalogInHandler
+	maxAge        maxAge
 }
 
 func (c *mqttCounter) start() {
 	c.energyCounter.start()
 	c.power.start()
+	c.maxAge.start()
 }
 
 func (c *mqttCounter) stop() {
 	c.energyCounter.stop()
 	c.power.stop()
+	c.maxAge.stop()
 }
 
 func (vd *VirtualDevices) addMQTTCounter(dev *vdevices.Device, chType counterChannelType) vdevices.GenericChannel {
@@ -70,6 +73,11 @@ func (vd *VirtualDevices) addMQTTCounter(dev *vdevices.Device, chType counterCha
 	ch.power.statusHandler = func(_ int) {}
 	ch.power.init()
 
+	// MAX_AGE (no status parameter available, only UNREACH is set)
+	ch.maxAge.init(&ch.baseChannel)
+	ch.energyCounter.maxAge = &ch.maxAge
+	ch.power.maxAge = &ch.maxAge
+
 	// store master param on PutParamset, reregister topics
 	ch.MasterParamset().HandlePutParamset(func() {
 		ch.stop()
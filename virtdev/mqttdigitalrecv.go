@@ -8,7 +8,8 @@ import (
 
 type mqttDigitalReceiver struct {
 	baseChannel
-	digitalChannel *vdevices.DigitalChannel
+	// sets the state of the channel
+	setState func(value bool)
 
 	paramTopic       *vdevices.StringParameter
 	paramOnPattern   *vdevices.StringParameter
@@ -17,9 +18,11 @@ type mqttDigitalReceiver struct {
 
 	subscribedTopic string
 	onPublish       service.OnPublishFunc
+	maxAge          maxAge
 }
 
 func (c *mqttDigitalReceiver) start() {
+	c.maxAge.start()
 	topic := c.paramTopic.Value().(string)
 	if topic != "" {
 		onMatcher, err := newMatcher(c.paramMatcherKind, c.paramOnPattern)
@@ -35,12 +38,13 @@ func (c *mqttDigitalReceiver) start() {
 		c.onPublish = func(msg *message.PublishMessage) error {
 			log.Debugf("Message for digital input %s:%d received: %s, %s", c.Description().Parent,
 				c.Description().Index, msg.Topic(), msg.Payload())
+			c.maxAge.touch()
 			if onMatcher.Match(msg.Payload()) {
 				log.Debugf("Turning on digital input %s:%d", c.Description().Parent, c.Description().Index)
-				c.digitalChannel.SetState(true)
+				c.setState(true)
 			} else if offMatcher.Match(msg.Payload()) {
 				log.Debugf("Turning off digital input %s:%d", c.Description().Parent, c.Description().Index)
-				c.digitalChannel.SetState(false)
+				c.setState(false)
 			} else {
 				log.Warningf("Invalid message for digital input %s:%d received: %s", c.Description().Parent,
 					c.Description().Index, msg.Payload())
@@ -56,39 +60,51 @@ func (c *mqttDigitalReceiver) start() {
 }
 
 func (c *mqttDigitalReceiver) stop() {
+	c.maxAge.stop()
 	if c.subscribedTopic != "" {
 		c.virtualDevices.MQTTServer.Unsubscribe(c.subscribedTopic, &c.onPublish)
 		c.subscribedTopic = ""
 	}
 }
 
-func (vd *VirtualDevices) addMQTTDoorSensor(dev *vdevices.Device) vdevices.GenericChannel {
-	ch := new(mqttDigitalReceiver)
-	ch.virtualDevices = vd
-	ch.device = dev
-
-	// inititalize baseChannel
-	ch.digitalChannel = vdevices.NewDoorSensorChannel(dev)
-	ch.GenericChannel = ch.digitalChannel
-
+// initParams adds the master parameters TOPIC, <ON>_PATTERN, <OFF>_PATTERN,
+// MATCHER and MAX_AGE to the channel.
+func (c *mqttDigitalReceiver) initParams(onPatternID, offPatternID string) {
 	// TOPIC
-	ch.paramTopic = vdevices.NewStringParameter("TOPIC")
-	ch.AddMasterParam(ch.paramTopic)
+	c.paramTopic = vdevices.NewStringParameter("TOPIC")
+	c.AddMasterParam(c.paramTopic)
 
-	// OPEN_PATTERN
-	ch.paramOnPattern = vdevices.NewStringParameter("OPEN_PATTERN")
-	ch.AddMasterParam(ch.paramOnPattern)
+	// ON_PATTERN
+	c.paramOnPattern = vdevices.NewStringParameter(onPatternID)
+	c.AddMasterParam(c.paramOnPattern)
 
-	// CLOSED_PATTERN
-	ch.paramOffPattern = vdevices.NewStringParameter("CLOSED_PATTERN")
-	ch.AddMasterParam(ch.paramOffPattern)
+	// OFF_PATTERN
+	c.paramOffPattern = vdevices.NewStringParameter(offPatternID)
+	c.AddMasterParam(c.paramOffPattern)
 
 	// MATCHER
-	ch.paramMatcherKind = newMatcherKindParameter("MATCHER")
-	ch.AddMasterParam(ch.paramMatcherKind)
+	c.paramMatcherKind = newMatcherKindParameter("MATCHER")
+	c.AddMasterParam(c.paramMatcherKind)
+
+	// MAX_AGE (no status parameter available, only UNREACH is set)
+	c.maxAge.init(&c.baseChannel)
+}
+
+// addMQTTDigitalReceiver creates a receiver for a digital channel of package
+// vdevices.
+func (vd *VirtualDevices) addMQTTDigitalReceiver(dev *vdevices.Device, digitalChannel *vdevices.DigitalChannel,
+	onPatternID, offPatternID string) vdevices.GenericChannel {
+	ch := new(mqttDigitalReceiver)
+	ch.virtualDevices = vd
+	ch.device = dev
+
+	// inititalize baseChannel
+	ch.GenericChannel = digitalChannel
+	ch.setState = digitalChannel.SetState
+	ch.initParams(onPatternID, offPatternID)
 
 	// clean up
-	ch.digitalChannel.OnDispose = ch.stop
+	digitalChannel.OnDispose = ch.stop
 
 	// store master param on PutParamset, reregister topics
 	ch.MasterParamset().HandlePutParamset(func() {
@@ -104,3 +120,17 @@ func (vd *VirtualDevices) addMQTTDoorSensor(dev *vdevices.Device) vdevices.Gener
 	ch.start()
 	return ch
 }
+
+func (vd *VirtualDevices) addMQTTDoorSensor(dev *vdevices.Device) vdevices.GenericChannel {
+	return vd.addMQTTDigitalReceiver(dev, vdevices.NewDoorSensorChannel(dev), "OPEN_PATTERN", "CLOSED_PATTERN")
+}
+
+func (vd *VirtualDevices) addMQTTSmokeDetector(dev *vdevices.Device) vdevices.GenericChannel {
+	return vd.addMQTTDigitalReceiver(dev, vdevices.NewDigitalChannel(dev, "SMOKE_DETECTOR", "SMOKE_DETECTOR.STATE"),
+		"ALARM_PATTERN", "IDLE_PATTERN")
+}
+
+func (vd *VirtualDevices) addMQTTWaterSensor(dev *vdevices.Device) vdevices.GenericChannel {
+	return vd.addMQTTDigitalReceiver(dev, vdevices.NewDigitalChannel(dev, "WATER_DETECTION_TRANSMITTER", "WATER_DETECTION.STATE"),
+		"WET_PATTERN", "DRY_PATTERN")
+}
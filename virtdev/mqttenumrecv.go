@@ -0,0 +1,235 @@
+package virtdev
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/mdzio/go-hmccu/itf"
+	"github.com/mdzio/go-hmccu/itf/vdevices"
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-mqtt/service"
+)
+
+// separator of the entries in PATTERNS and VALUE_LIST
+const enumListSeparator = ";"
+
+type mqttEnumReceiver struct {
+	baseChannel
+	enumChannel *vdevices.Channel
+	state       *vdevices.IntParameter
+
+	paramTopic       *vdevices.StringParameter
+	paramMatcherKind *vdevices.IntParameter
+
+	// configurable value list
+	paramPatterns  *vdevices.StringParameter
+	paramValueList *vdevices.StringParameter
+
+	// fixed value list, a pattern parameter for each value
+	paramFixedPatterns []*vdevices.StringParameter
+
+	subscribedTopic string
+	onPublish       service.OnPublishFunc
+	maxAge          maxAge
+}
+
+func splitEnumList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, enumListSeparator)
+}
+
+// patterns returns the patterns and the value list of STATE.
+func (c *mqttEnumReceiver) patterns() ([]string, []string) {
+	if c.paramFixedPatterns != nil {
+		patterns := make([]string, len(c.paramFixedPatterns))
+		for idx, p := range c.paramFixedPatterns {
+			patterns[idx] = p.Value().(string)
+		}
+		return patterns, c.state.Description().ValueList
+	}
+	// the value list of STATE is fixed at the creation of the channel
+	patterns, _ := c.configuredLists()
+	return patterns, c.state.Description().ValueList
+}
+
+// configuredLists returns the patterns and the value list from the master
+// parameters PATTERNS and VALUE_LIST.
+func (c *mqttEnumReceiver) configuredLists() ([]string, []string) {
+	// value list defaults to the patterns
+	patterns := splitEnumList(c.paramPatterns.Value().(string))
+	valueList := splitEnumList(c.paramValueList.Value().(string))
+	if len(valueList) == 0 {
+		valueList = patterns
+	}
+	if len(valueList) != len(patterns) {
+		log.Errorf("Number of patterns and values of enum receiver %s:%d mismatch", c.Description().Parent,
+			c.Description().Index)
+		patterns = nil
+		valueList = nil
+	}
+	if len(valueList) == 0 {
+		valueList = []string{""}
+	}
+	return patterns, valueList
+}
+
+func (c *mqttEnumReceiver) start() {
+	c.maxAge.start()
+	patterns, valueList := c.patterns()
+
+	topic := c.paramTopic.Value().(string)
+	if topic != "" {
+		matchers := make([]matcher, len(patterns))
+		kind := matcherKind(c.paramMatcherKind.Value().(int))
+		for idx, pattern := range patterns {
+			m, err := newMatcherFor(kind, pattern)
+			if err != nil {
+				log.Errorf("Creation of matcher for '%s' failed: %v", valueList[idx], err)
+				return
+			}
+			matchers[idx] = m
+		}
+		c.onPublish = func(msg *message.PublishMessage) error {
+			log.Debugf("Message for enum receiver %s:%d received: %s, %s", c.Description().Parent,
+				c.Description().Index, msg.Topic(), msg.Payload())
+			c.maxAge.touch()
+			// first matching pattern wins
+			for idx, m := range matchers {
+				if m.Match(msg.Payload()) {
+					log.Debugf("Setting enum receiver %s:%d to %s", c.Description().Parent, c.Description().Index,
+						valueList[idx])
+					c.state.InternalSetValue(idx)
+					return nil
+				}
+			}
+			log.Warningf("Invalid message for enum receiver %s:%d received: %s", c.Description().Parent,
+				c.Description().Index, msg.Payload())
+			return nil
+		}
+		if err := c.virtualDevices.MQTTServer.Subscribe(topic, message.QosExactlyOnce, &c.onPublish); err != nil {
+			log.Errorf("Subscribe failed on topic %s: %v", topic, err)
+			return
+		}
+		c.subscribedTopic = topic
+	}
+}
+
+func (c *mqttEnumReceiver) stop() {
+	c.maxAge.stop()
+	if c.subscribedTopic != "" {
+		c.virtualDevices.MQTTServer.Unsubscribe(c.subscribedTopic, &c.onPublish)
+		c.subscribedTopic = ""
+	}
+}
+
+// newMQTTEnumReceiver creates the channel with the parameters STATE, TOPIC,
+// MATCHER and MAX_AGE. The channel must be completed with initEnumReceiver.
+func (vd *VirtualDevices) newMQTTEnumReceiver(dev *vdevices.Device, channelType, control string,
+	valueList []string) *mqttEnumReceiver {
+	ch := new(mqttEnumReceiver)
+	ch.virtualDevices = vd
+	ch.device = dev
+
+	// inititalize baseChannel
+	ch.enumChannel = new(vdevices.Channel)
+	ch.enumChannel.Init(channelType)
+	// adding channel to device also initializes some fields
+	dev.AddChannel(ch.enumChannel)
+	ch.GenericChannel = ch.enumChannel
+	addInstallTest(ch)
+
+	// STATE
+	ch.state = vdevices.NewIntParameter("STATE")
+	ch.state.Description().Type = itf.ParameterTypeEnum
+	ch.state.Description().Control = control
+	ch.state.Description().Operations = itf.ParameterOperationRead | itf.ParameterOperationEvent
+	ch.state.Description().ValueList = valueList
+	ch.state.Description().Min = 0
+	ch.state.Description().Max = len(valueList) - 1
+	ch.state.Description().Default = 0
+	ch.AddValueParam(ch.state)
+
+	// TOPIC
+	ch.paramTopic = vdevices.NewStringParameter("TOPIC")
+	ch.AddMasterParam(ch.paramTopic)
+
+	// MATCHER
+	ch.paramMatcherKind = newMatcherKindParameter("MATCHER")
+	ch.AddMasterParam(ch.paramMatcherKind)
+
+	// MAX_AGE (no status parameter available, only UNREACH is set)
+	ch.maxAge.init(&ch.baseChannel)
+	return ch
+}
+
+// initEnumReceiver registers the handlers and loads the master parameters.
+// The value list of a configurable enum receiver is taken from the master
+// parameters. It is part of the device structure and can not be modified
+// afterwards. Therefore a change of PATTERNS or VALUE_LIST, which modifies the
+// value list, re-creates the device.
+func (c *mqttEnumReceiver) initEnumReceiver() {
+	// clean up
+	c.enumChannel.OnDispose = c.stop
+
+	// store master param on PutParamset, reregister topics
+	c.MasterParamset().HandlePutParamset(func() {
+		c.stop()
+		c.storeMasterParamset()
+		if c.paramFixedPatterns == nil {
+			if _, valueList := c.configuredLists(); !reflect.DeepEqual(valueList, c.state.Description().ValueList) {
+				// the handler must not remove its own device
+				go c.virtualDevices.recreateDevice(c.device.Description().Address)
+				return
+			}
+		}
+		c.start()
+	})
+
+	// load master parameters from config
+	c.loadMasterParamset()
+
+	// set value list of STATE before the device is added
+	if c.paramFixedPatterns == nil {
+		_, valueList := c.configuredLists()
+		c.state.Description().ValueList = valueList
+		c.state.Description().Max = len(valueList) - 1
+	}
+
+	// register topics
+	c.start()
+}
+
+func (vd *VirtualDevices) addMQTTEnumReceiver(dev *vdevices.Device) vdevices.GenericChannel {
+	// value list is set from the master parameters
+	ch := vd.newMQTTEnumReceiver(dev, "ENUM_INPUT_TRANSMITTER", "", []string{""})
+
+	// PATTERNS (separated by semicolons, the index of the first matching
+	// pattern is the value of STATE)
+	ch.paramPatterns = vdevices.NewStringParameter("PATTERNS")
+	ch.AddMasterParam(ch.paramPatterns)
+
+	// VALUE_LIST (names of the values separated by semicolons, defaults to the
+	// patterns, a modification re-creates the device)
+	ch.paramValueList = vdevices.NewStringParameter("VALUE_LIST")
+	ch.AddMasterParam(ch.paramValueList)
+
+	ch.initEnumReceiver()
+	return ch
+}
+
+func (vd *VirtualDevices) addMQTTWindowHandle(dev *vdevices.Device) vdevices.GenericChannel {
+	valueList := []string{"CLOSED", "TILTED", "OPEN"}
+	ch := vd.newMQTTEnumReceiver(dev, "ROTARY_HANDLE_SENSOR", "ROTARY_HANDLE.STATE", valueList)
+
+	// CLOSED_PATTERN, TILTED_PATTERN, OPEN_PATTERN
+	for _, v := range valueList {
+		p := vdevices.NewStringParameter(v + "_PATTERN")
+		ch.AddMasterParam(p)
+		ch.paramFixedPatterns = append(ch.paramFixedPatterns, p)
+	}
+
+	ch.initEnumReceiver()
+	return ch
+}
@@ -0,0 +1,86 @@
+package virtdev
+
+import (
+	"github.com/mdzio/go-hmccu/itf"
+	"github.com/mdzio/go-hmccu/itf/vdevices"
+)
+
+type mqttMotionDetector struct {
+	mqttDigitalReceiver
+	motionChannel *vdevices.Channel
+	illumination  mqttAnalogInHandler
+}
+
+func (c *mqttMotionDetector) start() {
+	c.mqttDigitalReceiver.start()
+	c.illumination.start()
+}
+
+func (c *mqttMotionDetector) stop() {
+	c.mqttDigitalReceiver.stop()
+	c.illumination.stop()
+}
+
+func (vd *VirtualDevices) addMQTTMotionDetector(dev *vdevices.Device) vdevices.GenericChannel {
+	ch := new(mqttMotionDetector)
+	ch.virtualDevices = vd
+	ch.device = dev
+
+	// inititalize baseChannel
+	ch.motionChannel = new(vdevices.Channel)
+	ch.motionChannel.Init("MOTION_DETECTOR")
+	// adding channel to device also initializes some fields
+	dev.AddChannel(ch.motionChannel)
+	ch.GenericChannel = ch.motionChannel
+	addInstallTest(ch)
+
+	// MOTION
+	motion := vdevices.NewBoolParameter("MOTION")
+	motion.Description().Control = "MOTIONDETECTOR_TRANSCEIVER.MOTION"
+	motion.Description().Operations = itf.ParameterOperationRead | itf.ParameterOperationEvent
+	ch.AddValueParam(motion)
+	ch.setState = func(value bool) {
+		motion.InternalSetValue(value)
+	}
+
+	// ILLUMINATION
+	illumination := vdevices.NewFloatParameter("ILLUMINATION")
+	illumination.Description().Control = "MOTIONDETECTOR_TRANSCEIVER.ILLUMINATION"
+	illumination.Description().Operations = itf.ParameterOperationRead | itf.ParameterOperationEvent
+	illumination.Description().Min = 0.0
+	illumination.Description().Max = 1677721.5
+	illumination.Description().Unit = "Lux"
+	ch.AddValueParam(illumination)
+
+	// TOPIC, MOTION_PATTERN, NO_MOTION_PATTERN, MATCHER, MAX_AGE
+	ch.initParams("MOTION_PATTERN", "NO_MOTION_PATTERN")
+
+	// ILLUMINATION_TOPIC, ILLUMINATION_PATTERN, ILLUMINATION_EXTRACTOR,
+	// ILLUMINATION_REGEXP_GROUP
+	ch.illumination.channel = ch
+	ch.illumination.targetParam = "ILLUMINATION"
+	ch.illumination.mqttServer = vd.MQTTServer
+	ch.illumination.valueHandler = func(value float64) {
+		illumination.InternalSetValue(value)
+	}
+	ch.illumination.statusHandler = func(_ int) {}
+	ch.illumination.maxAge = &ch.maxAge
+	ch.illumination.init()
+
+	// clean up
+	ch.motionChannel.OnDispose = ch.stop
+
+	// store master param on PutParamset, reregister topics
+	ch.MasterParamset().HandlePutParamset(func() {
+		ch.stop()
+		ch.storeMasterParamset()
+		ch.start()
+	})
+
+	// load master parameters from config
+	ch.loadMasterParamset()
+
+	// register topics
+	ch.start()
+	return ch
+}
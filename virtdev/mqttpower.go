@@ -12,6 +12,7 @@ type mqttPowerMeter struct {
 	current       mqttAnalogInHandler
 	voltage       mqttAnalogInHandler
 	frequency     mqttAnalogInHandler
+	maxAge        maxAge
 }
 
 func (c *mqttPowerMeter) start() {
@@ -20,6 +21,7 @@ func (c *mqttPowerMeter) start() {
 	c.current.start()
 	c.voltage.start()
 	c.frequency.start()
+	c.maxAge.start()
 }
 
 func (c *mqttPowerMeter) stop() {
@@ -28,6 +30,7 @@ func (c *mqttPowerMeter) stop() {
 	c.current.stop()
 	c.voltage.stop()
 	c.frequency.stop()
+	c.maxAge.stop()
 }
 
 func (vd *VirtualDevices) addMQTTPowerMeter(dev *vdevices.Device) vdevices.GenericChannel {
@@ -75,6 +78,12 @@ func (vd *VirtualDevices) addMQTTPowerMeter(dev *vdevices.Device) vdevices.Gener
 	ch.frequency.statusHandler = func(_ int) {}
 	ch.frequency.init()
 
+	// MAX_AGE (no status parameter available, only UNREACH is set)
+	ch.maxAge.init(&ch.baseChannel)
+	for _, h := range []*mqttAnalogInHandler{&ch.energyCounter, &ch.power, &ch.current, &ch.voltage, &ch.frequency} {
+		h.maxAge = &ch.maxAge
+	}
+
 	// clean up
 	specificCh.OnDispose = ch.stop
 
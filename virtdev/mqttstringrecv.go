@@ -0,0 +1,115 @@
+package virtdev
+
+import (
+	"strings"
+	"text/template"
+
+	"github.com/mdzio/go-hmccu/itf"
+	"github.com/mdzio/go-hmccu/itf/vdevices"
+	"github.com/mdzio/go-mqtt/message"
+	"github.com/mdzio/go-mqtt/service"
+)
+
+type mqttStringReceiver struct {
+	baseChannel
+	stringChannel *vdevices.Channel
+	value         *vdevices.StringParameter
+
+	paramTopic    *vdevices.StringParameter
+	paramTemplate *vdevices.StringParameter
+
+	subscribedTopic string
+	onPublish       service.OnPublishFunc
+	maxAge          maxAge
+}
+
+func (c *mqttStringReceiver) start() {
+	c.maxAge.start()
+	topic := c.paramTopic.Value().(string)
+	if topic != "" {
+		tmplText := c.paramTemplate.Value().(string)
+		specFuncs := createSpecificFuncs(c.virtualDevices.Devices, c.device, c)
+		tmpl, err := template.New("mqttstringrecv").Funcs(tmplFuncs).Funcs(specFuncs).Parse(tmplText)
+		if err != nil {
+			log.Errorf("Invalid template '%s': %v", tmplText, err)
+			return
+		}
+		c.onPublish = func(msg *message.PublishMessage) error {
+			log.Debugf("Message for string receiver %s:%d received: %s, %s", c.Description().Parent,
+				c.Description().Index, msg.Topic(), msg.Payload())
+			c.maxAge.touch()
+			var sb strings.Builder
+			err := tmpl.Execute(&sb, string(msg.Payload()))
+			if err != nil {
+				log.Warningf("Execution of template for string receiver %s:%d failed for payload '%s': %v",
+					c.Description().Parent, c.Description().Index, msg.Payload(), err)
+				return nil
+			}
+			// erase white space
+			c.value.InternalSetValue(strings.TrimSpace(sb.String()))
+			return nil
+		}
+		if err := c.virtualDevices.MQTTServer.Subscribe(topic, message.QosExactlyOnce, &c.onPublish); err != nil {
+			log.Errorf("Subscribe failed on topic %s: %v", topic, err)
+			return
+		}
+		c.subscribedTopic = topic
+	}
+}
+
+func (c *mqttStringReceiver) stop() {
+	c.maxAge.stop()
+	if c.subscribedTopic != "" {
+		c.virtualDevices.MQTTServer.Unsubscribe(c.subscribedTopic, &c.onPublish)
+		c.subscribedTopic = ""
+	}
+}
+
+func (vd *VirtualDevices) addMQTTStringReceiver(dev *vdevices.Device) vdevices.GenericChannel {
+	ch := new(mqttStringReceiver)
+	ch.virtualDevices = vd
+	ch.device = dev
+
+	// inititalize baseChannel
+	ch.stringChannel = new(vdevices.Channel)
+	ch.stringChannel.Init("STRING_INPUT_TRANSMITTER")
+	// adding channel to device also initializes some fields
+	dev.AddChannel(ch.stringChannel)
+	ch.GenericChannel = ch.stringChannel
+	addInstallTest(ch)
+
+	// VALUE
+	ch.value = vdevices.NewStringParameter("VALUE")
+	ch.value.Description().Operations = itf.ParameterOperationRead | itf.ParameterOperationEvent
+	ch.AddValueParam(ch.value)
+
+	// TOPIC
+	ch.paramTopic = vdevices.NewStringParameter("TOPIC")
+	ch.AddMasterParam(ch.paramTopic)
+
+	// TEMPLATE (receives the payload as string)
+	ch.paramTemplate = vdevices.NewStringParameter("TEMPLATE")
+	ch.paramTemplate.Description().Default = "{{ . }}"
+	ch.paramTemplate.InternalSetValue("{{ . }}")
+	ch.AddMasterParam(ch.paramTemplate)
+
+	// MAX_AGE (no status parameter available, only UNREACH is set)
+	ch.maxAge.init(&ch.baseChannel)
+
+	// clean up
+	ch.stringChannel.OnDispose = ch.stop
+
+	// store master param on PutParamset, reregister topics
+	ch.MasterParamset().HandlePutParamset(func() {
+		ch.stop()
+		ch.storeMasterParamset()
+		ch.start()
+	})
+
+	// load master parameters from config
+	ch.loadMasterParamset()
+
+	// register topics
+	ch.start()
+	return ch
+}
@@ -23,9 +23,13 @@ type mqttTemperature struct {
 	humidityRegexpGroup     *vdevices.IntParameter
 	humiditySubscribedTopic string
 	humidityOnPublish       service.OnPublishFunc
+
+	maxAge maxAge
 }
 
 func (c *mqttTemperature) start() {
+	c.maxAge.start()
+
 	temperatureTopic := c.temperatureTopic.Value().(string)
 	if temperatureTopic != "" {
 		extractor, err := newExtractor(c.temperatureExtractorKind, c.temperaturePattern, c.temperatureRegexpGroup)
@@ -37,6 +41,7 @@ func (c *mqttTemperature) start() {
 		c.temperatureOnPublish = func(msg *message.PublishMessage) error {
 			log.Debugf("Message for temperature %s:%d received: %s, %s", c.Description().Parent,
 				c.Description().Index, msg.Topic(), msg.Payload())
+			c.maxAge.touch()
 			value, err := extractor.Extract(msg.Payload())
 			if err != nil {
 				log.Warningf("Extraction of value for temperature %s:%d failed: %v", c.Description().Parent,
@@ -68,6 +73,7 @@ func (c *mqttTemperature) start() {
 		c.humidityOnPublish = func(msg *message.PublishMessage) error {
 			log.Debugf("Message for humidity %s:%d received: %s, %s", c.Description().Parent,
 				c.Description().Index, msg.Topic(), msg.Payload())
+			c.maxAge.touch()
 			value, err := extractor.Extract(msg.Payload())
 			if err != nil {
 				log.Warningf("Extraction of value for humidity %s:%d failed: %v", c.Description().Parent,
@@ -90,6 +96,8 @@ func (c *mqttTemperature) start() {
 }
 
 func (c *mqttTemperature) stop() {
+	c.maxAge.stop()
+
 	if c.temperatureSubscribedTopic != "" {
 		c.virtualDevices.MQTTServer.Unsubscribe(c.temperatureSubscribedTopic, &c.temperatureOnPublish)
 		c.temperatureSubscribedTopic = ""
@@ -148,6 +156,16 @@ func (vd *VirtualDevices) addMQTTTemperature(dev *vdevices.Device) vdevices.Gene
 	ch.humidityRegexpGroup.Description().Default = 0
 	ch.AddMasterParam(ch.humidityRegexpGroup)
 
+	// MAX_AGE
+	ch.maxAge.onStale = func() {
+		// set status to unknown
+		ch.temperatureChannel.SetTemperatureStatus(1)
+		if ch.humidityTopic.Value().(string) != "" {
+			ch.temperatureChannel.SetHumidityStatus(1)
+		}
+	}
+	ch.maxAge.init(&ch.baseChannel)
+
 	// clean up
 	ch.temperatureChannel.OnDispose = ch.stop
 
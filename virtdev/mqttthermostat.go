@@ -0,0 +1,245 @@
+package virtdev
+
+import (
+	"bytes"
+	"math"
+	"text/template"
+
+	"github.com/mdzio/go-hmccu/itf"
+	"github.com/mdzio/go-hmccu/itf/vdevices"
+	"github.com/mdzio/go-mqtt/message"
+)
+
+type mqttThermostat struct {
+	baseChannel
+	thermostatChannel *vdevices.Channel
+	setPointTemplate  *template.Template
+	modeTemplate      *template.Template
+
+	// value parameters
+	actualTemperature   *vdevices.FloatParameter
+	setPointTemperature *vdevices.FloatParameter
+	setPointMode        *vdevices.IntParameter
+	level               *vdevices.FloatParameter
+
+	// command parameters
+	paramSetPointTopic   *vdevices.StringParameter
+	paramSetPointPayload *vdevices.StringParameter
+	paramModeTopic       *vdevices.StringParameter
+	paramModePayload     *vdevices.StringParameter
+	paramRetain          *vdevices.BoolParameter
+
+	// feedback handlers
+	actualTemperatureFB   mqttAnalogInHandler
+	setPointTemperatureFB mqttAnalogInHandler
+	setPointModeFB        mqttAnalogInHandler
+	levelFB               mqttAnalogInHandler
+}
+
+func (c *mqttThermostat) createTemplate(param *vdevices.StringParameter) *template.Template {
+	txt := param.Value().(string)
+	specFuncs := createSpecificFuncs(c.virtualDevices.Devices, c.device, c)
+	tmpl, err := template.New("mqttthermostat").Funcs(tmplFuncs).Funcs(specFuncs).Parse(txt)
+	if err != nil {
+		log.Errorf("Invalid template '%s': %v", txt, err)
+		return nil
+	}
+	return tmpl
+}
+
+func (c *mqttThermostat) start() {
+	c.setPointTemplate = c.createTemplate(c.paramSetPointPayload)
+	c.modeTemplate = c.createTemplate(c.paramModePayload)
+
+	c.actualTemperatureFB.start()
+	c.setPointTemperatureFB.startFeedback(c.paramSetPointTopic.Value().(string))
+	c.setPointModeFB.startFeedback(c.paramModeTopic.Value().(string))
+	c.levelFB.start()
+}
+
+func (c *mqttThermostat) stop() {
+	c.actualTemperatureFB.stop()
+	c.setPointTemperatureFB.stop()
+	c.setPointModeFB.stop()
+	c.levelFB.stop()
+}
+
+func (c *mqttThermostat) publishToMQTT(topicParam *vdevices.StringParameter, tmpl *template.Template,
+	payloadParam *vdevices.StringParameter, value interface{}) {
+	topic := topicParam.Value().(string)
+	if topic == "" {
+		log.Warningf("No command topic configured for thermostat %s:%d", c.Description().Parent, c.Description().Index)
+		return
+	}
+	if tmpl == nil {
+		log.Warningf("Invalid template: %s", payloadParam.Value().(string))
+		return
+	}
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, value)
+	if err != nil {
+		log.Errorf("Execution of template '%s' failed for value %v: %v", payloadParam.Value().(string), value, err)
+		return
+	}
+	c.virtualDevices.MQTTServer.Publish(
+		topic,
+		buf.Bytes(),
+		message.QosExactlyOnce,
+		c.paramRetain.Value().(bool),
+	)
+}
+
+func (vd *VirtualDevices) addMQTTThermostat(dev *vdevices.Device) vdevices.GenericChannel {
+	ch := new(mqttThermostat)
+	ch.virtualDevices = vd
+	ch.device = dev
+
+	// inititalize baseChannel
+	ch.thermostatChannel = new(vdevices.Channel)
+	ch.thermostatChannel.Init("HEATING_CLIMATECONTROL_TRANSCEIVER")
+	// adding channel to device also initializes some fields
+	dev.AddChannel(ch.thermostatChannel)
+	ch.GenericChannel = ch.thermostatChannel
+	addInstallTest(ch)
+
+	// ACTUAL_TEMPERATURE
+	ch.actualTemperature = vdevices.NewFloatParameter("ACTUAL_TEMPERATURE")
+	ch.actualTemperature.Description().Control = "HEATING_CONTROL_HMIP.ACTUAL_TEMPERATURE"
+	ch.actualTemperature.Description().Operations = itf.ParameterOperationRead | itf.ParameterOperationEvent
+	ch.actualTemperature.Description().TabOrder = 0
+	ch.actualTemperature.Description().Min = -3276.8
+	ch.actualTemperature.Description().Max = 3276.7
+	ch.actualTemperature.Description().Unit = "°C"
+	ch.AddValueParam(ch.actualTemperature)
+
+	// SET_POINT_TEMPERATURE
+	ch.setPointTemperature = vdevices.NewFloatParameter("SET_POINT_TEMPERATURE")
+	ch.setPointTemperature.Description().Control = "HEATING_CONTROL_HMIP.SETPOINT"
+	ch.setPointTemperature.Description().TabOrder = 1
+	ch.setPointTemperature.Description().Min = 4.5
+	ch.setPointTemperature.Description().Max = 30.5
+	ch.setPointTemperature.Description().Default = 21.0
+	ch.setPointTemperature.Description().Unit = "°C"
+	ch.setPointTemperature.InternalSetValue(21.0)
+	ch.AddValueParam(ch.setPointTemperature)
+
+	// SET_POINT_MODE
+	ch.setPointMode = vdevices.NewIntParameter("SET_POINT_MODE")
+	ch.setPointMode.Description().Control = "HEATING_CONTROL_HMIP.SET_POINT_MODE"
+	ch.setPointMode.Description().Type = itf.ParameterTypeEnum
+	ch.setPointMode.Description().TabOrder = 2
+	ch.setPointMode.Description().ValueList = []string{"AUTOMATIC", "MANUAL", "OFF"}
+	ch.setPointMode.Description().Min = 0
+	ch.setPointMode.Description().Max = len(ch.setPointMode.Description().ValueList) - 1
+	ch.setPointMode.Description().Default = 0
+	ch.AddValueParam(ch.setPointMode)
+
+	// LEVEL (valve state)
+	ch.level = vdevices.NewFloatParameter("LEVEL")
+	ch.level.Description().Control = "HEATING_CONTROL_HMIP.LEVEL"
+	ch.level.Description().Operations = itf.ParameterOperationRead | itf.ParameterOperationEvent
+	ch.level.Description().TabOrder = 3
+	ch.level.Description().Min = 0.0
+	ch.level.Description().Max = 1.0
+	ch.level.Description().Unit = "100%"
+	ch.AddValueParam(ch.level)
+
+	// SET_POINT_TEMPERATURE_COMMAND_TOPIC
+	ch.paramSetPointTopic = vdevices.NewStringParameter("SET_POINT_TEMPERATURE_COMMAND_TOPIC")
+	ch.AddMasterParam(ch.paramSetPointTopic)
+
+	// SET_POINT_TEMPERATURE_PAYLOAD
+	ch.paramSetPointPayload = vdevices.NewStringParameter("SET_POINT_TEMPERATURE_PAYLOAD")
+	ch.paramSetPointPayload.Description().Default = "{{ . }}"
+	ch.paramSetPointPayload.InternalSetValue("{{ . }}")
+	ch.AddMasterParam(ch.paramSetPointPayload)
+
+	// SET_POINT_MODE_COMMAND_TOPIC
+	ch.paramModeTopic = vdevices.NewStringParameter("SET_POINT_MODE_COMMAND_TOPIC")
+	ch.AddMasterParam(ch.paramModeTopic)
+
+	// SET_POINT_MODE_PAYLOAD (the template receives the index of the mode)
+	ch.paramModePayload = vdevices.NewStringParameter("SET_POINT_MODE_PAYLOAD")
+	ch.paramModePayload.Description().Default = "{{ . }}"
+	ch.paramModePayload.InternalSetValue("{{ . }}")
+	ch.AddMasterParam(ch.paramModePayload)
+
+	// RETAIN
+	ch.paramRetain = vdevices.NewBoolParameter("RETAIN")
+	ch.AddMasterParam(ch.paramRetain)
+
+	// setup feedback handlers
+	ch.actualTemperatureFB.channel = ch
+	ch.actualTemperatureFB.targetParam = "ACTUAL_TEMPERATURE"
+	ch.actualTemperatureFB.mqttServer = vd.MQTTServer
+	ch.actualTemperatureFB.valueHandler = func(value float64) {
+		ch.actualTemperature.InternalSetValue(value)
+	}
+	ch.actualTemperatureFB.statusHandler = func(_ int) {}
+	ch.actualTemperatureFB.init()
+
+	ch.setPointTemperatureFB.channel = ch
+	ch.setPointTemperatureFB.targetParam = "SET_POINT_TEMPERATURE"
+	ch.setPointTemperatureFB.mqttServer = vd.MQTTServer
+	ch.setPointTemperatureFB.valueHandler = func(value float64) {
+		ch.setPointTemperature.InternalSetValue(value)
+	}
+	ch.setPointTemperatureFB.statusHandler = func(_ int) {}
+	ch.setPointTemperatureFB.init()
+
+	ch.setPointModeFB.channel = ch
+	ch.setPointModeFB.targetParam = "SET_POINT_MODE"
+	ch.setPointModeFB.mqttServer = vd.MQTTServer
+	ch.setPointModeFB.valueHandler = func(value float64) {
+		mode := int(math.Round(value))
+		if mode < 0 || mode > ch.setPointMode.Description().Max.(int) {
+			log.Warningf("Invalid set point mode for thermostat %s:%d: %g", ch.Description().Parent,
+				ch.Description().Index, value)
+			return
+		}
+		ch.setPointMode.InternalSetValue(mode)
+	}
+	ch.setPointModeFB.statusHandler = func(_ int) {}
+	ch.setPointModeFB.init()
+
+	// the valve state is expected in percent
+	ch.levelFB.channel = ch
+	ch.levelFB.targetParam = "LEVEL"
+	ch.levelFB.mqttServer = vd.MQTTServer
+	ch.levelFB.valueHandler = func(value float64) {
+		ch.level.InternalSetValue(math.Max(0.0, math.Min(1.0, value/100.0)))
+	}
+	ch.levelFB.statusHandler = func(_ int) {}
+	ch.levelFB.init()
+
+	// set point change
+	ch.setPointTemperature.OnSetValue = func(value float64) bool {
+		ch.publishToMQTT(ch.paramSetPointTopic, ch.setPointTemplate, ch.paramSetPointPayload, value)
+		// update set point in channel and publish event to CCU, a feedback
+		// overwrites the set point later on
+		return true
+	}
+
+	// mode change
+	ch.setPointMode.OnSetValue = func(value int) bool {
+		ch.publishToMQTT(ch.paramModeTopic, ch.modeTemplate, ch.paramModePayload, value)
+		return true
+	}
+
+	// clean up
+	ch.thermostatChannel.OnDispose = ch.stop
+
+	// store master param on PutParamset, reregister topics
+	ch.MasterParamset().HandlePutParamset(func() {
+		ch.stop()
+		ch.storeMasterParamset()
+		ch.start()
+	})
+
+	// load master parameters from config
+	ch.loadMasterParamset()
+
+	// register topics
+	ch.start()
+	return ch
+}
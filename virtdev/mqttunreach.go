@@ -113,18 +113,9 @@ func (c *mqttUnreach) setConnError(connError bool) {
 	// update this channel
 	c.digitalChannel.SetState(connError)
 
-	// set parameter UNREACH of channel 0 (maintenance channel)
-	gch, err := c.device.Channel("0")
-	if err != nil {
-		log.Errorf("Maintenance channel (0) not found: %v", err)
-		return
-	}
-	mch, ok := gch.(*vdevices.MaintenanceChannel)
-	if !ok {
-		log.Errorf("Channel (0) is not a maintenance channel")
-		return
-	}
-	mch.SetUnreach(connError)
+	// set parameter UNREACH of channel 0 (maintenance channel), other reasons
+	// (e.g. stale channels) are considered
+	c.virtualDevices.setUnreachSource(c.device, unreachSource{channelIdx: c.Description().Index, connError: true}, connError)
 }
 
 func (c *mqttUnreach) start() {
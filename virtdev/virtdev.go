@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"sync"
 
 	"github.com/mdzio/ccu-jack/mqtt"
 	"github.com/mdzio/ccu-jack/rtcfg"
@@ -11,6 +12,7 @@ import (
 	"github.com/mdzio/go-hmccu/itf/vdevices"
 	"github.com/mdzio/go-hmccu/itf/xmlrpc"
 	"github.com/mdzio/go-logging"
+	"github.com/mdzio/go-veap/model"
 )
 
 const (
@@ -37,6 +39,10 @@ type VirtualDevices struct {
 	EventPublisher vdevices.EventPublisher
 	// MQTT server for MQTT virtual devices, must be set before calling Start.
 	MQTTServer *mqtt.Server
+	// Service for reading data points in computed channels, optional.
+	Service *model.Service
+	// PVObserver triggers the recalculation of computed channels, optional.
+	PVObserver *PVObserver
 
 	// Container for virtual devices.
 	Devices *vdevices.Container
@@ -44,6 +50,18 @@ type VirtualDevices struct {
 	deviceHandler *vdevices.Handler
 	// actually used EventPublisher by devices
 	eventPublisher vdevices.EventPublisher
+
+	// active reasons for UNREACH by device address
+	unreachMtx     sync.Mutex
+	unreachSources map[string]map[unreachSource]bool
+}
+
+// unreachSource is a reason for the UNREACH state of a device.
+type unreachSource struct {
+	channelIdx int
+	// true for a connection error (q.v. mqttUnreach), false for a stale
+	// channel (q.v. maxAge)
+	connError bool
 }
 
 func (vd *VirtualDevices) Start() {
@@ -126,7 +144,7 @@ func (vd *VirtualDevices) SynchronizeDevices() {
 		if !exist {
 			// if not, remove it from container
 			log.Infof("Removing virtual device: %s", dev.Description().Address)
-			if err := vd.Devices.RemoveDevice(dev.Description().Address); err != nil {
+			if err := vd.removeDevice(dev.Description().Address); err != nil {
 				log.Errorf("Remove of virtual device %s failed: %v", dev.Description().Address, err)
 			}
 		}
@@ -145,6 +163,34 @@ func (vd *VirtualDevices) SynchronizeDevices() {
 	}
 }
 
+// recreateDevice replaces a device with a new instance based on the
+// configuration. This is needed, if the structure of the device (e.g. a value
+// list) changes.
+func (vd *VirtualDevices) recreateDevice(address string) {
+	vd.Store.RLock()
+	defer vd.Store.RUnlock()
+	devcfg, exist := vd.Store.Config.VirtualDevices.Devices[address]
+	if !exist {
+		return
+	}
+	log.Infof("Re-creating virtual device: %s", address)
+	if err := vd.removeDevice(address); err != nil {
+		log.Errorf("Remove of virtual device %s failed: %v", address, err)
+		return
+	}
+	if err := vd.createDevice(devcfg); err != nil {
+		log.Errorf("Creation of virtual device %s failed: %v", address, err)
+	}
+}
+
+// removeDevice removes a device from the container.
+func (vd *VirtualDevices) removeDevice(address string) error {
+	vd.unreachMtx.Lock()
+	delete(vd.unreachSources, address)
+	vd.unreachMtx.Unlock()
+	return vd.Devices.RemoveDevice(address)
+}
+
 func (vd *VirtualDevices) createDevice(devcfg *rtcfg.Device) error {
 	// create device
 	dev := vdevices.NewDevice(devcfg.Address, devcfg.HMType, vd.eventPublisher)
@@ -222,6 +268,36 @@ func (vd *VirtualDevices) createDevice(devcfg *rtcfg.Device) error {
 		case rtcfg.ChannelMQTTUnreach:
 			ch := vd.addMQTTUnreach(dev)
 			log.Debugf("Created MQTT connection error channel: %s", ch.Description().Address)
+		case rtcfg.ChannelMQTTBlind:
+			ch := vd.addMQTTBlind(dev)
+			log.Debugf("Created MQTT blind channel: %s", ch.Description().Address)
+		case rtcfg.ChannelMQTTThermostat:
+			ch := vd.addMQTTThermostat(dev)
+			log.Debugf("Created MQTT thermostat channel: %s", ch.Description().Address)
+		case rtcfg.ChannelMQTTColorLight:
+			ch := vd.addMQTTColorLight(dev)
+			log.Debugf("Created MQTT color light channel: %s", ch.Description().Address)
+		case rtcfg.ChannelMQTTStringReceiver:
+			ch := vd.addMQTTStringReceiver(dev)
+			log.Debugf("Created MQTT string receiver channel: %s", ch.Description().Address)
+		case rtcfg.ChannelMQTTEnumReceiver:
+			ch := vd.addMQTTEnumReceiver(dev)
+			log.Debugf("Created MQTT enum receiver channel: %s", ch.Description().Address)
+		case rtcfg.ChannelMQTTSmokeDetector:
+			ch := vd.addMQTTSmokeDetector(dev)
+			log.Debugf("Created MQTT smoke detector channel: %s", ch.Description().Address)
+		case rtcfg.ChannelMQTTWaterSensor:
+			ch := vd.addMQTTWaterSensor(dev)
+			log.Debugf("Created MQTT water sensor channel: %s", ch.Description().Address)
+		case rtcfg.ChannelMQTTMotionDetector:
+			ch := vd.addMQTTMotionDetector(dev)
+			log.Debugf("Created MQTT motion detector channel: %s", ch.Description().Address)
+		case rtcfg.ChannelMQTTWindowHandle:
+			ch := vd.addMQTTWindowHandle(dev)
+			log.Debugf("Created MQTT window handle channel: %s", ch.Description().Address)
+		case rtcfg.ChannelComputed:
+			ch := vd.addComputedChannel(dev)
+			log.Debugf("Created computed channel: %s", ch.Description().Address)
 
 		default:
 			return fmt.Errorf("Unsupported kind of channel in device %s: %v", devcfg.Address, chcfg.Kind)
@@ -233,3 +309,37 @@ func (vd *VirtualDevices) createDevice(devcfg *rtcfg.Device) error {
 	}
 	return nil
 }
+
+// setChannelStale updates the stale state of a channel (q.v. maxAge).
+func (vd *VirtualDevices) setChannelStale(dev *vdevices.Device, channelIdx int, stale bool) {
+	vd.setUnreachSource(dev, unreachSource{channelIdx: channelIdx}, stale)
+}
+
+// setUnreachSource activates or deactivates a reason for UNREACH. UNREACH of
+// the maintenance channel is set, if the first reason becomes active (e.g. a
+// channel becomes stale), and cleared, if the last one becomes inactive.
+func (vd *VirtualDevices) setUnreachSource(dev *vdevices.Device, src unreachSource, active bool) {
+	vd.unreachMtx.Lock()
+	defer vd.unreachMtx.Unlock()
+	if vd.unreachSources == nil {
+		vd.unreachSources = make(map[string]map[unreachSource]bool)
+	}
+	addr := dev.Description().Address
+	srcs := vd.unreachSources[addr]
+	wasUnreach := len(srcs) > 0
+	if active {
+		if srcs == nil {
+			srcs = make(map[unreachSource]bool)
+			vd.unreachSources[addr] = srcs
+		}
+		srcs[src] = true
+	} else {
+		delete(srcs, src)
+		if len(srcs) == 0 {
+			delete(vd.unreachSources, addr)
+		}
+	}
+	if isUnreach := len(srcs) > 0; isUnreach != wasUnreach {
+		setUnreach(dev, isUnreach)
+	}
+}
@@ -0,0 +1,144 @@
+package vmodel
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/model"
+
+	"github.com/mdzio/ccu-jack/mqtt"
+	"github.com/mdzio/ccu-jack/rtcfg"
+)
+
+// BridgeCol contains the MQTT bridges of the runtime configuration (q.v.
+// rtcfg.MQTTBridge). The items are kept in sync with the configuration. Each
+// bridge has the read-only variables connected, lastError, reconnects,
+// messagesIn, messagesOut, messagesDropped and messagesQueued.
+type BridgeCol struct {
+	model.Domain
+	Bridges *mqtt.Bridges
+
+	store   *rtcfg.Store
+	mtx     sync.Mutex
+	bridges map[string]*model.Domain
+}
+
+// NewBridgeCol creates a new BridgeCol.
+func NewBridgeCol(col model.ChangeableCollection, store *rtcfg.Store, bridges *mqtt.Bridges) *BridgeCol {
+	bc := new(BridgeCol)
+	bc.Identifier = "bridges"
+	bc.Title = "MQTT bridges"
+	bc.Description = "Connections to remote MQTT servers"
+	bc.Collection = col
+	bc.ItemRole = "bridge"
+	bc.Bridges = bridges
+	bc.store = store
+	bc.bridges = make(map[string]*model.Domain)
+	col.PutItem(bc)
+	return bc
+}
+
+// Items implements model.Collection.
+func (bc *BridgeCol) Items() []model.ItemObject {
+	bc.mtx.Lock()
+	defer bc.mtx.Unlock()
+	bc.synchronize()
+	ids := make([]string, 0, len(bc.bridges))
+	for id := range bc.bridges {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	items := make([]model.ItemObject, len(ids))
+	for i, id := range ids {
+		items[i] = bc.bridges[id]
+	}
+	return items
+}
+
+// Item implements model.Collection.
+func (bc *BridgeCol) Item(id string) (model.ItemObject, bool) {
+	bc.mtx.Lock()
+	defer bc.mtx.Unlock()
+	bc.synchronize()
+	b, ok := bc.bridges[id]
+	if !ok {
+		return nil, false
+	}
+	return b, true
+}
+
+// synchronize updates the bridge objects from the configuration. bc.mtx must
+// be locked.
+func (bc *BridgeCol) synchronize() {
+	bc.store.RLock()
+	defer bc.store.RUnlock()
+	cfgs := bc.store.Config.MQTT.Bridges
+	for id := range bc.bridges {
+		if _, ok := cfgs[id]; !ok {
+			delete(bc.bridges, id)
+		}
+	}
+	for id, cfg := range cfgs {
+		b, ok := bc.bridges[id]
+		if !ok {
+			b = bc.newBridge(id)
+			bc.bridges[id] = b
+		}
+		b.Description = cfg.Address
+	}
+}
+
+func (bc *BridgeCol) newBridge(id string) *model.Domain {
+	b := model.NewDomain(&model.DomainCfg{
+		Identifier:     id,
+		Title:          id,
+		ItemRole:       "variable",
+		CollectionRole: "bridges",
+	})
+	b.Collection = bc
+	for _, v := range []struct {
+		id, title, descr string
+		value            func(st mqtt.BridgeStatus) interface{}
+	}{
+		{"connected", "Connected", "Connection to the remote server is established",
+			func(st mqtt.BridgeStatus) interface{} { return st.Connected }},
+		{"lastError", "Last error", "Last error of the bridge",
+			func(st mqtt.BridgeStatus) interface{} { return st.LastError }},
+		{"reconnects", "Reconnects", "Number of connection attempts after an error",
+			func(st mqtt.BridgeStatus) interface{} { return st.Reconnects }},
+		{"messagesIn", "Incoming messages", "Number of messages received from the remote server",
+			func(st mqtt.BridgeStatus) interface{} { return st.MessagesIn }},
+		{"messagesOut", "Outgoing messages", "Number of messages sent to the remote server",
+			func(st mqtt.BridgeStatus) interface{} { return st.MessagesOut }},
+		{"messagesDropped", "Dropped messages", "Number of messages dropped by the transformations",
+			func(st mqtt.BridgeStatus) interface{} { return st.MessagesDropped }},
+		{"messagesQueued", "Queued messages", "Number of outgoing messages in the offline queue",
+			func(st mqtt.BridgeStatus) interface{} { return st.MessagesQueued }},
+	} {
+		v := v // clone for callback
+		model.NewROVariable(&model.ROVariableCfg{
+			Identifier:  v.id,
+			Title:       v.title,
+			Description: v.descr,
+			Collection:  b,
+			ReadPVFunc: func() (veap.PV, veap.Error) {
+				st, ok := bc.Bridges.Status(id)
+				if !ok {
+					return veap.PV{}, veap.NewErrorf(veap.StatusNotFound, "Bridge not found: %s", id)
+				}
+				ts := time.Now()
+				if v.id == "lastError" && !st.LastErrorTime.IsZero() {
+					ts = st.LastErrorTime
+				}
+				state := veap.StateGood
+				if !st.Enabled {
+					state = veap.StateUncertain
+				}
+				return veap.PV{Time: ts, Value: v.value(st), State: state}, nil
+			},
+		})
+	}
+	return b
+}
@@ -32,6 +32,12 @@ type DeviceCol struct {
 	Interconnector *itf.Interconnector
 	ReGaDOM        *script.ReGaDOM
 	ModelService   *model.Service
+	// MQTTTopics provides the MQTT topics of the parameters.
+	MQTTTopics MQTTTopics
+	// History provides the recorded values of the parameters.
+	History PVHistory
+	// Recorder receives the value changes of the parameters, optional.
+	Recorder PVRecorder
 
 	notifications chan *deviceNotif
 	stopRequest   chan struct{}
@@ -510,19 +516,18 @@ func (p *parameter) GetDescription() string {
 func (p *parameter) ReadAttributes() veap.AttrValues {
 	ch := p.Collection.(*channel)
 	dev := ch.Collection.(*device)
-	mqttTopic := dev.GetIdentifier() + "/" + ch.GetIdentifier() + "/" + p.GetIdentifier()
+	devCol := dev.Collection.(*DeviceCol)
 	attrs := veap.AttrValues{
-		"type":            p.descr.Type,
-		"operations":      p.descr.Operations,
-		"flags":           p.descr.Flags,
-		"default":         p.descr.Default,
-		"maximum":         p.descr.Max,
-		"minimum":         p.descr.Min,
-		"unit":            p.descr.Unit,
-		"tabOrder":        p.descr.TabOrder,
-		"control":         p.descr.Control,
-		"id":              p.descr.ID,
-		"mqttStatusTopic": "device/status/" + mqttTopic,
+		"type":       p.descr.Type,
+		"operations": p.descr.Operations,
+		"flags":      p.descr.Flags,
+		"default":    p.descr.Default,
+		"maximum":    p.descr.Max,
+		"minimum":    p.descr.Min,
+		"unit":       p.descr.Unit,
+		"tabOrder":   p.descr.TabOrder,
+		"control":    p.descr.Control,
+		"id":         p.descr.ID,
 	}
 
 	// special attributes
@@ -546,52 +551,85 @@ func (p *parameter) ReadAttributes() veap.AttrValues {
 		attrs["valueList"] = valueList
 	}
 
-	// parameter writeable?
-	if p.descr.Operations&itf.ParameterOperationWrite != 0 {
-		attrs["mqttSetTopic"] = "device/set/" + mqttTopic
-	}
+	// MQTT topics
+	writeable := p.descr.Operations&itf.ParameterOperationWrite != 0
+	addMQTTTopics(attrs, devCol.MQTTTopics, model.AbsPath(p), writeable)
 	return attrs
 }
 
 func (p *parameter) ReadPV() (veap.PV, veap.Error) {
 	// if no value is present, retrieve the current value from the ReGaHss of
 	// the CCU per HM script.
-	if p.pv.Value == nil {
-		ch := p.Collection.(*channel)
-		dev := ch.Collection.(*device)
-		devCol := dev.Collection.(*DeviceCol)
-		client := devCol.ReGaDOM.ScriptClient
-		addr := dev.itfClient.ReGaHssID + "." + ch.descr.Address + "." + p.descr.ID
-		val, err := client.ReadValues([]script.ValObjDef{{ISEID: addr, Type: p.descr.Type}})
-		if err != nil {
-			return veap.PV{}, veap.NewError(veap.StatusInternalServerError, err)
-		}
-		state := veap.StateGood
-		if val[0].Uncertain {
-			state = veap.StateUncertain
-		}
-		// store and return PV
-		p.pvLock.Lock()
-		defer p.pvLock.Unlock()
-		p.pv = veap.PV{
-			Time:  val[0].Timestamp,
-			Value: val[0].Value,
-			State: state,
-		}
-		return p.pv, nil
+	if pv, ok := p.cachedPV(); ok {
+		return pv, nil
+	}
+	val, err := p.scriptClient().ReadValues([]script.ValObjDef{p.valObjDef()})
+	if err != nil {
+		return veap.PV{}, veap.NewError(veap.StatusInternalServerError, err)
 	}
-	// return PV
+	return p.storeValue(val[0]), nil
+}
+
+// cachedPV returns the last received PV, if present.
+func (p *parameter) cachedPV() (veap.PV, bool) {
 	p.pvLock.RLock()
 	defer p.pvLock.RUnlock()
-	return p.pv, nil
+	return p.pv, p.pv.Value != nil
+}
+
+// valObjDef returns the definition for reading the value per HM script.
+func (p *parameter) valObjDef() script.ValObjDef {
+	ch := p.Collection.(*channel)
+	dev := ch.Collection.(*device)
+	addr := dev.itfClient.ReGaHssID + "." + ch.descr.Address + "." + p.descr.ID
+	return script.ValObjDef{ISEID: addr, Type: p.descr.Type}
+}
+
+func (p *parameter) scriptClient() *script.Client {
+	devCol := p.Collection.(*channel).Collection.(*device).Collection.(*DeviceCol)
+	return devCol.ReGaDOM.ScriptClient
+}
+
+// storeValue stores and returns a value read per HM script.
+func (p *parameter) storeValue(val script.Value) veap.PV {
+	state := veap.StateGood
+	if val.Uncertain {
+		state = veap.StateUncertain
+	}
+	p.pvLock.Lock()
+	defer p.pvLock.Unlock()
+	p.pv = veap.PV{
+		Time:  val.Timestamp,
+		Value: val.Value,
+		State: state,
+	}
+	return p.pv
+}
+
+func (p *parameter) ReadHistory(begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error) {
+	devCol := p.Collection.(*channel).Collection.(*device).Collection.(*DeviceCol)
+	return readHistory(devCol.History, model.AbsPath(p), begin, end, limit)
 }
 
 func (p *parameter) WritePV(pv veap.PV) veap.Error {
 	// get channel and device
 	ch := p.Collection.(*channel)
 	dev := ch.Collection.(*device)
+	value, verr := p.convertValue(pv.Value)
+	if verr != nil {
+		return verr
+	}
+	// set value through XML-RPC
+	err := dev.itfClient.SetValue(ch.descr.Address, p.descr.ID, value)
+	if err != nil {
+		return veap.NewError(veap.StatusInternalServerError, err)
+	}
+	return nil
+}
+
+// convertValue converts and checks a value for writing.
+func (p *parameter) convertValue(value interface{}) (interface{}, veap.Error) {
 	// convert JSON number/float64 to int for parameters of type INTEGER/ENUM
-	value := pv.Value
 	f, ok := value.(float64)
 	if (p.descr.Type == "ENUM" || p.descr.Type == "INTEGER") && ok {
 		value = int(f)
@@ -599,26 +637,28 @@ func (p *parameter) WritePV(pv veap.PV) veap.Error {
 	// check data type
 	err := checkType(p.descr.Type, value)
 	if err != nil {
-		return veap.NewErrorf(veap.StatusInternalServerError, "Writing parameter %s failed: %v", ch.descr.Address+"."+p.descr.ID, err)
-	}
-	// set value through XML-RPC
-	err = dev.itfClient.SetValue(ch.descr.Address, p.descr.ID, value)
-	if err != nil {
-		return veap.NewError(veap.StatusInternalServerError, err)
+		ch := p.Collection.(*channel)
+		return nil, veap.NewErrorf(veap.StatusInternalServerError, "Writing parameter %s failed: %v", ch.descr.Address+"."+p.descr.ID, err)
 	}
-	return nil
+	return value, nil
 }
 
 // update PV with new value
 func (p *parameter) updatePV(v interface{}) {
-	// store PV
-	p.pvLock.Lock()
-	defer p.pvLock.Unlock()
-	p.pv = veap.PV{
+	pv := veap.PV{
 		Time:  time.Now(),
 		Value: v,
 		State: veap.StateGood,
 	}
+	// store PV
+	p.pvLock.Lock()
+	p.pv = pv
+	p.pvLock.Unlock()
+	// notify recorder
+	devCol := p.Collection.(*channel).Collection.(*device).Collection.(*DeviceCol)
+	if devCol.Recorder != nil {
+		devCol.Recorder.Record(model.AbsPath(p), pv)
+	}
 }
 
 type paramset struct {
@@ -0,0 +1,273 @@
+package vmodel
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mdzio/go-lib/any"
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/model"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+)
+
+// DeviceTemplateCol contains the virtual device templates of the runtime
+// configuration (q.v. rtcfg.DeviceTemplate). The items are kept in sync with
+// the configuration. A template is instantiated by writing the name of the new
+// device or an object {"Name": "...", "Address": "...", "Params": {...}} to its
+// PV. Address and Params are optional. Afterwards, the PV of the template
+// contains the address of the created device (q.v. DeviceTemplateResult).
+type DeviceTemplateCol struct {
+	model.Domain
+
+	store     *rtcfg.Store
+	configVar *Config
+	mtx       sync.Mutex
+	templates map[string]*deviceTemplate
+}
+
+// DeviceTemplateResult is the PV value of a template after an instantiation.
+type DeviceTemplateResult struct {
+	Name    string
+	Address string
+}
+
+// NewDeviceTemplateCol creates a new DeviceTemplateCol. Created devices are
+// announced through the change listener of configVar.
+func NewDeviceTemplateCol(col model.ChangeableCollection, store *rtcfg.Store, configVar *Config) *DeviceTemplateCol {
+	tc := new(DeviceTemplateCol)
+	tc.Identifier = "devicetemplates"
+	tc.Title = "Device templates"
+	tc.Description = "Templates for virtual devices"
+	tc.Collection = col
+	tc.ItemRole = "devicetemplate"
+	tc.store = store
+	tc.configVar = configVar
+	tc.templates = make(map[string]*deviceTemplate)
+	col.PutItem(tc)
+	return tc
+}
+
+// Items implements model.Collection.
+func (tc *DeviceTemplateCol) Items() []model.ItemObject {
+	tc.mtx.Lock()
+	defer tc.mtx.Unlock()
+	tc.synchronize()
+	ids := make([]string, 0, len(tc.templates))
+	for id := range tc.templates {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	items := make([]model.ItemObject, len(ids))
+	for i, id := range ids {
+		items[i] = tc.templates[id]
+	}
+	return items
+}
+
+// Item implements model.Collection.
+func (tc *DeviceTemplateCol) Item(id string) (model.ItemObject, bool) {
+	tc.mtx.Lock()
+	defer tc.mtx.Unlock()
+	tc.synchronize()
+	t, ok := tc.templates[id]
+	if !ok {
+		return nil, false
+	}
+	return t, true
+}
+
+// synchronize updates the template objects from the configuration. tc.mtx
+// must be locked.
+func (tc *DeviceTemplateCol) synchronize() {
+	tc.store.RLock()
+	defer tc.store.RUnlock()
+	cfgs := tc.store.Config.VirtualDevices.Templates
+	for id := range tc.templates {
+		if _, ok := cfgs[id]; !ok {
+			delete(tc.templates, id)
+		}
+	}
+	for id, cfg := range cfgs {
+		t, ok := tc.templates[id]
+		if !ok {
+			t = &deviceTemplate{
+				pv: veap.PV{
+					Time:  time.Now(),
+					Value: DeviceTemplateResult{},
+					State: veap.StateGood,
+				},
+			}
+			t.Identifier = id
+			t.Title = id
+			t.Collection = tc
+			t.CollectionRole = "devicetemplates"
+			tc.templates[id] = t
+		}
+		t.Description = cfg.Description
+	}
+}
+
+// instantiate creates a virtual device from a template.
+func (tc *DeviceTemplateCol) instantiate(id, name, address string, params map[string]string) (string, error) {
+	tc.store.Lock()
+	defer tc.store.Unlock()
+	vds := &tc.store.Config.VirtualDevices
+	tmpl, ok := vds.Templates[id]
+	if !ok {
+		return "", fmt.Errorf("Device template not found: %s", id)
+	}
+	if vds.Devices == nil {
+		vds.Devices = make(map[string]*rtcfg.Device)
+	}
+	if address == "" {
+		address = vds.NewAddress()
+	} else if _, exists := vds.Devices[address]; exists {
+		return "", fmt.Errorf("Virtual device already exists: %s", address)
+	}
+	ps := map[string]string{"Name": name}
+	for k, v := range params {
+		ps[k] = v
+	}
+	vds.Devices[address] = tmpl.Instantiate(address, ps)
+	deviceLog.Infof("Virtual device %s created from template %s", address, id)
+	tc.configVar.notifyChange(&tc.store.Config)
+	return address, nil
+}
+
+// deviceTemplate is the VEAP object of a device template.
+type deviceTemplate struct {
+	model.BasicObject
+	model.BasicItem
+
+	pvMtx sync.RWMutex
+	pv    veap.PV
+}
+
+func (t *deviceTemplate) ReadAttributes() veap.AttrValues {
+	attrs := t.BasicObject.ReadAttributes()
+	tc := t.Collection.(*DeviceTemplateCol)
+	tc.store.RLock()
+	defer tc.store.RUnlock()
+	if cfg, ok := tc.store.Config.VirtualDevices.Templates[t.Identifier]; ok {
+		attrs["hmType"] = cfg.HMType
+		attrs["channels"] = len(cfg.Channels)
+	}
+	return attrs
+}
+
+func (t *deviceTemplate) ReadPV() (veap.PV, veap.Error) {
+	t.pvMtx.RLock()
+	defer t.pvMtx.RUnlock()
+	return t.pv, nil
+}
+
+func (t *deviceTemplate) WritePV(pv veap.PV) veap.Error {
+	if pv.State.Bad() {
+		return nil
+	}
+	var name, address string
+	params := make(map[string]string)
+	switch v := pv.Value.(type) {
+	case string:
+		name = v
+	case map[string]interface{}:
+		q := any.Q(v)
+		o := q.Map()
+		name = o.Key("Name").String()
+		address = o.TryKey("Address").String()
+		for k, p := range o.TryKey("Params").Map().Unwrap() {
+			params[k] = fmt.Sprint(p)
+		}
+		if q.Err() != nil {
+			return veap.NewErrorf(veap.StatusBadRequest, "Invalid instantiation of device template %s: %v", t.Identifier, q.Err())
+		}
+	default:
+		return veap.NewErrorf(veap.StatusBadRequest, "Process value is not of type string or object")
+	}
+	if name == "" {
+		return veap.NewErrorf(veap.StatusBadRequest, "Name of the device is missing")
+	}
+	address, err := t.Collection.(*DeviceTemplateCol).instantiate(t.Identifier, name, address, params)
+	if err != nil {
+		return veap.NewError(veap.StatusBadRequest, err)
+	}
+	t.pvMtx.Lock()
+	t.pv = veap.PV{Time: time.Now(), Value: DeviceTemplateResult{Name: name, Address: address}, State: veap.StateGood}
+	t.pvMtx.Unlock()
+	return nil
+}
+
+// NewDeviceDefinitions creates a variable for the export and import of virtual
+// device definitions. Reading returns the definitions of all virtual devices.
+// Writing a list of definitions adds the devices. Missing or already used
+// addresses are replaced by new ones. Added devices are announced through the
+// change listener of configVar.
+func NewDeviceDefinitions(col model.ChangeableCollection, store *rtcfg.Store, configVar *Config) *model.Variable {
+	return model.NewVariable(&model.VariableCfg{
+		Identifier:  "devicedefs",
+		Title:       "Device definitions",
+		Description: "Export and import of virtual device definitions",
+		Collection:  col,
+		ReadPVFunc: func() (veap.PV, veap.Error) {
+			store.RLock()
+			defer store.RUnlock()
+			devs := store.Config.VirtualDevices.Devices
+			addrs := make([]string, 0, len(devs))
+			for addr := range devs {
+				addrs = append(addrs, addr)
+			}
+			sort.Strings(addrs)
+			// copy definitions, because master parameters can be modified
+			// concurrently after releasing the lock
+			defs := make([]rtcfg.Device, len(addrs))
+			for i, addr := range addrs {
+				d := devs[addr]
+				defs[i] = rtcfg.Device{Address: d.Address, HMType: d.HMType, Channels: make([]rtcfg.Channel, len(d.Channels)), Discovered: d.Discovered}
+				for j, ch := range d.Channels {
+					ps := make(map[string]interface{}, len(ch.MasterParamset))
+					for id, v := range ch.MasterParamset {
+						ps[id] = v
+					}
+					defs[i].Channels[j] = rtcfg.Channel{Kind: ch.Kind, MasterParamset: ps}
+				}
+			}
+			return veap.PV{Time: time.Now(), Value: defs, State: veap.StateGood}, nil
+		},
+		WritePVFunc: func(pv veap.PV) veap.Error {
+			q := any.Q(pv.Value)
+			var defs []*rtcfg.Device
+			for _, dq := range q.Slice() {
+				d := decodeDevice(dq)
+				if q.Err() == nil && d.HMType == "" {
+					return veap.NewErrorf(veap.StatusBadRequest, "HM type of device %s is missing", d.Address)
+				}
+				defs = append(defs, d)
+			}
+			if q.Err() != nil {
+				return veap.NewErrorf(veap.StatusBadRequest, "Invalid device definitions: %v", q.Err())
+			}
+			store.Lock()
+			defer store.Unlock()
+			vds := &store.Config.VirtualDevices
+			if vds.Devices == nil {
+				vds.Devices = make(map[string]*rtcfg.Device)
+			}
+			for _, d := range defs {
+				if _, exists := vds.Devices[d.Address]; d.Address == "" || exists {
+					d.Address = vds.NewAddress()
+				}
+				// only one virtual device per discovered device
+				if d.Discovered != "" && vds.DiscoveredAddress(d.Discovered) != "" {
+					d.Discovered = ""
+				}
+				vds.Devices[d.Address] = d
+				deviceLog.Infof("Virtual device %s imported", d.Address)
+			}
+			configVar.notifyChange(&store.Config)
+			return nil
+		},
+	})
+}
@@ -0,0 +1,155 @@
+package vmodel
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/model"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+	"github.com/mdzio/ccu-jack/virtdev"
+)
+
+// DiscoveryCol contains the devices found by the device discovery (q.v.
+// virtdev.Discovery). The PV of a discovered device contains the address of
+// the created virtual device or an empty string. Writing true to the PV
+// creates the virtual device from the proposed definition. The link to the
+// discovered device is stored in the configuration of the virtual device
+// (q.v. rtcfg.Device.Discovered).
+type DiscoveryCol struct {
+	model.Domain
+
+	discovery *virtdev.Discovery
+	store     *rtcfg.Store
+	configVar *Config
+	mtx       sync.Mutex
+}
+
+// NewDiscoveryCol creates a new DiscoveryCol. Created devices are announced
+// through the change listener of configVar.
+func NewDiscoveryCol(col model.ChangeableCollection, discovery *virtdev.Discovery, store *rtcfg.Store, configVar *Config) *DiscoveryCol {
+	dc := new(DiscoveryCol)
+	dc.Identifier = "discovery"
+	dc.Title = "Device discovery"
+	dc.Description = "Devices announced on the MQTT server"
+	dc.Collection = col
+	dc.ItemRole = "discovereddevice"
+	dc.discovery = discovery
+	dc.store = store
+	dc.configVar = configVar
+	col.PutItem(dc)
+	return dc
+}
+
+// Items implements model.Collection.
+func (dc *DiscoveryCol) Items() []model.ItemObject {
+	devs := dc.discovery.Devices()
+	items := make([]model.ItemObject, len(devs))
+	for i, dev := range devs {
+		items[i] = dc.newItem(dev)
+	}
+	return items
+}
+
+// Item implements model.Collection.
+func (dc *DiscoveryCol) Item(id string) (model.ItemObject, bool) {
+	dev, ok := dc.discovery.Device(id)
+	if !ok {
+		return nil, false
+	}
+	return dc.newItem(dev), true
+}
+
+func (dc *DiscoveryCol) newItem(dev virtdev.DiscoveredDevice) *discoveredDevice {
+	d := &discoveredDevice{id: dev.Identifier}
+	d.Identifier = dev.Identifier
+	d.Title = dev.Name
+	d.Description = dev.Model
+	d.Collection = dc
+	d.CollectionRole = "discovery"
+	return d
+}
+
+// approve creates the virtual device for a discovered device.
+func (dc *DiscoveryCol) approve(id string) (string, error) {
+	// prevent concurrent approvals of the same device
+	dc.mtx.Lock()
+	defer dc.mtx.Unlock()
+	dev, ok := dc.discovery.Device(id)
+	if !ok {
+		return "", fmt.Errorf("Discovered device not found: %s", id)
+	}
+	if dev.Template == nil {
+		return "", fmt.Errorf("Discovered device %s (%s) is not supported", id, dev.Model)
+	}
+	dc.store.Lock()
+	defer dc.store.Unlock()
+	vds := &dc.store.Config.VirtualDevices
+	if addr := vds.DiscoveredAddress(id); addr != "" {
+		return "", fmt.Errorf("Virtual device %s already created for discovered device %s", addr, id)
+	}
+	if vds.Devices == nil {
+		vds.Devices = make(map[string]*rtcfg.Device)
+	}
+	address := vds.NewAddress()
+	// instantiation copies the master parameters
+	vdev := dev.Template.Instantiate(address, nil)
+	vdev.Discovered = id
+	vds.Devices[address] = vdev
+	deviceLog.Infof("Virtual device %s created for discovered device %s", address, id)
+	dc.configVar.notifyChange(&dc.store.Config)
+	return address, nil
+}
+
+// discoveredDevice is the VEAP object of a discovered device.
+type discoveredDevice struct {
+	model.BasicObject
+	model.BasicItem
+
+	id string
+}
+
+func (d *discoveredDevice) ReadAttributes() veap.AttrValues {
+	attrs := d.BasicObject.ReadAttributes()
+	dev, ok := d.Collection.(*DiscoveryCol).discovery.Device(d.id)
+	if !ok {
+		return attrs
+	}
+	attrs["source"] = dev.Source
+	attrs["supported"] = dev.Template != nil
+	if dev.Template != nil {
+		attrs["hmType"] = dev.Template.HMType
+		attrs["channels"] = len(dev.Template.Channels)
+	}
+	return attrs
+}
+
+func (d *discoveredDevice) ReadPV() (veap.PV, veap.Error) {
+	dc := d.Collection.(*DiscoveryCol)
+	if _, ok := dc.discovery.Device(d.id); !ok {
+		return veap.PV{}, veap.NewErrorf(veap.StatusNotFound, "Discovered device not found: %s", d.id)
+	}
+	dc.store.RLock()
+	address := dc.store.Config.VirtualDevices.DiscoveredAddress(d.id)
+	dc.store.RUnlock()
+	return veap.PV{Time: time.Now(), Value: address, State: veap.StateGood}, nil
+}
+
+func (d *discoveredDevice) WritePV(pv veap.PV) veap.Error {
+	if pv.State.Bad() {
+		return nil
+	}
+	b, ok := pv.Value.(bool)
+	if !ok {
+		return veap.NewErrorf(veap.StatusBadRequest, "Process value is not of type boolean")
+	}
+	if !b {
+		return nil
+	}
+	if _, err := d.Collection.(*DiscoveryCol).approve(d.id); err != nil {
+		return veap.NewError(veap.StatusBadRequest, err)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package vmodel
+
+import (
+	"github.com/mdzio/go-hmccu/script"
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/model"
+)
+
+// MetaService implements veap.MetaService with optimized bulk access to the
+// device parameters. Cached PVs of device parameters are returned directly,
+// missing PVs are retrieved from the ReGaHss with a single HM script.
+// Consecutive writes to parameters of the same channel are combined into one
+// putParamset call, so that they are applied at once. All other objects are
+// accessed one after another with the basic implementation.
+type MetaService struct {
+	veap.BasicMetaService
+	ModelService *model.Service
+}
+
+// NewMetaService creates a new MetaService.
+func NewMetaService(modelService *model.Service) *MetaService {
+	return &MetaService{
+		BasicMetaService: veap.BasicMetaService{Service: modelService},
+		ModelService:     modelService,
+	}
+}
+
+// Make sure that MetaService implements veap.MetaService.
+var _ veap.MetaService = (*MetaService)(nil)
+
+// paramWrites collects the writes to the parameters of a channel.
+type paramWrites struct {
+	channel *channel
+	params  []*parameter
+	values  map[string]interface{}
+	indices []int
+}
+
+// ExgData implements veap.MetaService. The writes are executed in the
+// requested order before the reads.
+func (s *MetaService) ExgData(writePVs []veap.WritePVParam, readPaths []string) (writeErrors []veap.Error, readResults []veap.ReadPVResult, serviceError veap.Error) {
+	writeErrors = s.writePVs(writePVs)
+	readResults = s.readPVs(readPaths)
+	return
+}
+
+func (s *MetaService) writePVs(writePVs []veap.WritePVParam) []veap.Error {
+	errs := make([]veap.Error, len(writePVs))
+	// consecutive writes to the same channel
+	var g *paramWrites
+	for idx, w := range writePVs {
+		p := s.parameter(w.Path)
+		if p == nil {
+			g.flush(errs)
+			g = nil
+			errs[idx] = s.WritePV(w.Path, w.PV)
+			continue
+		}
+		value, err := p.convertValue(w.PV.Value)
+		if err != nil {
+			errs[idx] = err
+			continue
+		}
+		ch := p.Collection.(*channel)
+		if g != nil {
+			// a parameter written twice needs a second call
+			_, dup := g.values[p.descr.ID]
+			if g.channel != ch || dup {
+				g.flush(errs)
+				g = nil
+			}
+		}
+		if g == nil {
+			g = &paramWrites{channel: ch, values: make(map[string]interface{})}
+		}
+		g.params = append(g.params, p)
+		g.values[p.descr.ID] = value
+		g.indices = append(g.indices, idx)
+	}
+	g.flush(errs)
+	return errs
+}
+
+// flush writes the collected parameters and stores the errors by request
+// index. g can be nil.
+func (g *paramWrites) flush(errs []veap.Error) {
+	if g == nil {
+		return
+	}
+	dev := g.channel.Collection.(*device)
+	var err error
+	if len(g.indices) == 1 {
+		err = dev.itfClient.SetValue(g.channel.descr.Address, g.params[0].descr.ID, g.values[g.params[0].descr.ID])
+	} else {
+		deviceLog.Debugf("Writing %d parameters of channel %s with putParamset", len(g.values), g.channel.descr.Address)
+		err = dev.itfClient.PutParamset(g.channel.descr.Address, "VALUES", g.values)
+	}
+	if err != nil {
+		verr := veap.NewError(veap.StatusInternalServerError, err)
+		for _, idx := range g.indices {
+			errs[idx] = verr
+		}
+	}
+}
+
+func (s *MetaService) readPVs(readPaths []string) []veap.ReadPVResult {
+	results := make([]veap.ReadPVResult, len(readPaths))
+	// parameters without cached PV
+	var missing []*parameter
+	var indices []int
+	for idx, path := range readPaths {
+		p := s.parameter(path)
+		if p == nil {
+			pv, err := s.ReadPV(path)
+			results[idx] = veap.ReadPVResult{PV: pv, Error: err}
+			continue
+		}
+		if pv, ok := p.cachedPV(); ok {
+			results[idx] = veap.ReadPVResult{PV: pv}
+			continue
+		}
+		missing = append(missing, p)
+		indices = append(indices, idx)
+	}
+	if len(missing) == 0 {
+		return results
+	}
+
+	// read missing PVs with a single HM script
+	defs := make([]script.ValObjDef, len(missing))
+	for i, p := range missing {
+		defs[i] = p.valObjDef()
+	}
+	vals, err := missing[0].scriptClient().ReadValues(defs)
+	if err != nil {
+		verr := veap.NewError(veap.StatusInternalServerError, err)
+		for _, idx := range indices {
+			results[idx] = veap.ReadPVResult{Error: verr}
+		}
+		return results
+	}
+	for i, p := range missing {
+		if vals[i].Err != nil {
+			results[indices[i]] = veap.ReadPVResult{Error: veap.NewError(veap.StatusInternalServerError, vals[i].Err)}
+			continue
+		}
+		results[indices[i]] = veap.ReadPVResult{PV: p.storeValue(vals[i])}
+	}
+	return results
+}
+
+// parameter returns the device parameter for the specified path or nil.
+func (s *MetaService) parameter(path string) *parameter {
+	obj, err := s.ModelService.EvalPath(path)
+	if err != nil {
+		return nil
+	}
+	p, _ := obj.(*parameter)
+	return p
+}
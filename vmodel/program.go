@@ -22,6 +22,11 @@ var prgLog = logging.Get("program")
 type ProgramCol struct {
 	model.Domain
 	ScriptClient *script.Client
+	// MQTTTopics provides the MQTT topics of the programs.
+	MQTTTopics MQTTTopics
+	// Recorder receives the executions of the programs by the CCU-Jack,
+	// optional.
+	Recorder PVRecorder
 
 	stopRequest chan struct{}
 	stopped     sync.WaitGroup
@@ -155,12 +160,10 @@ func (p *program) GetDescription() string {
 
 func (p *program) ReadAttributes() veap.AttrValues {
 	attr := veap.AttrValues{
-		"active":          p.prg.Active,
-		"visible":         p.prg.Visible,
-		"mqttGetTopic":    "program/get/" + p.prg.ISEID,
-		"mqttStatusTopic": "program/status/" + p.prg.ISEID,
-		"mqttSetTopic":    "program/set/" + p.prg.ISEID,
+		"active":  p.prg.Active,
+		"visible": p.prg.Visible,
 	}
+	addMQTTTopics(attr, p.Collection.(*ProgramCol).MQTTTopics, model.AbsPath(p), true)
 	return attr
 }
 
@@ -183,6 +186,10 @@ func (p *program) WritePV(pv veap.PV) veap.Error {
 		if err != nil {
 			return veap.NewError(veap.StatusInternalServerError, err)
 		}
+		// notify recorder with the execution time
+		if rec := p.Collection.(*ProgramCol).Recorder; rec != nil {
+			rec.Record(model.AbsPath(p), veap.PV{Time: time.Now(), Value: false, State: veap.StateGood})
+		}
 	}
 	return nil
 }
@@ -2,6 +2,7 @@ package vmodel
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -57,11 +58,7 @@ func NewConfig(col model.ChangeableCollection, store *rtcfg.Store) *Config {
 		// update succeeded, set config active
 		store.Config = cfg
 		// notify listener
-		c.mtx.Lock()
-		defer c.mtx.Unlock()
-		if c.changeListener != nil {
-			c.changeListener(&store.Config)
-		}
+		c.notifyChange(&store.Config)
 		return nil
 	}
 	col.PutItem(c)
@@ -74,6 +71,15 @@ func (c *Config) SetChangeListener(l func(*rtcfg.Config)) {
 	c.changeListener = l
 }
 
+// notifyChange calls the change listener. The config store must be locked.
+func (c *Config) notifyChange(cfg *rtcfg.Config) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.changeListener != nil {
+		c.changeListener(cfg)
+	}
+}
+
 func updateConfig(cfg *rtcfg.Config, v interface{}) error {
 	// v must be an JSON object
 	q := any.Q(v)
@@ -133,13 +139,34 @@ func updateConfig(cfg *rtcfg.Config, v interface{}) error {
 			} else {
 				user.EncryptedPassword = epwd
 			}
-			// set for now all permissions
-			user.AddPermission(&rtcfg.Permission{
-				Identifier:  "all",
-				Description: "All permissions",
-				Endpoint:    rtcfg.EndpointVEAP | rtcfg.EndpointMQTT,
-				Kind:        rtcfg.PermConfig | rtcfg.PermReadPV | rtcfg.PermWritePV,
-			})
+			// permissions present?
+			if uo.Has("Permissions") {
+				for pid, p := range uo.Key("Permissions").Map().Wrap() {
+					po := p.Map()
+					per := &rtcfg.Permission{
+						Identifier:  po.Key("Identifier").String(),
+						Description: po.TryKey("Description").String(),
+						Endpoint:    rtcfg.Endpoint(po.Key("Endpoint").Float64()),
+						Kind:        rtcfg.PermKind(po.Key("Kind").Float64()),
+						PVFilter:    po.TryKey("PVFilter").String(),
+					}
+					if q.Err() != nil {
+						return q.Err()
+					}
+					if pid != per.Identifier {
+						return fmt.Errorf("Permission identifier mismatches: %s", per.Identifier)
+					}
+					user.AddPermission(per)
+				}
+			} else {
+				// no permissions specified, set all permissions
+				user.AddPermission(&rtcfg.Permission{
+					Identifier:  "all",
+					Description: "All permissions",
+					Endpoint:    rtcfg.EndpointVEAP | rtcfg.EndpointMQTT,
+					Kind:        rtcfg.PermConfig | rtcfg.PermReadPV | rtcfg.PermWritePV,
+				})
+			}
 			users[id] = user
 		}
 		if q.Err() != nil {
@@ -167,6 +194,132 @@ func updateConfig(cfg *rtcfg.Config, v interface{}) error {
 		}
 	}
 
+	// Scenes property present?
+	if c.Has("Scenes") {
+		scenes := make(map[string]*rtcfg.Scene)
+		for id, s := range c.Key("Scenes").Map().Wrap() {
+			so := s.Map()
+			scene := &rtcfg.Scene{
+				Identifier:  so.Key("Identifier").String(),
+				Title:       so.TryKey("Title").String(),
+				Description: so.TryKey("Description").String(),
+				Steps:       make([]*rtcfg.SceneStep, 0), // no nil slice
+			}
+			for _, st := range so.Key("Steps").Slice() {
+				sto := st.Map()
+				step := &rtcfg.SceneStep{
+					Path:  sto.Key("Path").String(),
+					Value: sto.Key("Value").Unwrap(),
+					Delay: int(sto.TryKey("Delay").Float64()),
+				}
+				if q.Err() == nil && !strings.HasPrefix(step.Path, "/") {
+					return fmt.Errorf("Invalid path in scene %s: %s", id, step.Path)
+				}
+				scene.Steps = append(scene.Steps, step)
+			}
+			// valid scene data?
+			if q.Err() != nil {
+				return q.Err()
+			}
+			if id != scene.Identifier {
+				return fmt.Errorf("Scene identifier mismatches: %s", scene.Identifier)
+			}
+			scenes[id] = scene
+		}
+		if q.Err() != nil {
+			return q.Err()
+		}
+		cfg.Scenes = scenes
+	}
+
+	// Rules property present?
+	if c.Has("Rules") {
+		rules := make(map[string]*rtcfg.Rule)
+		for id, r := range c.Key("Rules").Map().Wrap() {
+			ro := r.Map()
+			to := ro.TryKey("Trigger").Map()
+			rule := &rtcfg.Rule{
+				Identifier:  ro.Key("Identifier").String(),
+				Description: ro.TryKey("Description").String(),
+				Enable:      ro.TryKey("Enable").Bool(),
+				Trigger: rtcfg.RuleTrigger{
+					PVPath:   to.TryKey("PVPath").String(),
+					Topic:    to.TryKey("Topic").String(),
+					Schedule: to.TryKey("Schedule").String(),
+				},
+				Condition: ro.TryKey("Condition").String(),
+				Actions:   make([]*rtcfg.RuleAction, 0), // no nil slice
+			}
+			for _, a := range ro.Key("Actions").Slice() {
+				ao := a.Map()
+				rule.Actions = append(rule.Actions, &rtcfg.RuleAction{
+					Path:  ao.Key("Path").String(),
+					Value: ao.Key("Value").String(),
+				})
+			}
+			// valid rule data?
+			if q.Err() != nil {
+				return q.Err()
+			}
+			if id != rule.Identifier {
+				return fmt.Errorf("Rule identifier mismatches: %s", rule.Identifier)
+			}
+			rules[id] = rule
+		}
+		if q.Err() != nil {
+			return q.Err()
+		}
+		cfg.Rules = rules
+	}
+
+	// MQTT bridges present?
+	if c.Has("MQTT") && c.Key("MQTT").Map().Has("Bridges") {
+		bridges := make(map[string]*rtcfg.MQTTBridge)
+		for id, b := range c.Key("MQTT").Map().Key("Bridges").Map().Wrap() {
+			bo := b.Map()
+			bridge := &rtcfg.MQTTBridge{
+				Identifier:   bo.Key("Identifier").String(),
+				Enable:       bo.TryKey("Enable").Bool(),
+				Address:      bo.Key("Address").String(),
+				Port:         int(bo.Key("Port").Float64()),
+				BufferSize:   int64(bo.TryKey("BufferSize").Float64()),
+				UseTLS:       bo.TryKey("UseTLS").Bool(),
+				CACertFile:   bo.TryKey("CACertFile").String(),
+				Insecure:     bo.TryKey("Insecure").Bool(),
+				Username:     bo.TryKey("Username").String(),
+				Password:     bo.TryKey("Password").String(),
+				ClientID:     bo.TryKey("ClientID").String(),
+				CleanSession: bo.TryKey("CleanSession").Bool(),
+				Incoming:     decodeSharedTopics(bo.TryKey("Incoming")),
+				Outgoing:     decodeSharedTopics(bo.TryKey("Outgoing")),
+			}
+			if bo.Has("Queue") {
+				qo := bo.Key("Queue").Map()
+				bridge.Queue = rtcfg.MQTTBridgeQueue{
+					Enable:     qo.TryKey("Enable").Bool(),
+					MaxEntries: int(qo.TryKey("MaxEntries").Float64()),
+					MaxAge:     int(qo.TryKey("MaxAge").Float64()),
+					LatestOnly: qo.TryKey("LatestOnly").Bool(),
+				}
+			}
+			// valid bridge data?
+			if q.Err() != nil {
+				return q.Err()
+			}
+			if id != bridge.Identifier {
+				return fmt.Errorf("Bridge identifier mismatches: %s", bridge.Identifier)
+			}
+			if bridge.Queue.Enable && bridge.Queue.MaxEntries <= 0 && bridge.Queue.MaxAge <= 0 {
+				return fmt.Errorf("Offline queue of bridge %s needs a size or age limit", id)
+			}
+			bridges[id] = bridge
+		}
+		if q.Err() != nil {
+			return q.Err()
+		}
+		cfg.MQTT.Bridges = bridges
+	}
+
 	// VirtualDevices property present?
 	if c.Has("VirtualDevices") {
 
@@ -174,45 +327,38 @@ func updateConfig(cfg *rtcfg.Config, v interface{}) error {
 		rvd := c.Key("VirtualDevices").Map()
 		cfg.VirtualDevices.Enable = rvd.Key("Enable").Bool()
 		cfg.VirtualDevices.NextSerialNo = int(rvd.Key("NextSerialNo").Float64())
+		cfg.VirtualDevices.Discovery = rvd.TryKey("Discovery").Bool()
 
 		// decode devices
 		ds := make(map[string]*rtcfg.Device)
 		for ra, rdq := range rvd.Key("Devices").Map().Wrap() {
+			d := decodeDevice(rdq)
+			if q.Err() == nil && ra != d.Address {
+				return fmt.Errorf("Device address mismatches: %s", d.Address)
+			}
+			ds[ra] = d
+		}
+		// update devices in config
+		cfg.VirtualDevices.Devices = ds
 
-			// decode device
-			rd := rdq.Map()
-			d := rtcfg.Device{
-				Address:  rd.Key("Address").String(),
-				HMType:   rd.Key("HMType").String(),
-				Channels: make([]rtcfg.Channel, 0, 8), // prevents JSON null for empty arrays
-			}
-			// add device
-			ds[ra] = &d
-
-			// decode channels
-			for _, rcq := range rd.Key("Channels").Slice() {
-
-				// decode channel
-				rc := rcq.Map()
-				var rk rtcfg.ChannelKind
-				err := rk.UnmarshalText(([]byte)(rc.Key("Kind").String()))
-				if err != nil {
-					q.SetErr(err)
-				}
-				c := rtcfg.Channel{
-					Kind:           rk,
-					MasterParamset: make(map[string]interface{}),
+		// decode templates, if present
+		if rvd.Has("Templates") {
+			ts := make(map[string]*rtcfg.DeviceTemplate)
+			for id, rtq := range rvd.Key("Templates").Map().Wrap() {
+				rt := rtq.Map()
+				t := &rtcfg.DeviceTemplate{
+					Identifier:  rt.Key("Identifier").String(),
+					Description: rt.TryKey("Description").String(),
+					HMType:      rt.Key("HMType").String(),
+					Channels:    decodeChannels(rt.Key("Channels")),
 				}
-				// decode master paramset
-				for n, v := range rc.Key("MasterParamset").Map().Wrap() {
-					c.MasterParamset[n] = v.Unwrap()
+				if q.Err() == nil && id != t.Identifier {
+					return fmt.Errorf("Device template identifier mismatches: %s", t.Identifier)
 				}
-				// add channel
-				d.Channels = append(d.Channels, c)
+				ts[id] = t
 			}
+			cfg.VirtualDevices.Templates = ts
 		}
-		// update devices in config
-		cfg.VirtualDevices.Devices = ds
 
 		// any error occured?
 		if q.Err() != nil {
@@ -221,3 +367,72 @@ func updateConfig(cfg *rtcfg.Config, v interface{}) error {
 	}
 	return nil
 }
+
+// decodeSharedTopics decodes the shared topics of an MQTT bridge. Errors are
+// reported through the query.
+func decodeSharedTopics(tsq *any.Query) []rtcfg.MQTTSharedTopic {
+	var ts []rtcfg.MQTTSharedTopic
+	for _, tq := range tsq.Slice() {
+		to := tq.Map()
+		t := rtcfg.MQTTSharedTopic{
+			Pattern:       to.Key("Pattern").String(),
+			LocalPrefix:   to.TryKey("LocalPrefix").String(),
+			RemotePrefix:  to.TryKey("RemotePrefix").String(),
+			QoS:           byte(to.TryKey("QoS").Float64()),
+			Template:      to.TryKey("Template").String(),
+			MinInterval:   int(to.TryKey("MinInterval").Float64()),
+			DropUnchanged: to.TryKey("DropUnchanged").Bool(),
+		}
+		// overrides are optional
+		if q := to.TryKey("PublishQoS"); q.Unwrap() != nil {
+			qos := byte(q.Float64())
+			t.PublishQoS = &qos
+		}
+		if q := to.TryKey("Retain"); q.Unwrap() != nil {
+			retain := q.Bool()
+			t.Retain = &retain
+		}
+		ts = append(ts, t)
+	}
+	return ts
+}
+
+// decodeDevice decodes a virtual device. Errors are reported through the query.
+// The address is optional (e.g. for imported device definitions).
+func decodeDevice(rdq *any.Query) *rtcfg.Device {
+	rd := rdq.Map()
+	return &rtcfg.Device{
+		Address:  rd.TryKey("Address").String(),
+		HMType:   rd.Key("HMType").String(),
+		Channels: decodeChannels(rd.Key("Channels")),
+		// optional
+		Discovered: rd.TryKey("Discovered").String(),
+	}
+}
+
+// decodeChannels decodes the channels of a virtual device. Errors are reported
+// through the query.
+func decodeChannels(rcsq *any.Query) []rtcfg.Channel {
+	cs := make([]rtcfg.Channel, 0, 8) // prevents JSON null for empty arrays
+	for _, rcq := range rcsq.Slice() {
+
+		// decode channel
+		rc := rcq.Map()
+		var rk rtcfg.ChannelKind
+		err := rk.UnmarshalText(([]byte)(rc.Key("Kind").String()))
+		if err != nil && rcq.Err() == nil {
+			rcq.SetErr(err)
+		}
+		c := rtcfg.Channel{
+			Kind:           rk,
+			MasterParamset: make(map[string]interface{}),
+		}
+		// decode master paramset
+		for n, v := range rc.Key("MasterParamset").Map().Wrap() {
+			c.MasterParamset[n] = v.Unwrap()
+		}
+		// add channel
+		cs = append(cs, c)
+	}
+	return cs
+}
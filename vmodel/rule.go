@@ -0,0 +1,142 @@
+package vmodel
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/model"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+)
+
+// RuleEngine executes the rules of the runtime configuration (e.g.
+// rules.Engine).
+type RuleEngine interface {
+	// SetEnabled enables or disables a rule in the configuration.
+	SetEnabled(id string, enable bool) error
+	// Status returns the status of a rule.
+	Status(id string) veap.PV
+}
+
+// RuleCol contains the rules of the runtime configuration (q.v. rtcfg.Rule).
+// The items are kept in sync with the configuration. Each rule has the
+// variables enabled and status.
+type RuleCol struct {
+	model.Domain
+	Engine RuleEngine
+
+	store *rtcfg.Store
+	mtx   sync.Mutex
+	rules map[string]*model.Domain
+}
+
+// NewRuleCol creates a new RuleCol.
+func NewRuleCol(col model.ChangeableCollection, store *rtcfg.Store, engine RuleEngine) *RuleCol {
+	rc := new(RuleCol)
+	rc.Identifier = "rules"
+	rc.Title = "Rules"
+	rc.Description = "Automations of the CCU-Jack"
+	rc.Collection = col
+	rc.ItemRole = "rule"
+	rc.Engine = engine
+	rc.store = store
+	rc.rules = make(map[string]*model.Domain)
+	col.PutItem(rc)
+	return rc
+}
+
+// Items implements model.Collection.
+func (rc *RuleCol) Items() []model.ItemObject {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	rc.synchronize()
+	ids := make([]string, 0, len(rc.rules))
+	for id := range rc.rules {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	items := make([]model.ItemObject, len(ids))
+	for i, id := range ids {
+		items[i] = rc.rules[id]
+	}
+	return items
+}
+
+// Item implements model.Collection.
+func (rc *RuleCol) Item(id string) (model.ItemObject, bool) {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	rc.synchronize()
+	r, ok := rc.rules[id]
+	if !ok {
+		return nil, false
+	}
+	return r, true
+}
+
+// synchronize updates the rule objects from the configuration. rc.mtx must be
+// locked.
+func (rc *RuleCol) synchronize() {
+	rc.store.RLock()
+	defer rc.store.RUnlock()
+	for id := range rc.rules {
+		if _, ok := rc.store.Config.Rules[id]; !ok {
+			delete(rc.rules, id)
+		}
+	}
+	for id, cfg := range rc.store.Config.Rules {
+		r, ok := rc.rules[id]
+		if !ok {
+			r = rc.newRule(id)
+			rc.rules[id] = r
+		}
+		r.Description = cfg.Description
+	}
+}
+
+func (rc *RuleCol) newRule(id string) *model.Domain {
+	r := model.NewDomain(&model.DomainCfg{
+		Identifier:     id,
+		Title:          id,
+		ItemRole:       "variable",
+		CollectionRole: "rules",
+	})
+	r.Collection = rc
+	model.NewVariable(&model.VariableCfg{
+		Identifier:  "enabled",
+		Title:       "Enabled",
+		Description: "Enables or disables the rule",
+		Collection:  r,
+		ReadPVFunc: func() (veap.PV, veap.Error) {
+			rc.store.RLock()
+			defer rc.store.RUnlock()
+			cfg, ok := rc.store.Config.Rules[id]
+			if !ok {
+				return veap.PV{}, veap.NewErrorf(veap.StatusNotFound, "Rule not found: %s", id)
+			}
+			return veap.PV{Time: time.Now(), Value: cfg.Enable, State: veap.StateGood}, nil
+		},
+		WritePVFunc: func(pv veap.PV) veap.Error {
+			b, ok := pv.Value.(bool)
+			if !ok {
+				return veap.NewErrorf(veap.StatusBadRequest, "Process value is not of type boolean")
+			}
+			if err := rc.Engine.SetEnabled(id, b); err != nil {
+				return veap.NewError(veap.StatusBadRequest, err)
+			}
+			return nil
+		},
+	})
+	model.NewROVariable(&model.ROVariableCfg{
+		Identifier:  "status",
+		Title:       "Status",
+		Description: "Status of the last trigger and execution",
+		Collection:  r,
+		ReadPVFunc: func() (veap.PV, veap.Error) {
+			return rc.Engine.Status(id), nil
+		},
+	})
+	return r
+}
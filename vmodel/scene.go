@@ -0,0 +1,325 @@
+package vmodel
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mdzio/go-logging"
+	"github.com/mdzio/go-veap"
+	"github.com/mdzio/go-veap/model"
+
+	"github.com/mdzio/ccu-jack/rtcfg"
+)
+
+var sceneLog = logging.Get("scene")
+
+// SceneCol contains the scenes of the runtime configuration (q.v.
+// rtcfg.Scene). The items are kept in sync with the configuration. A scene is
+// executed by writing true to its PV. Writing the object {"DryRun": true}
+// only checks the target data points. Afterwards, the PV of the scene contains
+// the result of each step (q.v. SceneResult). Scenes with delayed steps are
+// executed in the background, until Stop is called. A scene can not be
+// triggered again while it is running, this also breaks cycles of scenes
+// triggering each other.
+type SceneCol struct {
+	model.Domain
+	// Service is used to write the steps of the scenes, so that the same
+	// conversions apply as for single writes. Must be set before a scene is
+	// executed.
+	Service *model.Service
+	// MQTTTopics provides the MQTT topics of the scenes.
+	MQTTTopics MQTTTopics
+	// OnResult is called with the VEAP path and the result, when an execution
+	// in the background is completed (optional).
+	OnResult func(pvPath string, pv veap.PV)
+
+	store  *rtcfg.Store
+	mtx    sync.Mutex
+	scenes map[string]*scene
+
+	// cancellation of the executions in the background
+	stop    chan struct{}
+	running sync.WaitGroup
+}
+
+// SceneResult is the PV value of a scene after an execution.
+type SceneResult struct {
+	DryRun bool
+	Steps  []SceneStepResult
+}
+
+// SceneStepResult is the result of a single step of a scene.
+type SceneStepResult struct {
+	Path  string
+	Value interface{}
+	// Error is empty, if the step succeeded.
+	Error string `json:",omitempty"`
+}
+
+// NewSceneCol creates a new SceneCol.
+func NewSceneCol(col model.ChangeableCollection, store *rtcfg.Store) *SceneCol {
+	sc := new(SceneCol)
+	sc.Identifier = "scenes"
+	sc.Title = "Scenes"
+	sc.Description = "Named sequences of PV writes"
+	sc.Collection = col
+	sc.ItemRole = "scene"
+	sc.store = store
+	sc.scenes = make(map[string]*scene)
+	sc.stop = make(chan struct{})
+	col.PutItem(sc)
+	return sc
+}
+
+// Stop cancels the executions in the background and waits for their
+// termination. Remaining steps are not executed.
+func (sc *SceneCol) Stop() {
+	close(sc.stop)
+	sc.running.Wait()
+}
+
+// Items implements model.Collection.
+func (sc *SceneCol) Items() []model.ItemObject {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	sc.synchronize()
+	ids := make([]string, 0, len(sc.scenes))
+	for id := range sc.scenes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	items := make([]model.ItemObject, len(ids))
+	for i, id := range ids {
+		items[i] = sc.scenes[id]
+	}
+	return items
+}
+
+// Item implements model.Collection.
+func (sc *SceneCol) Item(id string) (model.ItemObject, bool) {
+	sc.mtx.Lock()
+	defer sc.mtx.Unlock()
+	sc.synchronize()
+	s, ok := sc.scenes[id]
+	if !ok {
+		return nil, false
+	}
+	return s, true
+}
+
+// synchronize updates the scene objects from the configuration. The results
+// of the last executions are retained. sc.mtx must be locked.
+func (sc *SceneCol) synchronize() {
+	sc.store.RLock()
+	defer sc.store.RUnlock()
+	for id := range sc.scenes {
+		if _, ok := sc.store.Config.Scenes[id]; !ok {
+			delete(sc.scenes, id)
+		}
+	}
+	for id, cfg := range sc.store.Config.Scenes {
+		s, ok := sc.scenes[id]
+		if !ok {
+			s = &scene{
+				pv: veap.PV{
+					Time:  time.Now(),
+					Value: SceneResult{Steps: []SceneStepResult{}},
+					State: veap.StateGood,
+				},
+			}
+			s.Identifier = id
+			s.Collection = sc
+			s.CollectionRole = "scenes"
+			sc.scenes[id] = s
+		}
+		s.Title = cfg.Title
+		if s.Title == "" {
+			s.Title = id
+		}
+		s.Description = cfg.Description
+	}
+}
+
+// steps returns a copy of the steps of a scene.
+func (sc *SceneCol) steps(id string) ([]rtcfg.SceneStep, bool) {
+	sc.store.RLock()
+	defer sc.store.RUnlock()
+	cfg, ok := sc.store.Config.Scenes[id]
+	if !ok {
+		return nil, false
+	}
+	steps := make([]rtcfg.SceneStep, len(cfg.Steps))
+	for i, st := range cfg.Steps {
+		steps[i] = *st
+	}
+	return steps, true
+}
+
+// scene is the VEAP object of a scene.
+type scene struct {
+	model.BasicObject
+	model.BasicItem
+
+	// true, while the scene is executed
+	runMtx  sync.Mutex
+	running bool
+
+	pvMtx sync.RWMutex
+	pv    veap.PV
+}
+
+func (s *scene) ReadAttributes() veap.AttrValues {
+	attrs := s.BasicObject.ReadAttributes()
+	if steps, ok := s.Collection.(*SceneCol).steps(s.Identifier); ok {
+		attrs["steps"] = len(steps)
+	}
+	addMQTTTopics(attrs, s.Collection.(*SceneCol).MQTTTopics, model.AbsPath(s), true)
+	return attrs
+}
+
+func (s *scene) ReadPV() (veap.PV, veap.Error) {
+	s.pvMtx.RLock()
+	defer s.pvMtx.RUnlock()
+	return s.pv, nil
+}
+
+func (s *scene) WritePV(pv veap.PV) veap.Error {
+	if pv.State.Bad() {
+		return nil
+	}
+	var dryRun bool
+	switch v := pv.Value.(type) {
+	case bool:
+		if !v {
+			return nil
+		}
+	case map[string]interface{}:
+		dryRun, _ = v["DryRun"].(bool)
+	default:
+		return veap.NewErrorf(veap.StatusBadRequest, "Process value is not of type boolean or object")
+	}
+	return s.execute(dryRun)
+}
+
+// execute executes the steps of the scene one after another. Failed steps do
+// not abort the execution. If a step is delayed, the scene is executed in the
+// background and nil is returned.
+func (s *scene) execute(dryRun bool) veap.Error {
+	sc := s.Collection.(*SceneCol)
+	steps, ok := sc.steps(s.Identifier)
+	if !ok {
+		return veap.NewErrorf(veap.StatusNotFound, "Scene not found: %s", s.Identifier)
+	}
+	if sc.Service == nil {
+		return veap.NewErrorf(veap.StatusInternalServerError, "Scenes are not available yet")
+	}
+	if dryRun {
+		sceneLog.Debugf("Checking scene %s", s.Identifier)
+		return s.run(steps, true)
+	}
+
+	// prevent recursion and concurrent executions
+	s.runMtx.Lock()
+	if s.running {
+		s.runMtx.Unlock()
+		return veap.NewErrorf(veap.StatusBadRequest, "Scene %s is already running", s.Identifier)
+	}
+	s.running = true
+	s.runMtx.Unlock()
+	finish := func() {
+		s.runMtx.Lock()
+		s.running = false
+		s.runMtx.Unlock()
+	}
+
+	delayed := false
+	for _, st := range steps {
+		if st.Delay > 0 {
+			delayed = true
+			break
+		}
+	}
+	if !delayed {
+		sceneLog.Debugf("Executing scene %s", s.Identifier)
+		defer finish()
+		return s.run(steps, false)
+	}
+
+	// do not block the caller (e.g. HTTP handler, MQTT server) with delays
+	sceneLog.Debugf("Executing scene %s in the background", s.Identifier)
+	sc.running.Add(1)
+	go func() {
+		defer sc.running.Done()
+		err := s.run(steps, false)
+		finish()
+		if err != nil {
+			sceneLog.Warning(err)
+		}
+		select {
+		case <-sc.stop:
+			// shutting down
+			return
+		default:
+		}
+		if sc.OnResult != nil {
+			pv, _ := s.ReadPV()
+			sc.OnResult(model.AbsPath(s), pv)
+		}
+	}()
+	return nil
+}
+
+// run executes or checks the steps and stores the result.
+func (s *scene) run(steps []rtcfg.SceneStep, dryRun bool) veap.Error {
+	sc := s.Collection.(*SceneCol)
+	res := SceneResult{DryRun: dryRun, Steps: make([]SceneStepResult, len(steps))}
+	failed := 0
+	for i, st := range steps {
+		var err error
+		if dryRun {
+			err = checkSceneStep(sc.Service, st.Path)
+		} else {
+			if st.Delay > 0 {
+				select {
+				case <-sc.stop:
+					return veap.NewErrorf(veap.StatusInternalServerError, "Execution of scene %s cancelled", s.Identifier)
+				case <-time.After(time.Duration(st.Delay) * time.Millisecond):
+				}
+			}
+			if verr := sc.Service.WritePV(st.Path, veap.PV{Time: time.Now(), Value: st.Value, State: veap.StateGood}); verr != nil {
+				err = verr
+			}
+		}
+		res.Steps[i] = SceneStepResult{Path: st.Path, Value: st.Value}
+		if err != nil {
+			sceneLog.Warningf("Step %d of scene %s failed: %v", i+1, s.Identifier, err)
+			res.Steps[i].Error = err.Error()
+			failed++
+		}
+	}
+
+	// store result
+	s.pvMtx.Lock()
+	s.pv = veap.PV{Time: time.Now(), Value: res, State: veap.StateGood}
+	s.pvMtx.Unlock()
+
+	if failed > 0 {
+		return veap.NewErrorf(veap.StatusInternalServerError, "%d of %d steps of scene %s failed", failed, len(steps), s.Identifier)
+	}
+	return nil
+}
+
+// checkSceneStep checks whether the data point of a step exists and is
+// writeable.
+func checkSceneStep(service *model.Service, path string) error {
+	obj, verr := service.EvalPath(path)
+	if verr != nil {
+		return verr
+	}
+	if _, ok := obj.(model.PVWriter); !ok {
+		return fmt.Errorf("Object is not writeable: %s", path)
+	}
+	return nil
+}
@@ -21,6 +21,10 @@ var sysVarLog = logging.Get("sysvar")
 type SysVarCol struct {
 	model.Domain
 	ScriptClient *script.Client
+	// MQTTTopics provides the MQTT topics of the system variables.
+	MQTTTopics MQTTTopics
+	// History provides the recorded values of the system variables.
+	History PVHistory
 
 	stopRequest chan struct{}
 	stopped     chan struct{}
@@ -154,13 +158,11 @@ func (v *sysVar) GetDescription() string {
 
 func (v *sysVar) ReadAttributes() veap.AttrValues {
 	attr := veap.AttrValues{
-		"unit":            v.sv.Unit,
-		"operations":      v.sv.Operations,
-		"type":            v.sv.Type,
-		"mqttGetTopic":    "sysvar/get/" + v.sv.ISEID,
-		"mqttStatusTopic": "sysvar/status/" + v.sv.ISEID,
-		"mqttSetTopic":    "sysvar/set/" + v.sv.ISEID,
+		"unit":       v.sv.Unit,
+		"operations": v.sv.Operations,
+		"type":       v.sv.Type,
 	}
+	addMQTTTopics(attr, v.Collection.(*SysVarCol).MQTTTopics, model.AbsPath(v), true)
 	if v.sv.Minimum != nil {
 		attr["minimum"] = v.sv.Minimum
 	}
@@ -193,6 +195,10 @@ func (v *sysVar) ReadPV() (veap.PV, veap.Error) {
 	return veap.PV{Time: res[0].Timestamp, Value: res[0].Value, State: state}, nil
 }
 
+func (v *sysVar) ReadHistory(begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error) {
+	return readHistory(v.Collection.(*SysVarCol).History, model.AbsPath(v), begin, end, limit)
+}
+
 func (v *sysVar) WritePV(pv veap.PV) veap.Error {
 	// convert JSON number/float64 to int for system variables of type ENUM
 	value := pv.Value
@@ -17,6 +17,10 @@ type VirtualDeviceCol struct {
 	Container    *vdevices.Container
 	ModelService *model.Service
 	ReGaDOM      *script.ReGaDOM
+	// MQTTTopics provides the MQTT topics of the parameters.
+	MQTTTopics MQTTTopics
+	// History provides the recorded values of the parameters.
+	History PVHistory
 
 	collection model.CollectionObject
 }
@@ -293,20 +297,18 @@ func (p *virtualParameter) GetCollectionRole() string {
 func (p *virtualParameter) ReadAttributes() veap.AttrValues {
 	ch := p.collection.(*virtualChannel)
 	dev := ch.collection.(*virtualDevice)
-	mqttTopic := dev.GetIdentifier() + "/" + ch.GetIdentifier() + "/" + p.GetIdentifier()
 	descr := p.parameter.Description()
 	attrs := veap.AttrValues{
-		"type":            descr.Type,
-		"operations":      descr.Operations,
-		"flags":           descr.Flags,
-		"default":         descr.Default,
-		"maximum":         descr.Max,
-		"minimum":         descr.Min,
-		"unit":            descr.Unit,
-		"tabOrder":        descr.TabOrder,
-		"control":         descr.Control,
-		"id":              descr.ID,
-		"mqttStatusTopic": "virtdev/status/" + mqttTopic,
+		"type":       descr.Type,
+		"operations": descr.Operations,
+		"flags":      descr.Flags,
+		"default":    descr.Default,
+		"maximum":    descr.Max,
+		"minimum":    descr.Min,
+		"unit":       descr.Unit,
+		"tabOrder":   descr.TabOrder,
+		"control":    descr.Control,
+		"id":         descr.ID,
 	}
 
 	// special attributes
@@ -330,10 +332,9 @@ func (p *virtualParameter) ReadAttributes() veap.AttrValues {
 		attrs["valueList"] = valueList
 	}
 
-	// parameter writeable?
-	if descr.Operations&itf.ParameterOperationWrite != 0 {
-		attrs["mqttSetTopic"] = "virtdev/set/" + mqttTopic
-	}
+	// MQTT topics
+	writeable := descr.Operations&itf.ParameterOperationWrite != 0
+	addMQTTTopics(attrs, dev.collection.(*VirtualDeviceCol).MQTTTopics, model.AbsPath(p), writeable)
 	return attrs
 }
 
@@ -346,6 +347,12 @@ func (p *virtualParameter) ReadPV() (veap.PV, veap.Error) {
 	}, nil
 }
 
+// ReadHistory implements model.HistoryReader.
+func (p *virtualParameter) ReadHistory(begin time.Time, end time.Time, limit int64) ([]veap.PV, veap.Error) {
+	devCol := p.collection.(*virtualChannel).collection.(*virtualDevice).collection.(*VirtualDeviceCol)
+	return readHistory(devCol.History, model.AbsPath(p), begin, end, limit)
+}
+
 // WritePV implements model.PVWriter.
 func (p *virtualParameter) WritePV(pv veap.PV) veap.Error {
 	// get channel
@@ -1,6 +1,7 @@
 package vmodel
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/mdzio/go-veap"
@@ -33,3 +34,85 @@ func NewRefreshVar(col model.ChangeableCollection, refresh func()) {
 		},
 	})
 }
+
+// NewSysVarNotifyVar adds a VEAP variable to the specified collection, which
+// accepts notifications about changed system variables. The PV value is the
+// ISE ID of the changed system variable. An empty string or true signals, that
+// all system variables should be read. A ReGaHss program can send a
+// notification with e.g. following HM script:
+//
+//	system.Exec("wget -q -O /dev/null 'http://127.0.0.1:2121/~vendor/sysvarnotify/~pv?writepv=\"" # dom.GetObject("Name").ID() # "\"'");
+func NewSysVarNotifyVar(col model.ChangeableCollection, notify func(iseID string)) {
+	model.NewVariable(&model.VariableCfg{
+		Identifier:  "sysvarnotify",
+		Title:       "System Variable Notification",
+		Description: "Notifies the CCU-Jack about a changed system variable (ISE ID)",
+		Collection:  col,
+		ReadPVFunc: func() (veap.PV, veap.Error) {
+			return veap.PV{Time: time.Now(), Value: "", State: veap.StateGood}, nil
+		},
+		WritePVFunc: func(pv veap.PV) veap.Error {
+			if pv.State.Bad() {
+				return nil
+			}
+			switch v := pv.Value.(type) {
+			case string:
+				notify(v)
+			case float64:
+				// ISE IDs are numbers
+				notify(strconv.FormatInt(int64(v), 10))
+			case bool:
+				if v {
+					notify("")
+				}
+			default:
+				return veap.NewErrorf(veap.StatusBadRequest, "Process value is not of type string")
+			}
+			return nil
+		},
+	})
+}
+
+// MQTTTopics provides the MQTT topics of data points (e.g. mqtt.Profile).
+type MQTTTopics interface {
+	// Topics returns the status, set and get topics for a VEAP path. Topics,
+	// which are not available, are empty.
+	Topics(pvPath string) (status, set, get string)
+}
+
+// PVHistory provides the recorded values of data points (e.g. history.Store).
+type PVHistory interface {
+	// Read returns the recorded PVs of a data point in the time range.
+	Read(pvPath string, begin, end time.Time, limit int64) ([]veap.PV, veap.Error)
+}
+
+// PVRecorder receives value changes of data points (e.g. the change stream).
+type PVRecorder interface {
+	Record(pvPath string, pv veap.PV)
+}
+
+// readHistory reads the history of a data point, if a history is available.
+func readHistory(hist PVHistory, pvPath string, begin, end time.Time, limit int64) ([]veap.PV, veap.Error) {
+	if hist == nil {
+		return nil, veap.NewErrorf(veap.StatusNotFound, "History not available: %s", pvPath)
+	}
+	return hist.Read(pvPath, begin, end, limit)
+}
+
+// addMQTTTopics adds the MQTT topics of a data point to the attributes. The set
+// topic is only added, if the data point is writeable.
+func addMQTTTopics(attrs veap.AttrValues, topics MQTTTopics, pvPath string, writeable bool) {
+	if topics == nil {
+		return
+	}
+	status, set, get := topics.Topics(pvPath)
+	if status != "" {
+		attrs["mqttStatusTopic"] = status
+	}
+	if set != "" && writeable {
+		attrs["mqttSetTopic"] = set
+	}
+	if get != "" {
+		attrs["mqttGetTopic"] = get
+	}
+}
@@ -230,6 +230,19 @@ function Config() {
                 "Der Hersteller der CCU kann unter Umständen Support-Leistungen ablehnen. Dies betrifft generell jede zusätzlich ",
                 "installierte Software auf der CCU."
             ),
+            m("label.form-switch",
+                m("input[type=checkbox]", {
+                    checked: config.VirtualDevices.Discovery,
+                    onchange: function (e) {
+                        config.VirtualDevices.Discovery = e.target.checked
+                        modified = true
+                    }
+                }),
+                m("i.form-icon"), "Geräteerkennung aktivieren", m("br"),
+                "Geräte, die sich über MQTT bei Tasmota, Shelly oder Zigbee2MQTT anmelden, werden im VEAP-Objekt ",
+                "~vendor/discovery aufgelistet und können von dort als virtuelle Geräte angelegt werden. ",
+                "Achtung: Neustart vom CCU-Jack ist erforderlich!"
+            ),
         )
     }
 
@@ -30,6 +30,16 @@ function ChannelKindSelect() {
                 m("option[value=MQTT_ENERGY_COUNTER]", { selected: channel.Kind === "MQTT_ENERGY_COUNTER" }, "MQTT Energiezähler"),
                 m("option[value=MQTT_GAS_COUNTER]", { selected: channel.Kind === "MQTT_GAS_COUNTER" }, "MQTT Gaszähler"),
                 m("option[value=MQTT_UNREACH]", { selected: channel.Kind === "MQTT_UNREACH" }, "MQTT Kommunikationsstörung"),
+                m("option[value=MQTT_BLIND]", { selected: channel.Kind === "MQTT_BLIND" }, "MQTT Rollladen-/Jalousieaktor"),
+                m("option[value=MQTT_THERMOSTAT]", { selected: channel.Kind === "MQTT_THERMOSTAT" }, "MQTT Heizungsthermostat"),
+                m("option[value=MQTT_COLOR_LIGHT]", { selected: channel.Kind === "MQTT_COLOR_LIGHT" }, "MQTT Farb-/Weißlicht"),
+                m("option[value=MQTT_STRING_RECEIVER]", { selected: channel.Kind === "MQTT_STRING_RECEIVER" }, "MQTT Textempfänger"),
+                m("option[value=MQTT_ENUM_RECEIVER]", { selected: channel.Kind === "MQTT_ENUM_RECEIVER" }, "MQTT Aufzählungsempfänger"),
+                m("option[value=MQTT_SMOKE_DETECTOR]", { selected: channel.Kind === "MQTT_SMOKE_DETECTOR" }, "MQTT Rauchmelder"),
+                m("option[value=MQTT_WATER_SENSOR]", { selected: channel.Kind === "MQTT_WATER_SENSOR" }, "MQTT Wassermelder"),
+                m("option[value=MQTT_MOTION_DETECTOR]", { selected: channel.Kind === "MQTT_MOTION_DETECTOR" }, "MQTT Bewegungsmelder"),
+                m("option[value=MQTT_WINDOW_HANDLE]", { selected: channel.Kind === "MQTT_WINDOW_HANDLE" }, "MQTT Fenstergriffsensor"),
+                m("option[value=COMPUTED]", { selected: channel.Kind === "COMPUTED" }, "Berechneter Wert"),
             )
         }
     }
@@ -44,6 +54,8 @@ function HMTypeSelect() {
         ["HM-LC-Dim1T-FM", "Dimmaktor 1-fach, Phasenab., UP"],
         ["HM-LC-Dim1T-DR", "Dimmaktor 1-fach, Phasenab., Huts."],
         ["HM-LC-Dim1TPBU-FM", "Dimmaktor 1-fach für Markens."],
+        ["HM-LC-Bl1-FM", "Rollladenaktor 1-fach, UP"],
+        ["HmIP-RGBW", "Dimmaktor RGBW"],
         ["HM-LC-Sw1-FM", "Schaltaktor 1-fach, UP"],
         ["HM-LC-Sw2-FM", "Schaltaktor 2-fach, UP"],
         ["HM-LC-Sw1-DR", "Schaltaktor 1-fach, Huts."],
@@ -56,6 +68,11 @@ function HMTypeSelect() {
         ["HM-RC-19", "Handsender 19 Tasten"],
         ["HM-Sec-SC-2", "Tür-/ Fensterkontakt"],
         ["HM-SCI-3-FM", "Schließerkontaktschnittstelle 3-fach, UP"],
+        ["HM-Sec-RHS", "Fenster-Drehgriffkontakt"],
+        ["HM-Sec-SD-2", "Rauchmelder"],
+        ["HM-Sec-WDS-2", "Wassermelder"],
+        ["HmIP-SMI", "Bewegungsmelder mit Dämmerungssensor"],
+        ["HmIP-eTRV-2", "Heizkörperthermostat"],
         ["HmIP-STHO", "Temp.- und Luftf.-sensor außen"],
         ["HmIP-STHD", "Temp.- und Luftf.-sensor innen mit Display"],
         ["HM-ES-TX-WM", "Zähler-Sensor"],
@@ -179,6 +196,13 @@ function VirtualDeviceModal() {
                             ),
                             device.Channels.length != 0 ||
                             m("p", "Keine Kanäle angelegt."),
+                            m("p.text-gray",
+                                "Bei MQTT-Empfangskanälen kann mit dem Parameter MAX_AGE die maximale Zeit in Sekunden " +
+                                "zwischen zwei Nachrichten festgelegt werden. Wird sie überschritten, so wird die " +
+                                "Kommunikationsstörung des Gerätes gesetzt. Nur Analogwertempfänger und Temperatursensoren " +
+                                "besitzen einen Status, der dann auf unbekannt gesetzt wird. Bei den übrigen Kanaltypen " +
+                                "bleibt der letzte Wert unverändert erhalten."
+                            ),
                         ),
                     ),
                     m(".modal-footer",